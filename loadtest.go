@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+var defaultNames = []string{"seznam.cz", "google.com", "atlas.cz", "example.com", "zive.cz"}
+
+type loadtestConfig struct {
+	server      string
+	network     string
+	qps         int
+	duration    time.Duration
+	timeout     time.Duration
+	concurrency int
+	names       []string
+}
+
+type loadtestResult struct {
+	lock      sync.Mutex
+	latencies []time.Duration
+	rcodes    map[int]int
+	errors    int
+	dropped   int
+}
+
+// runLoadtest sends queries at the given rate to the running server and reports latency percentiles and error rates.
+func runLoadtest(args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("loadtest", flag.ContinueOnError)
+	cfg := loadtestConfig{}
+	fs.StringVar(&cfg.server, "server", "127.0.0.1:53", "address of the tested server")
+	fs.StringVar(&cfg.network, "net", "udp", "transport used for the queries (udp or tcp)")
+	fs.IntVar(&cfg.qps, "qps", 100, "queries per second")
+	fs.DurationVar(&cfg.duration, "duration", 10*time.Second, "duration of the test")
+	fs.DurationVar(&cfg.timeout, "timeout", 2*time.Second, "timeout of a single query")
+	fs.IntVar(&cfg.concurrency, "concurrency", 100, "maximum number of queries in flight")
+	namesFile := fs.String("names", "", "file with the queried names, one per line (default: a built-in list)")
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return nil
+		}
+		return err
+	}
+	if cfg.qps <= 0 || cfg.concurrency <= 0 || cfg.duration <= 0 {
+		return errors.New("qps, concurrency and duration must be positive")
+	}
+	if cfg.network != "udp" && cfg.network != "tcp" {
+		return fmt.Errorf("unsupported transport: %s", cfg.network)
+	}
+
+	cfg.names = defaultNames
+	if *namesFile != "" {
+		names, err := readNames(*namesFile)
+		if err != nil {
+			return err
+		}
+		cfg.names = names
+	}
+
+	result := loadtest(cfg)
+	result.report(out, cfg.duration)
+	return nil
+}
+
+func readNames(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var names []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		names = append(names, dns.Fqdn(line))
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(names) == 0 {
+		return nil, fmt.Errorf("no names in %s", path)
+	}
+	return names, nil
+}
+
+func loadtest(cfg loadtestConfig) *loadtestResult {
+	result := &loadtestResult{rcodes: make(map[int]int)}
+	queries := make(chan string, cfg.concurrency)
+
+	var wg sync.WaitGroup
+	for i := 0; i < cfg.concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			client := &dns.Client{Net: cfg.network, Timeout: cfg.timeout}
+			for name := range queries {
+				msg := new(dns.Msg)
+				msg.SetQuestion(dns.Fqdn(name), dns.TypeA)
+				resp, rtt, err := client.Exchange(msg, cfg.server)
+				result.record(resp, rtt, err)
+			}
+		}()
+	}
+
+	// the queries are paced by the elapsed time, so the rate doesn't depend on the ticker precision
+	start := time.Now()
+	ticker := time.NewTicker(time.Millisecond)
+	sent := 0
+	for now := range ticker.C {
+		elapsed := now.Sub(start)
+		if elapsed >= cfg.duration {
+			break
+		}
+		for due := int(elapsed.Seconds() * float64(cfg.qps)); sent < due; sent++ {
+			select {
+			case queries <- cfg.names[sent%len(cfg.names)]:
+			default:
+				result.drop()
+			}
+		}
+	}
+	ticker.Stop()
+	close(queries)
+	wg.Wait()
+	return result
+}
+
+func (r *loadtestResult) record(resp *dns.Msg, rtt time.Duration, err error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if err != nil {
+		r.errors++
+		return
+	}
+	r.rcodes[resp.Rcode]++
+	r.latencies = append(r.latencies, rtt)
+}
+
+func (r *loadtestResult) drop() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.dropped++
+}
+
+func (r *loadtestResult) report(out io.Writer, duration time.Duration) {
+	answered := len(r.latencies)
+	total := answered + r.errors + r.dropped
+	fmt.Fprintf(out, "queries:  %d (%.1f/s)\n", total, float64(total)/duration.Seconds())
+	fmt.Fprintf(out, "answered: %d\n", answered)
+	fmt.Fprintf(out, "errors:   %d (%.2f%%)\n", r.errors, percent(r.errors, total))
+	fmt.Fprintf(out, "dropped:  %d (%.2f%%) - concurrency limit reached\n", r.dropped, percent(r.dropped, total))
+
+	rcodes := make([]int, 0, len(r.rcodes))
+	for rcode := range r.rcodes {
+		rcodes = append(rcodes, rcode)
+	}
+	sort.Ints(rcodes)
+	for _, rcode := range rcodes {
+		fmt.Fprintf(out, "  %-9s %d (%.2f%%)\n", dns.RcodeToString[rcode], r.rcodes[rcode], percent(r.rcodes[rcode], total))
+	}
+
+	if answered == 0 {
+		return
+	}
+	sort.Slice(r.latencies, func(i, j int) bool { return r.latencies[i] < r.latencies[j] })
+	fmt.Fprintf(out, "latency:  p50 %v, p90 %v, p99 %v, max %v\n",
+		r.percentile(50), r.percentile(90), r.percentile(99), r.latencies[answered-1])
+}
+
+// percentile expects the latencies to be sorted.
+func (r *loadtestResult) percentile(p int) time.Duration {
+	return r.latencies[(len(r.latencies)-1)*p/100]
+}
+
+func percent(n, total int) float64 {
+	if total == 0 {
+		return 0
+	}
+	return 100 * float64(n) / float64(total)
+}
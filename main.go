@@ -1,41 +1,62 @@
 package main
 
 import (
-	"bytes"
+	"flag"
 	"fmt"
+	"os"
+	"slices"
+
+	"github.com/coredns/caddy"
 	"github.com/coredns/coredns/core/dnsserver"
 	_ "github.com/coredns/coredns/core/plugin"
 	"github.com/coredns/coredns/coremain"
 	_ "hackforward/plugin/hackforward"
-	"os/exec"
-	"time"
 )
 
+var validate bool
+
 func init() {
-	dnsserver.Directives = []string{
-		"hack_forward",
+	// hack_forward takes the place of forward in the standard plugin chain
+	i := slices.Index(dnsserver.Directives, "forward")
+	if i < 0 {
+		i = len(dnsserver.Directives)
 	}
+	dnsserver.Directives = slices.Insert(dnsserver.Directives, i, "hack_forward")
+
+	flag.BoolVar(&validate, "validate", false, "Parse the Corefile and exit")
 }
 
 func main() {
-	//reqs := []string{"seznam.cz"}
-	reqs := []string{"seznam.cz", "google.com", "atlas.cz", "example.com", "zive.cz"}
-	time.AfterFunc(1000*time.Millisecond, func() {
-		for _, req := range reqs {
-			cmd := exec.Command("dig", "@localhost", req)
-			var out bytes.Buffer
-			var stderr bytes.Buffer
-			cmd.Stdout = &out
-			cmd.Stderr = &stderr
-			err := cmd.Run()
-			if err != nil {
-				fmt.Println(fmt.Sprint(err) + ": " + stderr.String())
-				return
-			}
-			//fmt.Println("Command output:\n", out.String())
-			time.Sleep(1000 * time.Millisecond)
+	if len(os.Args) > 1 && os.Args[1] == "loadtest" {
+		if err := runLoadtest(os.Args[2:], os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
 		}
-	})
+		return
+	}
+
+	flag.Parse()
+	if validate {
+		if err := validateCorefile(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
 
 	coremain.Run()
 }
+
+// validateCorefile loads the Corefile the same way CoreDNS does (-conf flag or ./Corefile) and runs the setup of all
+// the directives without starting the servers.
+func validateCorefile() error {
+	corefile, err := caddy.LoadCaddyfile("dns")
+	if err != nil {
+		return err
+	}
+	if err = caddy.ValidateAndExecuteDirectives(corefile, nil, true); err != nil {
+		return err
+	}
+	fmt.Printf("%s is valid\n", corefile.Path())
+	return nil
+}
@@ -0,0 +1,137 @@
+package corefile
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+)
+
+const argTag = "arg"
+
+// argPath is the path of the plugin argument in the errors, e.g. arg[0].
+func argPath(index int) string {
+	return fmt.Sprintf("arg[%d]", index)
+}
+
+// argumentFields returns the fields of the structure bound to the plugin arguments by their arg tags ordered by the
+// indexes, which have to be 0, 1, 2 and so on. Only the last field may be a slice, taking the rest of the arguments.
+func argumentFields(structType reflect.Type) ([]reflect.StructField, error) {
+	var fields []reflect.StructField
+	var indexes []int
+	for _, field := range structFields(structType) {
+		tag, ok := field.Tag.Lookup(argTag)
+		if !ok || !field.IsExported() {
+			continue
+		}
+		index, err := strconv.Atoi(tag)
+		if err != nil || index < 0 {
+			return nil, fmt.Errorf("field '%s': invalid '%s' tag '%s', argument index expected", field.Name, argTag, tag)
+		}
+		fields = append(fields, field)
+		indexes = append(indexes, index)
+	}
+
+	ordered := make([]reflect.StructField, len(fields))
+	for i, index := range indexes {
+		if index >= len(fields) || ordered[index].Name != "" {
+			return nil, fmt.Errorf("field '%s': argument indexes have to be unique from 0 to %d", fields[i].Name,
+				len(fields)-1)
+		}
+		ordered[index] = fields[i]
+	}
+	for i, field := range ordered[:max(len(ordered)-1, 0)] {
+		if isRestArgument(field) {
+			return nil, fmt.Errorf("field '%s': only the last argument %s can be a slice", field.Name, argPath(i))
+		}
+	}
+	return ordered, nil
+}
+
+// isRestArgument reports whether the argument field takes the rest of the arguments.
+func isRestArgument(field reflect.StructField) bool {
+	return field.Type.Kind() == reflect.Slice
+}
+
+// parseArguments assigns the plugin arguments to the fields bound by their arg tags, the fields of the missing
+// arguments keep their defaults. The arguments are parsed after the defaults are applied.
+func (p *parser) parseArguments(structVal reflect.Value, args []string) error {
+	fields, err := argumentFields(structVal.Type())
+	if err != nil {
+		return p.log.Errf("invalid argument: %v", err)
+	}
+	if len(fields) == 0 {
+		return nil
+	}
+
+	loc := p.locations[""]
+	for i, fieldType := range fields {
+		if i >= len(args) {
+			break
+		}
+		values := args[i : i+1]
+		if isRestArgument(fieldType) {
+			values = args[i:]
+		}
+		if err := assignProperty(structVal.FieldByIndex(fieldType.Index), fieldType, values); err != nil {
+			if isSecret(fieldType) {
+				err = redact(err, values)
+			}
+			return loc.propertyErr(argPath(i), fmt.Errorf("assigning value failed: %w", err))
+		}
+	}
+	last := fields[len(fields)-1]
+	if len(args) > len(fields) && !isRestArgument(last) && !structVal.FieldByName(pluginArgsFieldName).IsValid() {
+		return loc.propertyErr(argPath(len(fields)), errors.New("unexpected argument"))
+	}
+	return nil
+}
+
+// validateArguments validates the fields bound to the plugin arguments, which is needed when the plugin has no block.
+// The block validates them along with the other fields otherwise.
+func (v *validator) validateArguments(structVal reflect.Value) error {
+	var errs []error
+	for _, field := range structFields(structVal.Type()) {
+		if _, ok := field.Tag.Lookup(argTag); !ok {
+			continue
+		}
+		if err := v.validateStructField(structVal, field, ""); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// marshalArguments formats the fields bound to the plugin arguments, the trailing arguments equal to their defaults
+// are omitted.
+func marshalArguments(structVal reflect.Value) ([]string, error) {
+	fields, err := argumentFields(structVal.Type())
+	if err != nil {
+		return nil, err
+	}
+	var args []string
+	given := 0
+	for i, fieldType := range fields {
+		field := structVal.FieldByIndex(fieldType.Index)
+		values, err := formatValue(field, fieldType.Tag.Get(layoutTag))
+		if err != nil {
+			return nil, fmt.Errorf("marshaling argument %s failed: %v", argPath(i), err)
+		}
+		if isSecret(fieldType) {
+			values = maskValues(values)
+		}
+		if !isRestArgument(fieldType) && len(values) == 0 {
+			// the argument keeps its position
+			values = []string{""}
+		}
+		args = append(args, values...)
+		isDefault, err := isDefaultValue(structVal, field, fieldType)
+		if err != nil {
+			return nil, err
+		}
+		if !isDefault {
+			given = len(args)
+		}
+	}
+	return args[:given], nil
+}
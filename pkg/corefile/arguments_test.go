@@ -0,0 +1,150 @@
+package corefile
+
+import (
+	"testing"
+	"time"
+
+	"github.com/coredns/caddy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type zoneConfig struct {
+	Zone      string        `arg:"0" default:"." check:"nonempty"`
+	Upstreams []string      `arg:"1" check:"each:hostport"`
+	Timeout   time.Duration `cf:"timeout" default:"1s"`
+}
+
+func TestArguments(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     string
+		want    zoneConfig
+		wantErr string
+	}{
+		{
+			name: "no arguments",
+			cfg:  "plugin",
+			want: zoneConfig{Zone: ".", Timeout: time.Second},
+		},
+		{
+			name: "zone",
+			cfg:  "plugin example.org",
+			want: zoneConfig{Zone: "example.org", Timeout: time.Second},
+		},
+		{
+			name: "zone and upstreams",
+			cfg:  "plugin example.org 10.0.0.1:53 10.0.0.2:53",
+			want: zoneConfig{Zone: "example.org", Upstreams: []string{"10.0.0.1:53", "10.0.0.2:53"}, Timeout: time.Second},
+		},
+		{
+			name: "arguments and block",
+			cfg:  "plugin example.org 10.0.0.1:53 {\n\ttimeout 2s\n}",
+			want: zoneConfig{Zone: "example.org", Upstreams: []string{"10.0.0.1:53"}, Timeout: 2 * time.Second},
+		},
+		{
+			name:    "check",
+			cfg:     "plugin \"\"",
+			wantErr: "Testfile:1: property 'arg[0]': nonempty: cannot be empty",
+		},
+		{
+			name:    "check of the rest",
+			cfg:     "plugin example.org 10.0.0.1:53 10.0.0.2",
+			wantErr: "Testfile:1: property 'arg[1]': each:hostport: element 1: invalid hostport: 10.0.0.2",
+		},
+		{
+			name:    "check with block",
+			cfg:     "plugin example.org 10.0.0.2 {\n\ttimeout 2s\n}",
+			wantErr: "Testfile:1: property 'arg[1]': each:hostport: element 0: invalid hostport: 10.0.0.2",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var cfg zoneConfig
+			err := Parse(caddy.NewTestController("dns", tt.cfg), &cfg)
+			if tt.wantErr != "" {
+				assert.EqualError(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, cfg)
+		})
+	}
+}
+
+func TestArguments_invalid(t *testing.T) {
+	var port struct {
+		Port int `arg:"0"`
+	}
+	assert.EqualError(t, Parse(caddy.NewTestController("dns", "plugin x"), &port),
+		"Testfile:1: property 'arg[0]': assigning value failed: strconv.ParseInt: parsing \"x\": invalid syntax")
+	assert.EqualError(t, Parse(caddy.NewTestController("dns", "plugin 53 54"), &port),
+		"Testfile:1: property 'arg[1]': unexpected argument")
+
+	var withArguments struct {
+		Arguments []string
+		Port      int `arg:"0"`
+	}
+	require.NoError(t, Parse(caddy.NewTestController("dns", "plugin 53 54"), &withArguments))
+	assert.Equal(t, []string{"53", "54"}, withArguments.Arguments)
+	assert.Equal(t, 53, withArguments.Port)
+
+	var invalidIndex struct {
+		Port int `arg:"first"`
+	}
+	assert.Error(t, Parse(caddy.NewTestController("dns", "plugin"), &invalidIndex))
+	var missingIndex struct {
+		Port int `arg:"1"`
+	}
+	assert.Error(t, Parse(caddy.NewTestController("dns", "plugin"), &missingIndex))
+	var restNotLast struct {
+		Upstreams []string `arg:"0"`
+		Port      int      `arg:"1"`
+	}
+	assert.Error(t, Parse(caddy.NewTestController("dns", "plugin"), &restNotLast))
+}
+
+func TestArguments_marshal(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  zoneConfig
+		want string
+	}{
+		{
+			name: "defaults",
+			cfg:  zoneConfig{Zone: ".", Timeout: time.Second},
+			want: "{\n}\n",
+		},
+		{
+			name: "zone",
+			cfg:  zoneConfig{Zone: "example.org", Timeout: time.Second},
+			want: "example.org {\n}\n",
+		},
+		{
+			name: "default zone and upstreams",
+			cfg:  zoneConfig{Zone: ".", Upstreams: []string{"10.0.0.1:53", "10.0.0.2:53"}, Timeout: 2 * time.Second},
+			want: ". 10.0.0.1:53 10.0.0.2:53 {\n\ttimeout 2s\n}\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			text, err := Marshal(tt.cfg)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, text)
+
+			var parsed zoneConfig
+			require.NoError(t, Parse(caddy.NewTestController("dns", "plugin "+text), &parsed))
+			assert.Equal(t, tt.cfg, parsed)
+		})
+	}
+}
+
+func TestArguments_describe(t *testing.T) {
+	schema, err := Describe(zoneConfig{})
+	require.NoError(t, err)
+	assert.Equal(t, []Property{
+		{Name: "arg[0]", Type: "string", Kind: KindValue, Default: ".", Constraints: []Constraint{{Name: "nonempty"}}},
+		{Name: "arg[1]", Type: "[]string", Kind: KindValue, Constraints: []Constraint{{Name: "hostport", Each: true}}},
+		{Name: "timeout", Type: "time.Duration", Kind: KindValue, Default: "1s"},
+	}, schema.Properties)
+}
@@ -0,0 +1,57 @@
+package corefile
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ByteSize is a number of bytes written human-readably in the configuration, e.g. 512KiB or 10MB.
+type ByteSize int64
+
+// byteUnits are the multipliers of the units, decimal (KB, MB, ...) as well as binary (KiB, MiB, ...) ones.
+var byteUnits = map[string]int64{
+	"":    1,
+	"b":   1,
+	"kb":  1000,
+	"mb":  1000 * 1000,
+	"gb":  1000 * 1000 * 1000,
+	"tb":  1000 * 1000 * 1000 * 1000,
+	"kib": 1 << 10,
+	"mib": 1 << 20,
+	"gib": 1 << 30,
+	"tib": 1 << 40,
+}
+
+// ParseByteSize parses the number of bytes followed by an optional case-insensitive unit.
+func ParseByteSize(input string) (ByteSize, error) {
+	input = strings.TrimSpace(input)
+	i := strings.IndexFunc(input, func(r rune) bool { return (r < '0' || r > '9') && r != '.' })
+	if i < 0 {
+		i = len(input)
+	}
+	multiplier, ok := byteUnits[strings.ToLower(input[i:])]
+	if !ok {
+		return 0, fmt.Errorf("unknown byte size unit: %s", input[i:])
+	}
+	number, err := strconv.ParseFloat(input[:i], 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid byte size: %s", input)
+	}
+	size := number * float64(multiplier)
+	if size != float64(int64(size)) {
+		return 0, fmt.Errorf("byte size is not a whole number of bytes: %s", input)
+	}
+	return ByteSize(size), nil
+}
+
+// String formats the size by the largest binary unit dividing it, the decimal units are not used.
+func (s ByteSize) String() string {
+	for _, unit := range []string{"TiB", "GiB", "MiB", "KiB"} {
+		multiplier := byteUnits[strings.ToLower(unit)]
+		if s != 0 && int64(s)%multiplier == 0 {
+			return strconv.FormatInt(int64(s)/multiplier, 10) + unit
+		}
+	}
+	return strconv.FormatInt(int64(s), 10) + "B"
+}
@@ -0,0 +1,64 @@
+package corefile
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseByteSize(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    ByteSize
+		wantErr bool
+	}{
+		{input: "0", want: 0},
+		{input: "512", want: 512},
+		{input: "512B", want: 512},
+		{input: "10KB", want: 10000},
+		{input: "10MB", want: 10000000},
+		{input: "2GB", want: 2000000000},
+		{input: "512KiB", want: 512 << 10},
+		{input: "10mib", want: 10 << 20},
+		{input: "1.5GiB", want: 3 << 29},
+		{input: "1TiB", want: 1 << 40},
+		{input: "1.5B", wantErr: true},
+		{input: "10XB", wantErr: true},
+		{input: "MB", wantErr: true},
+		{input: "-1MB", wantErr: true},
+		{input: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			got, err := ParseByteSize(tt.input)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestByteSize_String(t *testing.T) {
+	tests := []struct {
+		size ByteSize
+		want string
+	}{
+		{size: 0, want: "0B"},
+		{size: 1000, want: "1000B"},
+		{size: 10 << 20, want: "10MiB"},
+		{size: 1536, want: "1536B"},
+		{size: 3 << 29, want: "1536MiB"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.want, func(t *testing.T) {
+			assert.Equal(t, tt.want, tt.size.String())
+			parsed, err := ParseByteSize(tt.size.String())
+			require.NoError(t, err)
+			assert.Equal(t, tt.size, parsed)
+		})
+	}
+}
@@ -0,0 +1,115 @@
+package corefile
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+const (
+	defaultIfTag = "default_if"
+	checkIfTag   = "check_if"
+)
+
+// conditionalRule is a rule of the default_if and check_if tags written as `property=value:then`, the then part being
+// the default value or the checks applied when the sibling property has the value. The rules of a tag are separated by
+// semicolons, the first matching rule of default_if wins, all the matching rules of check_if are checked.
+type conditionalRule struct {
+	property string
+	value    string
+	then     string
+}
+
+func parseConditionalRules(tag string) ([]conditionalRule, error) {
+	var rules []conditionalRule
+	for _, rule := range strings.Split(tag, ";") {
+		condition, then, ok := strings.Cut(strings.TrimSpace(rule), ":")
+		property, value, hasValue := strings.Cut(condition, "=")
+		if !ok || !hasValue || property == "" {
+			return nil, fmt.Errorf("invalid rule '%s', 'property=value:then' expected", rule)
+		}
+		rules = append(rules, conditionalRule{property: property, value: value, then: then})
+	}
+	return rules, nil
+}
+
+// matches reports whether the sibling property of the structure has the value of the rule, the values of a slice are
+// compared joined by commas.
+func (r conditionalRule) matches(structVal reflect.Value) (bool, error) {
+	field := findFieldByTag(structVal, r.property)
+	if !field.IsValid() {
+		return false, fmt.Errorf("unknown property '%s'", r.property)
+	}
+	fieldType, _ := findStructFieldByTag(structVal.Type(), r.property)
+	values, err := formatValue(field, fieldType.Tag.Get(layoutTag))
+	if err != nil {
+		return false, err
+	}
+	return strings.Join(values, ",") == r.value, nil
+}
+
+// maskConditionalDefaults masks the default values of the default_if rules, the invalid rules are masked entirely.
+func maskConditionalDefaults(tag string) string {
+	rules, err := parseConditionalRules(tag)
+	if err != nil {
+		return secretMask
+	}
+	masked := make([]string, len(rules))
+	for i, rule := range rules {
+		masked[i] = rule.property + "=" + rule.value + ":" + secretMask
+	}
+	return strings.Join(masked, ";")
+}
+
+// applyConditionalDefaults assigns the values of the default_if tags to the fields not given in the block, so they
+// depend on the values of the other properties once the block is parsed.
+func (p *parser) applyConditionalDefaults(structVal reflect.Value, path string) error {
+	for _, fieldType := range structFields(structVal.Type()) {
+		tag, ok := fieldType.Tag.Lookup(defaultIfTag)
+		if !ok {
+			continue
+		}
+		name := fieldType.Tag.Get(cfTag)
+		if _, given := p.locations[joinPath(path, name)]; given {
+			continue
+		}
+		rules, err := parseConditionalRules(tag)
+		if err != nil {
+			return p.log.Errf("apply conditional defaults to property '%s': %v", name, err)
+		}
+		for _, rule := range rules {
+			match, err := rule.matches(structVal)
+			if err != nil {
+				return p.log.Errf("apply conditional defaults to property '%s': %v", name, err)
+			}
+			if match {
+				if err := assignDefault(structVal.FieldByIndex(fieldType.Index), fieldType, rule.then); err != nil {
+					return p.log.Errf("apply conditional defaults to property '%s': %v", name, err)
+				}
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// validateConditionalChecks runs the checks of the check_if rules matching the sibling properties.
+func (v *validator) validateConditionalChecks(structVal reflect.Value, val reflect.Value, tag string) error {
+	rules, err := parseConditionalRules(tag)
+	if err != nil {
+		return err
+	}
+	for _, rule := range rules {
+		match, err := rule.matches(structVal)
+		if err != nil {
+			return err
+		}
+		if !match {
+			continue
+		}
+		if err := v.validateFieldOf(structVal, val, rule.then); err != nil {
+			return fmt.Errorf("%s=%s: %w", rule.property, rule.value, err)
+		}
+	}
+	return nil
+}
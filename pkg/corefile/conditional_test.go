@@ -0,0 +1,79 @@
+package corefile
+
+import (
+	"testing"
+
+	"github.com/coredns/caddy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type transportConfig struct {
+	Transport  string `cf:"transport" default:"dns" check:"oneOf(dns|tls|https)"`
+	Port       int    `cf:"port" default:"53" default_if:"transport=tls:853;transport=https:443"`
+	ServerName string `cf:"server_name" check_if:"transport=tls:nonempty;transport=https:nonempty,hostname"`
+}
+
+func TestConditionalRules(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     string
+		want    transportConfig
+		wantErr string
+	}{
+		{
+			name: "no block",
+			cfg:  "plugin",
+			want: transportConfig{Transport: "dns", Port: 53},
+		},
+		{
+			name: "default of the transport",
+			cfg:  "plugin {\n\ttransport tls\n\tserver_name dns.example\n}",
+			want: transportConfig{Transport: "tls", Port: 853, ServerName: "dns.example"},
+		},
+		{
+			name: "given value wins",
+			cfg:  "plugin {\n\ttransport https\n\tport 8443\n\tserver_name dns.example\n}",
+			want: transportConfig{Transport: "https", Port: 8443, ServerName: "dns.example"},
+		},
+		{
+			name: "checks not matching",
+			cfg:  "plugin {\n\ttransport dns\n}",
+			want: transportConfig{Transport: "dns", Port: 53},
+		},
+		{
+			name:    "check of the transport",
+			cfg:     "plugin {\n\ttransport tls\n}",
+			wantErr: "Testfile:1: property 'server_name': transport=tls: nonempty: cannot be empty",
+		},
+		{
+			name:    "all the checks of the transport",
+			cfg:     "plugin {\n\ttransport https\n\tserver_name dns_1\n}",
+			wantErr: "Testfile:3: property 'server_name': transport=https: hostname: invalid hostname: dns_1",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var cfg transportConfig
+			err := Parse(caddy.NewTestController("dns", tt.cfg), &cfg)
+			if tt.wantErr != "" {
+				assert.EqualError(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, cfg)
+		})
+	}
+}
+
+func TestConditionalRules_invalid(t *testing.T) {
+	var invalidRule struct {
+		Port int `cf:"port" default_if:"transport:853"`
+	}
+	assert.Error(t, Parse(caddy.NewTestController("dns", "plugin {\n}"), &invalidRule))
+
+	var unknownProperty struct {
+		Name string `cf:"name" check_if:"transport=tls:nonempty"`
+	}
+	assert.Error(t, Parse(caddy.NewTestController("dns", "plugin {\n}"), &unknownProperty))
+}
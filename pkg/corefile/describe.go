@@ -0,0 +1,222 @@
+package corefile
+
+import (
+	"fmt"
+	"reflect"
+	"slices"
+	"strings"
+)
+
+const helpTag = "help"
+
+// PropertyKind tells how the property is written in the configuration.
+type PropertyKind string
+
+const (
+	// KindValue is a property with its values on a single line.
+	KindValue PropertyKind = "value"
+	// KindRows is a property which may be repeated, every occurrence is a row of values.
+	KindRows PropertyKind = "rows"
+	// KindBlock is a nested block of properties.
+	KindBlock PropertyKind = "block"
+	// KindBlocks is a nested block which may be repeated.
+	KindBlocks PropertyKind = "blocks"
+	// KindMap is a block of `key value` lines.
+	KindMap PropertyKind = "map"
+	// KindImplementation is the name of a registered implementation of the interface followed by its block.
+	KindImplementation PropertyKind = "implementation"
+)
+
+// Schema describes the properties of the configuration structure.
+type Schema struct {
+	Properties []Property `json:"properties"`
+}
+
+// Property describes a single property given by the tags of the structure field.
+type Property struct {
+	Name            string       `json:"name"`
+	Type            string       `json:"type"`
+	Kind            PropertyKind `json:"kind"`
+	Default         string       `json:"default,omitempty"`
+	DefaultIf       string       `json:"default_if,omitempty"`
+	Layout          string       `json:"layout,omitempty"`
+	Help            string       `json:"help,omitempty"`
+	Constraints     []Constraint `json:"constraints,omitempty"`
+	CheckIf         string       `json:"check_if,omitempty"`
+	Deprecated      *string      `json:"deprecated,omitempty"`
+	Secret          bool         `json:"secret,omitempty"`
+	Implementations []string     `json:"implementations,omitempty"`
+	Properties      []Property   `json:"properties,omitempty"`
+}
+
+// Constraint is a checker of the check tag with its arguments, applied to every element of the slice if Each is set.
+type Constraint struct {
+	Name string   `json:"name"`
+	Args []string `json:"args,omitempty"`
+	Each bool     `json:"each,omitempty"`
+}
+
+func (c Constraint) String() string {
+	name := c.Name
+	if c.Each {
+		name = eachPrefix + name
+	}
+	if len(c.Args) == 0 {
+		return name
+	}
+	return name + "(" + strings.Join(c.Args, "|") + ")"
+}
+
+// Describe describes the properties of the structure, or the pointer to it, by its cf, arg, default, default_if,
+// layout, check, check_if, deprecated, secret and help tags. The properties bound to the plugin arguments are named by
+// their positions, e.g. arg[0]. The default values of the secret properties are masked. The check tags are verified
+// to refer known checkers.
+func Describe(v any) (*Schema, error) {
+	structType := reflect.TypeOf(v)
+	if structType != nil && structType.Kind() == reflect.Pointer {
+		structType = structType.Elem()
+	}
+	if structType == nil || structType.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("invalid argument: structure or pointer to a structure expected")
+	}
+	properties, err := describeStructure(structType, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &Schema{Properties: properties}, nil
+}
+
+// describeStructure describes the properties of the structure, the parents are the structures enclosing it, so
+// a recursive structure is not described again.
+func describeStructure(structType reflect.Type, parents []reflect.Type) ([]Property, error) {
+	var properties []Property
+	v := validator{checkers: defaultChecks}
+	for _, field := range structFields(structType) {
+		_, isProperty := field.Tag.Lookup(cfTag)
+		_, isArgument := field.Tag.Lookup(argTag)
+		if !(isProperty || isArgument) || !field.IsExported() {
+			continue
+		}
+		name := propertyName(field)
+		property := Property{
+			Name:      name,
+			Type:      field.Type.String(),
+			Default:   field.Tag.Get(defaultTag),
+			DefaultIf: field.Tag.Get(defaultIfTag),
+			Layout:    field.Tag.Get(layoutTag),
+			Help:      field.Tag.Get(helpTag),
+			CheckIf:   field.Tag.Get(checkIfTag),
+		}
+		if msg, ok := field.Tag.Lookup(deprecatedTag); ok {
+			property.Deprecated = &msg
+		}
+		if isSecret(field) {
+			property.Secret = true
+			if property.Default != "" {
+				property.Default = secretMask
+			}
+			if property.DefaultIf != "" {
+				property.DefaultIf = maskConditionalDefaults(property.DefaultIf)
+			}
+		}
+		if tag := field.Tag.Get(checkTag); tag != "" {
+			for _, condition := range splitConditions(tag) {
+				checkerName, args, err := parseCondition(condition)
+				if err != nil {
+					return nil, fmt.Errorf("property '%s': %v", name, err)
+				}
+				checkerName, each := cutEach(checkerName)
+				if _, ok := v.lookupChecker(checkerName); !ok && relationChecks[strings.ToLower(checkerName)] == nil {
+					return nil, fmt.Errorf("property '%s': unknown checker: %s", name, checkerName)
+				}
+				property.Constraints = append(property.Constraints, Constraint{Name: checkerName, Args: args, Each: each})
+			}
+		}
+
+		var nested reflect.Type
+		switch t := field.Type; {
+		case isScalarStruct(t) || isScalar(t) || isPointerToPrimitive(t):
+			property.Kind = KindValue
+		case t.Kind() == reflect.Pointer && t.Elem().Kind() == reflect.Struct:
+			property.Kind, nested = KindBlock, t.Elem()
+		case t.Kind() == reflect.Struct:
+			property.Kind, nested = KindBlock, t
+		case isSliceOfStructs(t):
+			property.Kind, nested = KindBlocks, t.Elem()
+			if nested.Kind() == reflect.Pointer {
+				nested = nested.Elem()
+			}
+		case t.Kind() == reflect.Slice && t.Elem().Kind() == reflect.Slice:
+			property.Kind = KindRows
+		case t.Kind() == reflect.Map:
+			property.Kind = KindMap
+		case t.Kind() == reflect.Interface:
+			property.Kind, property.Implementations = KindImplementation, implementationNames(t)
+		default:
+			return nil, fmt.Errorf("property '%s': unsupported type: %v", name, t)
+		}
+		if nested != nil && nested != structType && !slices.Contains(parents, nested) {
+			nestedProperties, err := describeStructure(nested, append(parents, structType))
+			if err != nil {
+				return nil, err
+			}
+			property.Properties = nestedProperties
+		}
+		properties = append(properties, property)
+	}
+	return properties, nil
+}
+
+// Help renders the schema as a Markdown table of the properties, the nested ones are named by the path of the blocks,
+// e.g. `health_check.interval`.
+func (s *Schema) Help() string {
+	var sb strings.Builder
+	sb.WriteString("| Property | Type | Default | Constraints | Description |\n")
+	sb.WriteString("|---|---|---|---|---|\n")
+	writeHelpRows(&sb, s.Properties, "")
+	return sb.String()
+}
+
+func writeHelpRows(sb *strings.Builder, properties []Property, prefix string) {
+	for _, p := range properties {
+		typ := p.Type
+		switch p.Kind {
+		case KindBlock:
+			typ = "block"
+		case KindBlocks:
+			typ = "block, repeatable"
+		case KindRows:
+			typ += ", repeatable"
+		case KindImplementation:
+			typ = "block of " + strings.Join(p.Implementations, ", ")
+		}
+		if p.Layout != "" {
+			typ += ", layout `" + p.Layout + "`"
+		}
+		var defaultValue string
+		if p.Default != "" {
+			defaultValue = "`" + p.Default + "`"
+		}
+		constraints := make([]string, len(p.Constraints))
+		for i, c := range p.Constraints {
+			constraints[i] = "`" + c.String() + "`"
+		}
+		description := p.Help
+		if p.Deprecated != nil {
+			deprecated := "**Deprecated**"
+			if *p.Deprecated != "" {
+				deprecated += ": " + *p.Deprecated
+			}
+			if description != "" {
+				deprecated += ". " + description
+			}
+			description = deprecated
+		}
+		cells := []string{"`" + prefix + p.Name + "`", typ, defaultValue, strings.Join(constraints, ", "), description}
+		for i := range cells {
+			cells[i] = strings.ReplaceAll(cells[i], "|", `\|`)
+		}
+		sb.WriteString("| " + strings.Join(cells, " | ") + " |\n")
+		writeHelpRows(sb, p.Properties, prefix+p.Name+".")
+	}
+}
@@ -0,0 +1,78 @@
+package corefile
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDescribe(t *testing.T) {
+	schema, err := Describe(&person{})
+	require.NoError(t, err)
+	assert.Equal(t, []Property{
+		{Name: "name", Type: "string", Kind: KindValue, Default: "not-known"},
+		{Name: "wife", Type: "*corefile.person", Kind: KindBlock},
+		{Name: "details", Type: "corefile.personDetails", Kind: KindBlock, Properties: []Property{
+			{Name: "age", Type: "int", Kind: KindValue, Default: "17"},
+		}},
+		{Name: "child", Type: "[]*corefile.person", Kind: KindBlocks},
+		{Name: "pet", Type: "[]corefile.pet", Kind: KindBlocks, Properties: []Property{
+			{Name: "kind", Type: "string", Kind: KindValue, Constraints: []Constraint{{Name: "nonempty"}}},
+			{Name: "age", Type: "int", Kind: KindValue, Default: "1"},
+		}},
+	}, schema.Properties)
+
+	schema, err = Describe(testStruct{})
+	require.NoError(t, err)
+	assert.Equal(t, Property{Name: "int16num", Type: "int16", Kind: KindValue, Default: "99",
+		Constraints: []Constraint{{Name: "nonempty"}, {Name: "LTE", Args: []string{"99"}}}}, schema.Properties[3])
+
+	schema, err = Describe(struct {
+		Ports []string `cf:"ports" check:"minlen(1),each:port"`
+	}{})
+	require.NoError(t, err)
+	assert.Equal(t, []Constraint{{Name: "minlen", Args: []string{"1"}}, {Name: "port", Each: true}},
+		schema.Properties[0].Constraints)
+	assert.Equal(t, "each:port", schema.Properties[0].Constraints[1].String())
+
+	schema, err = Describe(transportConfig{})
+	require.NoError(t, err)
+	assert.Equal(t, "transport=tls:853;transport=https:443", schema.Properties[1].DefaultIf)
+	assert.Equal(t, "transport=tls:nonempty;transport=https:nonempty,hostname", schema.Properties[2].CheckIf)
+
+	schema, err = Describe(struct {
+		Host  string `cf:"host" deprecated:"use 'upstream' instead"`
+		Hosts string `cf:"hosts" deprecated:""`
+	}{})
+	require.NoError(t, err)
+	assert.Equal(t, ptr("use 'upstream' instead"), schema.Properties[0].Deprecated)
+	assert.Equal(t, ptr(""), schema.Properties[1].Deprecated)
+
+	_, err = Describe(5)
+	assert.Error(t, err)
+	_, err = Describe(&struct {
+		Str string `cf:"str" check:"unknown"`
+	}{})
+	assert.Error(t, err)
+}
+
+func TestSchema_Help(t *testing.T) {
+	schema, err := Describe(struct {
+		Mode     string        `cf:"mode" default:"fast" check:"oneOf(fast|slow)" help:"processing mode"`
+		Timeout  time.Duration `cf:"timeout" default:"1s"`
+		Hosts    [][]string    `cf:"hosts" deprecated:"use 'upstream' instead" help:"static hosts"`
+		Upstream *struct {
+			Addr string `cf:"addr" check:"nonempty"`
+		} `cf:"upstream"`
+	}{})
+	require.NoError(t, err)
+	assert.Equal(t, "| Property | Type | Default | Constraints | Description |\n"+
+		"|---|---|---|---|---|\n"+
+		"| `mode` | string | `fast` | `oneOf(fast\\|slow)` | processing mode |\n"+
+		"| `timeout` | time.Duration | `1s` |  |  |\n"+
+		"| `hosts` | [][]string, repeatable |  |  | **Deprecated**: use 'upstream' instead. static hosts |\n"+
+		"| `upstream` | block |  |  |  |\n"+
+		"| `upstream.addr` | string |  | `nonempty` |  |\n", schema.Help())
+}
@@ -0,0 +1,57 @@
+package corefile
+
+import (
+	"os"
+	"reflect"
+	"strings"
+)
+
+// envPlaceholders are the delimiters of the environment variables in the values, {$VAR} and {%VAR%} as in Caddyfile.
+var envPlaceholders = [][2]string{{"{$", "}"}, {"{%", "%}"}}
+
+// expandEnv replaces the placeholders of the environment variables in the value by their values, unset variables
+// are replaced by an empty string. The expanded values are not expanded again.
+func expandEnv(value string) string {
+	for _, placeholder := range envPlaceholders {
+		value = expandEnvPlaceholder(value, placeholder[0], placeholder[1])
+	}
+	return value
+}
+
+func expandEnvPlaceholder(value string, start string, end string) string {
+	var expanded strings.Builder
+	for {
+		i := strings.Index(value, start)
+		if i < 0 {
+			break
+		}
+		j := strings.Index(value[i+len(start):], end)
+		if j <= 0 {
+			break
+		}
+		expanded.WriteString(value[:i])
+		expanded.WriteString(os.Getenv(value[i+len(start) : i+len(start)+j]))
+		value = value[i+len(start)+j+len(end):]
+	}
+	expanded.WriteString(value)
+	return expanded.String()
+}
+
+// envDefaultPrefix of the default tag takes the default value from the environment variable, e.g.
+// `default:"env:PORT"`, optionally followed by the fallback value for the variable not set, e.g.
+// `default:"env:PORT,53"`.
+const envDefaultPrefix = "env:"
+
+// lookupDefault returns the default value of the field given by its default tag, the value of the environment variable
+// for the env prefix. An empty variable is not set, without the fallback the field has no default then.
+func lookupDefault(field reflect.StructField) (string, bool) {
+	value, ok := field.Tag.Lookup(defaultTag)
+	if !ok || !strings.HasPrefix(value, envDefaultPrefix) {
+		return value, ok
+	}
+	name, fallback, hasFallback := strings.Cut(strings.TrimPrefix(value, envDefaultPrefix), ",")
+	if envValue := os.Getenv(name); envValue != "" {
+		return envValue, true
+	}
+	return fallback, hasFallback
+}
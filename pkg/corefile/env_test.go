@@ -0,0 +1,64 @@
+package corefile
+
+import (
+	"testing"
+
+	"github.com/coredns/caddy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_expandEnv(t *testing.T) {
+	t.Setenv("COREFILE_HOST", "10.0.0.1")
+	t.Setenv("COREFILE_PORT", "5353")
+	t.Setenv("COREFILE_REF", "{$COREFILE_HOST}")
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{value: "plain", want: "plain"},
+		{value: "{$COREFILE_HOST}", want: "10.0.0.1"},
+		{value: "{%COREFILE_HOST%}", want: "10.0.0.1"},
+		{value: "{$COREFILE_HOST}:{%COREFILE_PORT%}", want: "10.0.0.1:5353"},
+		{value: "tcp://{$COREFILE_HOST}:{$COREFILE_PORT}/path", want: "tcp://10.0.0.1:5353/path"},
+		{value: "{$COREFILE_UNSET}", want: ""},
+		{value: "{$COREFILE_REF}", want: "{$COREFILE_HOST}"},
+		{value: "{$}", want: "{$}"},
+		{value: "{$COREFILE_HOST", want: "{$COREFILE_HOST"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			assert.Equal(t, tt.want, expandEnv(tt.value))
+		})
+	}
+}
+
+func Test_envDefault(t *testing.T) {
+	t.Setenv("COREFILE_PORT", "5353")
+	t.Setenv("COREFILE_EMPTY", "")
+	t.Setenv("COREFILE_KEY", "not-a-number")
+	type config struct {
+		Port     int      `cf:"port" default:"env:COREFILE_PORT,53"`
+		Fallback int      `cf:"fallback" default:"env:COREFILE_UNSET,53"`
+		Empty    string   `cf:"empty" default:"env:COREFILE_EMPTY,fallback"`
+		NoDef    string   `cf:"nodef" default:"env:COREFILE_UNSET"`
+		Hosts    []string `cf:"hosts" default:"env:COREFILE_UNSET,a,b"`
+	}
+	var cfg config
+	require.NoError(t, Parse(caddy.NewTestController("dns", "plugin {\n\tport 853\n}"), &cfg))
+	assert.Equal(t, config{Port: 853, Fallback: 53, Empty: "fallback", Hosts: []string{"a", "b"}}, cfg)
+
+	cfg = config{}
+	require.NoError(t, Parse(caddy.NewTestController("dns", "plugin"), &cfg))
+	assert.Equal(t, 5353, cfg.Port)
+	text, err := Marshal(cfg)
+	require.NoError(t, err)
+	assert.Equal(t, "{\n}\n", text)
+
+	var invalid struct {
+		Key int `cf:"key" secret:"true" default:"env:COREFILE_KEY"`
+	}
+	assert.EqualError(t, Parse(caddy.NewTestController("dns", "plugin"), &invalid),
+		"Testfile:1 - Error during parsing: apply defaults to property 'key': "+
+			"strconv.ParseInt: parsing \"********\": invalid syntax")
+}
@@ -0,0 +1,140 @@
+package corefile
+
+import (
+	"fmt"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// implementation is the structure registered as an implementation of the interface, created by its factory.
+type implementation struct {
+	name    string
+	factory func() any
+	typ     reflect.Type
+}
+
+var (
+	registeredImplementations     = map[reflect.Type]map[string]implementation{}
+	registeredImplementationsLock sync.RWMutex
+)
+
+// RegisterImplementation registers the structure created by the factory as the implementation of the interface under
+// the name, so a field of the interface type is filled by the property giving the name followed by the optional block
+// of the structure, e.g. `transport tcp { ... }`. The factory returns a pointer to a new structure implementing
+// the interface. The name is case-insensitive like the names of the checkers, it must be unique for the interface.
+// It is safe to be called concurrently, typically from the init function of a plugin.
+func RegisterImplementation(ifaceType reflect.Type, name string, factory func() any) error {
+	if ifaceType == nil || ifaceType.Kind() != reflect.Interface {
+		return fmt.Errorf("invalid interface type: %v", ifaceType)
+	}
+	if name == "" || strings.ContainsAny(name, " \t{}\"#") {
+		return fmt.Errorf("invalid implementation name: '%s'", name)
+	}
+	if factory == nil {
+		return fmt.Errorf("implementation '%s' has no factory", name)
+	}
+	typ := reflect.TypeOf(factory())
+	if typ == nil || typ.Kind() != reflect.Pointer || typ.Elem().Kind() != reflect.Struct || !typ.Implements(ifaceType) {
+		return fmt.Errorf("implementation '%s': pointer to a structure implementing %v expected, got %v", name,
+			ifaceType, typ)
+	}
+	key := strings.ToLower(name)
+	registeredImplementationsLock.Lock()
+	defer registeredImplementationsLock.Unlock()
+	implementations := registeredImplementations[ifaceType]
+	if implementations == nil {
+		implementations = map[string]implementation{}
+		registeredImplementations[ifaceType] = implementations
+	}
+	if _, ok := implementations[key]; ok {
+		return fmt.Errorf("implementation '%s' of %v is already registered", name, ifaceType)
+	}
+	implementations[key] = implementation{name: name, factory: factory, typ: typ}
+	return nil
+}
+
+// lookupImplementation returns the implementation of the interface registered under the name.
+func lookupImplementation(ifaceType reflect.Type, name string) (implementation, bool) {
+	registeredImplementationsLock.RLock()
+	defer registeredImplementationsLock.RUnlock()
+	impl, ok := registeredImplementations[ifaceType][strings.ToLower(name)]
+	return impl, ok
+}
+
+// implementationNames returns the sorted names of the implementations registered for the interface.
+func implementationNames(ifaceType reflect.Type) []string {
+	registeredImplementationsLock.RLock()
+	defer registeredImplementationsLock.RUnlock()
+	var names []string
+	for _, impl := range registeredImplementations[ifaceType] {
+		names = append(names, impl.name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// implementationName returns the registered name of the implementation of the interface by the type of its value.
+func implementationName(ifaceType reflect.Type, typ reflect.Type) (string, bool) {
+	registeredImplementationsLock.RLock()
+	defer registeredImplementationsLock.RUnlock()
+	for _, impl := range registeredImplementations[ifaceType] {
+		if impl.typ == typ {
+			return impl.name, true
+		}
+	}
+	return "", false
+}
+
+// parseImplementation creates the implementation of the interface field given by the single value of the property and
+// parses the block following it on the same line into it. Without the block the implementation keeps its defaults.
+func (p *parser) parseImplementation(field reflect.Value, values []string, path string, loc location) error {
+	if len(values) != 1 {
+		return loc.propertyErr(path, fmt.Errorf("implementation name expected, one of %v",
+			implementationNames(field.Type())))
+	}
+	impl, ok := lookupImplementation(field.Type(), values[0])
+	if !ok {
+		return loc.propertyErr(path, fmt.Errorf("unknown implementation '%s', one of %v expected", values[0],
+			implementationNames(field.Type())))
+	}
+	instance := reflect.ValueOf(impl.factory())
+	if err := p.applyDefaults(instance.Elem()); err != nil {
+		return err
+	}
+
+	// the opening brace of the block is left by RemainingArgs
+	if p.lexer.NextArg() {
+		if p.lexer.Val() != "{" {
+			return p.log.Errf("structure opening character '{' expected, got '%s'", p.lexer.Val())
+		}
+		if err := p.parseStructure(instance.Elem(), path); err != nil {
+			return err
+		}
+	} else {
+		if err := p.applyConditionalDefaults(instance.Elem(), path); err != nil {
+			return err
+		}
+		if err := p.validator.validateStructure(instance.Elem(), path); err != nil {
+			p.errs = append(p.errs, p.locate(err))
+		}
+	}
+	field.Set(instance)
+	return nil
+}
+
+// marshalImplementation writes the implementation of the interface field as the property giving its name followed
+// by its block.
+func marshalImplementation(sb *strings.Builder, field reflect.Value, name string, depth int) error {
+	elem := field.Elem()
+	implName, ok := implementationName(field.Type(), elem.Type())
+	if !ok {
+		return fmt.Errorf("marshaling property '%s' failed: type %v is not a registered implementation of %v", name,
+			elem.Type(), field.Type())
+	}
+	if elem.IsNil() {
+		return fmt.Errorf("marshaling property '%s' failed: nil implementation", name)
+	}
+	return marshalBlock(sb, elem.Elem(), name+" "+quoteValues([]string{implName})[0], depth)
+}
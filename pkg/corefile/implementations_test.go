@@ -0,0 +1,151 @@
+package corefile
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/coredns/caddy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type transport interface {
+	Network() string
+}
+
+var transportType = reflect.TypeOf((*transport)(nil)).Elem()
+
+type tcpTransport struct {
+	Port      int           `cf:"port" default:"53" check:"range(1-65535)"`
+	KeepAlive time.Duration `cf:"keepalive" default:"10s"`
+}
+
+func (*tcpTransport) Network() string {
+	return "tcp"
+}
+
+type tlsTransport struct {
+	Port       int    `cf:"port" default:"853"`
+	ServerName string `cf:"server_name" check:"nonempty"`
+}
+
+func (*tlsTransport) Network() string {
+	return "tcp-tls"
+}
+
+type upstreamConfig struct {
+	Addr      string    `cf:"addr"`
+	Transport transport `cf:"transport" check:"nonempty"`
+}
+
+func init() {
+	if err := RegisterImplementation(transportType, "tcp", func() any { return &tcpTransport{} }); err != nil {
+		panic(err)
+	}
+	if err := RegisterImplementation(transportType, "tls", func() any { return &tlsTransport{} }); err != nil {
+		panic(err)
+	}
+}
+
+func TestImplementations(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     string
+		want    upstreamConfig
+		wantErr string
+	}{
+		{
+			name: "implementation without block",
+			cfg:  "plugin {\n\ttransport tcp\n}",
+			want: upstreamConfig{Transport: &tcpTransport{Port: 53, KeepAlive: 10 * time.Second}},
+		},
+		{
+			name: "implementation with block",
+			cfg:  "plugin {\n\taddr 10.0.0.1\n\ttransport TLS {\n\t\tserver_name dns.example\n\t}\n}",
+			want: upstreamConfig{Addr: "10.0.0.1", Transport: &tlsTransport{Port: 853, ServerName: "dns.example"}},
+		},
+		{
+			name:    "unknown implementation",
+			cfg:     "plugin {\n\ttransport udp\n}",
+			wantErr: "Testfile:2: property 'transport': unknown implementation 'udp', one of [tcp tls] expected",
+		},
+		{
+			name:    "missing implementation name",
+			cfg:     "plugin {\n\ttransport\n}",
+			wantErr: "Testfile:2: property 'transport': implementation name expected, one of [tcp tls]",
+		},
+		{
+			name:    "check of the implementation block",
+			cfg:     "plugin {\n\ttransport tcp {\n\t\tport 0\n\t}\n}",
+			wantErr: "Testfile:3: property 'transport.port': range: should be in [1, 65535]",
+		},
+		{
+			name:    "check of the implementation without block",
+			cfg:     "plugin {\n\ttransport tls\n}",
+			wantErr: "Testfile:2: property 'transport.server_name': nonempty: cannot be empty",
+		},
+		{
+			name:    "missing implementation",
+			cfg:     "plugin {\n\taddr 10.0.0.1\n}",
+			wantErr: "Testfile:1: property 'transport': nonempty: cannot be empty",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var cfg upstreamConfig
+			err := Parse(caddy.NewTestController("dns", tt.cfg), &cfg)
+			if tt.wantErr != "" {
+				assert.EqualError(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, cfg)
+
+			text, err := Marshal(cfg)
+			require.NoError(t, err)
+			var parsed upstreamConfig
+			require.NoError(t, Parse(caddy.NewTestController("dns", "plugin "+text), &parsed))
+			assert.Equal(t, cfg, parsed)
+		})
+	}
+}
+
+func TestImplementations_marshalDescribe(t *testing.T) {
+	text, err := Marshal(upstreamConfig{Transport: &tlsTransport{Port: 8853, ServerName: "dns.example"}})
+	require.NoError(t, err)
+	assert.Equal(t, "{\n\ttransport tls {\n\t\tport 8853\n\t\tserver_name dns.example\n\t}\n}\n", text)
+
+	type udpTransport struct{ tcpTransport }
+	_, err = Marshal(upstreamConfig{Transport: &udpTransport{}})
+	assert.Error(t, err)
+
+	schema, err := Describe(upstreamConfig{})
+	require.NoError(t, err)
+	assert.Equal(t, Property{Name: "transport", Type: "corefile.transport", Kind: KindImplementation,
+		Constraints: []Constraint{{Name: "nonempty"}}, Implementations: []string{"tcp", "tls"}}, schema.Properties[1])
+	assert.Contains(t, schema.Help(), "| `transport` | block of tcp, tls |  | `nonempty` |  |")
+}
+
+func TestRegisterImplementation(t *testing.T) {
+	tests := []struct {
+		name      string
+		ifaceType reflect.Type
+		implName  string
+		factory   func() any
+	}{
+		{name: "not an interface", ifaceType: reflect.TypeOf(tcpTransport{}), implName: "tcp2",
+			factory: func() any { return &tcpTransport{} }},
+		{name: "empty name", ifaceType: transportType, factory: func() any { return &tcpTransport{} }},
+		{name: "invalid name", ifaceType: transportType, implName: "tcp {", factory: func() any { return &tcpTransport{} }},
+		{name: "no factory", ifaceType: transportType, implName: "tcp2"},
+		{name: "not a pointer", ifaceType: transportType, implName: "tcp2", factory: func() any { return tcpTransport{} }},
+		{name: "not implementing", ifaceType: transportType, implName: "tcp2", factory: func() any { return &zoneConfig{} }},
+		{name: "duplicate", ifaceType: transportType, implName: "TCP", factory: func() any { return &tcpTransport{} }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Error(t, RegisterImplementation(tt.ifaceType, tt.implName, tt.factory))
+		})
+	}
+}
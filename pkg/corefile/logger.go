@@ -1,6 +1,21 @@
 package corefile
 
+import (
+	"github.com/coredns/caddy"
+	clog "github.com/coredns/coredns/plugin/pkg/log"
+)
+
 type logger interface {
 	Err(msg string) error
 	Errf(format string, args ...interface{}) error
+	Warningf(format string, args ...interface{})
+}
+
+// controllerLogger reports the errors by the caddy controller and logs the warnings by the CoreDNS log.
+type controllerLogger struct {
+	*caddy.Controller
+}
+
+func (l controllerLogger) Warningf(format string, args ...interface{}) {
+	clog.Warningf(format, args...)
 }
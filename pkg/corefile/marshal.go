@@ -0,0 +1,261 @@
+package corefile
+
+import (
+	"encoding"
+	"fmt"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Marshal serializes the structure, or the pointer to it, back to the Corefile syntax. The result is the text following
+// the plugin name, i.e. the plugin arguments and the block, so `name + " " + text` parses back into an equal structure.
+// A field equal to its default value, or to the zero value without the default, is omitted. The values of the secret
+// fields are masked, so the text is not parsed back into an equal structure with them.
+func Marshal(v any) (string, error) {
+	structVal := reflect.ValueOf(v)
+	if structVal.Kind() == reflect.Pointer && !structVal.IsNil() {
+		structVal = structVal.Elem()
+	}
+	if structVal.Kind() != reflect.Struct {
+		return "", fmt.Errorf("invalid argument: structure or pointer to a structure expected")
+	}
+
+	var sb strings.Builder
+	args, err := marshalArguments(structVal)
+	if err != nil {
+		return "", err
+	}
+	argsVal := structVal.FieldByName(pluginArgsFieldName)
+	if len(args) == 0 && argsVal.IsValid() && argsVal.CanInterface() {
+		args, _ = argsVal.Interface().([]string)
+	}
+	if len(args) > 0 {
+		sb.WriteString(strings.Join(quoteValues(args), " ") + " ")
+	}
+	sb.WriteString("{\n")
+	if err := marshalStructure(&sb, structVal, 1); err != nil {
+		return "", err
+	}
+	sb.WriteString("}\n")
+	return sb.String(), nil
+}
+
+func marshalStructure(sb *strings.Builder, structVal reflect.Value, depth int) error {
+	indent := strings.Repeat("\t", depth)
+	for _, fieldType := range structFields(structVal.Type()) {
+		name, ok := fieldType.Tag.Lookup(cfTag)
+		if !ok || !fieldType.IsExported() {
+			continue
+		}
+		field := structVal.FieldByIndex(fieldType.Index)
+		isDefault, err := isDefaultValue(structVal, field, fieldType)
+		if err != nil {
+			return err
+		}
+		if isDefault {
+			continue
+		}
+
+		switch {
+		case isScalarStruct(field.Type()) || isScalar(field.Type()) || isPointerToPrimitive(field.Type()):
+			values, err := formatValue(field, fieldType.Tag.Get(layoutTag))
+			if err != nil {
+				return fmt.Errorf("marshaling property '%s' failed: %v", name, err)
+			}
+			if isSecret(fieldType) {
+				values = maskValues(values)
+			}
+			sb.WriteString(indent + name + " " + strings.Join(quoteValues(values), " ") + "\n")
+		case field.Kind() == reflect.Pointer && field.Type().Elem().Kind() == reflect.Struct:
+			// the presence of the block matters even if all its fields keep the defaults
+			if err := marshalBlock(sb, field.Elem(), name, depth); err != nil {
+				return err
+			}
+		case field.Kind() == reflect.Struct:
+			var nested strings.Builder
+			if err := marshalStructure(&nested, field, depth+1); err != nil {
+				return err
+			}
+			if nested.Len() > 0 {
+				sb.WriteString(indent + name + " {\n" + nested.String() + indent + "}\n")
+			}
+		case isSliceOfStructs(field.Type()):
+			for j := 0; j < field.Len(); j++ {
+				elem := field.Index(j)
+				if elem.Kind() == reflect.Pointer {
+					if elem.IsNil() {
+						continue
+					}
+					elem = elem.Elem()
+				}
+				if err := marshalBlock(sb, elem, name, depth); err != nil {
+					return err
+				}
+			}
+		case field.Kind() == reflect.Slice && field.Type().Elem().Kind() == reflect.Slice:
+			// every row is a repeated occurrence of the property
+			for j := 0; j < field.Len(); j++ {
+				values, err := formatValue(field.Index(j), "")
+				if err != nil {
+					return fmt.Errorf("marshaling property '%s' failed: %v", name, err)
+				}
+				if isSecret(fieldType) {
+					values = maskValues(values)
+				}
+				sb.WriteString(indent + name + " " + strings.Join(quoteValues(values), " ") + "\n")
+			}
+		case field.Kind() == reflect.Interface:
+			if err := marshalImplementation(sb, field, name, depth); err != nil {
+				return err
+			}
+		case field.Kind() == reflect.Map:
+			if err := marshalMap(sb, field, name, isSecret(fieldType), depth); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("marshaling property '%s' failed: unsupported type: %v", name, field.Type())
+		}
+	}
+	return nil
+}
+
+func marshalBlock(sb *strings.Builder, structVal reflect.Value, name string, depth int) error {
+	indent := strings.Repeat("\t", depth)
+	sb.WriteString(indent + name + " {\n")
+	if err := marshalStructure(sb, structVal, depth+1); err != nil {
+		return err
+	}
+	sb.WriteString(indent + "}\n")
+	return nil
+}
+
+// marshalMap writes the map as a block of `key value` lines sorted by the keys, the values are masked if secret.
+func marshalMap(sb *strings.Builder, mapVal reflect.Value, name string, secret bool, depth int) error {
+	indent := strings.Repeat("\t", depth)
+	keys := mapVal.MapKeys()
+	slices.SortFunc(keys, func(a, b reflect.Value) int { return strings.Compare(a.String(), b.String()) })
+	sb.WriteString(indent + name + " {\n")
+	for _, key := range keys {
+		values, err := formatValue(mapVal.MapIndex(key), "")
+		if err != nil {
+			return fmt.Errorf("marshaling key '%s' of map '%s' failed: %v", key.String(), name, err)
+		}
+		if secret {
+			values = maskValues(values)
+		}
+		sb.WriteString(indent + "\t" + quoteValues([]string{key.String()})[0] + " " +
+			strings.Join(quoteValues(values), " ") + "\n")
+	}
+	sb.WriteString(indent + "}\n")
+	return nil
+}
+
+// isDefaultValue reports whether the field of the structure equals its default value, or the zero value without
+// the default.
+func isDefaultValue(structVal reflect.Value, field reflect.Value, fieldType reflect.StructField) (bool, error) {
+	defaultVal := reflect.New(field.Type()).Elem()
+	if defaultValue, ok := defaultFor(structVal, fieldType); ok {
+		if err := assignDefault(defaultVal, fieldType, defaultValue); err != nil {
+			return false, fmt.Errorf("invalid default value of property '%s': %v", fieldType.Tag.Get(cfTag), err)
+		}
+	}
+	if field.Kind() == reflect.Slice || field.Kind() == reflect.Map {
+		// nil and empty are the same in the configuration
+		if field.Len() == 0 && defaultVal.Len() == 0 {
+			return true, nil
+		}
+	}
+	return reflect.DeepEqual(field.Interface(), defaultVal.Interface()), nil
+}
+
+// isScalar reports whether the property of the type is written as a single line of values.
+func isScalar(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.String, reflect.Bool, reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr, reflect.Float32,
+		reflect.Float64:
+		return true
+	case reflect.Slice:
+		return t.Elem().Kind() != reflect.Slice && !isSliceOfStructs(t)
+	}
+	return false
+}
+
+var (
+	textMarshalerType = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+	stringerType      = reflect.TypeOf((*fmt.Stringer)(nil)).Elem()
+)
+
+// formatValue formats the value to the property values, the inverse of assignFromString.
+func formatValue(v reflect.Value, layout string) ([]string, error) {
+	if v.Kind() == reflect.Pointer {
+		if v.IsNil() {
+			return nil, nil
+		}
+		v = v.Elem()
+	}
+	if v.Type() == timeType {
+		if layout == "" {
+			layout = time.RFC3339
+		}
+		return []string{v.Interface().(time.Time).Format(layout)}, nil
+	}
+
+	// the pointer receivers are reachable through the addressable copy
+	ptr := reflect.New(v.Type())
+	ptr.Elem().Set(v)
+	if ptr.Type().Implements(textMarshalerType) {
+		text, err := ptr.Interface().(encoding.TextMarshaler).MarshalText()
+		if err != nil {
+			return nil, err
+		}
+		return []string{string(text)}, nil
+	}
+	if ptr.Type().Implements(stringerType) {
+		return []string{ptr.Interface().(fmt.Stringer).String()}, nil
+	}
+	if isTextUnmarshaler(v.Type()) {
+		return nil, fmt.Errorf("type %v implements neither encoding.TextMarshaler nor fmt.Stringer", v.Type())
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		return []string{v.String()}, nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return []string{strconv.FormatInt(v.Int(), 10)}, nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return []string{strconv.FormatUint(v.Uint(), 10)}, nil
+	case reflect.Float32:
+		return []string{strconv.FormatFloat(v.Float(), 'g', -1, 32)}, nil
+	case reflect.Float64:
+		return []string{strconv.FormatFloat(v.Float(), 'g', -1, 64)}, nil
+	case reflect.Bool:
+		return []string{strconv.FormatBool(v.Bool())}, nil
+	case reflect.Slice:
+		var values []string
+		for i := 0; i < v.Len(); i++ {
+			elemValues, err := formatValue(v.Index(i), layout)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, elemValues...)
+		}
+		return values, nil
+	}
+	return nil, fmt.Errorf("unsupported type: %v", v.Type())
+}
+
+// quoteValues quotes the values which would not be read back as a single token.
+func quoteValues(values []string) []string {
+	quoted := make([]string, len(values))
+	for i, value := range values {
+		if value == "" || strings.ContainsAny(value, " \t\r\n\"{}#") {
+			value = `"` + strings.ReplaceAll(value, `"`, `\"`) + `"`
+		}
+		quoted[i] = value
+	}
+	return quoted
+}
@@ -0,0 +1,102 @@
+package corefile
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/coredns/caddy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMarshal(t *testing.T) {
+	tests := []struct {
+		name  string
+		input any
+		want  string
+	}{
+		{
+			name:  "defaults are omitted",
+			input: person{Name: "not-known", Details: personDetails{Age: 17}},
+			want:  "{\n}\n",
+		},
+		{
+			name: "nested blocks",
+			input: &person{Name: "Karel", Wife: &person{Name: "not-known", Details: personDetails{Age: 30}},
+				Details: personDetails{Age: 17}, Pets: []pet{{Kind: "cat", Age: 1}, {Kind: "dog", Age: 3}}},
+			want: "{\n\tname Karel\n\twife {\n\t\tdetails {\n\t\t\tage 30\n\t\t}\n\t}\n" +
+				"\tpet {\n\t\tkind cat\n\t}\n\tpet {\n\t\tkind dog\n\t\tage 3\n\t}\n}\n",
+		},
+		{
+			name: "arguments, quoting and maps",
+			input: testStruct{Arguments: []string{"arg1", "arg 2"}, Str: "a \"b\"", Int16Num: 99,
+				StrMap: map[string]string{"b": "2", "a": "1"}, Addr: netip.MustParseAddr("10.0.0.1")},
+			want: "arg1 \"arg 2\" {\n\tstr \"a \\\"b\\\"\"\n\tstrmap {\n\t\ta 1\n\t\tb 2\n\t}\n\taddr 10.0.0.1\n}\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Marshal(tt.input)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+
+	_, err := Marshal("plugin")
+	assert.Error(t, err)
+	_, err = Marshal(testStruct{Level: level(7)})
+	assert.Error(t, err)
+}
+
+func TestMarshal_roundTrip(t *testing.T) {
+	var ts testStruct
+	require.NoError(t, Parse(caddy.NewTestController("dns", `plugin arg1 "arg 2" {
+		str string
+		intnum -1
+		int8num 8
+		int16num 16
+		int32num 32
+		int64num 64
+		uintnum 1
+		uint8num 8
+		uint64num 18446744073709551615
+		uintptrnum 4096
+		duration 1m30s
+		real32 1.5
+		real64 0.25
+		boolean true
+		strslice a b c
+		intslice 1 2 3
+		strrows a b
+		strrows c
+		ip 10.0.0.1
+		strmap {
+			key "some value"
+		}
+		intmap {
+			one 1
+		}
+		ipnet 10.0.0.0/8
+		ipnetptr 2001:db8::/32
+		ipnets 10.0.0.0/8 192.168.0.0/16
+		prefix 172.16.0.0/12
+		prefixes 10.0.0.0/8 2001:db8::/32
+		url tls://1.1.1.1:853
+		time 2026-10-16T08:30:00Z
+		date 2026-10-16 08:30
+		size 10MiB
+		addr 10.0.0.1
+		addrptr 2001:db8::1
+		level debug
+		intptr 0
+		boolptr false
+	}`), &ts))
+	assert.Equal(t, time.Date(2026, 10, 16, 8, 30, 0, 0, time.UTC), ts.Date)
+
+	text, err := Marshal(&ts)
+	require.NoError(t, err)
+	var got testStruct
+	require.NoError(t, Parse(caddy.NewTestController("dns", "plugin "+text), &got))
+	assert.Equal(t, ts, got)
+}
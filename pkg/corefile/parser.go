@@ -1,6 +1,8 @@
 package corefile
 
 import (
+	"errors"
+	"fmt"
 	"reflect"
 	"strings"
 
@@ -12,6 +14,9 @@ const (
 	cfTag               = "cf"
 	defaultTag          = "default"
 	checkTag            = "check"
+	layoutTag           = "layout"
+	checkMsgTag         = "checkmsg"
+	deprecatedTag       = "deprecated"
 )
 
 // Initializer is implemented by a structure when custom structure initialization is required.
@@ -19,15 +24,47 @@ type Initializer interface {
 	Init() error
 }
 
+// DefaultProvider is implemented by a structure when the default values of its fields are computed, e.g. from the
+// number of CPUs. DefaultFor is given the cf name of the property and returns its default value in the format of
+// the configuration, or false to apply the default tag.
+type DefaultProvider interface {
+	DefaultFor(field string) (string, bool)
+}
+
 type parser struct {
 	lexer     *caddy.Controller
 	log       logger
 	validator validator
+	// locations of the properties by their paths, e.g. wife.details.age
+	locations map[string]location
+	// errs are the validation errors of the blocks, collected to be reported at once
+	errs []error
+}
+
+// location is the position of a property in the Corefile.
+type location struct {
+	file string
+	line int
+}
+
+// propertyErr reports the error of the property at its location as "file:line: property 'path': message".
+func (l location) propertyErr(path string, err error) error {
+	return fmt.Errorf("%s:%d: %w", l.file, l.line, &fieldError{path: path, err: err})
+}
+
+// joinPath appends the property name to the path of the enclosing block.
+func joinPath(path, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
 }
 
 // Parse parses the input provided by caddy and fills the configuration into provided pointer to a custom structure.
 func Parse(c *caddy.Controller, v any) error {
-	p := parser{lexer: c, log: c, validator: validator{log: c, checkers: defaultChecks}}
+	log := controllerLogger{Controller: c}
+	p := parser{lexer: c, log: log, validator: validator{log: log, checkers: defaultChecks},
+		locations: map[string]location{}}
 	return p.parse(v)
 }
 
@@ -41,48 +78,131 @@ func (p *parser) parse(s any) error {
 
 	pluginName := p.lexer.Val()
 	structVal := reflect.ValueOf(s).Elem()
+	p.locations[""] = p.location()
 
-	if err := p.parsePluginHeader(structVal, pluginName); err != nil {
+	pluginArgs, err := p.parsePluginHeader(structVal, pluginName)
+	if err != nil {
 		return err
 	}
 
 	if err := p.applyDefaults(structVal); err != nil {
 		return err
 	}
+	if err := p.parseArguments(structVal, pluginArgs); err != nil {
+		return err
+	}
 
 	if p.lexer.Next() {
 		if p.lexer.Val() != "{" {
 			return p.log.Err("'{' expected")
 		}
-		return p.parseStructure(structVal, pluginName)
+		if err := p.parseStructure(structVal, ""); err != nil {
+			p.errs = append(p.errs, err)
+		}
+		return errors.Join(p.errs...)
 	}
 
-	return p.applyDefaults(structVal)
+	if err := p.applyConditionalDefaults(structVal, ""); err != nil {
+		return err
+	}
+	if err := p.validator.validateArguments(structVal); err != nil {
+		return p.locate(err)
+	}
+	return nil
 }
 
-func (p *parser) parsePluginHeader(structVal reflect.Value, pluginName string) error {
+// parsePluginHeader stores the plugin arguments into the Arguments field, unless the structure binds them to its
+// fields by the arg tags and has no such field.
+func (p *parser) parsePluginHeader(structVal reflect.Value, pluginName string) ([]string, error) {
 	pluginArgs := p.lexer.RemainingArgs()
-	if len(pluginArgs) > 0 {
-		if err := assignToField(structVal, pluginArgsFieldName, pluginArgs); err != nil {
-			return p.log.Errf("cannot store plugin '%s' arguments into field '%s': %v", pluginName, pluginArgsFieldName, err)
+	if len(pluginArgs) == 0 {
+		return nil, nil
+	}
+	fields, _ := argumentFields(structVal.Type())
+	if len(fields) > 0 && !structVal.FieldByName(pluginArgsFieldName).IsValid() {
+		return pluginArgs, nil
+	}
+	if err := assignToField(structVal, pluginArgsFieldName, pluginArgs); err != nil {
+		return nil, p.log.Errf("cannot store plugin '%s' arguments into field '%s': %v", pluginName, pluginArgsFieldName, err)
+	}
+	return pluginArgs, nil
+}
+
+// location returns the location of the current token.
+func (p *parser) location() location {
+	return location{file: p.lexer.File(), line: p.lexer.Line()}
+}
+
+// locate adds the location of the property to the validation error, the location of the enclosing block is used for
+// a property not present in the configuration. Every error of the joined errors is located on its own.
+func (p *parser) locate(err error) error {
+	if joined, ok := err.(interface{ Unwrap() []error }); ok {
+		var errs []error
+		for _, err := range joined.Unwrap() {
+			errs = append(errs, p.locate(err))
+		}
+		return errors.Join(errs...)
+	}
+	var fe *fieldError
+	if !errors.As(err, &fe) {
+		return err
+	}
+	for path := fe.path; ; path = path[:max(strings.LastIndex(path, "."), 0)] {
+		if loc, ok := p.locations[path]; ok {
+			return fmt.Errorf("%s:%d: %w", loc.file, loc.line, err)
+		}
+		if path == "" {
+			return err
 		}
 	}
-	return nil
 }
 
-func (p *parser) parseStructure(structVal reflect.Value, structName string) error {
+// parseStructure parses the block into the structure, the path is the path of the block, empty for the plugin block.
+func (p *parser) parseStructure(structVal reflect.Value, path string) error {
 	for p.lexer.Next() {
 		if p.lexer.Val() == "}" {
-			return p.validator.validateStructure(structVal)
+			if err := p.applyConditionalDefaults(structVal, path); err != nil {
+				return err
+			}
+			// the parsing continues to report the validation errors of all the blocks at once
+			if err := p.validator.validateStructure(structVal, path); err != nil {
+				p.errs = append(p.errs, p.locate(err))
+			}
+			return nil
 		}
 
 		property := p.lexer.Val()
+		loc := p.location()
+		propPath := joinPath(path, property)
+		_, repeated := p.locations[propPath]
+		p.locations[propPath] = loc
+		p.warnDeprecated(structVal.Type(), property, propPath, loc)
 		propValues := p.lexer.RemainingArgs()
 
+		fieldType, ok := findStructFieldByTag(structVal.Type(), property)
+		if ok && fieldType.Type.Kind() == reflect.Interface {
+			if err := p.parseImplementation(structVal.FieldByIndex(fieldType.Index), propValues, propPath, loc); err != nil {
+				return err
+			}
+			continue
+		}
+
 		if len(propValues) == 0 {
 			field := findFieldByTag(structVal, property)
 			if !field.IsValid() {
-				return p.log.Errf("property '%s' in structure '%s' not found", property, structName)
+				return loc.propertyErr(propPath, errors.New("not found"))
+			}
+			if isFlag(field.Type()) {
+				// a bool without value is a flag turned on by its presence
+				if err := assignFromString(field, "true"); err != nil {
+					return loc.propertyErr(propPath, fmt.Errorf("assigning value failed: %w", err))
+				}
+				continue
+			}
+			if isScalarStruct(field.Type()) || isPointerToPrimitive(field.Type()) {
+				// a network, URL, time or pointer to a primitive without value keeps its default value like the other
+				// scalars
+				continue
 			}
 
 			if field.Type().Kind() == reflect.Pointer {
@@ -99,21 +219,52 @@ func (p *parser) parseStructure(structVal reflect.Value, structName string) erro
 				if !p.lexer.Next() || p.lexer.Val() != "{" {
 					return p.log.Errf("structure opening character '{' expected, got '%s'", p.lexer.Val())
 				}
-				if err := p.parseStructure(field, property); err != nil {
+				if err := p.parseStructure(field, propPath); err != nil {
+					return err
+				}
+			}
+			if isSliceOfStructs(field.Type()) {
+				if !p.lexer.Next() || p.lexer.Val() != "{" {
+					return p.log.Errf("structure opening character '{' expected, got '%s'", p.lexer.Val())
+				}
+				if err := p.parseSliceElement(field, propPath, loc); err != nil {
+					return err
+				}
+			}
+			if field.Type().Kind() == reflect.Map {
+				if !p.lexer.Next() || p.lexer.Val() != "{" {
+					return p.log.Errf("map opening character '{' expected, got '%s'", p.lexer.Val())
+				}
+				if err := p.parseMap(field, propPath); err != nil {
 					return err
 				}
 			}
 			// or it is a field without value that keeps its default value that has been set by applying defaults
 			// or zero value if a default value had not been present
 		} else {
-			field := findFieldByTag(structVal, property)
-			if !field.IsValid() {
-				return p.log.Err("field not found: " + property)
+			fieldType, ok := findStructFieldByTag(structVal.Type(), property)
+			if !ok {
+				return loc.propertyErr(propPath, errors.New("not found"))
 			}
 
-			value := strings.Join(propValues, ",")
-			if err := assignFromString(field, value); err != nil {
-				return p.log.Errf("assigning property value failed: %v", err)
+			for i := range propValues {
+				propValues[i] = expandEnv(propValues[i])
+			}
+			field := structVal.FieldByIndex(fieldType.Index)
+			target := field
+			// the repeated property appends its values, the first occurrence replaces the default ones
+			appends := repeated && isValueList(field.Type())
+			if appends {
+				target = reflect.New(field.Type()).Elem()
+			}
+			if err := assignProperty(target, fieldType, propValues); err != nil {
+				if isSecret(fieldType) {
+					err = redact(err, propValues)
+				}
+				return loc.propertyErr(propPath, fmt.Errorf("assigning value failed: %w", err))
+			}
+			if appends {
+				field.Set(reflect.AppendSlice(field, target))
 			}
 		}
 	}
@@ -121,19 +272,99 @@ func (p *parser) parseStructure(structVal reflect.Value, structName string) erro
 	return p.log.Err("'}' expected")
 }
 
+// warnDeprecated logs a warning if the property is marked by the deprecated tag, the property is parsed anyway.
+func (p *parser) warnDeprecated(structType reflect.Type, property, path string, loc location) {
+	fieldType, ok := findStructFieldByTag(structType, property)
+	if !ok {
+		return
+	}
+	msg, ok := fieldType.Tag.Lookup(deprecatedTag)
+	if !ok {
+		return
+	}
+	if msg != "" {
+		msg = ": " + msg
+	}
+	p.log.Warningf("%s:%d: property '%s' is deprecated%s", loc.file, loc.line, path, msg)
+}
+
+// parseSliceElement parses the block into a new element appended to the slice of structures or pointers to them,
+// so every occurrence of the block adds an element with its own defaults and validations. The path of the element is
+// indexed, e.g. view[1].
+func (p *parser) parseSliceElement(sliceVal reflect.Value, path string, loc location) error {
+	path = fmt.Sprintf("%s[%d]", path, sliceVal.Len())
+	p.locations[path] = loc
+	elemType := sliceVal.Type().Elem()
+	elemPtr := reflect.New(elemType)
+	elem := elemPtr.Elem()
+	if elemType.Kind() == reflect.Pointer {
+		elem.Set(reflect.New(elemType.Elem()))
+		elem = elem.Elem()
+	}
+	if err := p.applyDefaults(elem); err != nil {
+		return err
+	}
+	if err := p.parseStructure(elem, path); err != nil {
+		return err
+	}
+	sliceVal.Set(reflect.Append(sliceVal, elemPtr.Elem()))
+	return nil
+}
+
+// parseMap fills the map by the block of `key value` lines, every key may be present once.
+func (p *parser) parseMap(mapVal reflect.Value, path string) error {
+	if mapVal.IsNil() {
+		mapVal.Set(reflect.MakeMap(mapVal.Type()))
+	}
+	for p.lexer.Next() {
+		key := p.lexer.Val()
+		if key == "}" {
+			return nil
+		}
+		loc := p.location()
+		values := p.lexer.RemainingArgs()
+		if len(values) != 1 {
+			return loc.propertyErr(joinPath(path, key), errors.New("single value expected"))
+		}
+		if err := assignMapEntry(mapVal, key, expandEnv(values[0])); err != nil {
+			return loc.propertyErr(joinPath(path, key), fmt.Errorf("assigning value failed: %w", err))
+		}
+	}
+	return p.log.Err("'}' expected")
+}
+
+// assignProperty assigns the values of the property given in the configuration to the field, every value of a slice
+// field is its element. The values of a time field are joined by spaces and parsed by the layout of its tag.
+func assignProperty(field reflect.Value, fieldType reflect.StructField, values []string) error {
+	if field.Type() == timeType {
+		return assignTime(field, strings.Join(values, " "), fieldType.Tag.Get(layoutTag))
+	}
+	return assignValues(field, values)
+}
+
+// assignDefault assigns the default value to the field, the elements of a slice field are separated by commas.
+func assignDefault(field reflect.Value, fieldType reflect.StructField, value string) error {
+	if field.Type() == timeType {
+		return assignTime(field, value, fieldType.Tag.Get(layoutTag))
+	}
+	return assignFromString(field, value)
+}
+
 func (p *parser) applyDefaults(structVal reflect.Value) error {
-	structType := structVal.Type()
-	for i := 0; i < structVal.NumField(); i++ {
-		fieldType := structType.Field(i)
-		field := structVal.Field(i)
-		if field.Kind() == reflect.Struct {
+	for _, fieldType := range structFields(structVal.Type()) {
+		field := structVal.FieldByIndex(fieldType.Index)
+		if field.Kind() == reflect.Struct && !isScalarStruct(field.Type()) {
 			if err := p.applyDefaults(field); err != nil {
 				return err
 			}
 		} else {
-			if defaultValue, ok := fieldType.Tag.Lookup(defaultTag); ok {
-				if err := assignFromString(field, defaultValue); err != nil {
-					return p.log.Errf("apply defaults to property: %v", err)
+			if defaultValue, ok := defaultFor(structVal, fieldType); ok {
+				if err := assignDefault(field, fieldType, defaultValue); err != nil {
+					// the default may come from the environment, so the secret is redacted
+					if isSecret(fieldType) {
+						err = redact(err, []string{defaultValue})
+					}
+					return p.log.Errf("apply defaults to property '%s': %v", propertyName(fieldType), err)
 				}
 			}
 		}
@@ -141,6 +372,26 @@ func (p *parser) applyDefaults(structVal reflect.Value) error {
 	return p.executeCustomInit(structVal)
 }
 
+// defaultFor returns the default value of the field of the structure, the DefaultProvider of the structure is consulted
+// before the default tag.
+func defaultFor(structVal reflect.Value, field reflect.StructField) (string, bool) {
+	ptr := reflect.New(structVal.Type())
+	if structVal.CanAddr() {
+		ptr = structVal.Addr()
+	} else {
+		ptr.Elem().Set(structVal)
+	}
+	if !ptr.CanInterface() {
+		return lookupDefault(field)
+	}
+	if provider, ok := ptr.Interface().(DefaultProvider); ok {
+		if value, ok := provider.DefaultFor(propertyName(field)); ok {
+			return value, true
+		}
+	}
+	return lookupDefault(field)
+}
+
 func (p *parser) executeCustomInit(structVal reflect.Value) error {
 	if itf, ok := structVal.Addr().Interface().(Initializer); ok && itf != nil {
 		if err := itf.Init(); err != nil {
@@ -2,33 +2,60 @@ package corefile
 
 import (
 	"net"
+	"net/netip"
+	"net/url"
 	"testing"
 	"time"
 
 	"github.com/coredns/caddy"
 	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 //nolint:unused
 type testStruct struct {
-	Arguments []string
-	Str       string        `cf:"str" check:"oneOF(string|initialized)"`
-	IntNum    int           `cf:"intnum"`
-	Int8Num   int8          `cf:"int8num"`
-	Int16Num  int16         `cf:"int16num" default:"99" check:"nonempty,LTE(99)"`
-	Int32Num  int32         `cf:"int32num"`
-	Int64Num  int64         `cf:"int64num"`
-	Duration  time.Duration `cf:"duration"`
-	Real32    float32       `cf:"real32"`
-	Real64    float64       `cf:"real64"`
-	Boolean   bool          `cf:"boolean"`
-	StrSlice  []string      `cf:"strslice"`
-	IntSlice  []int         `cf:"intslice"`
-	IP        net.IP        `cf:"ip"`
+	Arguments  []string
+	Str        string            `cf:"str" check:"oneOF(string|initialized)"`
+	IntNum     int               `cf:"intnum"`
+	Int8Num    int8              `cf:"int8num"`
+	Int16Num   int16             `cf:"int16num" default:"99" check:"nonempty,LTE(99)"`
+	Int32Num   int32             `cf:"int32num"`
+	Int64Num   int64             `cf:"int64num"`
+	UintNum    uint              `cf:"uintnum"`
+	Uint8Num   uint8             `cf:"uint8num" check:"lte(250)"`
+	Uint64Num  uint64            `cf:"uint64num"`
+	UintptrNum uintptr           `cf:"uintptrnum"`
+	Duration   time.Duration     `cf:"duration"`
+	Real32     float32           `cf:"real32"`
+	Real64     float64           `cf:"real64"`
+	Boolean    bool              `cf:"boolean"`
+	StrSlice   []string          `cf:"strslice"`
+	IntSlice   []int             `cf:"intslice"`
+	StrRows    [][]string        `cf:"strrows"`
+	IP         net.IP            `cf:"ip"`
+	StrMap     map[string]string `cf:"strmap"`
+	IntMap     map[string]int    `cf:"intmap"`
+	IPNet      net.IPNet         `cf:"ipnet"`
+	IPNetPtr   *net.IPNet        `cf:"ipnetptr"`
+	IPNets     []*net.IPNet      `cf:"ipnets"`
+	Prefix     netip.Prefix      `cf:"prefix"`
+	Prefixes   []netip.Prefix    `cf:"prefixes"`
+	URL        *url.URL          `cf:"url" check:"url(https|tls)"`
+	Time       time.Time         `cf:"time"`
+	Date       time.Time         `cf:"date" layout:"2006-01-02 15:04"`
+	Size       ByteSize          `cf:"size" check:"lte(1GiB)"`
+	Addr       netip.Addr        `cf:"addr"`
+	AddrPtr    *netip.Addr       `cf:"addrptr"`
+	Level      level             `cf:"level"`
+	StrPtr     *string           `cf:"strptr"`
+	IntPtr     *int              `cf:"intptr" check:"lte(10)"`
+	BoolPtr    *bool             `cf:"boolptr"`
+	TimeoutPtr *time.Duration    `cf:"timeoutptr"`
 
 	Unsupported      struct{}
 	UnsupportedSlice []struct{}
+	UnsupportedRows  [][]int
 	unexported       int `cf:"unexported"`
 	notTagged        int
 }
@@ -45,6 +72,40 @@ func (t *testStruct) Init() error {
 	return nil
 }
 
+func ptr[T any](v T) *T {
+	return &v
+}
+
+// level is an enum parsed and marshaled by its encoding.TextUnmarshaler and encoding.TextMarshaler implementations.
+type level int
+
+const (
+	levelInfo level = iota + 1
+	levelDebug
+)
+
+func (l *level) UnmarshalText(text []byte) error {
+	switch string(text) {
+	case "info":
+		*l = levelInfo
+	case "debug":
+		*l = levelDebug
+	default:
+		return errors.Errorf("unknown level: %s", text)
+	}
+	return nil
+}
+
+func (l level) MarshalText() ([]byte, error) {
+	switch l {
+	case levelInfo:
+		return []byte("info"), nil
+	case levelDebug:
+		return []byte("debug"), nil
+	}
+	return nil, errors.Errorf("unknown level: %d", l)
+}
+
 func Test_ParseWithCaddy(t *testing.T) {
 	tests := []struct {
 		name    string
@@ -91,6 +152,224 @@ func Test_ParseWithCaddy(t *testing.T) {
 					}`,
 			want: testStruct{Str: "initialized", Int16Num: 99},
 		},
+		{
+			name: "repeated rows property",
+			cfg: `plugin {
+						strrows a b
+						strrows c
+					}`,
+			want: testStruct{Str: "initialized", Int16Num: 99, StrRows: [][]string{{"a", "b"}, {"c"}}},
+		},
+		{
+			name: "environment variables are expanded",
+			cfg: `plugin {
+						str {$COREFILE_TEST_STR}
+						intnum {%COREFILE_TEST_NUM%}
+						strslice a-{$COREFILE_TEST_NUM} b
+						strmap {
+							key {$COREFILE_TEST_STR}
+						}
+					}`,
+			want: testStruct{Str: "string", IntNum: 7, Int16Num: 99, StrSlice: []string{"a-7", "b"},
+				StrMap: map[string]string{"key": "string"}},
+		},
+		{
+			name: "network properties",
+			cfg: `plugin {
+						prefix 10.0.0.0/8
+						prefixes 10.0.0.0/8 2001:db8::/32
+						ipnetptr 192.168.0.0/16
+						ipnet
+					}`,
+			want: testStruct{Str: "initialized", Int16Num: 99, Prefix: netip.MustParsePrefix("10.0.0.0/8"),
+				Prefixes: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8"), netip.MustParsePrefix("2001:db8::/32")},
+				IPNetPtr: &net.IPNet{IP: net.IPv4(192, 168, 0, 0).To4(), Mask: net.CIDRMask(16, 32)}},
+		},
+		{
+			name: "byte size property",
+			cfg: `plugin {
+						size 10MiB
+					}`,
+			want: testStruct{Str: "initialized", Int16Num: 99, Size: 10 << 20},
+		},
+		{
+			name: "byte size property out of range",
+			cfg: `plugin {
+						size 2GiB
+					}`,
+			wantErr: true,
+		},
+		{
+			name: "text unmarshaler properties",
+			cfg: `plugin {
+						addr 10.0.0.1
+						addrptr 2001:db8::1
+						level debug
+					}`,
+			want: testStruct{Str: "initialized", Int16Num: 99, Addr: netip.MustParseAddr("10.0.0.1"),
+				AddrPtr: func() *netip.Addr { a := netip.MustParseAddr("2001:db8::1"); return &a }(), Level: levelDebug},
+		},
+		{
+			name: "text unmarshaler property invalid",
+			cfg: `plugin {
+						level trace
+					}`,
+			wantErr: true,
+		},
+		{
+			name: "unsigned numbers",
+			cfg: `plugin {
+						uintnum 1
+						uint8num 250
+						uint64num 18446744073709551615
+						uintptrnum 4096
+					}`,
+			want: testStruct{Str: "initialized", Int16Num: 99, UintNum: 1, Uint8Num: 250, Uint64Num: 1<<64 - 1,
+				UintptrNum: 4096},
+		},
+		{
+			name: "unsigned number overflow",
+			cfg: `plugin {
+						uint8num 256
+					}`,
+			wantErr: true,
+		},
+		{
+			name: "unsigned number out of range",
+			cfg: `plugin {
+						uint8num 251
+					}`,
+			wantErr: true,
+		},
+		{
+			name: "pointers to primitives",
+			cfg: `plugin {
+						strptr ""
+						intptr 0
+						boolptr false
+						timeoutptr 5s
+					}`,
+			want: testStruct{Str: "initialized", Int16Num: 99, StrPtr: ptr(""), IntPtr: ptr(0), BoolPtr: ptr(false),
+				TimeoutPtr: ptr(5 * time.Second)},
+		},
+		{
+			name: "bool without value is turned on",
+			cfg: `plugin {
+						boolean
+						boolptr
+					}`,
+			want: testStruct{Str: "initialized", Int16Num: 99, Boolean: true, BoolPtr: ptr(true)},
+		},
+		{
+			name: "pointer to primitive without value stays unset",
+			cfg: `plugin {
+						intptr
+					}`,
+			want: testStruct{Str: "initialized", Int16Num: 99},
+		},
+		{
+			name: "pointer to primitive out of range",
+			cfg: `plugin {
+						intptr 11
+					}`,
+			wantErr: true,
+		},
+		{
+			name: "time properties",
+			cfg: `plugin {
+						time 2026-10-16T08:30:00+02:00
+						date 2026-10-16 08:30
+					}`,
+			want: testStruct{Str: "initialized", Int16Num: 99,
+				Time: time.Date(2026, 10, 16, 8, 30, 0, 0, time.FixedZone("", 2*60*60)),
+				Date: time.Date(2026, 10, 16, 8, 30, 0, 0, time.UTC)},
+		},
+		{
+			name: "time not matching the layout",
+			cfg: `plugin {
+						date 2026-10-16T08:30
+					}`,
+			wantErr: true,
+		},
+		{
+			name: "url property",
+			cfg: `plugin {
+						url https://dns.example/dns-query
+					}`,
+			want: testStruct{Str: "initialized", Int16Num: 99, URL: &url.URL{Scheme: "https", Host: "dns.example",
+				Path: "/dns-query"}},
+		},
+		{
+			name: "url property with scheme not allowed",
+			cfg: `plugin {
+						url http://dns.example
+					}`,
+			wantErr: true,
+		},
+		{
+			name: "invalid network property",
+			cfg: `plugin {
+						prefix 10.0.0.0/33
+					}`,
+			wantErr: true,
+		},
+		{
+			name: "map properties",
+			cfg: `plugin {
+						strmap {
+							key value
+							other "spaced value"
+						}
+						intmap {
+							one 1
+						}
+					}`,
+			want: testStruct{Str: "initialized", Int16Num: 99, StrMap: map[string]string{"key": "value",
+				"other": "spaced value"}, IntMap: map[string]int{"one": 1}},
+		},
+		{
+			name: "empty map",
+			cfg: `plugin {
+						strmap {
+						}
+					}`,
+			want: testStruct{Str: "initialized", Int16Num: 99, StrMap: map[string]string{}},
+		},
+		{
+			name: "map needs body",
+			cfg: `plugin {
+						strmap
+					}`,
+			wantErr: true,
+		},
+		{
+			name: "duplicate map key",
+			cfg: `plugin {
+						strmap {
+							key a
+							key b
+						}
+					}`,
+			wantErr: true,
+		},
+		{
+			name: "map key without value",
+			cfg: `plugin {
+						strmap {
+							key
+						}
+					}`,
+			wantErr: true,
+		},
+		{
+			name: "wrong map value type",
+			cfg: `plugin {
+						intmap {
+							one string
+						}
+					}`,
+			wantErr: true,
+		},
 		{
 			name:    "missing plugin name",
 			cfg:     "",
@@ -145,6 +424,8 @@ func Test_ParseWithCaddy(t *testing.T) {
 			wantErr: true,
 		},
 	}
+	t.Setenv("COREFILE_TEST_STR", "string")
+	t.Setenv("COREFILE_TEST_NUM", "7")
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			c := caddy.NewTestController("dns", tt.cfg)
@@ -159,15 +440,22 @@ func Test_ParseWithCaddy(t *testing.T) {
 }
 
 type person struct {
-	Name    string        `cf:"name" default:"not-known"`
-	Wife    *person       `cf:"wife"`
-	Details personDetails `cf:"details"`
+	Name     string        `cf:"name" default:"not-known"`
+	Wife     *person       `cf:"wife"`
+	Details  personDetails `cf:"details"`
+	Children []*person     `cf:"child"`
+	Pets     []pet         `cf:"pet"`
 }
 
 type personDetails struct {
 	Age int `cf:"age" default:"17"`
 }
 
+type pet struct {
+	Kind string `cf:"kind" check:"nonempty"`
+	Age  int    `cf:"age" default:"1"`
+}
+
 func Test_ParseWithCaddy_NestedStructures(t *testing.T) {
 	tests := []struct {
 		name    string
@@ -230,6 +518,49 @@ func Test_ParseWithCaddy_NestedStructures(t *testing.T) {
 					}`,
 			wantErr: true,
 		},
+		{
+			name: "repeated blocks append elements",
+			cfg: `plugin {
+						child {
+							name Hans
+						}
+						child {
+						}
+						pet {
+							kind cat
+						}
+						pet {
+							kind dog
+							age 3
+						}
+					}`,
+			want: person{Name: "not-known", Details: personDetails{Age: 17},
+				Children: []*person{
+					{Name: "Hans", Details: personDetails{Age: 17}},
+					{Name: "not-known", Details: personDetails{Age: 17}},
+				},
+				Pets: []pet{{Kind: "cat", Age: 1}, {Kind: "dog", Age: 3}},
+			},
+		},
+		{
+			name: "repeated block element is validated",
+			cfg: `plugin {
+						pet {
+							kind cat
+						}
+						pet {
+							age 3
+						}
+					}`,
+			wantErr: true,
+		},
+		{
+			name: "repeated block needs body",
+			cfg: `plugin {
+						pet
+					}`,
+			wantErr: true,
+		},
 		{
 			name: "initialization of a nested structure needs body",
 			cfg: `plugin {
@@ -250,3 +581,322 @@ func Test_ParseWithCaddy_NestedStructures(t *testing.T) {
 		})
 	}
 }
+
+func Test_ParseWithCaddy_errorLocation(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     string
+		target  any
+		wantErr string
+	}{
+		{
+			name:    "unknown nested property",
+			cfg:     "plugin {\n\twife {\n\t\tfoo 1\n\t}\n}",
+			target:  &person{},
+			wantErr: "Testfile:3: property 'wife.foo': not found",
+		},
+		{
+			name:    "invalid value",
+			cfg:     "plugin {\n\tint16num x\n}",
+			target:  &testStruct{},
+			wantErr: "Testfile:2: property 'int16num': assigning value failed: strconv.ParseInt: parsing \"x\": invalid syntax",
+		},
+		{
+			name:    "value out of range of the field",
+			cfg:     "plugin {\n\tint8num 300\n}",
+			target:  &testStruct{},
+			wantErr: "Testfile:2: property 'int8num': assigning value failed: 300 out of range of int8 [-128, 127]",
+		},
+		{
+			name:    "unsigned value out of range of the field",
+			cfg:     "plugin {\n\tuint8num 256\n}",
+			target:  &testStruct{},
+			wantErr: "Testfile:2: property 'uint8num': assigning value failed: 256 out of range of uint8 [0, 255]",
+		},
+		{
+			name:    "check of the given property",
+			cfg:     "plugin {\n\tstr string\n\tint16num 100\n}",
+			target:  &testStruct{},
+			wantErr: "Testfile:3: property 'int16num': LTE: should be <= 99",
+		},
+		{
+			name:    "check of the missing property in a repeated block",
+			cfg:     "plugin {\n\tpet {\n\t\tkind cat\n\t}\n\tpet {\n\t\tage 2\n\t}\n}",
+			target:  &person{},
+			wantErr: "Testfile:5: property 'pet[1].kind': nonempty: cannot be empty",
+		},
+		{
+			name:   "all the invalid blocks",
+			cfg:    "plugin {\n\tpet {\n\t}\n\tpet {\n\t\tkind dog\n\t}\n\tpet {\n\t}\n}",
+			target: &person{},
+			wantErr: "Testfile:2: property 'pet[0].kind': nonempty: cannot be empty\n" +
+				"Testfile:7: property 'pet[2].kind': nonempty: cannot be empty",
+		},
+		{
+			name:    "map entry",
+			cfg:     "plugin {\n\tstrmap {\n\t\ta 1 2\n\t}\n}",
+			target:  &testStruct{},
+			wantErr: "Testfile:3: property 'strmap.a': single value expected",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := Parse(caddy.NewTestController("dns", tt.cfg), tt.target)
+			assert.EqualError(t, err, tt.wantErr)
+		})
+	}
+}
+
+func Test_ParseWithCaddy_deprecated(t *testing.T) {
+	type upstream struct {
+		Addr string `cf:"addr" deprecated:""`
+	}
+	type config struct {
+		Host     string    `cf:"host" deprecated:"use 'upstream' instead"`
+		Upstream *upstream `cf:"upstream"`
+		Timeout  int       `cf:"timeout" deprecated:"not used anymore"`
+	}
+	log := &mockLogger{}
+	p := parser{
+		lexer:     caddy.NewTestController("dns", "plugin {\n\thost 10.0.0.1\n\tupstream {\n\t\taddr 10.0.0.2\n\t}\n}"),
+		log:       log,
+		validator: validator{log: log, checkers: defaultChecks},
+		locations: map[string]location{},
+	}
+	var cfg config
+	require.NoError(t, p.parse(&cfg))
+	assert.Equal(t, config{Host: "10.0.0.1", Upstream: &upstream{Addr: "10.0.0.2"}}, cfg)
+	assert.Equal(t, []string{
+		"Testfile:2: property 'host' is deprecated: use 'upstream' instead",
+		"Testfile:4: property 'upstream.addr' is deprecated",
+	}, log.warnings)
+}
+
+type workerConfig struct {
+	Workers  int    `cf:"workers" default:"1" check:"gt(0)"`
+	Hostname string `cf:"hostname" default:"localhost"`
+	invalid  bool
+}
+
+func (c *workerConfig) DefaultFor(field string) (string, bool) {
+	switch {
+	case field == "workers" && c.invalid:
+		return "many", true
+	case field == "workers":
+		return "4", true
+	}
+	return "", false
+}
+
+func Test_ParseWithCaddy_defaultProvider(t *testing.T) {
+	var cfg workerConfig
+	require.NoError(t, Parse(caddy.NewTestController("dns", "plugin"), &cfg))
+	assert.Equal(t, workerConfig{Workers: 4, Hostname: "localhost"}, cfg)
+
+	cfg = workerConfig{}
+	require.NoError(t, Parse(caddy.NewTestController("dns", "plugin {\n\tworkers 2\n}"), &cfg))
+	assert.Equal(t, workerConfig{Workers: 2, Hostname: "localhost"}, cfg)
+
+	text, err := Marshal(workerConfig{Workers: 4, Hostname: "localhost"})
+	require.NoError(t, err)
+	assert.Equal(t, "{\n}\n", text)
+	text, err = Marshal(&workerConfig{Workers: 1, Hostname: "localhost"})
+	require.NoError(t, err)
+	assert.Equal(t, "{\n\tworkers 1\n}\n", text)
+
+	cfg = workerConfig{invalid: true}
+	assert.EqualError(t, Parse(caddy.NewTestController("dns", "plugin"), &cfg),
+		"Testfile:1 - Error during parsing: apply defaults to property 'workers': "+
+			"strconv.ParseInt: parsing \"many\": invalid syntax")
+}
+
+func Test_ParseWithCaddy_quotedValues(t *testing.T) {
+	type config struct {
+		Message string     `cf:"message"`
+		Hosts   []string   `cf:"hosts" default:"a,b"`
+		Ports   []int      `cf:"ports"`
+		Rows    [][]string `cf:"row"`
+	}
+	tests := []struct {
+		name    string
+		cfg     string
+		want    config
+		wantErr string
+	}{
+		{
+			name: "defaults separated by commas",
+			cfg:  "plugin {\n}",
+			want: config{Hosts: []string{"a", "b"}},
+		},
+		{
+			name: "spaces, commas and braces",
+			cfg:  "plugin {\n\tmessage \"hello, {world}\"\n}",
+			want: config{Message: "hello, {world}", Hosts: []string{"a", "b"}},
+		},
+		{
+			name: "escaped quotes",
+			cfg:  "plugin {\n\tmessage \"say \\\"hi\\\"\"\n}",
+			want: config{Message: `say "hi"`, Hosts: []string{"a", "b"}},
+		},
+		{
+			name: "elements of the slice",
+			cfg:  "plugin {\n\thosts \"x y\" \"c,d\" e\n\tports 53 853\n}",
+			want: config{Hosts: []string{"x y", "c,d", "e"}, Ports: []int{53, 853}},
+		},
+		{
+			name: "rows",
+			cfg:  "plugin {\n\trow \"x y\" z,w\n\trow }\n}",
+			want: config{Hosts: []string{"a", "b"}, Rows: [][]string{{"x y", "z,w"}, {"}"}}},
+		},
+		{
+			name:    "unquoted spaces",
+			cfg:     "plugin {\n\tmessage hello world\n}",
+			wantErr: "Testfile:2: property 'message': assigning value failed: single value expected, got 2, a value containing spaces has to be quoted",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var cfg config
+			err := Parse(caddy.NewTestController("dns", tt.cfg), &cfg)
+			if tt.wantErr != "" {
+				assert.EqualError(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, cfg)
+
+			text, err := Marshal(cfg)
+			require.NoError(t, err)
+			var parsed config
+			require.NoError(t, Parse(caddy.NewTestController("dns", "plugin "+text), &parsed))
+			assert.Equal(t, cfg, parsed)
+		})
+	}
+}
+
+func Test_ParseWithCaddy_repeatedValues(t *testing.T) {
+	type view struct {
+		Networks []netip.Prefix `cf:"networks"`
+	}
+	type config struct {
+		Except []string `cf:"except" default:"local."`
+		Ports  []int    `cf:"ports"`
+		Views  []view   `cf:"view"`
+		Name   string   `cf:"name"`
+	}
+	tests := []struct {
+		name string
+		cfg  string
+		want config
+	}{
+		{
+			name: "default",
+			cfg:  "plugin {\n}",
+			want: config{Except: []string{"local."}},
+		},
+		{
+			name: "first occurrence replaces the default",
+			cfg:  "plugin {\n\texcept a.example.\n}",
+			want: config{Except: []string{"a.example."}},
+		},
+		{
+			name: "occurrences append",
+			cfg:  "plugin {\n\texcept a.example.\n\tports 53\n\texcept b.example. c.example.\n\tports 853\n}",
+			want: config{Except: []string{"a.example.", "b.example.", "c.example."}, Ports: []int{53, 853}},
+		},
+		{
+			name: "repeated blocks",
+			cfg: "plugin {\n\tview {\n\t\tnetworks 10.0.0.0/8\n\t\tnetworks 192.168.0.0/16\n\t}\n" +
+				"\tview {\n\t\tnetworks 172.16.0.0/12\n\t}\n}",
+			want: config{Except: []string{"local."}, Views: []view{
+				{Networks: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8"), netip.MustParsePrefix("192.168.0.0/16")}},
+				{Networks: []netip.Prefix{netip.MustParsePrefix("172.16.0.0/12")}},
+			}},
+		},
+		{
+			name: "scalar is overwritten",
+			cfg:  "plugin {\n\tname first\n\tname second\n}",
+			want: config{Except: []string{"local."}, Name: "second"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var cfg config
+			require.NoError(t, Parse(caddy.NewTestController("dns", tt.cfg), &cfg))
+			assert.Equal(t, tt.want, cfg)
+		})
+	}
+}
+
+type tlsOptions struct {
+	CertFile   string `cf:"cert_file" check:"nonempty"`
+	ServerName string `cf:"server_name" default:"localhost"`
+	Insecure   bool   `cf:"insecure"`
+}
+
+type embeddingConfig struct {
+	tlsOptions
+	Upstream string `cf:"upstream" check:"mutuallyExclusive(insecure)"`
+}
+
+func Test_ParseWithCaddy_embedded(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     string
+		want    embeddingConfig
+		wantErr string
+	}{
+		{
+			name: "promoted properties",
+			cfg:  "plugin {\n\tcert_file /cert.pem\n\tupstream 10.0.0.1\n}",
+			want: embeddingConfig{tlsOptions: tlsOptions{CertFile: "/cert.pem", ServerName: "localhost"},
+				Upstream: "10.0.0.1"},
+		},
+		{
+			name:    "check of the promoted property",
+			cfg:     "plugin {\n\tupstream 10.0.0.1\n}",
+			wantErr: "Testfile:1: property 'cert_file': nonempty: cannot be empty",
+		},
+		{
+			name:    "relation to the promoted property",
+			cfg:     "plugin {\n\tcert_file /cert.pem\n\tinsecure\n\tupstream 10.0.0.1\n}",
+			wantErr: "Testfile:4: property 'upstream': mutuallyExclusive: mutually exclusive with 'insecure'",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var cfg embeddingConfig
+			err := Parse(caddy.NewTestController("dns", tt.cfg), &cfg)
+			if tt.wantErr != "" {
+				assert.EqualError(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, cfg)
+		})
+	}
+
+	text, err := Marshal(embeddingConfig{tlsOptions: tlsOptions{CertFile: "/cert.pem", ServerName: "localhost"}})
+	require.NoError(t, err)
+	assert.Equal(t, "{\n\tcert_file /cert.pem\n}\n", text)
+
+	schema, err := Describe(embeddingConfig{})
+	require.NoError(t, err)
+	var names []string
+	for _, property := range schema.Properties {
+		names = append(names, property.Name)
+	}
+	assert.Equal(t, []string{"cert_file", "server_name", "insecure", "upstream"}, names)
+
+	var shadowing struct {
+		tlsOptions
+		ServerName string `cf:"server_name" default:"outer"`
+	}
+	require.NoError(t, Parse(caddy.NewTestController("dns", "plugin {\n\tcert_file /cert.pem\n\tserver_name dns.example\n}"),
+		&shadowing))
+	assert.Equal(t, "dns.example", shadowing.ServerName)
+	assert.Empty(t, shadowing.tlsOptions.ServerName)
+	schema, err = Describe(shadowing)
+	require.NoError(t, err)
+	assert.Len(t, schema.Properties, 3)
+}
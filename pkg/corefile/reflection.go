@@ -1,10 +1,15 @@
 package corefile
 
 import (
+	"encoding"
 	"errors"
 	"fmt"
+	"math"
 	"net"
+	"net/netip"
+	"net/url"
 	"reflect"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
@@ -25,6 +30,18 @@ func isPointerToStruct(ps interface{}) bool {
 	return s != nil && s.Kind() == reflect.Struct
 }
 
+// isSliceOfStructs reports whether the type is a slice of structures or pointers to structures.
+func isSliceOfStructs(t reflect.Type) bool {
+	if t.Kind() != reflect.Slice {
+		return false
+	}
+	elem := t.Elem()
+	if elem.Kind() == reflect.Pointer {
+		elem = elem.Elem()
+	}
+	return elem.Kind() == reflect.Struct
+}
+
 func assignToField(structVal reflect.Value, fieldName string, data interface{}) error {
 	field := structVal.FieldByName(fieldName)
 	if !field.IsValid() {
@@ -57,19 +74,263 @@ func checkIfAssignable(target reflect.Value, data interface{}) error {
 }
 
 func findFieldByTag(structVal reflect.Value, name string) reflect.Value {
-	structType := structVal.Type()
+	if field, ok := findStructFieldByTag(structVal.Type(), name); ok {
+		return structVal.FieldByIndex(field.Index)
+	}
+	return reflect.Value{}
+}
+
+// findStructFieldByTag finds the field by its cf name, the fields of the embedded structures included.
+func findStructFieldByTag(structType reflect.Type, name string) (reflect.StructField, bool) {
+	for _, field := range structFields(structType) {
+		if tag, ok := field.Tag.Lookup(cfTag); ok && tag == name {
+			return field, true
+		}
+	}
+	return reflect.StructField{}, false
+}
+
+// structFields returns the fields of the structure in the order of declaration, the fields of the embedded structures
+// promoted in place of them as if they were declared by the structure. The Index of the promoted field is the index
+// sequence for FieldByIndex. A promoted field is shadowed by the field of the same cf name declared closer to
+// the structure.
+func structFields(structType reflect.Type) []reflect.StructField {
+	var fields []reflect.StructField
 	for i := 0; i < structType.NumField(); i++ {
 		field := structType.Field(i)
-		if tag, ok := field.Tag.Lookup(cfTag); ok {
-			if ok && tag == name {
-				return structVal.Field(i)
+		if !isEmbeddedStruct(field) {
+			fields = append(fields, field)
+			continue
+		}
+		for _, promoted := range structFields(field.Type) {
+			promoted.Index = append([]int{i}, promoted.Index...)
+			fields = append(fields, promoted)
+		}
+	}
+	declared := slices.Clone(fields)
+	return slices.DeleteFunc(fields, func(field reflect.StructField) bool {
+		name, ok := field.Tag.Lookup(cfTag)
+		return ok && slices.ContainsFunc(declared, func(other reflect.StructField) bool {
+			return len(other.Index) < len(field.Index) && other.Tag.Get(cfTag) == name
+		})
+	})
+}
+
+// isEmbeddedStruct reports whether the field is an embedded structure without the cf tag, whose fields are promoted
+// to the enclosing structure. An embedded structure with the cf tag is a nested block like a named field.
+func isEmbeddedStruct(field reflect.StructField) bool {
+	_, tagged := field.Tag.Lookup(cfTag)
+	return field.Anonymous && !tagged && field.Type.Kind() == reflect.Struct && !isScalarStruct(field.Type)
+}
+
+// assignMapEntry parses the value to the element type of the map and stores it under the key, the keys are strings.
+func assignMapEntry(target reflect.Value, key string, input string) error {
+	if target.Type().Key().Kind() != reflect.String {
+		return fmt.Errorf("unsupported map type: %v", target.Type())
+	}
+	keyVal := reflect.ValueOf(key).Convert(target.Type().Key())
+	if target.MapIndex(keyVal).IsValid() {
+		return errors.New("duplicate key")
+	}
+	elem := reflect.New(target.Type().Elem()).Elem()
+	if err := assignFromString(elem, input); err != nil {
+		return err
+	}
+	target.SetMapIndex(keyVal, elem)
+	return nil
+}
+
+var (
+	ipNetType     = reflect.TypeOf(net.IPNet{})
+	prefixType    = reflect.TypeOf(netip.Prefix{})
+	ipNetPtrType  = reflect.PointerTo(ipNetType)
+	networkTypes  = []reflect.Type{ipNetType, ipNetPtrType, prefixType}
+	networkSlices = []reflect.Type{reflect.SliceOf(ipNetType), reflect.SliceOf(ipNetPtrType), reflect.SliceOf(prefixType)}
+	urlType       = reflect.TypeOf(url.URL{})
+	urlPtrType    = reflect.PointerTo(urlType)
+	timeType      = reflect.TypeOf(time.Time{})
+	byteSizeType  = reflect.TypeOf(ByteSize(0))
+	durationType  = reflect.TypeOf(time.Duration(0))
+
+	textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+)
+
+// assignNetwork parses the CIDR to the field of net.IPNet, *net.IPNet or netip.Prefix type, or the comma separated
+// CIDRs to a slice of them.
+func assignNetwork(target reflect.Value, input string) error {
+	if target.Kind() == reflect.Slice {
+		networks := reflect.MakeSlice(target.Type(), 0, 0)
+		for _, cidr := range strings.Split(input, ",") {
+			network := reflect.New(target.Type().Elem()).Elem()
+			if err := assignNetwork(network, cidr); err != nil {
+				return err
 			}
+			networks = reflect.Append(networks, network)
 		}
+		target.Set(networks)
+		return nil
 	}
-	return reflect.Value{}
+	if target.Type() == prefixType {
+		prefix, err := netip.ParsePrefix(input)
+		if err != nil {
+			return err
+		}
+		target.Set(reflect.ValueOf(prefix))
+		return nil
+	}
+	_, ipNet, err := net.ParseCIDR(input)
+	if err != nil {
+		return err
+	}
+	if target.Type() == ipNetPtrType {
+		target.Set(reflect.ValueOf(ipNet))
+	} else {
+		target.Set(reflect.ValueOf(*ipNet))
+	}
+	return nil
+}
+
+// assignURL parses the absolute URL to the field of url.URL or *url.URL type.
+func assignURL(target reflect.Value, input string) error {
+	u, err := parseURL(input)
+	if err != nil {
+		return err
+	}
+	if target.Type() == urlPtrType {
+		target.Set(reflect.ValueOf(u))
+	} else {
+		target.Set(reflect.ValueOf(*u))
+	}
+	return nil
+}
+
+// parseURL parses the URL, which must have the scheme and the host.
+func parseURL(input string) (*url.URL, error) {
+	u, err := url.Parse(input)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("absolute URL expected: %s", input)
+	}
+	return u, nil
+}
+
+// assignTime parses the time by the layout, RFC 3339 if the layout is empty.
+func assignTime(target reflect.Value, input string, layout string) error {
+	if layout == "" {
+		layout = time.RFC3339
+	}
+	t, err := time.Parse(layout, input)
+	if err != nil {
+		return err
+	}
+	target.Set(reflect.ValueOf(t))
+	return nil
+}
+
+// isScalarStruct reports whether the type is one of the networks, URLs, times or text unmarshalers, which are parsed
+// from a string and assigned as the scalars, not as the structures.
+func isScalarStruct(t reflect.Type) bool {
+	return isNetworkType(t) || t == urlType || t == urlPtrType || t == timeType || isTextUnmarshaler(t)
+}
+
+// isPointerToPrimitive reports whether the type is a pointer to a string, bool or numeric type, which is allocated when
+// the property is present, so an unset property can be told from the zero value.
+func isPointerToPrimitive(t reflect.Type) bool {
+	if t.Kind() != reflect.Pointer {
+		return false
+	}
+	switch t.Elem().Kind() {
+	case reflect.String, reflect.Bool, reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr, reflect.Float32,
+		reflect.Float64:
+		return !isTextUnmarshaler(t.Elem())
+	}
+	return false
+}
+
+// isValueList reports whether the type is a slice of values given on a single line, not a row of the repeated property,
+// a net.IP or a type parsed by its encoding.TextUnmarshaler implementation.
+func isValueList(t reflect.Type) bool {
+	return t.Kind() == reflect.Slice && t.Elem().Kind() != reflect.Uint8 && t.Elem().Kind() != reflect.Slice &&
+		!isTextUnmarshaler(t)
+}
+
+// isFlag reports whether the type is a bool or a pointer to it, which is turned on by the property without value.
+func isFlag(t reflect.Type) bool {
+	if t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	return t.Kind() == reflect.Bool && !isTextUnmarshaler(t)
+}
+
+func isNetworkType(t reflect.Type) bool {
+	return slices.Contains(networkTypes, t) || slices.Contains(networkSlices, t)
+}
+
+// isTextUnmarshaler reports whether the type or the pointer to it implements encoding.TextUnmarshaler.
+func isTextUnmarshaler(t reflect.Type) bool {
+	return t.Implements(textUnmarshalerType) || reflect.PointerTo(t).Implements(textUnmarshalerType)
+}
+
+// assignText delegates the parsing to UnmarshalText of the field, a nil pointer field is allocated first.
+func assignText(target reflect.Value, input string) error {
+	if target.Kind() == reflect.Pointer && target.Type().Implements(textUnmarshalerType) {
+		if target.IsNil() {
+			target.Set(reflect.New(target.Type().Elem()))
+		}
+	} else {
+		if !target.CanAddr() {
+			return errNotSettable
+		}
+		target = target.Addr()
+	}
+	return target.Interface().(encoding.TextUnmarshaler).UnmarshalText([]byte(input))
+}
+
+// numError describes the range of the integer field when the value exceeds its bit size, instead of the bare
+// strconv error.
+func numError(target reflect.Value, input string, err error) error {
+	if !errors.Is(err, strconv.ErrRange) {
+		return err
+	}
+	bits := target.Type().Bits()
+	if target.CanInt() {
+		minValue := int64(-1) << (bits - 1)
+		return fmt.Errorf("%s out of range of %v [%d, %d]", input, target.Type(), minValue, -(minValue + 1))
+	}
+	return fmt.Errorf("%s out of range of %v [0, %d]", input, target.Type(), uint64(math.MaxUint64)>>(64-bits))
 }
 
 func assignFromString(target reflect.Value, input string) error {
+	switch target.Type() {
+	case urlType, urlPtrType:
+		return assignURL(target, input)
+	case timeType:
+		return assignTime(target, input, "")
+	case byteSizeType:
+		size, err := ParseByteSize(input)
+		if err != nil {
+			return err
+		}
+		target.SetInt(int64(size))
+		return nil
+	}
+	if isNetworkType(target.Type()) {
+		return assignNetwork(target, input)
+	}
+	if isTextUnmarshaler(target.Type()) {
+		return assignText(target, input)
+	}
+	if isPointerToPrimitive(target.Type()) {
+		value := reflect.New(target.Type().Elem())
+		if err := assignFromString(value.Elem(), input); err != nil {
+			return err
+		}
+		target.Set(value)
+		return nil
+	}
 	switch target.Kind() {
 	case reflect.String:
 		target.SetString(input)
@@ -89,12 +350,18 @@ func assignFromString(target reflect.Value, input string) error {
 			}
 			target.SetInt(int64(durationValue))
 		} else {
-			intValue, err := strconv.Atoi(input)
+			intValue, err := strconv.ParseInt(input, 10, target.Type().Bits())
 			if err != nil {
-				return err
+				return numError(target, input, err)
 			}
-			target.SetInt(int64(intValue))
+			target.SetInt(intValue)
 		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		uintValue, err := strconv.ParseUint(input, 10, target.Type().Bits())
+		if err != nil {
+			return numError(target, input, err)
+		}
+		target.SetUint(uintValue)
 	case reflect.Float32:
 		floatValue, err := strconv.ParseFloat(input, 32)
 		if err != nil {
@@ -128,6 +395,12 @@ func assignFromString(target reflect.Value, input string) error {
 				intSlice = append(intSlice, intValue)
 			}
 			target.Set(reflect.ValueOf(intSlice))
+		case reflect.Slice:
+			if target.Type().Elem().Elem().Kind() != reflect.String {
+				return fmt.Errorf("unsupported slice type: %v", target.Type())
+			}
+			// every occurrence of the property appends a row
+			target.Set(reflect.Append(target, reflect.ValueOf(strings.Split(input, ","))))
 		case reflect.Uint8:
 			ip := net.ParseIP(input)
 			if ip == nil {
@@ -142,3 +415,33 @@ func assignFromString(target reflect.Value, input string) error {
 	}
 	return nil
 }
+
+// assignValues assigns the values given in the configuration to the target, every value of a slice is its element
+// kept as is, i.e. a quoted value may contain commas and spaces. A row of values is appended to the slice of rows,
+// the other types take a single value.
+func assignValues(target reflect.Value, values []string) error {
+	if target.Kind() != reflect.Slice || target.Type().Elem().Kind() == reflect.Uint8 || isTextUnmarshaler(target.Type()) {
+		if len(values) != 1 {
+			return fmt.Errorf("single value expected, got %d, a value containing spaces has to be quoted", len(values))
+		}
+		return assignFromString(target, values[0])
+	}
+	if target.Type().Elem().Kind() == reflect.Slice {
+		if target.Type().Elem().Elem().Kind() != reflect.String {
+			return fmt.Errorf("unsupported slice type: %v", target.Type())
+		}
+		// every occurrence of the property appends a row
+		target.Set(reflect.Append(target, reflect.ValueOf(slices.Clone(values))))
+		return nil
+	}
+	elems := reflect.MakeSlice(target.Type(), 0, len(values))
+	for _, value := range values {
+		elem := reflect.New(target.Type().Elem()).Elem()
+		if err := assignFromString(elem, value); err != nil {
+			return err
+		}
+		elems = reflect.Append(elems, elem)
+	}
+	target.Set(elems)
+	return nil
+}
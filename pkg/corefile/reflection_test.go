@@ -2,6 +2,8 @@ package corefile
 
 import (
 	"net"
+	"net/netip"
+	"net/url"
 	"reflect"
 	"testing"
 	"time"
@@ -174,13 +176,46 @@ func Test_assignFromString(t *testing.T) {
 		{field: "Int16Num", input: "1", want: int16(1)},
 		{field: "Int32Num", input: "1", want: int32(1)},
 		{field: "Int64Num", input: "1", want: int64(1)},
+		{field: "UintNum", input: "1", want: uint(1)},
+		{field: "Uint8Num", input: "255", want: uint8(255)},
+		{field: "Uint64Num", input: "18446744073709551615", want: uint64(1<<64 - 1)},
+		{field: "UintptrNum", input: "4096", want: uintptr(4096)},
 		{field: "Duration", input: "10s", want: 10 * time.Second},
 		{field: "Real32", input: "1.0", want: float32(1)},
 		{field: "Real64", input: "1.0", want: float64(1)},
 		{field: "Boolean", input: "true", want: true},
 		{field: "StrSlice", input: "a,b,c", want: []string{"a", "b", "c"}},
 		{field: "IntSlice", input: "1,2,3", want: []int{1, 2, 3}},
+		{field: "StrRows", input: "a,b", want: [][]string{{"a", "b"}}},
 		{field: "IP", input: "1.2.3.4", want: net.ParseIP("1.2.3.4")},
+		{field: "IPNet", input: "10.0.0.0/8", want: net.IPNet{IP: net.IPv4(10, 0, 0, 0).To4(), Mask: net.CIDRMask(8, 32)}},
+		{field: "IPNetPtr", input: "2001:db8::/32", want: &net.IPNet{IP: net.ParseIP("2001:db8::"), Mask: net.CIDRMask(32, 128)}},
+		{field: "IPNets", input: "10.0.0.0/8,192.168.0.0/16", want: []*net.IPNet{
+			{IP: net.IPv4(10, 0, 0, 0).To4(), Mask: net.CIDRMask(8, 32)},
+			{IP: net.IPv4(192, 168, 0, 0).To4(), Mask: net.CIDRMask(16, 32)},
+		}},
+		{field: "Prefix", input: "10.0.0.0/8", want: netip.MustParsePrefix("10.0.0.0/8")},
+		{field: "Prefixes", input: "10.0.0.0/8,2001:db8::/32", want: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8"),
+			netip.MustParsePrefix("2001:db8::/32")}},
+		{field: "URL", input: "tls://1.1.1.1:853", want: &url.URL{Scheme: "tls", Host: "1.1.1.1:853"}},
+		{field: "URL", input: "1.1.1.1", wantErr: true},
+		{field: "Time", input: "2026-10-16T08:30:00Z", want: time.Date(2026, 10, 16, 8, 30, 0, 0, time.UTC)},
+		{field: "Time", input: "2026-10-16", wantErr: true},
+		{field: "Size", input: "512KiB", want: ByteSize(512 << 10)},
+		{field: "Addr", input: "10.0.0.1", want: netip.MustParseAddr("10.0.0.1")},
+		{field: "AddrPtr", input: "::1", want: func() *netip.Addr { a := netip.IPv6Loopback(); return &a }()},
+		{field: "Level", input: "info", want: levelInfo},
+		{field: "Addr", input: "10.0.0.", wantErr: true},
+		{field: "Level", input: "trace", wantErr: true},
+		{field: "StrPtr", input: "sth", want: ptr("sth")},
+		{field: "IntPtr", input: "0", want: ptr(0)},
+		{field: "TimeoutPtr", input: "1m", want: ptr(time.Minute)},
+		{field: "IntPtr", input: "x", wantErr: true},
+		{field: "Int8Num", input: "-128", want: int8(-128)},
+		{field: "Int8Num", input: "300", wantErr: true},
+		{field: "Int16Num", input: "-32769", wantErr: true},
+		{field: "Uint8Num", input: "256", wantErr: true},
+		{field: "UintNum", input: "-1", wantErr: true},
 		{field: "Int64Num", input: "ff", wantErr: true},
 		{field: "Duration", input: "x", wantErr: true},
 		{field: "Real32", input: "x0", wantErr: true},
@@ -188,8 +223,13 @@ func Test_assignFromString(t *testing.T) {
 		{field: "Boolean", input: "y", wantErr: true},
 		{field: "IntSlice", input: "a", wantErr: true},
 		{field: "IP", input: "1.2.3.", wantErr: true},
+		{field: "IPNet", input: "10.0.0.1", wantErr: true},
+		{field: "IPNetPtr", input: "10.0.0.0/33", wantErr: true},
+		{field: "Prefix", input: "10.0.0.0/", wantErr: true},
+		{field: "Prefixes", input: "10.0.0.0/8,x", wantErr: true},
 		{field: "Unsupported", input: "{}", wantErr: true},
 		{field: "UnsupportedSlice", input: "{},{}", wantErr: true},
+		{field: "UnsupportedRows", input: "1,2", wantErr: true},
 	}
 	for _, tt := range tests {
 		t.Run("check assign to field "+tt.field, func(t *testing.T) {
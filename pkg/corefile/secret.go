@@ -0,0 +1,55 @@
+package corefile
+
+import (
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+const (
+	secretTag = "secret"
+	// secretMask replaces the values of the secret properties in the errors, the marshaled text and the schema.
+	secretMask = "********"
+)
+
+// isSecret reports whether the field is marked by the secret tag, e.g. `secret:"true"`.
+func isSecret(field reflect.StructField) bool {
+	secret, _ := strconv.ParseBool(field.Tag.Get(secretTag))
+	return secret
+}
+
+// redact masks the values of the secret property in the error message, keeping the error wrapped.
+func redact(err error, values []string) error {
+	msg := err.Error()
+	for _, value := range values {
+		if value != "" {
+			msg = strings.ReplaceAll(msg, value, secretMask)
+		}
+	}
+	if msg == err.Error() {
+		return err
+	}
+	return &messageError{msg: msg, err: err}
+}
+
+// redactField masks the value of the field in its error if the field is secret.
+func redactField(field reflect.StructField, val reflect.Value, err error) error {
+	if !isSecret(field) {
+		return err
+	}
+	values, formatErr := formatValue(val, field.Tag.Get(layoutTag))
+	if formatErr != nil {
+		// the value is unknown, so the whole message is masked
+		return &messageError{msg: secretMask, err: err}
+	}
+	return redact(err, values)
+}
+
+// maskValues replaces every value by the mask.
+func maskValues(values []string) []string {
+	masked := make([]string, len(values))
+	for i := range masked {
+		masked[i] = secretMask
+	}
+	return masked
+}
@@ -0,0 +1,80 @@
+package corefile
+
+import (
+	"testing"
+
+	"github.com/coredns/caddy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type tsigConfig struct {
+	Name      string            `cf:"name" check:"nonempty"`
+	Secret    string            `cf:"secret" secret:"true" check:"minlen(8),hostname"`
+	Password  string            `cf:"password" secret:"true" default:"changeit" default_if:"name=admin:admin-pass"`
+	Port      int               `cf:"port" secret:"true"`
+	Keys      [][]string        `cf:"key" secret:"true"`
+	Passwords map[string]string `cf:"passwords" secret:"true"`
+}
+
+func TestSecret_errors(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     string
+		wantErr string
+	}{
+		{
+			name:    "validation",
+			cfg:     "plugin {\n\tname key\n\tsecret top_secret\n}",
+			wantErr: "Testfile:3: property 'secret': hostname: invalid hostname: ********",
+		},
+		{
+			name:    "validation without the value in the message",
+			cfg:     "plugin {\n\tname key\n\tsecret short\n}",
+			wantErr: "Testfile:3: property 'secret': minlen: length should be >= 8, got 5",
+		},
+		{
+			name:    "assignment",
+			cfg:     "plugin {\n\tname key\n\tport p4ssw0rd\n}",
+			wantErr: "Testfile:3: property 'port': assigning value failed: strconv.ParseInt: parsing \"********\": invalid syntax",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var cfg tsigConfig
+			err := Parse(caddy.NewTestController("dns", tt.cfg), &cfg)
+			assert.EqualError(t, err, tt.wantErr)
+		})
+	}
+}
+
+func TestSecret_marshal(t *testing.T) {
+	text, err := Marshal(tsigConfig{
+		Name:      "key",
+		Secret:    "example.com",
+		Password:  "p4ssw0rd",
+		Keys:      [][]string{{"hmac-sha256", "c2VjcmV0"}},
+		Passwords: map[string]string{"admin": "p4ssw0rd"},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "{\n"+
+		"\tname key\n"+
+		"\tsecret ********\n"+
+		"\tpassword ********\n"+
+		"\tkey ******** ********\n"+
+		"\tpasswords {\n"+
+		"\t\tadmin ********\n"+
+		"\t}\n"+
+		"}\n", text)
+}
+
+func TestSecret_describe(t *testing.T) {
+	schema, err := Describe(tsigConfig{})
+	require.NoError(t, err)
+	assert.False(t, schema.Properties[0].Secret)
+	assert.True(t, schema.Properties[1].Secret)
+	assert.Equal(t, Property{Name: "password", Type: "string", Kind: KindValue, Default: "********",
+		DefaultIf: "name=admin:********", Secret: true}, schema.Properties[2])
+	assert.Contains(t, schema.Help(), "| `password` | string | `********` |  |  |")
+	assert.NotContains(t, schema.Help(), "changeit")
+}
@@ -3,9 +3,16 @@ package corefile
 import (
 	"errors"
 	"fmt"
+	"net"
+	"net/netip"
+	"net/url"
 	"reflect"
+	"regexp"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
 
 	"k8s.io/utils/strings/slices"
 )
@@ -17,18 +24,76 @@ type validator struct {
 
 type checkFunc func(val reflect.Value, args []string, specifier string) error
 
+// CheckFunc validates the value of the field, the args are the arguments of the checker given in the check tag,
+// e.g. `check:"name(arg1|arg2)"`.
+type CheckFunc func(val reflect.Value, args []string) error
+
 type checker struct {
 	checkFunc checkFunc
 	specifier string
 }
 
 var defaultChecks = map[string]checker{
-	"nonempty": {checkFunc: nonempty},
-	"oneof":    {checkFunc: oneOf},
-	"lt":       {checkFunc: numericComp, specifier: "<"},
-	"lte":      {checkFunc: numericComp, specifier: "<="},
-	"gt":       {checkFunc: numericComp, specifier: ">"},
-	"gte":      {checkFunc: numericComp, specifier: ">="},
+	"nonempty":  {checkFunc: nonempty},
+	"oneof":     {checkFunc: oneOf},
+	"lt":        {checkFunc: numericComp, specifier: "<"},
+	"lte":       {checkFunc: numericComp, specifier: "<="},
+	"gt":        {checkFunc: numericComp, specifier: ">"},
+	"gte":       {checkFunc: numericComp, specifier: ">="},
+	"range":     {checkFunc: numericRange, specifier: "[]"},
+	"rangeexcl": {checkFunc: numericRange, specifier: "()"},
+	"minlen":    {checkFunc: length, specifier: ">="},
+	"maxlen":    {checkFunc: length, specifier: "<="},
+	"regex":     {checkFunc: regex},
+	"cidr":      {checkFunc: network, specifier: "cidr"},
+	"ip":        {checkFunc: network, specifier: "ip"},
+	"port":      {checkFunc: network, specifier: "port"},
+	"hostname":  {checkFunc: network, specifier: "hostname"},
+	"hostport":  {checkFunc: network, specifier: "hostport"},
+	"url":       {checkFunc: urlCheck},
+}
+
+// relationFunc validates the value of the field against the sibling fields of the structure.
+type relationFunc func(structVal reflect.Value, val reflect.Value, args []string) error
+
+// relationChecks are the cross-field checkers, the arguments are the cf names of the sibling properties.
+var relationChecks = map[string]relationFunc{
+	"requiredwith":      requiredWith,
+	"requiredwithout":   requiredWithout,
+	"mutuallyexclusive": mutuallyExclusive,
+}
+
+var (
+	registeredChecks     = map[string]checker{}
+	registeredChecksLock sync.RWMutex
+)
+
+// RegisterChecker adds a checker usable in the check tags of all the parsed structures. The name is case-insensitive
+// like the names of the built-in checkers, it must not collide with any of them or with the already registered ones.
+// It is safe to be called concurrently, typically from the init function of a plugin.
+func RegisterChecker(name string, fn CheckFunc) error {
+	if name == "" || strings.ContainsAny(name, "(),| \t") {
+		return fmt.Errorf("invalid checker name: '%s'", name)
+	}
+	if fn == nil {
+		return fmt.Errorf("checker '%s' has no function", name)
+	}
+	key := strings.ToLower(name)
+	registeredChecksLock.Lock()
+	defer registeredChecksLock.Unlock()
+	if _, ok := defaultChecks[key]; ok {
+		return fmt.Errorf("checker '%s' is built-in", name)
+	}
+	if _, ok := relationChecks[key]; ok {
+		return fmt.Errorf("checker '%s' is built-in", name)
+	}
+	if _, ok := registeredChecks[key]; ok {
+		return fmt.Errorf("checker '%s' is already registered", name)
+	}
+	registeredChecks[key] = checker{checkFunc: func(val reflect.Value, args []string, _ string) error {
+		return fn(val, args)
+	}}
+	return nil
 }
 
 // CustomChecker represents a custom validation function call.
@@ -36,51 +101,119 @@ type CustomChecker interface {
 	Check() error
 }
 
-func (v *validator) validateStructure(structVal reflect.Value) error {
+// fieldError is the error of the property given by its path, e.g. wife.details.age.
+type fieldError struct {
+	path string
+	err  error
+}
+
+func (e *fieldError) Error() string {
+	if e.path == "" {
+		return e.err.Error()
+	}
+	return fmt.Sprintf("property '%s': %v", e.path, e.err)
+}
+
+func (e *fieldError) Unwrap() error {
+	return e.err
+}
+
+// validateStructure validates the fields of the structure and runs its custom checks, the path is the path of the
+// structure in the configuration, reported by the errors of its fields. The errors of all the invalid fields are
+// joined, the custom checks run only when the fields are valid.
+func (v *validator) validateStructure(structVal reflect.Value, path string) error {
 	if structVal.Kind() != reflect.Struct {
 		return v.log.Err("not a struct")
 	}
 
-	for i := 0; i < structVal.NumField(); i++ {
-		field := structVal.Type().Field(i)
-		if tags, ok := field.Tag.Lookup(checkTag); ok && len(tags) > 0 {
-			fieldVal := structVal.Field(i)
-			for _, tag := range strings.Split(tags, ",") {
-				tag = strings.TrimSpace(tag)
-				if len(tag) == 0 {
-					return v.log.Errf("empty '%s' tag not allowed", checkTag)
-				}
+	var errs []error
+	for _, field := range structFields(structVal.Type()) {
+		if err := v.validateStructField(structVal, field, path); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	}
 
-				if err := v.validateField(fieldVal, tags); err != nil {
-					return v.log.Errf("%s: %w", field.Name, err)
-				}
+	if err := v.executeCustomChecks(structVal); err != nil {
+		return &fieldError{path: path, err: err}
+	}
+	return nil
+}
+
+// validateStructField runs the checks of the field of the structure, the conditional checks run only when the checks
+// pass.
+func (v *validator) validateStructField(structVal reflect.Value, field reflect.StructField, path string) error {
+	val := structVal.FieldByIndex(field.Index)
+	if tags, ok := field.Tag.Lookup(checkTag); ok && len(tags) > 0 {
+		for _, tag := range splitConditions(tags) {
+			if len(strings.TrimSpace(tag)) == 0 {
+				return v.log.Errf("empty '%s' tag not allowed", checkTag)
 			}
 		}
+		if err := v.validateFieldOf(structVal, val, tags); err != nil {
+			return &fieldError{path: joinPath(path, propertyName(field)),
+				err: redactField(field, val, checkMessage(field, err))}
+		}
 	}
-
-	return v.executeCustomChecks(structVal)
+	if tag, ok := field.Tag.Lookup(checkIfTag); ok {
+		if err := v.validateConditionalChecks(structVal, val, tag); err != nil {
+			return &fieldError{path: joinPath(path, propertyName(field)),
+				err: redactField(field, val, checkMessage(field, err))}
+		}
+	}
+	return nil
 }
 
 func (v *validator) validateField(val reflect.Value, tag string) error {
-	for _, condition := range strings.Split(tag, ",") {
-		condition = strings.TrimSpace(condition)
-		var checkerName string
-		var args []string
-		if strings.Contains(condition, "(") {
-			start := strings.Index(condition, "(")
-			end := strings.Index(condition, ")")
-			checkerName = condition[:start]
-			content := condition[start+1 : end]
-			args = strings.Split(content, "|")
-		} else {
-			checkerName = condition
-		}
-
-		checker, ok := v.checkers[strings.ToLower(checkerName)]
+	return v.validateFieldOf(reflect.Value{}, val, tag)
+}
+
+// validateFieldOf validates the field of the structure, which is needed by the cross-field checkers only.
+func (v *validator) validateFieldOf(structVal reflect.Value, val reflect.Value, tag string) error {
+	for _, condition := range splitConditions(tag) {
+		checkerName, args, err := parseCondition(condition)
+		if err != nil {
+			return err
+		}
+
+		if relation, ok := relationChecks[strings.ToLower(checkerName)]; ok {
+			if !structVal.IsValid() {
+				return fmt.Errorf("%s: no structure to relate to", checkerName)
+			}
+			if err := relation(structVal, val, args); err != nil {
+				return fmt.Errorf("%s: %w", checkerName, err)
+			}
+			continue
+		}
+
+		val := val
+		if isPointerToPrimitive(val.Type()) && !strings.EqualFold(checkerName, "nonempty") {
+			// an unset property passes, the presence is checked by nonempty
+			if val.IsNil() {
+				continue
+			}
+			val = val.Elem()
+		}
+
+		checkerName, each := cutEach(checkerName)
+		checker, ok := v.lookupChecker(checkerName)
 		if !ok {
 			return errors.New("unknown checker")
 		}
 
+		if each {
+			if val.Kind() != reflect.Slice && val.Kind() != reflect.Array {
+				return fmt.Errorf("%s%s: unsupported field type: %v", eachPrefix, checkerName, val.Type())
+			}
+			for i := 0; i < val.Len(); i++ {
+				if err := checker.checkFunc(val.Index(i), args, checker.specifier); err != nil {
+					return fmt.Errorf("%s%s: element %d: %w", eachPrefix, checkerName, i, err)
+				}
+			}
+			continue
+		}
 		if err := checker.checkFunc(val, args, checker.specifier); err != nil {
 			return fmt.Errorf("%s: %w", checkerName, err)
 		}
@@ -88,18 +221,179 @@ func (v *validator) validateField(val reflect.Value, tag string) error {
 	return nil
 }
 
+// eachPrefix of the checker name applies the checker to every element of the slice instead of the slice itself,
+// e.g. `check:"each:port"`.
+const eachPrefix = "each:"
+
+// cutEach removes the case-insensitive each prefix from the checker name and reports whether it was present.
+func cutEach(checkerName string) (string, bool) {
+	if len(checkerName) > len(eachPrefix) && strings.EqualFold(checkerName[:len(eachPrefix)], eachPrefix) {
+		return checkerName[len(eachPrefix):], true
+	}
+	return checkerName, false
+}
+
+// messageError replaces the message of the check error by the one of the checkmsg tag, keeping the error wrapped.
+type messageError struct {
+	msg string
+	err error
+}
+
+func (e *messageError) Error() string {
+	return e.msg
+}
+
+func (e *messageError) Unwrap() error {
+	return e.err
+}
+
+// checkMessage overrides the error of the field checks by the message of its checkmsg tag if there is any.
+func checkMessage(field reflect.StructField, err error) error {
+	if msg, ok := field.Tag.Lookup(checkMsgTag); ok && msg != "" {
+		return &messageError{msg: msg, err: err}
+	}
+	return err
+}
+
+// propertyName returns the cf name of the field, the argument path of the field bound to the plugin argument,
+// or the field name without the tags.
+func propertyName(field reflect.StructField) string {
+	if name, ok := field.Tag.Lookup(cfTag); ok {
+		return name
+	}
+	if tag, ok := field.Tag.Lookup(argTag); ok {
+		if index, err := strconv.Atoi(tag); err == nil {
+			return argPath(index)
+		}
+	}
+	return field.Name
+}
+
+// isSet reports whether the property is present in the configuration, i.e. its value is not zero, an empty slice or
+// an empty map.
+func isSet(v reflect.Value) bool {
+	if v.Kind() == reflect.Slice || v.Kind() == reflect.Map {
+		return v.Len() > 0
+	}
+	return !v.IsZero()
+}
+
+// siblings returns the sibling fields of the structure given by their cf names.
+func siblings(structVal reflect.Value, names []string) ([]reflect.Value, error) {
+	if len(names) == 0 {
+		return nil, errors.New("expects at least one property")
+	}
+	fields := make([]reflect.Value, len(names))
+	for i, name := range names {
+		fields[i] = findFieldByTag(structVal, name)
+		if !fields[i].IsValid() {
+			return nil, fmt.Errorf("unknown property '%s'", name)
+		}
+	}
+	return fields, nil
+}
+
+// requiredWith requires the field when any of the properties is set.
+func requiredWith(structVal reflect.Value, val reflect.Value, args []string) error {
+	fields, err := siblings(structVal, args)
+	if err != nil {
+		return err
+	}
+	for i, field := range fields {
+		if isSet(field) && !isSet(val) {
+			return fmt.Errorf("required with '%s'", args[i])
+		}
+	}
+	return nil
+}
+
+// requiredWithout requires the field when any of the properties is not set.
+func requiredWithout(structVal reflect.Value, val reflect.Value, args []string) error {
+	fields, err := siblings(structVal, args)
+	if err != nil {
+		return err
+	}
+	for i, field := range fields {
+		if !isSet(field) && !isSet(val) {
+			return fmt.Errorf("required without '%s'", args[i])
+		}
+	}
+	return nil
+}
+
+// mutuallyExclusive forbids the properties when the field is set.
+func mutuallyExclusive(structVal reflect.Value, val reflect.Value, args []string) error {
+	fields, err := siblings(structVal, args)
+	if err != nil {
+		return err
+	}
+	for i, field := range fields {
+		if isSet(field) && isSet(val) {
+			return fmt.Errorf("mutually exclusive with '%s'", args[i])
+		}
+	}
+	return nil
+}
+
+// parseCondition splits the condition to the checker name and its arguments separated by '|'.
+func parseCondition(condition string) (string, []string, error) {
+	condition = strings.TrimSpace(condition)
+	if !strings.Contains(condition, "(") {
+		return condition, nil, nil
+	}
+	start := strings.Index(condition, "(")
+	end := strings.LastIndex(condition, ")")
+	if end < start {
+		return "", nil, fmt.Errorf("missing ')' in %s", condition)
+	}
+	return condition[:start], strings.Split(condition[start+1:end], "|"), nil
+}
+
+// splitConditions splits the check tag to the conditions separated by commas outside the parentheses, so the arguments
+// may contain commas, e.g. the regular expressions.
+func splitConditions(tag string) []string {
+	var conditions []string
+	depth, start := 0, 0
+	for i, c := range tag {
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ',':
+			if depth == 0 {
+				conditions = append(conditions, tag[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(conditions, tag[start:])
+}
+
+// lookupChecker finds the checker among the checkers of the validator, or the registered ones.
+func (v *validator) lookupChecker(name string) (checker, bool) {
+	name = strings.ToLower(name)
+	if checker, ok := v.checkers[name]; ok {
+		return checker, true
+	}
+	registeredChecksLock.RLock()
+	defer registeredChecksLock.RUnlock()
+	checker, ok := registeredChecks[name]
+	return checker, ok
+}
+
 func (v *validator) executeCustomChecks(structVal reflect.Value) error {
 	if structVal.CanAddr() {
 		if itf, ok := structVal.Addr().Interface().(CustomChecker); ok && itf != nil {
 			if err := itf.Check(); err != nil {
-				return v.log.Errf("custom check failed: %v", err)
+				return fmt.Errorf("custom check failed: %w", err)
 			}
 		}
 	}
 
 	if itf, ok := structVal.Interface().(CustomChecker); ok && itf != nil {
 		if err := itf.Check(); err != nil {
-			return v.log.Errf("custom check failed: %w", err)
+			return fmt.Errorf("custom check failed: %w", err)
 		}
 		return nil
 	}
@@ -145,10 +439,13 @@ func numericComp(v reflect.Value, args []string, specifier string) error {
 			(specifier == "<=" && v1Int > v2Int) ||
 			(specifier == ">" && v1Int <= v2Int) ||
 			(specifier == ">=" && v1Int < v2Int) {
+			if v.Type() == durationType {
+				return fmt.Errorf("should be %s %v", specifier, time.Duration(v2Int))
+			}
 			return fmt.Errorf("should be %s %d", specifier, v2Int)
 		}
 
-	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
 		v1Uint, v2Uint := v.Uint(), v2.Uint()
 
 		if (specifier == "<" && v1Uint >= v2Uint) ||
@@ -176,8 +473,50 @@ func numericComp(v reflect.Value, args []string, specifier string) error {
 	return nil
 }
 
+// numericRange checks the value is within the bounds given as `min-max`, inclusive for the "[]" specifier and exclusive
+// for the "()" one.
+func numericRange(v reflect.Value, args []string, specifier string) error {
+	if len(args) != 1 || args[0] == "" {
+		return fmt.Errorf("range expects one argument")
+	}
+	// the minimum may be negative, so the separator is searched behind its first character
+	sep := strings.Index(args[0][1:], "-") + 1
+	if sep == 0 {
+		return fmt.Errorf("range expects 'min-max', got '%s'", args[0])
+	}
+	lower, upper := args[0][:sep], args[0][sep+1:]
+	lowerSpec, upperSpec := ">=", "<="
+	if specifier == "()" {
+		lowerSpec, upperSpec = ">", "<"
+	}
+	for _, bound := range []string{lower, upper} {
+		if _, err := convertToSameType(v, bound); err != nil {
+			return err
+		}
+	}
+	if numericComp(v, []string{lower}, lowerSpec) != nil || numericComp(v, []string{upper}, upperSpec) != nil {
+		return fmt.Errorf("should be in %c%s, %s%c", specifier[0], lower, upper, specifier[1])
+	}
+	return nil
+}
+
 func convertToSameType(val reflect.Value, arg string) (reflect.Value, error) {
 	argValue := reflect.New(val.Type()).Elem()
+	if val.Type() == byteSizeType {
+		size, err := ParseByteSize(arg)
+		if err != nil {
+			return reflect.Value{}, fmt.Errorf("cannot convert %s to byte size", arg)
+		}
+		argValue.SetInt(int64(size))
+		return argValue, nil
+	}
+	if val.Type() == durationType {
+		// the duration syntax, or the plain nanoseconds
+		if d, err := time.ParseDuration(arg); err == nil {
+			argValue.SetInt(int64(d))
+			return argValue, nil
+		}
+	}
 	switch val.Kind() {
 	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
 		i, err := strconv.ParseInt(arg, 10, 64)
@@ -186,7 +525,7 @@ func convertToSameType(val reflect.Value, arg string) (reflect.Value, error) {
 		}
 		argValue.SetInt(i)
 
-	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
 		u, err := strconv.ParseUint(arg, 10, 64)
 		if err != nil {
 			return reflect.Value{}, fmt.Errorf("cannot convert %s to uint", arg)
@@ -206,3 +545,154 @@ func convertToSameType(val reflect.Value, arg string) (reflect.Value, error) {
 
 	return argValue, nil
 }
+
+// length compares the length of the string, in characters, or the number of the elements of the slice or map with
+// the argument.
+func length(v reflect.Value, args []string, specifier string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("length check expects one argument")
+	}
+	limit, err := strconv.Atoi(args[0])
+	if err != nil || limit < 0 {
+		return fmt.Errorf("invalid length: %s", args[0])
+	}
+	var n int
+	switch v.Kind() {
+	case reflect.String:
+		n = utf8.RuneCountInString(v.String())
+	case reflect.Slice, reflect.Map, reflect.Array:
+		n = v.Len()
+	default:
+		return fmt.Errorf("unsupported field type: %v", v.Type())
+	}
+	if (specifier == ">=" && n < limit) || (specifier == "<=" && n > limit) {
+		return fmt.Errorf("length should be %s %d, got %d", specifier, limit, n)
+	}
+	return nil
+}
+
+// regexCache holds the compiled patterns of the regex checker, keyed by the pattern.
+var regexCache sync.Map
+
+// regex matches the string against the pattern, the arguments are joined back, so the pattern may use alternations.
+func regex(v reflect.Value, args []string, _ string) error {
+	pattern := strings.Join(args, "|")
+	if pattern == "" {
+		return errors.New("regex expects a pattern")
+	}
+	if v.Kind() != reflect.String {
+		return fmt.Errorf("unsupported field type: %v", v.Type())
+	}
+	re, ok := regexCache.Load(pattern)
+	if !ok {
+		compiled, err := regexp.Compile(pattern)
+		if err != nil {
+			return fmt.Errorf("invalid pattern %s: %w", pattern, err)
+		}
+		re, _ = regexCache.LoadOrStore(pattern, compiled)
+	}
+	if !re.(*regexp.Regexp).MatchString(v.String()) {
+		return fmt.Errorf("should match %s", pattern)
+	}
+	return nil
+}
+
+// network checks that the string, or every string of the slice, is a CIDR, an IP address, a port, a hostname or
+// a host:port as given by the specifier. An empty string passes, the presence is checked by nonempty.
+func network(v reflect.Value, args []string, specifier string) error {
+	if len(args) != 0 {
+		return fmt.Errorf("%s expects no arguments", specifier)
+	}
+	var values []string
+	switch {
+	case v.Kind() == reflect.String:
+		if v.String() != "" {
+			values = []string{v.String()}
+		}
+	case v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.String:
+		for i := 0; i < v.Len(); i++ {
+			values = append(values, v.Index(i).String())
+		}
+	default:
+		return fmt.Errorf("unsupported field type: %v", v.Type())
+	}
+	for _, value := range values {
+		var valid bool
+		switch specifier {
+		case "cidr":
+			_, err := netip.ParsePrefix(value)
+			valid = err == nil
+		case "ip":
+			_, err := netip.ParseAddr(value)
+			valid = err == nil
+		case "port":
+			valid = isPort(value)
+		case "hostname":
+			valid = isHostname(value)
+		case "hostport":
+			host, port, err := net.SplitHostPort(value)
+			_, ipErr := netip.ParseAddr(host)
+			valid = err == nil && (ipErr == nil || isHostname(host)) && isPort(port)
+		}
+		if !valid {
+			return fmt.Errorf("invalid %s: %s", specifier, value)
+		}
+	}
+	return nil
+}
+
+// isPort reports whether the string is a port number from 1 to 65535.
+func isPort(s string) bool {
+	port, err := strconv.ParseUint(s, 10, 16)
+	return err == nil && port > 0
+}
+
+// isHostname reports whether the string is a hostname by RFC 1123, the labels of letters, digits and hyphens not
+// starting or ending with a hyphen. The trailing dot of the fully qualified name is allowed.
+func isHostname(s string) bool {
+	s = strings.TrimSuffix(s, ".")
+	if s == "" || len(s) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(s, ".") {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, c := range label {
+			if (c < 'a' || c > 'z') && (c < 'A' || c > 'Z') && (c < '0' || c > '9') && c != '-' {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// urlCheck checks that the string is an absolute URL, and its scheme is one of the arguments if there are any.
+// The URL fields are checked for the scheme only. An empty string and nil URL pass, the presence is checked by nonempty.
+func urlCheck(v reflect.Value, args []string, _ string) error {
+	var u *url.URL
+	switch {
+	case v.Kind() == reflect.String:
+		if v.String() == "" {
+			return nil
+		}
+		var err error
+		if u, err = parseURL(v.String()); err != nil {
+			return err
+		}
+	case v.Type() == urlPtrType:
+		if v.IsNil() {
+			return nil
+		}
+		u = v.Interface().(*url.URL)
+	case v.Type() == urlType:
+		value := v.Interface().(url.URL)
+		u = &value
+	default:
+		return fmt.Errorf("unsupported field type: %v", v.Type())
+	}
+	if len(args) > 0 && !slices.Contains(args, strings.ToLower(u.Scheme)) {
+		return fmt.Errorf("scheme should be one of %v", args)
+	}
+	return nil
+}
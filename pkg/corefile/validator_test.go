@@ -3,10 +3,15 @@ package corefile
 import (
 	"errors"
 	"fmt"
+	"net/url"
 	"reflect"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestValidator_validateStructure(t *testing.T) {
@@ -51,22 +56,34 @@ func TestValidator_validateStructure(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			structVal := reflect.ValueOf(tt.structure)
-			if err := v.validateStructure(structVal); (err != nil) != tt.wantErr {
+			if err := v.validateStructure(structVal, ""); (err != nil) != tt.wantErr {
 				t.Errorf("Validator.validateStructure() error = %v, wantErr %v", err, tt.wantErr)
 			}
 		})
 	}
 }
 
+func TestValidator_validateStructure_allErrors(t *testing.T) {
+	type testStruct struct {
+		Str string `cf:"str" check:"nonempty"`
+		Num int    `check:"lt(5)"`
+	}
+	v := &validator{log: &mockLogger{}, checkers: defaultChecks}
+	err := v.validateStructure(reflect.ValueOf(testStruct{Num: 10}), "block")
+	assert.EqualError(t, err, "property 'block.str': nonempty: cannot be empty\nproperty 'block.Num': lt: should be < 5")
+}
+
 func TestValidator_validateStructure_customCheckExecuted(t *testing.T) {
 	s := &testStruct{Str: "fail"}
 	structVal := reflect.ValueOf(s).Elem()
 	v := &validator{log: &mockLogger{}, checkers: defaultChecks}
-	err := v.validateStructure(structVal)
+	err := v.validateStructure(structVal, "")
 	assert.NotNil(t, err)
 }
 
-type mockLogger struct{}
+type mockLogger struct {
+	warnings []string
+}
 
 func (*mockLogger) Err(msg string) error {
 	return errors.New(msg)
@@ -76,6 +93,10 @@ func (*mockLogger) Errf(format string, args ...interface{}) error {
 	return fmt.Errorf(format, args...)
 }
 
+func (l *mockLogger) Warningf(format string, args ...interface{}) {
+	l.warnings = append(l.warnings, fmt.Sprintf(format, args...))
+}
+
 func TestValidator_validateField(t *testing.T) {
 	v := &validator{log: &mockLogger{}, checkers: defaultChecks}
 	tests := []struct {
@@ -128,6 +149,61 @@ func TestValidator_validateField(t *testing.T) {
 	}
 }
 
+func TestRegisterChecker(t *testing.T) {
+	t.Cleanup(func() {
+		registeredChecksLock.Lock()
+		defer registeredChecksLock.Unlock()
+		registeredChecks = map[string]checker{}
+	})
+	multipleOf := func(val reflect.Value, args []string) error {
+		if len(args) != 1 {
+			return errors.New("multipleOf expects one argument")
+		}
+		arg, err := convertToSameType(val, args[0])
+		if err != nil {
+			return err
+		}
+		if val.Int()%arg.Int() != 0 {
+			return fmt.Errorf("should be a multiple of %d", arg.Int())
+		}
+		return nil
+	}
+	assert.NoError(t, RegisterChecker("multipleOf", multipleOf))
+
+	v := &validator{log: &mockLogger{}, checkers: defaultChecks}
+	assert.NoError(t, v.validateField(reflect.ValueOf(6), "gt(0),MULTIPLEOF(3)"))
+	assert.Error(t, v.validateField(reflect.ValueOf(7), "multipleOf(3)"))
+
+	tests := []struct {
+		name    string
+		checker string
+		fn      CheckFunc
+	}{
+		{name: "collision with registered checker", checker: "MultipleOf", fn: multipleOf},
+		{name: "collision with built-in checker", checker: "nonEmpty", fn: multipleOf},
+		{name: "empty name", checker: "", fn: multipleOf},
+		{name: "name with tag syntax", checker: "multiple(Of)", fn: multipleOf},
+		{name: "missing function", checker: "missing"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Error(t, RegisterChecker(tt.checker, tt.fn))
+		})
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			assert.NoError(t, RegisterChecker(fmt.Sprintf("concurrent%d", i), multipleOf))
+			_, ok := v.lookupChecker(fmt.Sprintf("concurrent%d", i))
+			assert.True(t, ok)
+		}(i)
+	}
+	wg.Wait()
+}
+
 type ValueReceiver struct {
 	output error
 }
@@ -237,6 +313,146 @@ func TestOneOf(t *testing.T) {
 	}
 }
 
+func TestRegex(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   interface{}
+		tag     string
+		wantErr bool
+	}{
+		{
+			name:  "matching zone",
+			value: "example.org.",
+			tag:   `regex(^([a-z0-9-]+\.)+$)`,
+		},
+		{
+			name:    "not matching zone",
+			value:   "example.org",
+			tag:     `regex(^([a-z0-9-]+\.)+$)`,
+			wantErr: true,
+		},
+		{
+			name:  "alternation and repetition with comma",
+			value: "tls",
+			tag:   "regex(^(tcp|tls|[a-z]{5,6})$),nonempty",
+		},
+		{
+			name:    "alternation not matching",
+			value:   "quic",
+			tag:     "regex(^(tcp|tls)$)",
+			wantErr: true,
+		},
+		{
+			name:    "missing pattern",
+			value:   "a",
+			tag:     "regex()",
+			wantErr: true,
+		},
+		{
+			name:    "invalid pattern",
+			value:   "a",
+			tag:     "regex(^[a-$)",
+			wantErr: true,
+		},
+		{
+			name:    "not a string",
+			value:   1,
+			tag:     "regex(^1$)",
+			wantErr: true,
+		},
+	}
+
+	v := &validator{log: &mockLogger{}, checkers: defaultChecks}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := v.validateField(reflect.ValueOf(tt.value), tt.tag)
+			assert.Equal(t, tt.wantErr, err != nil, "unexpected error: %v", err)
+		})
+	}
+	_, cached := regexCache.Load(`^([a-z0-9-]+\.)+$`)
+	assert.True(t, cached, "the compiled pattern is expected to be cached")
+}
+
+func TestNetwork(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   interface{}
+		tag     string
+		wantErr bool
+	}{
+		{name: "cidr", value: "10.0.0.0/8", tag: "cidr"},
+		{name: "ipv6 cidr", value: "2001:db8::/32", tag: "cidr"},
+		{name: "cidr list", value: []string{"10.0.0.0/8", "192.168.0.0/16"}, tag: "cidr"},
+		{name: "bare ip is not cidr", value: "10.0.0.1", tag: "cidr", wantErr: true},
+		{name: "invalid cidr in list", value: []string{"10.0.0.0/8", "10.0.0.0/33"}, tag: "cidr", wantErr: true},
+		{name: "ip", value: "10.0.0.1", tag: "ip"},
+		{name: "ipv6", value: "2001:db8::1", tag: "ip"},
+		{name: "ip list", value: []string{"10.0.0.1", "::1"}, tag: "ip"},
+		{name: "cidr is not ip", value: "10.0.0.0/8", tag: "ip", wantErr: true},
+		{name: "hostname is not ip", value: "example.org", tag: "ip", wantErr: true},
+		{name: "port", value: "53", tag: "port"},
+		{name: "port list", value: []string{"53", "65535"}, tag: "port"},
+		{name: "zero port", value: "0", tag: "port", wantErr: true},
+		{name: "port out of range", value: "65536", tag: "port", wantErr: true},
+		{name: "named port", value: "dns", tag: "port", wantErr: true},
+		{name: "hostname", value: "dns-1.example.org", tag: "hostname"},
+		{name: "fqdn", value: "example.org.", tag: "hostname"},
+		{name: "single label", value: "localhost", tag: "hostname"},
+		{name: "hyphen at label start", value: "-dns.example.org", tag: "hostname", wantErr: true},
+		{name: "empty label", value: "dns..example.org", tag: "hostname", wantErr: true},
+		{name: "underscore", value: "_dns.example.org", tag: "hostname", wantErr: true},
+		{name: "long label", value: strings.Repeat("a", 64) + ".org", tag: "hostname", wantErr: true},
+		{name: "hostport", value: "dns.example.org:853", tag: "hostport"},
+		{name: "ip hostport", value: "10.0.0.1:53", tag: "hostport"},
+		{name: "ipv6 hostport", value: "[2001:db8::1]:53", tag: "hostport"},
+		{name: "hostport without port", value: "dns.example.org", tag: "hostport", wantErr: true},
+		{name: "ipv6 hostport without brackets", value: "2001:db8::1:53", tag: "hostport", wantErr: true},
+		{name: "hostport with invalid port", value: "dns.example.org:0", tag: "hostport", wantErr: true},
+		{name: "hostport with invalid host", value: "dns_1:53", tag: "hostport", wantErr: true},
+		{name: "empty string", value: "", tag: "cidr"},
+		{name: "empty hostport", value: "", tag: "hostport"},
+		{name: "not a string", value: 1, tag: "ip", wantErr: true},
+		{name: "unexpected arguments", value: "10.0.0.1", tag: "ip(4)", wantErr: true},
+	}
+
+	v := &validator{log: &mockLogger{}, checkers: defaultChecks}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := v.validateField(reflect.ValueOf(tt.value), tt.tag)
+			assert.Equal(t, tt.wantErr, err != nil, "unexpected error: %v", err)
+		})
+	}
+}
+
+func TestURLCheck(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   interface{}
+		tag     string
+		wantErr bool
+	}{
+		{name: "any scheme", value: "https://dns.example/dns-query", tag: "url"},
+		{name: "whitelisted scheme", value: "tls://1.1.1.1:853", tag: "url(https|tls)"},
+		{name: "scheme case", value: "HTTPS://dns.example", tag: "url(https)"},
+		{name: "scheme not whitelisted", value: "http://dns.example", tag: "url(https|tls)", wantErr: true},
+		{name: "relative url", value: "/dns-query", tag: "url", wantErr: true},
+		{name: "missing host", value: "https:///dns-query", tag: "url", wantErr: true},
+		{name: "empty string", value: "", tag: "url(https)"},
+		{name: "url field", value: url.URL{Scheme: "https", Host: "dns.example"}, tag: "url(https)"},
+		{name: "url pointer field", value: &url.URL{Scheme: "tls", Host: "dns.example"}, tag: "url(https)", wantErr: true},
+		{name: "nil url pointer", value: (*url.URL)(nil), tag: "url(https)"},
+		{name: "not a string", value: 1, tag: "url", wantErr: true},
+	}
+
+	v := &validator{log: &mockLogger{}, checkers: defaultChecks}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := v.validateField(reflect.ValueOf(tt.value), tt.tag)
+			assert.Equal(t, tt.wantErr, err != nil, "unexpected error: %v", err)
+		})
+	}
+}
+
 func TestNumericComp(t *testing.T) {
 	tests := []struct {
 		name      string
@@ -420,6 +636,194 @@ func TestNumericComp(t *testing.T) {
 	}
 }
 
+func TestNumericComp_byteSize(t *testing.T) {
+	v := &validator{log: &mockLogger{}, checkers: defaultChecks}
+	assert.NoError(t, v.validateField(reflect.ValueOf(ByteSize(512<<10)), "gte(512KiB),lte(1MB)"))
+	assert.Error(t, v.validateField(reflect.ValueOf(ByteSize(2<<20)), "lte(1MB)"))
+	assert.Error(t, v.validateField(reflect.ValueOf(ByteSize(1)), "lte(1XB)"))
+}
+
+func TestNumericRange(t *testing.T) {
+	v := &validator{log: &mockLogger{}, checkers: defaultChecks}
+	tests := []struct {
+		val     any
+		tag     string
+		wantErr bool
+	}{
+		{val: 1, tag: "range(1-65535)"},
+		{val: 65535, tag: "range(1-65535)"},
+		{val: 0, tag: "range(1-65535)", wantErr: true},
+		{val: 65536, tag: "range(1-65535)", wantErr: true},
+		{val: -5, tag: "range(-10--1)"},
+		{val: 0, tag: "range(-10--1)", wantErr: true},
+		{val: uint16(53), tag: "range(1-1024)"},
+		{val: 0.5, tag: "rangeExcl(0-1)"},
+		{val: 1.0, tag: "rangeExcl(0-1)", wantErr: true},
+		{val: 0.0, tag: "rangeExcl(0-1)", wantErr: true},
+		{val: 1.0, tag: "range(0-1)"},
+		{val: ByteSize(1 << 20), tag: "range(1KiB-1MiB)"},
+		{val: 1, tag: "range(1)", wantErr: true},
+		{val: 1, tag: "range(a-b)", wantErr: true},
+		{val: 1, tag: "range(1-2|3-4)", wantErr: true},
+		{val: "a", tag: "range(1-2)", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.tag, func(t *testing.T) {
+			err := v.validateField(reflect.ValueOf(tt.val), tt.tag)
+			assert.Equal(t, tt.wantErr, err != nil, "%v", err)
+		})
+	}
+	assert.EqualError(t, v.validateField(reflect.ValueOf(0), "range(1-65535)"), "range: should be in [1, 65535]")
+	assert.EqualError(t, v.validateField(reflect.ValueOf(1.0), "rangeExcl(0-1)"), "rangeExcl: should be in (0, 1)")
+}
+
+func TestLength(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   any
+		tag     string
+		wantErr bool
+	}{
+		{name: "string", value: "abc", tag: "minlen(1),maxlen(3)"},
+		{name: "characters", value: "žluť", tag: "maxlen(4)"},
+		{name: "short string", value: "", tag: "minlen(1)", wantErr: true},
+		{name: "long string", value: "abcd", tag: "maxlen(3)", wantErr: true},
+		{name: "slice", value: []string{"a", "b"}, tag: "minlen(1),maxlen(2)"},
+		{name: "empty slice", value: []int(nil), tag: "minlen(1)", wantErr: true},
+		{name: "long slice", value: []int{1, 2, 3}, tag: "maxlen(2)", wantErr: true},
+		{name: "map", value: map[string]int{"a": 1}, tag: "maxLen(1)"},
+		{name: "pointer to string", value: ptr("ab"), tag: "maxlen(1)", wantErr: true},
+		{name: "unsupported type", value: 1, tag: "maxlen(1)", wantErr: true},
+		{name: "invalid argument", value: "a", tag: "maxlen(x)", wantErr: true},
+		{name: "negative argument", value: "a", tag: "minlen(-1)", wantErr: true},
+		{name: "missing argument", value: "a", tag: "minlen", wantErr: true},
+	}
+	v := &validator{log: &mockLogger{}, checkers: defaultChecks}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := v.validateField(reflect.ValueOf(tt.value), tt.tag)
+			assert.Equal(t, tt.wantErr, err != nil, "unexpected error: %v", err)
+		})
+	}
+}
+
+func TestEach(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   any
+		tag     string
+		wantErr bool
+	}{
+		{name: "every element", value: []string{"53", "853"}, tag: "each:port"},
+		{name: "invalid element", value: []string{"53", "0"}, tag: "each:port", wantErr: true},
+		{name: "empty slice", value: []string(nil), tag: "each:nonempty"},
+		{name: "empty element", value: []string{"a", ""}, tag: "each:nonempty", wantErr: true},
+		{name: "numeric elements", value: []int{1, 5}, tag: "minlen(1),each:range(1-5)"},
+		{name: "numeric element out of range", value: []int{1, 6}, tag: "each:range(1-5)", wantErr: true},
+		{name: "arguments", value: []string{"a", "b"}, tag: "EACH:oneOf(a|b)"},
+		{name: "array", value: [2]string{"a", "c"}, tag: "each:oneOf(a|b)", wantErr: true},
+		{name: "not a slice", value: "a", tag: "each:nonempty", wantErr: true},
+		{name: "unknown checker", value: []string{"a"}, tag: "each:unknown", wantErr: true},
+	}
+	v := &validator{log: &mockLogger{}, checkers: defaultChecks}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := v.validateField(reflect.ValueOf(tt.value), tt.tag)
+			assert.Equal(t, tt.wantErr, err != nil, "unexpected error: %v", err)
+		})
+	}
+	assert.EqualError(t, v.validateField(reflect.ValueOf([]string{"53", "0"}), "each:port"),
+		"each:port: element 1: invalid port: 0")
+}
+
+func TestRelations(t *testing.T) {
+	type tlsConfig struct {
+		Cert     string   `cf:"tls_cert"`
+		Key      string   `cf:"tls_key" check:"requiredWith(tls_cert)"`
+		Insecure bool     `cf:"insecure" check:"mutuallyExclusive(tls_cert|ca)"`
+		CA       []string `cf:"ca"`
+		Upstream string   `cf:"upstream" check:"requiredWithout(ca)"`
+	}
+	type unknownProperty struct {
+		Key string `cf:"key" check:"requiredWith(cert)"`
+	}
+	tests := []struct {
+		name    string
+		value   any
+		wantErr string
+	}{
+		{name: "nothing set", value: tlsConfig{Upstream: "a"}},
+		{name: "cert with key", value: tlsConfig{Cert: "c", Key: "k", Upstream: "a"}},
+		{name: "key without cert", value: tlsConfig{Key: "k", Upstream: "a"}},
+		{name: "cert without key", value: tlsConfig{Cert: "c", Upstream: "a"},
+			wantErr: "property 'tls_key': requiredWith: required with 'tls_cert'"},
+		{name: "insecure alone", value: tlsConfig{Insecure: true, Upstream: "a"}},
+		{name: "insecure with cert", value: tlsConfig{Cert: "c", Key: "k", Insecure: true, Upstream: "a"},
+			wantErr: "property 'insecure': mutuallyExclusive: mutually exclusive with 'tls_cert'"},
+		{name: "insecure with ca", value: tlsConfig{Insecure: true, CA: []string{"ca"}},
+			wantErr: "property 'insecure': mutuallyExclusive: mutually exclusive with 'ca'"},
+		{name: "ca without upstream", value: tlsConfig{CA: []string{"ca"}}},
+		{name: "neither ca nor upstream", value: tlsConfig{CA: []string{}},
+			wantErr: "property 'upstream': requiredWithout: required without 'ca'"},
+		{name: "unknown property", value: unknownProperty{Key: "k"},
+			wantErr: "property 'key': requiredWith: unknown property 'cert'"},
+	}
+	v := &validator{log: &mockLogger{}, checkers: defaultChecks}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := v.validateStructure(reflect.ValueOf(tt.value), "")
+			if tt.wantErr == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.EqualError(t, err, tt.wantErr)
+			}
+		})
+	}
+	assert.Error(t, v.validateField(reflect.ValueOf("k"), "requiredWith(cert)"))
+	assert.Error(t, RegisterChecker("mutuallyExclusive", func(reflect.Value, []string) error { return nil }))
+}
+
+func TestCheckMessage(t *testing.T) {
+	type testStruct struct {
+		Upstreams []string `cf:"upstreams" check:"nonempty" checkmsg:"upstream list must not be empty"`
+		Port      int      `cf:"port" check:"range(1-65535)"`
+		Transport string   `cf:"transport"`
+		Name      string   `cf:"name" check_if:"transport=tls:nonempty" checkmsg:"name is required by tls"`
+	}
+	v := &validator{log: &mockLogger{}, checkers: defaultChecks}
+	err := v.validateStructure(reflect.ValueOf(testStruct{Transport: "tls"}), "")
+	assert.EqualError(t, err, "property 'upstreams': upstream list must not be empty\n"+
+		"property 'port': range: should be in [1, 65535]\n"+
+		"property 'name': name is required by tls")
+
+	var me *messageError
+	require.ErrorAs(t, err, &me)
+	assert.EqualError(t, errors.Unwrap(me), "nonempty: cannot be empty")
+}
+
+func TestNumericComp_duration(t *testing.T) {
+	v := &validator{log: &mockLogger{}, checkers: defaultChecks}
+	assert.NoError(t, v.validateField(reflect.ValueOf(time.Second), "gte(100ms),lte(30s)"))
+	assert.NoError(t, v.validateField(reflect.ValueOf(time.Second), "range(1s-1m)"))
+	assert.EqualError(t, v.validateField(reflect.ValueOf(time.Minute), "gte(100ms),lte(30s)"), "lte: should be <= 30s")
+	assert.Error(t, v.validateField(reflect.ValueOf(time.Millisecond), "gt(1000000)"))
+}
+
+func TestNumericComp_uintptr(t *testing.T) {
+	v := &validator{log: &mockLogger{}, checkers: defaultChecks}
+	assert.NoError(t, v.validateField(reflect.ValueOf(uintptr(10)), "gt(1),lte(10)"))
+	assert.Error(t, v.validateField(reflect.ValueOf(uintptr(11)), "lte(10)"))
+}
+
+func TestValidator_validateField_pointerToPrimitive(t *testing.T) {
+	v := &validator{log: &mockLogger{}, checkers: defaultChecks}
+	assert.NoError(t, v.validateField(reflect.ValueOf((*int)(nil)), "lte(10)"))
+	assert.Error(t, v.validateField(reflect.ValueOf((*int)(nil)), "nonempty,lte(10)"))
+	assert.NoError(t, v.validateField(reflect.ValueOf(ptr(0)), "nonempty,lte(10)"))
+	assert.Error(t, v.validateField(reflect.ValueOf(ptr(11)), "lte(10)"))
+	assert.NoError(t, v.validateField(reflect.ValueOf(ptr("b")), "oneOf(a|b)"))
+}
+
 func TestConvertToSameType(t *testing.T) {
 	tests := []struct {
 		name    string
@@ -434,6 +838,24 @@ func TestConvertToSameType(t *testing.T) {
 			arg:   "10",
 			want:  reflect.ValueOf(10),
 		},
+		{
+			name:  "duration",
+			value: time.Second,
+			arg:   "100ms",
+			want:  reflect.ValueOf(100 * time.Millisecond),
+		},
+		{
+			name:  "duration in nanoseconds",
+			value: time.Second,
+			arg:   "1000000",
+			want:  reflect.ValueOf(time.Millisecond),
+		},
+		{
+			name:    "invalid duration",
+			value:   time.Second,
+			arg:     "1x",
+			wantErr: true,
+		},
 		{
 			name:  "int8",
 			value: int8(5),
@@ -0,0 +1,83 @@
+package pipeline
+
+import (
+	"math"
+	"time"
+)
+
+// AutoscaleConfig bounds and drives the number of the primary pipes.
+type AutoscaleConfig struct {
+	MinPipes          int
+	MaxPipes          int
+	TargetOutstanding int
+	TargetQPS         int
+	Interval          time.Duration
+	Cooldown          time.Duration
+}
+
+// autoscale periodically adjusts the number of primary pipes to the load until the driver is closed.
+func (pd *Driver) autoscale() {
+	ticker := time.NewTicker(pd.autoscaleCfg.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-pd.done:
+			return
+		case <-ticker.C:
+			pd.scale()
+		}
+	}
+}
+
+func (pd *Driver) scale() {
+	cfg := pd.autoscaleCfg
+	qps := float64(pd.queries.Swap(0)) / cfg.Interval.Seconds()
+
+	outstanding := 0
+	var primaries []*Pipe
+	pd.pipesLock.RLock()
+	for _, pipe := range pd.pipes {
+		if pipe.primary {
+			primaries = append(primaries, pipe)
+			outstanding += pipe.outstanding()
+		}
+	}
+	pd.pipesLock.RUnlock()
+
+	desired := int(math.Max(
+		math.Ceil(float64(outstanding)/float64(cfg.TargetOutstanding)),
+		math.Ceil(qps/float64(cfg.TargetQPS)),
+	))
+	desired = max(cfg.MinPipes, min(cfg.MaxPipes, desired))
+
+	pd.loadingLock.Lock()
+	if len(primaries) == 0 && pd.primaryLoading == 0 {
+		// the pool is initialized lazily by the first query
+		pd.loadingLock.Unlock()
+		return
+	}
+	pd.primaryLimit = desired
+	missing := desired - len(primaries) - pd.primaryLoading
+	for i := 0; i < missing; i++ {
+		upstream, ok := pd.selectUpstream(true)
+		if !ok {
+			break
+		}
+		pd.primaryLoading++
+		NewPipe(pd, true, upstream, pd.pipeConfig)
+	}
+	pd.loadingLock.Unlock()
+
+	if missing > 0 {
+		pd.log("Driver: scaling up to %d pipes (qps %.0f, outstanding %d)", desired, qps, outstanding)
+		pd.lastScaleUp = time.Now()
+		return
+	}
+
+	if len(primaries) > desired && time.Since(pd.lastScaleUp) > cfg.Cooldown {
+		pd.log("Driver: scaling down to %d pipes (qps %.0f, outstanding %d)", len(primaries)-1, qps, outstanding)
+		pipe := leastLoaded(primaries)
+		pd.metrics.observePipeEvent(pipe.upstream, eventDrained)
+		pipe.drain()
+	}
+}
@@ -0,0 +1,42 @@
+package pipeline
+
+import (
+	"math/rand"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// encode0x20 randomizes the case of the letters of the query name (draft-vixie-dnsext-dns0x20), so a spoofed response
+// has to guess the case as well as the message ID. The message is expected to be a copy owned by the caller, returns
+// the encoded name to be checked by decode0x20.
+func encode0x20(msg *dns.Msg) string {
+	name := []byte(msg.Question[0].Name)
+	for i, c := range name {
+		if ('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z') && rand.Intn(2) == 0 {
+			name[i] ^= 0x20
+		}
+	}
+	msg.Question[0].Name = string(name)
+	return msg.Question[0].Name
+}
+
+// decode0x20 verifies that the response echoes the encoded query name in the exact case, and restores the original
+// name in the response, including the owner names of the records.
+func decode0x20(resp *dns.Msg, encoded string, original string) error {
+	if resp == nil || len(resp.Question) == 0 {
+		return nil
+	}
+	if resp.Question[0].Name != encoded {
+		return responseMismatch
+	}
+	resp.Question[0].Name = original
+	for _, section := range [][]dns.RR{resp.Answer, resp.Ns, resp.Extra} {
+		for _, rr := range section {
+			if strings.EqualFold(rr.Header().Name, encoded) {
+				rr.Header().Name = original
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,176 @@
+package pipeline
+
+import (
+	"crypto/tls"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	defaultAttemptTimeout  = 1 * time.Second
+	defaultTimeout         = 2 * time.Second
+	defaultAttemptDeadline = 500 * time.Millisecond
+	defaultRetryInterval   = 100 * time.Millisecond
+	// defaultFallbackDelay is the Connection Attempt Delay recommended by RFC 8305
+	defaultFallbackDelay = 250 * time.Millisecond
+	defaultProbeInterval = 5 * time.Second
+	defaultProbeTimeout  = 1 * time.Second
+	defaultProbeFailures = 3
+	defaultProbeRecovery = 1
+)
+
+// The transports of the upstreams.
+const (
+	TransportTCP   = "tcp"
+	TransportTLS   = "tls"
+	TransportUDP   = "udp"
+	TransportHTTPS = "https"
+)
+
+type ConnConfig struct {
+	Hostname string
+	Port     int
+	// Transport is one of the Transport constants, empty means TCP.
+	Transport string
+	// Path is the URL path of the DNS over HTTPS endpoint.
+	Path string
+}
+
+func (c ConnConfig) String() string {
+	return net.JoinHostPort(c.Hostname, strconv.Itoa(c.Port))
+}
+
+func (c ConnConfig) transport() string {
+	if c.Transport == "" {
+		return TransportTCP
+	}
+	return c.Transport
+}
+
+// Config configures the Driver.
+type Config struct {
+	// MaxRetries is the number of retries of a query after a timeout or a response with one of RetryRcodes.
+	MaxRetries int
+	// RetryRcodes are the response codes retried on another upstream, nil means SERVFAIL only.
+	RetryRcodes []int
+	// AttemptTimeout limits a single attempt to forward the query.
+	AttemptTimeout time.Duration
+	// Timeout limits the query including the retries.
+	Timeout time.Duration
+	// AttemptDeadline limits the time an attempt waits for a pipe to be available.
+	AttemptDeadline time.Duration
+	// RetryInterval is the interval of the checks for an available pipe.
+	RetryInterval time.Duration
+	// Cookies enables DNS cookies (RFC 7873) on the forwarded queries.
+	Cookies bool
+	// Referrals decides what happens to the responses without answer, but with authority or additional records.
+	Referrals ReferralPolicy
+	// Case0x20 randomizes the case of the query names and drops the responses not echoing it.
+	Case0x20 bool
+	// HedgeDelay sends a copy of the query to another upstream when no response arrives within the delay, the first
+	// response wins (0 disables hedging).
+	HedgeDelay time.Duration
+	// Backups are used only when no pipe to the upstreams is available.
+	Backups []ConnConfig
+	// WarmStandby keeps the secondary pipes established, but out of the traffic while any primary pipe is available.
+	// The standby pipes are probed by HealthCheck, so the failed ones are replaced before they are needed.
+	WarmStandby bool
+	HealthCheck HealthCheckConfig
+	Pipe        PipeConfig
+	// Autoscale adjusts the number of pipes to the load, if set.
+	Autoscale *AutoscaleConfig
+	// Metrics registers the collectors of the driver, nil leaves them unregistered. The drivers sharing the registry
+	// and MetricsNamespace share the collectors as well.
+	Metrics prometheus.Registerer
+	// MetricsNamespace prefixes the names of the metrics, e.g. coredns_hack_forward.
+	MetricsNamespace string
+	// Logger receives the debug messages of the driver and its pipes, nil discards them.
+	Logger Logger
+}
+
+// Logger logs the debug messages, e.g. the logger of a CoreDNS plugin.
+type Logger interface {
+	Debugf(format string, args ...any)
+}
+
+type PipeConfig struct {
+	Keepalive       bool
+	KeepalivePeriod time.Duration
+	// IdleTimeout closes a pipe not used for the duration and replaces it by a new one (0 disables it).
+	IdleTimeout time.Duration
+	// ReapTimeout closes a pipe not used for the duration without replacing it, shrinking the pool (0 disables it).
+	ReapTimeout time.Duration
+	// TLSConfig is used by the TLS and HTTPS transports, the server name defaults to the hostname of the upstream.
+	TLSConfig *tls.Config
+	// FallbackDelay is the head start of the IPv6 connection attempt to a dual-stack hostname, before IPv4 is dialed in
+	// parallel and the first connection established wins (Happy Eyeballs, RFC 8305). 0 means 250ms.
+	FallbackDelay time.Duration
+	// MaxInflight caps the requests in flight per pipe, further queries spill over to the other pipes
+	// (0 means PIPE_INFLIGHT_MAX).
+	MaxInflight int
+
+	// logger and metrics are set by the driver to its own ones
+	logger  Logger
+	metrics *metrics
+}
+
+// HealthCheckConfig configures the probes of the standby pipes.
+type HealthCheckConfig struct {
+	// Interval between the probes, 0 means 5s.
+	Interval time.Duration
+	// Timeout of a probe, 0 means 1s.
+	Timeout time.Duration
+	// Qname and Qtype are queried by the probes, empty means ". NS".
+	Qname string
+	Qtype uint16
+	// Failures is the number of the consecutive failed probes replacing the pipe and marking its upstream unhealthy,
+	// 0 means 3.
+	Failures int
+	// Recoveries is the number of the consecutive rounds of the probes passed by all the pipes to the unhealthy
+	// upstream, marking it healthy again, 0 means 1.
+	Recoveries int
+}
+
+func (c Config) withDefaults() Config {
+	if c.AttemptTimeout == 0 {
+		c.AttemptTimeout = defaultAttemptTimeout
+	}
+	if c.Timeout == 0 {
+		c.Timeout = defaultTimeout
+	}
+	if c.AttemptDeadline == 0 {
+		c.AttemptDeadline = defaultAttemptDeadline
+	}
+	if c.RetryInterval == 0 {
+		c.RetryInterval = defaultRetryInterval
+	}
+	if c.RetryRcodes == nil {
+		c.RetryRcodes = []int{dns.RcodeServerFailure}
+	}
+	if c.HealthCheck.Interval == 0 {
+		c.HealthCheck.Interval = defaultProbeInterval
+	}
+	if c.HealthCheck.Timeout == 0 {
+		c.HealthCheck.Timeout = defaultProbeTimeout
+	}
+	if c.HealthCheck.Qname == "" {
+		c.HealthCheck.Qname = "."
+	}
+	if c.HealthCheck.Qtype == 0 {
+		c.HealthCheck.Qtype = dns.TypeNS
+	}
+	if c.HealthCheck.Failures == 0 {
+		c.HealthCheck.Failures = defaultProbeFailures
+	}
+	if c.HealthCheck.Recoveries == 0 {
+		c.HealthCheck.Recoveries = defaultProbeRecovery
+	}
+	if c.Pipe.FallbackDelay == 0 {
+		c.Pipe.FallbackDelay = defaultFallbackDelay
+	}
+	return c
+}
@@ -0,0 +1,100 @@
+package pipeline
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+const clientCookieLen = 8
+
+// cookieJar maintains the DNS cookies (RFC 7873) of the upstreams: a random client cookie generated per upstream
+// and the server cookie last returned by it.
+type cookieJar struct {
+	lock      sync.Mutex
+	upstreams map[ConnConfig]*cookieState
+}
+
+type cookieState struct {
+	client string
+	server string
+}
+
+func newCookieJar(enabled bool) *cookieJar {
+	if !enabled {
+		return nil
+	}
+	return &cookieJar{upstreams: make(map[ConnConfig]*cookieState)}
+}
+
+// attach replaces the cookie option of the query by the one maintained for the upstream, it is a no-op on nil jar.
+// The query is expected to be a copy owned by the attempt, as the option is modified in place.
+func (j *cookieJar) attach(msg *dns.Msg, upstream ConnConfig) {
+	if j == nil {
+		return
+	}
+	opt := msg.IsEdns0()
+	if opt == nil {
+		return
+	}
+	j.lock.Lock()
+	state := j.state(upstream)
+	cookie := state.client + state.server
+	j.lock.Unlock()
+
+	removeOption(opt, dns.EDNS0COOKIE)
+	opt.Option = append(opt.Option, &dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: cookie})
+}
+
+// update stores the server cookie returned by the upstream and removes the cookie option from the response, so it
+// doesn't leak to the client. Responses echoing a different client cookie are ignored.
+func (j *cookieJar) update(resp *dns.Msg, upstream ConnConfig) {
+	if j == nil || resp == nil {
+		return
+	}
+	opt := resp.IsEdns0()
+	if opt == nil {
+		return
+	}
+	for _, option := range opt.Option {
+		cookie, ok := option.(*dns.EDNS0_COOKIE)
+		if !ok || len(cookie.Cookie) <= 2*clientCookieLen {
+			continue
+		}
+		j.lock.Lock()
+		state := j.state(upstream)
+		if cookie.Cookie[:2*clientCookieLen] == state.client {
+			state.server = cookie.Cookie[2*clientCookieLen:]
+		}
+		j.lock.Unlock()
+	}
+	removeOption(opt, dns.EDNS0COOKIE)
+}
+
+// state returns the cookies of the upstream, the caller is expected to hold the lock.
+func (j *cookieJar) state(upstream ConnConfig) *cookieState {
+	state, ok := j.upstreams[upstream]
+	if !ok {
+		state = &cookieState{client: newClientCookie()}
+		j.upstreams[upstream] = state
+	}
+	return state
+}
+
+func newClientCookie() string {
+	b := make([]byte, clientCookieLen)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func removeOption(opt *dns.OPT, code uint16) {
+	options := opt.Option[:0]
+	for _, option := range opt.Option {
+		if option.Option() != code {
+			options = append(options, option)
+		}
+	}
+	opt.Option = options
+}
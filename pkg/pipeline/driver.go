@@ -0,0 +1,629 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"math"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+	"k8s.io/apimachinery/pkg/util/rand"
+)
+
+const (
+	PRIMARY_PIPES_MAX   = 50
+	SECONDARY_PIPES_MAX = 50
+	// PIPE_INFLIGHT_MAX caps the requests in flight per pipe by default, so a stuck connection doesn't accumulate
+	// the waiters
+	PIPE_INFLIGHT_MAX = 1000
+
+	// maintenanceInterval is the period of loading the empty pool by the driver itself
+	maintenanceInterval = time.Second
+)
+
+// Driver forwards DNS messages over a pool of persistent pipelined TCP connections (pipes) to the upstreams.
+type Driver struct {
+	upstreams       []ConnConfig
+	upstreamsLock   sync.RWMutex
+	backups         []ConnConfig
+	maxRetries      int
+	attemptTimeout  time.Duration
+	timeout         time.Duration
+	attemptDeadline time.Duration
+	retryInterval   time.Duration
+	retryRcodes     []int
+	referrals       ReferralPolicy
+	cookies         *cookieJar
+	case0x20        bool
+	hedgeDelay      time.Duration
+	warmStandby     bool
+	healthCheck     HealthCheckConfig
+	// unhealthy counts the successful rounds of the probes of the upstreams marked unhealthy by the failed ones
+	unhealthy      map[ConnConfig]int
+	healthLock     sync.Mutex
+	pipeConfig     PipeConfig
+	primaryLimit   int
+	secondaryLimit int
+	pipes          []*Pipe
+	pipesLock      sync.RWMutex
+	ready          chan struct{}
+
+	primaryLoading   int
+	secondaryLoading int
+	loadingLock      sync.Mutex
+
+	autoscaleCfg *AutoscaleConfig
+	// queries counts the attempts for the autoscaling, queryCount and failureCount the queries since the start
+	queries      atomic.Int64
+	queryCount   atomic.Int64
+	failureCount atomic.Int64
+	lastScaleUp  time.Time
+	done         chan struct{}
+
+	logger  Logger
+	metrics *metrics
+}
+
+// PipeDriver receives the lifecycle events of the pipes it manages.
+type PipeDriver interface {
+	removePipe(pipe *Pipe)
+	pipeReady(pipe *Pipe)
+	pipeInitFailed(pipe *Pipe)
+	pipeExpired(pipe *Pipe)
+}
+
+// New creates a driver forwarding to the upstreams. The pipes are established by the first query, by Preconnect, or
+// by the maintenance loop of the driver within a second. Zero timeouts of the config are replaced by the defaults. Fails when the metrics cannot be registered.
+func New(upstreams []ConnConfig, cfg Config) (*Driver, error) {
+	cfg = cfg.withDefaults()
+	m := newMetrics(cfg.MetricsNamespace)
+	if err := m.register(cfg.Metrics); err != nil {
+		return nil, err
+	}
+	d := Driver{
+		upstreams:       upstreams,
+		backups:         cfg.Backups,
+		maxRetries:      cfg.MaxRetries,
+		attemptTimeout:  cfg.AttemptTimeout,
+		timeout:         cfg.Timeout,
+		attemptDeadline: cfg.AttemptDeadline,
+		retryInterval:   cfg.RetryInterval,
+		retryRcodes:     cfg.RetryRcodes,
+		referrals:       cfg.Referrals,
+		ready:           make(chan struct{}),
+		cookies:         newCookieJar(cfg.Cookies),
+		case0x20:        cfg.Case0x20,
+		hedgeDelay:      cfg.HedgeDelay,
+		warmStandby:     cfg.WarmStandby,
+		healthCheck:     cfg.HealthCheck,
+		unhealthy:       make(map[ConnConfig]int),
+		pipeConfig:      cfg.Pipe,
+		primaryLimit:    PRIMARY_PIPES_MAX,
+		secondaryLimit:  SECONDARY_PIPES_MAX,
+		autoscaleCfg:    cfg.Autoscale,
+		done:            make(chan struct{}),
+		logger:          cfg.Logger,
+		metrics:         m,
+	}
+	d.pipeConfig.logger, d.pipeConfig.metrics = d.logger, d.metrics
+	go d.maintain()
+	if d.autoscaleCfg != nil {
+		d.primaryLimit = d.autoscaleCfg.MinPipes
+		d.secondaryLimit = min(d.autoscaleCfg.MinPipes, SECONDARY_PIPES_MAX)
+		go d.autoscale()
+	}
+	if d.warmStandby {
+		go d.standby()
+	}
+	return &d, nil
+}
+
+// Close stops the background tasks of the driver and drains its pipes in the background, so they are not leaked
+// when the driver is replaced, e.g. on the reload of the configuration. It is safe to be called on nil driver.
+func (pd *Driver) Close() {
+	if pd == nil {
+		return
+	}
+	safeClose(pd.done)
+
+	pd.pipesLock.RLock()
+	pipes := append([]*Pipe(nil), pd.pipes...)
+	pd.pipesLock.RUnlock()
+	pd.log("Driver: closing, draining %d pipes", len(pipes))
+	for _, pipe := range pipes {
+		pd.metrics.observePipeEvent(pipe.upstream, eventDrained)
+		pipe.drain()
+	}
+}
+
+func (pd *Driver) isClosed() bool {
+	select {
+	case <-pd.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (pd *Driver) removePipe(pipe *Pipe) {
+	pd.pipesLock.Lock()
+	defer pd.pipesLock.Unlock()
+	for i := 0; i < len(pd.pipes); i++ {
+		if pd.pipes[i] == pipe {
+			pd.log("Driver: pipe removed [%d]", pipe.id)
+			pd.pipes = remove(pd.pipes, i)
+			return
+		}
+	}
+}
+
+func (pd *Driver) pipeReady(pipe *Pipe) {
+	pd.log("Driver: pipe ready [%d]", pipe.id)
+
+	pd.pipesLock.Lock()
+	defer pd.pipesLock.Unlock()
+	if pd.isClosed() {
+		// the pipe was being established while the driver was closed
+		pd.metrics.observePipeEvent(pipe.upstream, eventDrained)
+		go pipe.drain()
+	} else {
+		pd.pipes = append(pd.pipes, pipe)
+		// wake up the requests waiting for a pipe
+		close(pd.ready)
+		pd.ready = make(chan struct{})
+	}
+
+	pd.loadingLock.Lock()
+	if pipe.primary {
+		pd.primaryLoading--
+	} else {
+		pd.secondaryLoading--
+	}
+	pd.loadingLock.Unlock()
+}
+
+func (pd *Driver) pipeInitFailed(pipe *Pipe) {
+	pd.log("Driver: pipe init failed [%d]", pipe.id)
+
+	upstream, ok := pd.selectUpstream(pipe.primary)
+	if !ok {
+		pd.loadingLock.Lock()
+		if pipe.primary {
+			pd.primaryLoading--
+		} else {
+			pd.secondaryLoading--
+		}
+		pd.loadingLock.Unlock()
+		return
+	}
+	NewPipe(pd, pipe.primary, upstream, pd.pipeConfig)
+}
+
+// pipeExpired replaces a pipe closed due to inactivity.
+func (pd *Driver) pipeExpired(pipe *Pipe) {
+	pd.log("Driver: pipe expired [%d]", pipe.id)
+	pd.replacePipe(pipe)
+}
+
+// replacePipe establishes a new pipe of the same kind as the closed one.
+func (pd *Driver) replacePipe(pipe *Pipe) {
+	upstream, ok := pd.selectUpstream(pipe.primary)
+	if !ok {
+		return
+	}
+
+	pd.loadingLock.Lock()
+	if pipe.primary {
+		pd.primaryLoading++
+	} else {
+		pd.secondaryLoading++
+	}
+	pd.loadingLock.Unlock()
+
+	NewPipe(pd, pipe.primary, upstream, pd.pipeConfig)
+}
+
+func (pd *Driver) selectUpstream(primary bool) (ConnConfig, bool) {
+	pd.upstreamsLock.RLock()
+	defer pd.upstreamsLock.RUnlock()
+	primaries, secondaries := pd.upstreamSets()
+	candidates := primaries
+	if !primary {
+		candidates = secondaries
+	}
+	if len(candidates) == 0 || pd.isClosed() {
+		return ConnConfig{}, false
+	}
+	return candidates[rand.Intn(len(candidates))], true
+}
+
+// upstreamSets splits the upstreams to the ones served by the primary and the secondary pipes. With backups
+// configured, the primary pipes are spread over all the upstreams and the secondary pipes connect to the backups,
+// otherwise the first upstream is the primary one. Expects upstreamsLock to be held.
+func (pd *Driver) upstreamSets() (primary []ConnConfig, secondary []ConnConfig) {
+	if len(pd.backups) > 0 {
+		return pd.upstreams, pd.backups
+	}
+	if len(pd.upstreams) <= 1 {
+		return pd.upstreams, pd.upstreams
+	}
+	return pd.upstreams[:1], pd.upstreams[1:]
+}
+
+// SetUpstreams replaces the upstream list, the pipes not matching the new list are drained.
+func (pd *Driver) SetUpstreams(upstreams []ConnConfig) {
+	pd.log("Driver: setting upstreams %v", upstreams)
+	pd.upstreamsLock.Lock()
+	pd.upstreams = upstreams
+	pd.upstreamsLock.Unlock()
+
+	var stale []*Pipe
+	pd.pipesLock.RLock()
+	for _, pipe := range pd.pipes {
+		if !pd.isUpstreamValid(pipe) {
+			stale = append(stale, pipe)
+		}
+	}
+	pd.pipesLock.RUnlock()
+
+	for _, pipe := range stale {
+		pd.metrics.observePipeEvent(pipe.upstream, eventDrained)
+		pipe.drain()
+	}
+}
+
+// isUpstreamValid checks that the pipe is still connected to the upstream it would be assigned to.
+func (pd *Driver) isUpstreamValid(pipe *Pipe) bool {
+	pd.upstreamsLock.RLock()
+	defer pd.upstreamsLock.RUnlock()
+	primaries, secondaries := pd.upstreamSets()
+	candidates := primaries
+	if !pipe.primary {
+		candidates = secondaries
+	}
+	return slices.Contains(candidates, pipe.upstream)
+}
+
+// Query forwards the message upstream, retrying on another pipe when the attempt is retryable. The message ID is
+// preserved, the response carries the ID of the message.
+func (pd *Driver) Query(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	trace := contextTrace(ctx)
+	pd.queryCount.Add(1)
+	deadline := time.Now().Add(pd.timeout)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+	var resp *dns.Msg
+	var err error
+	var lastPipe *Pipe
+	tried := make(map[ConnConfig]bool)
+	for attempt := 0; attempt <= pd.maxRetries; attempt++ {
+		if attempt > 0 {
+			if !time.Now().Before(deadline) {
+				pd.log("Driver: overall deadline exceeded (%s)", msg.Question[0].Name)
+				break
+			}
+			pd.log("Driver: retrying (%s), attempt %d", msg.Question[0].Name, attempt)
+		}
+
+		start := time.Now()
+		resp, lastPipe, err = pd.hedgedForward(ctx, msg, lastPipe, tried, deadline)
+		if lastPipe != nil {
+			pd.metrics.observeUpstream(lastPipe.upstream, start, resp, err)
+			tried[lastPipe.upstream] = true
+			trace.attempt(Attempt{
+				Number:     attempt,
+				Upstream:   lastPipe.upstream,
+				Pipe:       lastPipe.id,
+				RemoteAddr: lastPipe.remoteAddr(),
+				Start:      start,
+				Query:      msg,
+				Response:   resp,
+				Err:        err,
+			})
+		}
+		if !pd.isRetryable(resp, err) {
+			break
+		}
+	}
+	if pd.referrals != ReferralPass && err == nil && isReferral(resp) {
+		pd.log("Driver: referral replaced by SERVFAIL (%s)", msg.Question[0].Name)
+		toServfail(resp)
+	}
+	if err != nil {
+		pd.failureCount.Add(1)
+	}
+	return resp, err
+}
+
+// forward sends the message through a single pipe, avoiding the previously used one and the already tried upstreams
+// if possible. The selected pipe is stored to the optional selected pointer before the message is sent.
+func (pd *Driver) forward(ctx context.Context, msg *dns.Msg, prev *Pipe, tried map[ConnConfig]bool,
+	deadline time.Time, selected *atomic.Pointer[Pipe]) (*dns.Msg, *Pipe, error) {
+	pipeDeadline := time.Now().Add(pd.attemptDeadline)
+	if deadline.Before(pipeDeadline) {
+		pipeDeadline = deadline
+	}
+	for {
+		pd.log("Driver: process (%s)", msg.Question[0].Name)
+		var pipe *Pipe
+		pd.pipesLock.RLock()
+		ready := pd.ready
+		if len(pd.pipes) == 0 {
+			pd.loadPipes()
+		} else if pipe = pd.selectPipe(prev, tried); pipe == nil {
+			pd.spillOver()
+		}
+		pd.pipesLock.RUnlock()
+
+		if pipe == nil {
+			wait := time.Until(pipeDeadline)
+			if wait <= 0 {
+				pd.log("Driver: deadline exceeded")
+				return nil, nil, errors.New("no pipe available")
+			}
+			pd.log("Driver: no pipe available -> waiting")
+			if wait > pd.retryInterval {
+				wait = pd.retryInterval
+			}
+			select {
+			case <-ctx.Done():
+				return nil, nil, ctx.Err()
+			case <-ready:
+			case <-time.After(wait):
+			}
+			continue
+		}
+
+		timeout := time.Until(deadline)
+		if timeout <= 0 {
+			return nil, pipe, timeoutErr
+		}
+		if timeout > pd.attemptTimeout {
+			timeout = pd.attemptTimeout
+		}
+
+		if selected != nil {
+			selected.Store(pipe)
+		}
+		resp, err := pd.send(ctx, pipe, msg, timeout)
+		if errors.Is(err, pipeSaturated) {
+			if !time.Now().Before(pipeDeadline) {
+				return nil, pipe, err
+			}
+			prev = pipe
+			continue
+		}
+		if err == nil || !errors.Is(err, writeNotReady) {
+			return resp, pipe, err
+		}
+	}
+}
+
+// send forwards the message through the pipe, attaching the cookie and randomizing the case of the name if enabled.
+func (pd *Driver) send(ctx context.Context, pipe *Pipe, msg *dns.Msg, timeout time.Duration) (*dns.Msg, error) {
+	pd.queries.Add(1)
+	query := msg
+	if pd.case0x20 || pd.cookies != nil {
+		// the cookie and the case are set on a copy owned by the attempt, the message is shared by the retries and
+		// the hedges
+		query = msg.Copy()
+	}
+	var encoded string
+	if pd.case0x20 {
+		encoded = encode0x20(query)
+	}
+	pd.cookies.attach(query, pipe.upstream)
+	resp, err := pipe.process(ctx, query, timeout)
+	if err == nil && resp.Truncated && pipe.upstream.transport() == TransportUDP {
+		pd.log("Driver: truncated response over UDP -> retrying over TCP (%s)", msg.Question[0].Name)
+		resp, err = pd.exchangeTCP(ctx, pipe.upstream, query, timeout)
+	}
+	if pd.case0x20 {
+		if decodeErr := decode0x20(resp, encoded, msg.Question[0].Name); decodeErr != nil {
+			pipe.log("response case mismatch id(%d)", msg.Id)
+			pd.metrics.observeResponseMismatch()
+			resp, err = nil, decodeErr
+		}
+	}
+	pd.cookies.update(resp, pipe.upstream)
+	return resp, err
+}
+
+// selectPipe picks the least loaded pipe, preferring the ones bound to an upstream not tried yet and avoiding the
+// previous pipe. Returns nil if all the pipes are saturated. Expects pipesLock to be held.
+func (pd *Driver) selectPipe(prev *Pipe, tried map[ConnConfig]bool) *Pipe {
+	var pipes []*Pipe
+	for _, pipe := range pd.failoverPipes() {
+		if !pipe.saturated() {
+			pipes = append(pipes, pipe)
+		}
+	}
+	if len(pipes) == 0 {
+		return nil
+	}
+	if (prev == nil && len(tried) == 0) || len(pipes) == 1 {
+		return leastLoaded(pipes)
+	}
+	var others, untried []*Pipe
+	for _, pipe := range pipes {
+		if pipe == prev {
+			continue
+		}
+		others = append(others, pipe)
+		if !tried[pipe.upstream] {
+			untried = append(untried, pipe)
+		}
+	}
+	if len(untried) > 0 {
+		return leastLoaded(untried)
+	}
+	if len(others) > 0 {
+		return leastLoaded(others)
+	}
+	return leastLoaded(pipes)
+}
+
+// leastLoaded picks the pipe with the fewest requests in flight, the ties are broken randomly.
+func leastLoaded(pipes []*Pipe) *Pipe {
+	var candidates []*Pipe
+	minLoad := math.MaxInt
+	for _, pipe := range pipes {
+		load := pipe.outstanding()
+		if load < minLoad {
+			minLoad = load
+			candidates = append(candidates[:0], pipe)
+		} else if load == minLoad {
+			candidates = append(candidates, pipe)
+		}
+	}
+	return candidates[rand.Intn(len(candidates))]
+}
+
+// failoverPipes returns the pipes eligible for forwarding: with backups configured or in the warm standby mode,
+// the secondary pipes are used only when no primary pipe is available, preferring the healthy upstreams.
+// Expects pipesLock to be held.
+func (pd *Driver) failoverPipes() []*Pipe {
+	if len(pd.backups) == 0 && !pd.warmStandby {
+		return pd.pipes
+	}
+	var primaries []*Pipe
+	for _, pipe := range pd.pipes {
+		if pipe.primary {
+			primaries = append(primaries, pipe)
+		}
+	}
+	if len(primaries) == 0 {
+		return pd.healthyPipes()
+	}
+	return primaries
+}
+
+// isRetryable reports whether the attempt failed or the upstream responded with an rcode worth trying elsewhere, or
+// with a referral if configured so. Other responses, including the ones without answers (NXDOMAIN, NODATA), are final.
+func (pd *Driver) isRetryable(resp *dns.Msg, err error) bool {
+	if err != nil {
+		return errors.Is(err, timeoutErr) || errors.Is(err, responseMismatch)
+	}
+	if pd.referrals == ReferralRetry && isReferral(resp) {
+		return true
+	}
+	// BADCOOKIE carries a fresh server cookie, so the retry is expected to succeed
+	return resp.Rcode == dns.RcodeBadCookie || slices.Contains(pd.retryRcodes, resp.Rcode)
+}
+
+// Preconnect establishes the pipes in advance, so the first queries don't have to wait for them.
+func (pd *Driver) Preconnect() {
+	pd.log("Driver: preconnecting pipes")
+	pd.pipesLock.RLock()
+	defer pd.pipesLock.RUnlock()
+	pd.loadPipes()
+}
+
+// maintain loads the pool whenever it is empty until the driver is closed, e.g. before the first query or after all
+// the pipes were lost, so the readiness doesn't depend on the traffic.
+func (pd *Driver) maintain() {
+	ticker := time.NewTicker(maintenanceInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-pd.done:
+			return
+		case <-ticker.C:
+			pd.pipesLock.RLock()
+			if len(pd.pipes) == 0 {
+				pd.loadPipes()
+			}
+			pd.pipesLock.RUnlock()
+		}
+	}
+}
+
+func (pd *Driver) loadPipes() {
+	pd.loadingLock.Lock()
+	primary, secondary := pd.countPipes()
+	if primary == 0 {
+		loading := 0
+		for i := 0; i < pd.primaryLimit-pd.primaryLoading; i++ {
+			upstream, ok := pd.selectUpstream(true)
+			if !ok {
+				break
+			}
+			loading++
+			NewPipe(pd, true, upstream, pd.pipeConfig)
+		}
+		pd.primaryLoading = loading + pd.primaryLoading
+
+		loading = 0
+		for i := 0; i < pd.secondaryLimit-secondary-pd.secondaryLoading; i++ {
+			upstream, ok := pd.selectUpstream(false)
+			if !ok {
+				break
+			}
+			loading++
+			NewPipe(pd, false, upstream, pd.pipeConfig)
+		}
+		pd.secondaryLoading = loading + pd.secondaryLoading
+	} else {
+		loading := 0
+		for i := 0; i < pd.primaryLimit-primary-pd.primaryLoading; i++ {
+			upstream, ok := pd.selectUpstream(true)
+			if !ok {
+				break
+			}
+			loading++
+			NewPipe(pd, true, upstream, pd.pipeConfig)
+		}
+		pd.primaryLoading = loading + pd.primaryLoading
+	}
+	pd.loadingLock.Unlock()
+}
+
+// spillOver adds a primary pipe when all the pipes are saturated, unless the pool is full already: PRIMARY_PIPES_MAX,
+// or the maximum of the autoscaling, which scales the pool down later. The pipes are added one by one, so the waiting
+// queries don't establish a pipe each. Expects pipesLock to be held.
+func (pd *Driver) spillOver() {
+	poolLimit := PRIMARY_PIPES_MAX
+	if pd.autoscaleCfg != nil {
+		poolLimit = pd.autoscaleCfg.MaxPipes
+	}
+	pd.loadingLock.Lock()
+	defer pd.loadingLock.Unlock()
+	primary, _ := pd.countPipes()
+	if pd.primaryLoading > 0 || primary >= poolLimit {
+		return
+	}
+	upstream, ok := pd.selectUpstream(true)
+	if !ok {
+		return
+	}
+	pd.log("Driver: all pipes saturated -> spilling over")
+	pd.primaryLoading++
+	NewPipe(pd, true, upstream, pd.pipeConfig)
+}
+
+func (pd *Driver) countPipes() (primary int, secondary int) {
+	for i := 0; i < len(pd.pipes); i++ {
+		if pd.pipes[i].primary {
+			primary++
+		} else {
+			secondary++
+		}
+	}
+	return
+}
+
+func remove[T any](slice []T, s int) []T {
+	return append(slice[:s], slice[s+1:]...)
+}
+
+// log passes the debug message to the logger of the driver, if any.
+func (pd *Driver) log(format string, a ...any) {
+	if pd.logger == nil {
+		return
+	}
+	pd.logger.Debugf(format, a...)
+}
@@ -0,0 +1,693 @@
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestDriver(t testing.TB, upstreams []*mockUpstream, backups []*mockUpstream) *Driver {
+	t.Helper()
+	var upstreamCfgs, backupCfgs []ConnConfig
+	for _, upstream := range upstreams {
+		upstreamCfgs = append(upstreamCfgs, upstream.addr())
+	}
+	for _, backup := range backups {
+		backupCfgs = append(backupCfgs, backup.addr())
+	}
+	driver, err := New(upstreamCfgs, Config{
+		MaxRetries:      2,
+		AttemptTimeout:  100 * time.Millisecond,
+		Timeout:         time.Second,
+		AttemptDeadline: 500 * time.Millisecond,
+		RetryInterval:   10 * time.Millisecond,
+		Backups:         backupCfgs,
+	})
+	require.NoError(t, err)
+	driver.primaryLimit = 2
+	driver.secondaryLimit = 2
+	t.Cleanup(driver.Close)
+	return driver
+}
+
+func query(t *testing.T, driver *Driver, name string) *dns.Msg {
+	t.Helper()
+	msg := newQuery(name)
+	resp, err := driver.Query(context.Background(), msg)
+	require.NoError(t, err)
+	require.Equal(t, msg.Id, resp.Id)
+	return resp
+}
+
+func countPrimaryPipes(driver *Driver) int {
+	driver.pipesLock.RLock()
+	defer driver.pipesLock.RUnlock()
+	primary, _ := driver.countPipes()
+	return primary
+}
+
+func countStandbyPipes(driver *Driver) int {
+	driver.pipesLock.RLock()
+	defer driver.pipesLock.RUnlock()
+	_, secondary := driver.countPipes()
+	return secondary
+}
+
+func TestDriver_Query(t *testing.T) {
+	upstream := newMockUpstream(t)
+	driver := newTestDriver(t, []*mockUpstream{upstream}, nil)
+
+	resp := query(t, driver, "example.org")
+	assert.Equal(t, dns.RcodeSuccess, resp.Rcode)
+	require.Len(t, resp.Answer, 1)
+	assert.Equal(t, "example.org.", resp.Answer[0].Header().Name)
+}
+
+func TestNew_metrics(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	first, err := New(nil, Config{Metrics: registry, MetricsNamespace: "test"})
+	require.NoError(t, err)
+	t.Cleanup(first.Close)
+	// the driver replaced on reload shares the collectors of the previous one
+	second, err := New(nil, Config{Metrics: registry, MetricsNamespace: "test"})
+	require.NoError(t, err)
+	t.Cleanup(second.Close)
+	assert.Same(t, first.metrics.pipeEventCount, second.metrics.pipeEventCount)
+
+	// the collector of the same name but different labels cannot be registered
+	conflicting := prometheus.NewCounterVec(prometheus.CounterOpts{Namespace: "other", Name: "pipe_events_total"},
+		[]string{"upstream"})
+	require.NoError(t, registry.Register(conflicting))
+	_, err = New(nil, Config{Metrics: registry, MetricsNamespace: "other"})
+	assert.Error(t, err)
+}
+
+func TestDriver_failover(t *testing.T) {
+	tests := []struct {
+		name     string
+		behavior mockBehavior
+	}{
+		{
+			name:     "dropped queries",
+			behavior: mockDrop,
+		},
+		{
+			name:     "wrong response IDs",
+			behavior: mockWrongID,
+		},
+		{
+			name:     "servfail",
+			behavior: mockServfail,
+		},
+		{
+			name:     "connection resets",
+			behavior: mockReset,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			broken := newMockUpstream(t)
+			broken.setBehavior(tt.behavior)
+			healthy := newMockUpstream(t)
+			driver := newTestDriver(t, []*mockUpstream{broken, healthy}, nil)
+
+			for i := 0; i < 5; i++ {
+				resp := query(t, driver, "example.org")
+				assert.Equal(t, dns.RcodeSuccess, resp.Rcode)
+			}
+			assert.Positive(t, healthy.queries.Load())
+		})
+	}
+}
+
+func TestDriver_backups(t *testing.T) {
+	primary := newMockUpstream(t)
+	backup := newMockUpstream(t)
+	driver := newTestDriver(t, []*mockUpstream{primary}, []*mockUpstream{backup})
+	driver.Preconnect()
+	require.Eventually(t, func() bool { return countPrimaryPipes(driver) == driver.primaryLimit }, time.Second,
+		time.Millisecond)
+
+	for i := 0; i < 5; i++ {
+		query(t, driver, "example.org")
+	}
+	assert.EqualValues(t, 5, primary.queries.Load())
+	assert.Zero(t, backup.queries.Load(), "backups must not be used while the primaries are up")
+
+	primary.close()
+	require.Eventually(t, func() bool { return countPrimaryPipes(driver) == 0 }, time.Second, time.Millisecond)
+	for i := 0; i < 5; i++ {
+		query(t, driver, "example.org")
+	}
+	assert.EqualValues(t, 5, backup.queries.Load())
+}
+
+func TestDriver_warmStandby(t *testing.T) {
+	primary := newMockUpstream(t)
+	standby := newMockUpstream(t)
+	driver := newTestDriver(t, []*mockUpstream{primary, standby}, nil)
+	driver.warmStandby = true
+	driver.healthCheck = Config{}.withDefaults().HealthCheck
+	driver.Preconnect()
+	require.Eventually(t, func() bool { return countStandbyPipes(driver) == driver.secondaryLimit }, time.Second,
+		time.Millisecond)
+
+	for i := 0; i < 5; i++ {
+		query(t, driver, "example.org")
+	}
+	assert.EqualValues(t, 5, primary.queries.Load())
+	assert.Zero(t, standby.queries.Load(), "standby pipes must not be used while the primaries are up")
+
+	driver.probeStandby()
+	assert.EqualValues(t, driver.secondaryLimit, standby.queries.Load(), "every standby pipe is expected to be probed")
+
+	primary.close()
+	require.Eventually(t, func() bool { return countPrimaryPipes(driver) == 0 }, time.Second, time.Millisecond)
+	for i := 0; i < 5; i++ {
+		query(t, driver, "example.org")
+	}
+	assert.EqualValues(t, driver.secondaryLimit+5, standby.queries.Load())
+}
+
+func TestDriver_standbyProbeFailed(t *testing.T) {
+	primary := newMockUpstream(t)
+	standby := newMockUpstream(t)
+	driver := newTestDriver(t, []*mockUpstream{primary, standby}, nil)
+	driver.warmStandby = true
+	driver.healthCheck = HealthCheckConfig{Timeout: 20 * time.Millisecond, Qname: ".", Qtype: dns.TypeNS, Failures: 2}
+	driver.Preconnect()
+	require.Eventually(t, func() bool { return countStandbyPipes(driver) == driver.secondaryLimit }, time.Second,
+		time.Millisecond)
+	accepted := standby.accepted.Load()
+
+	standby.setBehavior(mockDrop)
+	driver.probeStandby()
+	assert.Equal(t, driver.secondaryLimit, countStandbyPipes(driver), "a single failed probe must not replace the pipe")
+	assert.Equal(t, accepted, standby.accepted.Load())
+
+	standby.setBehavior(mockAnswer)
+	driver.probeStandby()
+	standby.setBehavior(mockDrop)
+	driver.probeStandby()
+	assert.Equal(t, accepted, standby.accepted.Load(), "a successful probe resets the failures")
+
+	driver.probeStandby()
+	require.Eventually(t, func() bool { return standby.accepted.Load() == accepted+int64(driver.secondaryLimit) },
+		time.Second, time.Millisecond, "the pipes failing the probes are expected to be replaced")
+	require.Eventually(t, func() bool { return countStandbyPipes(driver) == driver.secondaryLimit }, time.Second,
+		time.Millisecond)
+}
+
+func TestDriver_standbyRecovery(t *testing.T) {
+	primary := newMockUpstream(t)
+	standby := newMockUpstream(t)
+	driver := newTestDriver(t, []*mockUpstream{primary, standby}, nil)
+	driver.warmStandby = true
+	driver.healthCheck = HealthCheckConfig{Timeout: 20 * time.Millisecond, Qname: ".", Qtype: dns.TypeNS, Failures: 1,
+		Recoveries: 2}
+	driver.Preconnect()
+	waitStandby := func() {
+		require.Eventually(t, func() bool { return countStandbyPipes(driver) == driver.secondaryLimit }, time.Second,
+			time.Millisecond)
+	}
+	waitStandby()
+
+	standby.setBehavior(mockDrop)
+	driver.probeStandby()
+	assert.False(t, driver.isHealthy(standby.addr()))
+	waitStandby()
+
+	standby.setBehavior(mockAnswer)
+	driver.probeStandby()
+	assert.False(t, driver.isHealthy(standby.addr()), "a single successful probe must not recover the upstream")
+	driver.probeStandby()
+	assert.True(t, driver.isHealthy(standby.addr()))
+}
+
+func TestDriver_healthyPipes(t *testing.T) {
+	primary := newMockUpstream(t)
+	healthy := newMockUpstream(t)
+	unhealthy := newMockUpstream(t)
+	driver := newTestDriver(t, []*mockUpstream{primary, healthy, unhealthy}, nil)
+	driver.warmStandby = true
+	driver.secondaryLimit = 10
+	driver.Preconnect()
+	require.Eventually(t, func() bool { return countStandbyPipes(driver) == driver.secondaryLimit }, time.Second,
+		time.Millisecond)
+
+	driver.markUnhealthy(unhealthy.addr())
+	primary.close()
+	require.Eventually(t, func() bool { return countPrimaryPipes(driver) == 0 }, time.Second, time.Millisecond)
+	for i := 0; i < 5; i++ {
+		query(t, driver, "example.org")
+	}
+	assert.EqualValues(t, 5, healthy.queries.Load())
+	assert.Zero(t, unhealthy.queries.Load(), "the pipes to the unhealthy upstream must not be used")
+
+	driver.markUnhealthy(healthy.addr())
+	query(t, driver, "example.org")
+	assert.EqualValues(t, 6, healthy.queries.Load()+unhealthy.queries.Load(),
+		"all the pipes are used when no upstream is healthy")
+}
+
+func TestDriver_Ready(t *testing.T) {
+	first := newMockUpstream(t)
+	second := newMockUpstream(t)
+	backup := newMockUpstream(t)
+	driver := newTestDriver(t, []*mockUpstream{first, second}, []*mockUpstream{backup})
+	driver.primaryLimit = 10
+	assert.False(t, driver.Ready())
+	assert.Zero(t, countPrimaryPipes(driver), "the pipes are not loaded by the probe")
+	require.Eventually(t, driver.Ready, 3*maintenanceInterval, time.Millisecond)
+
+	second.close()
+	require.Eventually(t, func() bool { return countPrimaryPipes(driver) < driver.primaryLimit }, time.Second,
+		time.Millisecond)
+	assert.False(t, driver.Ready(), "every primary upstream is expected to have a pipe")
+
+	empty, err := New(nil, Config{})
+	require.NoError(t, err)
+	t.Cleanup(empty.Close)
+	assert.False(t, empty.Ready())
+}
+
+func TestDriver_reconnect(t *testing.T) {
+	upstream := newMockUpstream(t)
+	driver := newTestDriver(t, []*mockUpstream{upstream}, nil)
+
+	query(t, driver, "example.org")
+	accepted := upstream.accepted.Load()
+
+	upstream.resetConns()
+	require.Eventually(t, func() bool {
+		driver.pipesLock.RLock()
+		defer driver.pipesLock.RUnlock()
+		return len(driver.pipes) == 0
+	}, time.Second, time.Millisecond)
+
+	query(t, driver, "example.org")
+	assert.Greater(t, upstream.accepted.Load(), accepted, "new connections are expected to be established")
+}
+
+func TestDriver_close(t *testing.T) {
+	upstream := newMockUpstream(t)
+	driver := newTestDriver(t, []*mockUpstream{upstream}, nil)
+	query(t, driver, "example.org")
+
+	driver.Close()
+	driver.pipesLock.RLock()
+	assert.Empty(t, driver.pipes)
+	driver.pipesLock.RUnlock()
+
+	_, ok := driver.selectUpstream(true)
+	assert.False(t, ok, "closed driver must not establish new pipes")
+}
+
+func BenchmarkDriver_Query(b *testing.B) {
+	for _, pipes := range []int{1, 10, 50} {
+		b.Run(fmt.Sprintf("pipes=%d", pipes), func(b *testing.B) {
+			upstream := newMockUpstream(b)
+			driver := newTestDriver(b, []*mockUpstream{upstream}, nil)
+			driver.primaryLimit = pipes
+			driver.secondaryLimit = 0
+			driver.Preconnect()
+			for countPrimaryPipes(driver) < pipes {
+				time.Sleep(time.Millisecond)
+			}
+
+			var seq atomic.Int64
+			b.ReportAllocs()
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					msg := newQuery(fmt.Sprintf("q%d.example.org", seq.Add(1)))
+					if _, err := driver.Query(context.Background(), msg); err != nil {
+						b.Error(err)
+					}
+				}
+			})
+			b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "queries/s")
+		})
+	}
+}
+
+// TestDriver_stress runs concurrent queries through the timeouts, retries and hedges of a slow upstream with the cookies
+// and the case randomization enabled, so the shared messages are exercised by the race detector (go test -race).
+func TestDriver_stress(t *testing.T) {
+	slow, fast := newMockUpstream(t), newMockUpstream(t)
+	slow.setDelay(150 * time.Millisecond)
+	fast.setDelay(time.Millisecond)
+	driver := newTestDriver(t, []*mockUpstream{slow, fast}, nil)
+	driver.cookies = newCookieJar(true)
+	driver.case0x20 = true
+	driver.hedgeDelay = 20 * time.Millisecond
+
+	const workers, queries = 16, 50
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < queries; i++ {
+				name := fmt.Sprintf("q%d-%d.Example.org.", w, i)
+				msg := newQuery(name)
+				msg.SetEdns0(dns.DefaultMsgSize, false)
+				id := msg.Id
+				resp, err := driver.Query(context.Background(), msg)
+				assert.Equal(t, id, msg.Id)
+				assert.Equal(t, name, msg.Question[0].Name)
+				assert.Empty(t, msg.IsEdns0().Option)
+				if assert.NoError(t, err) {
+					assert.Equal(t, id, resp.Id)
+					assert.Equal(t, name, resp.Question[0].Name)
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+}
+
+func TestDriver_trace(t *testing.T) {
+	broken := newMockUpstream(t)
+	broken.setBehavior(mockServfail)
+	driver := newTestDriver(t, []*mockUpstream{broken}, nil)
+
+	var attempts []Attempt
+	var writes []Write
+	ctx := WithTrace(context.Background(), &Trace{
+		Write:   func(w Write) { writes = append(writes, w) },
+		Attempt: func(a Attempt) { attempts = append(attempts, a) },
+	})
+	resp, err := driver.Query(ctx, newQuery("example.org"))
+	require.NoError(t, err)
+	assert.Equal(t, dns.RcodeServerFailure, resp.Rcode)
+
+	require.Len(t, attempts, driver.maxRetries+1)
+	require.Len(t, writes, driver.maxRetries+1)
+	for i, a := range attempts {
+		assert.Equal(t, i, a.Number)
+		assert.Equal(t, broken.addr(), a.Upstream)
+		assert.NotZero(t, a.Pipe)
+		assert.NoError(t, a.Err)
+		assert.Equal(t, dns.RcodeServerFailure, a.Response.Rcode)
+		assert.Equal(t, a.Pipe, writes[i].Pipe)
+		assert.False(t, writes[i].Time.Before(a.Start))
+	}
+}
+
+func TestDriver_selectPipe(t *testing.T) {
+	newPipe := func(upstream ConnConfig, outstanding int) *Pipe {
+		pipe := &Pipe{upstream: upstream, primary: true, cache: SenderCache{cache: make(map[uint16]*Sender)}}
+		for i := 0; i < outstanding; i++ {
+			_, _, _ = pipe.cache.add(time.Time{})
+		}
+		return pipe
+	}
+	upstreamA := ConnConfig{Hostname: "10.0.0.1", Port: 53}
+	upstreamB := ConnConfig{Hostname: "10.0.0.2", Port: 53}
+	busyA, idleA, busyB := newPipe(upstreamA, 5), newPipe(upstreamA, 1), newPipe(upstreamB, 3)
+	driver := &Driver{pipes: []*Pipe{busyA, idleA, busyB}}
+
+	tests := []struct {
+		name  string
+		prev  *Pipe
+		tried map[ConnConfig]bool
+		want  *Pipe
+	}{
+		{
+			name: "least loaded pipe",
+			want: idleA,
+		},
+		{
+			name: "previous pipe avoided",
+			prev: idleA,
+			want: busyB,
+		},
+		{
+			name:  "untried upstream preferred",
+			tried: map[ConnConfig]bool{upstreamA: true},
+			want:  busyB,
+		},
+		{
+			name:  "least loaded pipe when all upstreams tried",
+			tried: map[ConnConfig]bool{upstreamA: true, upstreamB: true},
+			want:  idleA,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, driver.selectPipe(tt.prev, tt.tried))
+		})
+	}
+}
+
+func TestDriver_retryRcodes(t *testing.T) {
+	tests := []struct {
+		name         string
+		behavior     mockBehavior
+		retryRcodes  []int
+		wantAttempts int
+	}{
+		{
+			name:         "servfail retried by default",
+			behavior:     mockServfail,
+			wantAttempts: 3,
+		},
+		{
+			name:         "nxdomain is final",
+			behavior:     mockNXDomain,
+			wantAttempts: 1,
+		},
+		{
+			name:         "refused is final by default",
+			behavior:     mockRefused,
+			wantAttempts: 1,
+		},
+		{
+			name:         "refused retried when configured",
+			behavior:     mockRefused,
+			retryRcodes:  []int{dns.RcodeRefused},
+			wantAttempts: 3,
+		},
+		{
+			name:         "servfail not retried when not configured",
+			behavior:     mockServfail,
+			retryRcodes:  []int{dns.RcodeRefused},
+			wantAttempts: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstream := newMockUpstream(t)
+			upstream.setBehavior(tt.behavior)
+			driver := newTestDriver(t, []*mockUpstream{upstream}, nil)
+			if tt.retryRcodes != nil {
+				driver.retryRcodes = tt.retryRcodes
+			}
+
+			attempts := 0
+			ctx := WithTrace(context.Background(), &Trace{Attempt: func(Attempt) { attempts++ }})
+			_, err := driver.Query(ctx, newQuery("example.org"))
+			require.NoError(t, err)
+			assert.Equal(t, tt.wantAttempts, attempts)
+		})
+	}
+}
+
+func TestDriver_case0x20(t *testing.T) {
+	tests := []struct {
+		name     string
+		case0x20 bool
+		behavior mockBehavior
+		wantErr  error
+	}{
+		{
+			name:     "disabled",
+			behavior: mockAnswer,
+		},
+		{
+			name:     "case echoed",
+			case0x20: true,
+			behavior: mockAnswer,
+		},
+		{
+			name:     "case not echoed",
+			case0x20: true,
+			behavior: mockFlipCase,
+			wantErr:  responseMismatch,
+		},
+		{
+			name:     "case not checked when disabled",
+			behavior: mockFlipCase,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstream := newMockUpstream(t)
+			upstream.setBehavior(tt.behavior)
+			driver := newTestDriver(t, []*mockUpstream{upstream}, nil)
+			driver.case0x20 = tt.case0x20
+
+			msg := newQuery("www.Example.org")
+			resp, err := driver.Query(context.Background(), msg)
+			assert.Equal(t, "www.Example.org.", msg.Question[0].Name)
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			if tt.behavior == mockAnswer {
+				assert.Equal(t, "www.Example.org.", resp.Question[0].Name)
+				require.Len(t, resp.Answer, 1)
+				assert.Equal(t, "www.Example.org.", resp.Answer[0].Header().Name)
+			}
+		})
+	}
+}
+
+func TestDriver_cookies(t *testing.T) {
+	upstream := newMockUpstream(t)
+	driver := newTestDriver(t, []*mockUpstream{upstream}, nil)
+	driver.cookies = newCookieJar(true)
+
+	msg := newQuery("example.org")
+	msg.SetEdns0(dns.DefaultMsgSize, false)
+	_, err := driver.Query(context.Background(), msg)
+	require.NoError(t, err)
+	// the cookie is attached to the copy sent upstream only
+	assert.Empty(t, msg.IsEdns0().Option)
+}
+
+func TestDriver_spillOver(t *testing.T) {
+	upstream := newMockUpstream(t)
+	upstream.setDelay(200 * time.Millisecond)
+	driver := newTestDriver(t, []*mockUpstream{upstream}, nil)
+	driver.primaryLimit = 1
+	driver.secondaryLimit = 0
+	driver.pipeConfig.MaxInflight = 1
+	driver.attemptTimeout = time.Second
+
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := driver.Query(context.Background(), newQuery("example.org"))
+			assert.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, 3, countPrimaryPipes(driver))
+	assert.EqualValues(t, 3, upstream.queries.Load())
+}
+
+func TestDriver_referrals(t *testing.T) {
+	tests := []struct {
+		name         string
+		policy       ReferralPolicy
+		behavior     mockBehavior
+		wantRcode    int
+		wantAttempts int
+	}{
+		{
+			name:         "passed",
+			policy:       ReferralPass,
+			behavior:     mockReferral,
+			wantRcode:    dns.RcodeSuccess,
+			wantAttempts: 1,
+		},
+		{
+			name:         "replaced by servfail",
+			policy:       ReferralServfail,
+			behavior:     mockReferral,
+			wantRcode:    dns.RcodeServerFailure,
+			wantAttempts: 1,
+		},
+		{
+			name:         "retried",
+			policy:       ReferralRetry,
+			behavior:     mockReferral,
+			wantRcode:    dns.RcodeServerFailure,
+			wantAttempts: 3,
+		},
+		{
+			name:         "nodata is not a referral",
+			policy:       ReferralRetry,
+			behavior:     mockNoData,
+			wantRcode:    dns.RcodeSuccess,
+			wantAttempts: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstream := newMockUpstream(t)
+			upstream.setBehavior(tt.behavior)
+			driver := newTestDriver(t, []*mockUpstream{upstream}, nil)
+			driver.referrals = tt.policy
+
+			attempts := 0
+			ctx := WithTrace(context.Background(), &Trace{Attempt: func(Attempt) { attempts++ }})
+			resp, err := driver.Query(ctx, newQuery("example.org"))
+			require.NoError(t, err)
+			assert.Equal(t, tt.wantRcode, resp.Rcode)
+			assert.Equal(t, tt.wantAttempts, attempts)
+			if tt.wantRcode == dns.RcodeServerFailure {
+				assert.Empty(t, resp.Ns)
+				assert.Empty(t, resp.Extra)
+			} else {
+				assert.NotEmpty(t, resp.Ns)
+			}
+		})
+	}
+}
+
+func TestDriver_hedge(t *testing.T) {
+	tests := []struct {
+		name        string
+		hedgeDelay  time.Duration
+		slowDelay   time.Duration
+		wantMaxTime time.Duration
+	}{
+		{
+			name:        "disabled",
+			slowDelay:   50 * time.Millisecond,
+			wantMaxTime: time.Second,
+		},
+		{
+			name:        "slow upstream hedged",
+			hedgeDelay:  20 * time.Millisecond,
+			slowDelay:   500 * time.Millisecond,
+			wantMaxTime: 300 * time.Millisecond,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			slow := newMockUpstream(t)
+			slow.setDelay(tt.slowDelay)
+			fast := newMockUpstream(t)
+			driver := newTestDriver(t, []*mockUpstream{slow, fast}, nil)
+			driver.attemptTimeout = time.Second
+			driver.hedgeDelay = tt.hedgeDelay
+			driver.Preconnect()
+			require.Eventually(t, func() bool { return countPrimaryPipes(driver) == driver.primaryLimit }, time.Second,
+				time.Millisecond)
+
+			for i := 0; i < 5; i++ {
+				start := time.Now()
+				query(t, driver, "example.org")
+				assert.Less(t, time.Since(start), tt.wantMaxTime)
+			}
+			if tt.hedgeDelay == 0 {
+				assert.EqualValues(t, 5, slow.queries.Load()+fast.queries.Load(), "no query is hedged when disabled")
+			}
+		})
+	}
+}
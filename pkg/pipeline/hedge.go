@@ -0,0 +1,91 @@
+package pipeline
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+type hedgeResult struct {
+	resp  *dns.Msg
+	pipe  *Pipe
+	err   error
+	hedge bool
+}
+
+// hedgedForward forwards the message like forward, and if no response arrives within the hedge delay, sends it
+// through a pipe to another upstream as well. The first response wins and the other request is cancelled, a failed
+// request waits for the other one. Returns after both requests are finished, so the message is not used anymore.
+func (pd *Driver) hedgedForward(ctx context.Context, msg *dns.Msg, prev *Pipe, tried map[ConnConfig]bool,
+	deadline time.Time) (*dns.Msg, *Pipe, error) {
+	if pd.hedgeDelay == 0 {
+		return pd.forward(ctx, msg, prev, tried, deadline, nil)
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var selected atomic.Pointer[Pipe]
+	results := make(chan hedgeResult, 2)
+	go func() {
+		resp, pipe, err := pd.forward(ctx, msg, prev, tried, deadline, &selected)
+		results <- hedgeResult{resp: resp, pipe: pipe, err: err}
+	}()
+
+	timer := time.NewTimer(pd.hedgeDelay)
+	defer timer.Stop()
+	select {
+	case r := <-results:
+		return r.resp, r.pipe, r.err
+	case <-timer.C:
+	}
+
+	pending := 1
+	if hedge := pd.selectHedgePipe(selected.Load(), tried); hedge != nil {
+		timeout := min(time.Until(deadline), pd.attemptTimeout)
+		pending++
+		pd.log("Driver: hedging (%s) to %s", msg.Question[0].Name, hedge.upstream)
+		// the trace hooks are not expected to be called concurrently, so the hedged request is not traced
+		hedgeCtx := WithTrace(ctx, nil)
+		go func() {
+			resp, err := pd.send(hedgeCtx, hedge, msg, timeout)
+			results <- hedgeResult{resp: resp, pipe: hedge, err: err, hedge: true}
+		}()
+	}
+
+	var winner *hedgeResult
+	for ; pending > 0; pending-- {
+		r := <-results
+		if winner == nil || winner.err != nil && r.err == nil {
+			if r.err == nil {
+				cancel()
+			}
+			if r.hedge {
+				pd.metrics.observeHedge(r.pipe.upstream, r.err == nil)
+			}
+			winner = &r
+		} else if r.hedge {
+			pd.metrics.observeHedge(r.pipe.upstream, false)
+		}
+	}
+	return winner.resp, winner.pipe, winner.err
+}
+
+// selectHedgePipe picks the least loaded pipe bound to an upstream other than the one of the original request and
+// the already tried ones. Returns nil if there is no such pipe.
+func (pd *Driver) selectHedgePipe(original *Pipe, tried map[ConnConfig]bool) *Pipe {
+	pd.pipesLock.RLock()
+	defer pd.pipesLock.RUnlock()
+	var pipes []*Pipe
+	for _, pipe := range pd.failoverPipes() {
+		if pipe.saturated() || tried[pipe.upstream] || original != nil && pipe.upstream == original.upstream {
+			continue
+		}
+		pipes = append(pipes, pipe)
+	}
+	if len(pipes) == 0 {
+		return nil
+	}
+	return leastLoaded(pipes)
+}
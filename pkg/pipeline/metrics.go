@@ -0,0 +1,210 @@
+package pipeline
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// metrics holds the collectors of a driver and its pipes. All methods are safe to be called on nil metrics, which
+// counts nothing.
+type metrics struct {
+	responseMismatchCount prometheus.Counter
+	upstreamDuration      *prometheus.HistogramVec
+	upstreamRcodeCount    *prometheus.CounterVec
+	pipeEventCount        *prometheus.CounterVec
+	resurrectedCount      *prometheus.CounterVec
+	evictionCount         *prometheus.CounterVec
+	hedgeCount            *prometheus.CounterVec
+	probeCount            *prometheus.CounterVec
+}
+
+// newMetrics creates the collectors named with the namespace prefix, they are left unregistered until register.
+func newMetrics(namespace string) *metrics {
+	return &metrics{
+		responseMismatchCount: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "response_mismatch_total",
+			Help:      "Counter of the number of upstream responses discarded because the question didn't match the query.",
+		}),
+		upstreamDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "upstream_request_duration_seconds",
+			Buckets:   prometheus.ExponentialBuckets(0.00025, 2, 16),
+			Help:      "Histogram of the time each request took per upstream.",
+		}, []string{"to", "transport"}),
+		upstreamRcodeCount: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "upstream_responses_total",
+			Help:      "Counter of the responses received per upstream and rcode, failed requests are counted with rcode 'error'.",
+		}, []string{"to", "transport", "rcode"}),
+		pipeEventCount: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "pipe_events_total",
+			Help:      "Counter of the pipe lifecycle events per upstream, a spike of the failures signals a flapping upstream.",
+		}, []string{"to", "event"}),
+		resurrectedCount: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "pipe_resurrected_requests_total",
+			Help:      "Counter of the requests returned from a closing pipe to be retried through another one.",
+		}, []string{"to"}),
+		evictionCount: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "pipe_evicted_requests_total",
+			Help:      "Counter of the requests evicted from a pipe long after their deadline, without being answered.",
+		}, []string{"to"}),
+		hedgeCount: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "hedged_requests_total",
+			Help:      "Counter of the hedged requests per upstream, by whether they answered before the original request.",
+		}, []string{"to", "result"}),
+		probeCount: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "health_probes_total",
+			Help:      "Counter of the health probes of the standby pipes per upstream, by whether they were answered.",
+		}, []string{"to", "result"}),
+	}
+}
+
+// register registers the collectors, nil registerer leaves them unregistered. The collectors already registered by
+// another driver with the same namespace are shared.
+func (m *metrics) register(registerer prometheus.Registerer) (err error) {
+	if m.responseMismatchCount, err = register(registerer, m.responseMismatchCount); err != nil {
+		return err
+	}
+	if m.upstreamDuration, err = register(registerer, m.upstreamDuration); err != nil {
+		return err
+	}
+	if m.upstreamRcodeCount, err = register(registerer, m.upstreamRcodeCount); err != nil {
+		return err
+	}
+	if m.pipeEventCount, err = register(registerer, m.pipeEventCount); err != nil {
+		return err
+	}
+	if m.resurrectedCount, err = register(registerer, m.resurrectedCount); err != nil {
+		return err
+	}
+	if m.evictionCount, err = register(registerer, m.evictionCount); err != nil {
+		return err
+	}
+	if m.hedgeCount, err = register(registerer, m.hedgeCount); err != nil {
+		return err
+	}
+	if m.probeCount, err = register(registerer, m.probeCount); err != nil {
+		return err
+	}
+	return nil
+}
+
+// register registers the collector, or returns the equal one already registered, e.g. by the driver replaced on reload.
+func register[T prometheus.Collector](registerer prometheus.Registerer, collector T) (T, error) {
+	if registerer == nil {
+		return collector, nil
+	}
+	if err := registerer.Register(collector); err != nil {
+		var registered prometheus.AlreadyRegisteredError
+		if errors.As(err, &registered) {
+			if existing, ok := registered.ExistingCollector.(T); ok {
+				return existing, nil
+			}
+		}
+		return collector, fmt.Errorf("registering metrics: %w", err)
+	}
+	return collector, nil
+}
+
+// The events of the pipe lifecycle counted by pipeEventCount.
+const (
+	eventCreated            = "created"
+	eventDialFailed         = "dial_failed"
+	eventReadDeadlineError  = "read_deadline_error"
+	eventWriteDeadlineError = "write_deadline_error"
+	eventReadError          = "read_error"
+	eventWriteError         = "write_error"
+	// eventWriteRetried counts the transient write errors, the pipe survives them unless they persist
+	eventWriteRetried = "write_retried"
+	eventExpired      = "expired"
+	eventReaped       = "reaped"
+	// eventDrained counts the pipes closed by the driver, e.g. on the change of the upstreams or on scaling down
+	eventDrained = "drained"
+	// eventProbeFailed counts the standby pipes replaced after failing the health probes
+	eventProbeFailed = "probe_failed"
+)
+
+// The results of the hedged requests counted by hedgeCount.
+const (
+	hedgeWon  = "won"
+	hedgeLost = "lost"
+)
+
+// The results of the health probes counted by probeCount.
+const (
+	probeSuccess = "success"
+	probeFailure = "failure"
+)
+
+func (m *metrics) observePipeEvent(upstream ConnConfig, event string) {
+	if m == nil {
+		return
+	}
+	m.pipeEventCount.WithLabelValues(upstream.String(), event).Inc()
+}
+
+func (m *metrics) observeUpstream(upstream ConnConfig, start time.Time, resp *dns.Msg, err error) {
+	if m == nil {
+		return
+	}
+	to, transport := upstream.String(), upstream.transport()
+	rcode := "error"
+	if err == nil {
+		m.upstreamDuration.WithLabelValues(to, transport).Observe(time.Since(start).Seconds())
+		rcode = dns.RcodeToString[resp.Rcode]
+	}
+	m.upstreamRcodeCount.WithLabelValues(to, transport, rcode).Inc()
+}
+
+func (m *metrics) observeHedge(upstream ConnConfig, won bool) {
+	if m == nil {
+		return
+	}
+	result := hedgeLost
+	if won {
+		result = hedgeWon
+	}
+	m.hedgeCount.WithLabelValues(upstream.String(), result).Inc()
+}
+
+func (m *metrics) observeProbe(upstream ConnConfig, healthy bool) {
+	if m == nil {
+		return
+	}
+	result := probeFailure
+	if healthy {
+		result = probeSuccess
+	}
+	m.probeCount.WithLabelValues(upstream.String(), result).Inc()
+}
+
+func (m *metrics) observeResponseMismatch() {
+	if m == nil {
+		return
+	}
+	m.responseMismatchCount.Inc()
+}
+
+func (m *metrics) observeResurrected(upstream ConnConfig) {
+	if m == nil {
+		return
+	}
+	m.resurrectedCount.WithLabelValues(upstream.String()).Inc()
+}
+
+func (m *metrics) observeEviction(upstream ConnConfig) {
+	if m == nil {
+		return
+	}
+	m.evictionCount.WithLabelValues(upstream.String()).Inc()
+}
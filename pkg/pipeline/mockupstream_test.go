@@ -0,0 +1,234 @@
+package pipeline
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+type mockBehavior int32
+
+const (
+	mockAnswer mockBehavior = iota
+	mockDrop
+	mockWrongID
+	mockReset
+	mockServfail
+	mockNXDomain
+	mockRefused
+	mockFormerr
+	mockFlipCase
+	mockReferral
+	mockNoData
+)
+
+// mockUpstream is a DNS over TCP server answering the pipelined queries according to a scriptable behavior.
+type mockUpstream struct {
+	listener  net.Listener
+	behavior  atomic.Int32
+	resetNext atomic.Bool
+	delay     atomic.Int64
+	queries   atomic.Int64
+	accepted  atomic.Int64
+
+	connsLock sync.Mutex
+	conns     map[net.Conn]struct{}
+	wg        sync.WaitGroup
+}
+
+func newMockUpstream(t testing.TB) *mockUpstream {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listening failed: %v", err)
+	}
+	m := &mockUpstream{listener: listener, conns: make(map[net.Conn]struct{})}
+	m.wg.Add(1)
+	go m.serve()
+	t.Cleanup(m.close)
+	return m
+}
+
+func (m *mockUpstream) addr() ConnConfig {
+	addr := m.listener.Addr().(*net.TCPAddr)
+	return ConnConfig{Hostname: addr.IP.String(), Port: addr.Port}
+}
+
+func (m *mockUpstream) setBehavior(behavior mockBehavior) {
+	m.behavior.Store(int32(behavior))
+}
+
+// resetOnce makes the upstream reset the connection the next query is received on.
+func (m *mockUpstream) resetOnce() {
+	m.resetNext.Store(true)
+}
+
+func (m *mockUpstream) setDelay(delay time.Duration) {
+	m.delay.Store(int64(delay))
+}
+
+// resetConns resets all the connections accepted so far.
+func (m *mockUpstream) resetConns() {
+	m.connsLock.Lock()
+	defer m.connsLock.Unlock()
+	for conn := range m.conns {
+		reset(conn)
+	}
+}
+
+func (m *mockUpstream) close() {
+	m.listener.Close()
+	m.resetConns()
+	m.wg.Wait()
+}
+
+func (m *mockUpstream) serve() {
+	defer m.wg.Done()
+	for {
+		conn, err := m.listener.Accept()
+		if err != nil {
+			return
+		}
+		m.accepted.Add(1)
+		m.connsLock.Lock()
+		m.conns[conn] = struct{}{}
+		m.connsLock.Unlock()
+		m.wg.Add(1)
+		go m.handle(conn)
+	}
+}
+
+func (m *mockUpstream) handle(conn net.Conn) {
+	defer m.wg.Done()
+	defer func() {
+		m.connsLock.Lock()
+		delete(m.conns, conn)
+		m.connsLock.Unlock()
+		conn.Close()
+	}()
+
+	dnsConn := &dns.Conn{Conn: conn}
+	var writeLock sync.Mutex
+	for {
+		req, err := dnsConn.ReadMsg()
+		if err != nil {
+			return
+		}
+		m.queries.Add(1)
+
+		behavior := mockBehavior(m.behavior.Load())
+		if m.resetNext.CompareAndSwap(true, false) {
+			behavior = mockReset
+		}
+		resp := new(dns.Msg)
+		resp.SetReply(req)
+		switch behavior {
+		case mockDrop:
+			continue
+		case mockReset:
+			reset(conn)
+			return
+		case mockWrongID:
+			resp.Id = req.Id + 1
+		case mockServfail:
+			resp.Rcode = dns.RcodeServerFailure
+		case mockNXDomain:
+			resp.Rcode = dns.RcodeNameError
+		case mockRefused:
+			resp.Rcode = dns.RcodeRefused
+		case mockFormerr:
+			resp.Rcode = dns.RcodeFormatError
+			resp.Question = nil
+		case mockReferral:
+			resp.Ns = append(resp.Ns, &dns.NS{
+				Hdr: dns.RR_Header{Name: "org.", Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: 60},
+				Ns:  "ns.org.",
+			})
+			resp.Extra = append(resp.Extra, &dns.A{
+				Hdr: dns.RR_Header{Name: "ns.org.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+				A:   net.ParseIP("127.0.0.2"),
+			})
+		case mockNoData:
+			resp.Ns = append(resp.Ns, &dns.SOA{
+				Hdr:    dns.RR_Header{Name: "org.", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 60},
+				Ns:     "ns.org.",
+				Mbox:   "admin.org.",
+				Minttl: 60,
+			})
+		case mockFlipCase:
+			name := []byte(req.Question[0].Name)
+			for i, c := range name {
+				if 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' {
+					name[i] ^= 0x20
+				}
+			}
+			resp.Question[0].Name = string(name)
+		default:
+			resp.Answer = append(resp.Answer, &dns.A{
+				Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+				A:   net.ParseIP("127.0.0.1"),
+			})
+		}
+
+		// the responses are written asynchronously, so the delayed ones don't block the pipeline
+		delay := time.Duration(m.delay.Load())
+		go func() {
+			time.Sleep(delay)
+			writeLock.Lock()
+			defer writeLock.Unlock()
+			_ = dnsConn.WriteMsg(resp)
+		}()
+	}
+}
+
+// reset closes the connection with RST instead of FIN.
+func reset(conn net.Conn) {
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		_ = tcpConn.SetLinger(0)
+	}
+	conn.Close()
+}
+
+// mockDriver records the pipe events a Pipe reports to its driver.
+type mockDriver struct {
+	ready      chan *Pipe
+	initFailed chan *Pipe
+	removed    chan *Pipe
+	expired    chan *Pipe
+}
+
+func newMockDriver() *mockDriver {
+	return &mockDriver{
+		ready:      make(chan *Pipe, 16),
+		initFailed: make(chan *Pipe, 16),
+		removed:    make(chan *Pipe, 16),
+		expired:    make(chan *Pipe, 16),
+	}
+}
+
+func (d *mockDriver) removePipe(pipe *Pipe)     { d.removed <- pipe }
+func (d *mockDriver) pipeReady(pipe *Pipe)      { d.ready <- pipe }
+func (d *mockDriver) pipeInitFailed(pipe *Pipe) { d.initFailed <- pipe }
+func (d *mockDriver) pipeExpired(pipe *Pipe)    { d.expired <- pipe }
+
+func newQuery(name string) *dns.Msg {
+	msg := new(dns.Msg)
+	msg.SetQuestion(dns.Fqdn(name), dns.TypeA)
+	return msg
+}
+
+// waitFor returns the pipe received on the channel or fails the test after a second.
+func waitFor(t *testing.T, ch chan *Pipe) *Pipe {
+	t.Helper()
+	select {
+	case pipe := <-ch:
+		return pipe
+	case <-time.After(time.Second):
+		t.Fatal("pipe event not received")
+		return nil
+	}
+}
@@ -0,0 +1,557 @@
+package pipeline
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+var timeoutErr = errors.New("request timeouted")
+var writeNotReady = errors.New("writer not ready")
+var pipeSaturated = errors.New("pipe saturated")
+var responseMismatch = errors.New("response does not match the query")
+
+var pipeIDGen atomic.Int32
+
+type Pipe struct {
+	primary         bool
+	driver          PipeDriver
+	dialTimeout     time.Duration
+	readTimeout     time.Duration
+	writeTimeout    time.Duration
+	writeRetries    int
+	writeBackoff    time.Duration
+	finalizeTimeout time.Duration
+	sweepInterval   time.Duration
+	batchWindow     time.Duration
+	batchSize       int
+	keepalive       time.Duration
+	idleTimeout     time.Duration
+	reapTimeout     time.Duration
+	tlsConfig       *tls.Config
+	fallbackDelay   time.Duration
+	lastActivity    atomic.Int64
+	// probeFailures counts the consecutive failed health probes of a standby pipe
+	probeFailures atomic.Int32
+	upstream      ConnConfig
+	conn          *dns.Conn
+	// httpClient and url are set instead of conn for the DNS over HTTPS upstreams
+	httpClient *http.Client
+	url        string
+	//readChan  chan *dns.Msg
+	writeChan chan request
+
+	writeReady bool
+	writeLock  sync.Mutex
+
+	doneR chan struct{}
+	doneW chan struct{}
+	cache SenderCache
+
+	id      int
+	logger  Logger
+	metrics *metrics
+}
+
+func NewPipe(driver PipeDriver, primary bool, config ConnConfig, pipeConfig PipeConfig) *Pipe {
+	maxInflight := pipeConfig.MaxInflight
+	if maxInflight == 0 {
+		maxInflight = PIPE_INFLIGHT_MAX
+	}
+	p := Pipe{
+		id:              int(pipeIDGen.Add(1)),
+		primary:         primary,
+		upstream:        config,
+		cache:           SenderCache{cache: make(map[uint16]*Sender), limit: maxInflight},
+		driver:          driver,
+		dialTimeout:     1 * time.Second,
+		readTimeout:     500 * time.Millisecond,
+		writeTimeout:    5 * time.Millisecond,
+		writeRetries:    3,
+		writeBackoff:    1 * time.Millisecond,
+		finalizeTimeout: 2 * time.Second,
+		sweepInterval:   1 * time.Second,
+		batchWindow:     50 * time.Microsecond,
+		batchSize:       64,
+		keepalive:       -1,
+		idleTimeout:     pipeConfig.IdleTimeout,
+		reapTimeout:     pipeConfig.ReapTimeout,
+		tlsConfig:       pipeConfig.TLSConfig,
+		fallbackDelay:   pipeConfig.FallbackDelay,
+		doneR:           make(chan struct{}),
+		doneW:           make(chan struct{}),
+		writeChan:       make(chan request),
+		logger:          pipeConfig.logger,
+		metrics:         pipeConfig.metrics,
+	}
+	if pipeConfig.Keepalive {
+		p.keepalive = pipeConfig.KeepalivePeriod
+	}
+	p.touch()
+	p.log("initialized primary(%v)", primary)
+
+	go p.initConn(config)
+
+	return &p
+}
+
+func (p *Pipe) initConn(cfg ConnConfig) {
+	if cfg.transport() == TransportHTTPS {
+		p.initHTTPS(cfg, p.tlsConfig)
+		return
+	}
+	dialer := p.dialer()
+	conn, err := dialUpstream(context.Background(), dialer, cfg, p.tlsConfig)
+	if err != nil {
+		p.log("Initiating connection '%s' failed: %v", cfg, err)
+		p.metrics.observePipeEvent(p.upstream, eventDialFailed)
+		p.driver.pipeInitFailed(p)
+		return
+	}
+	p.log("connected to %s", conn.RemoteAddr())
+	// the responses over UDP are not limited to 512 bytes, the queries advertise their buffer size by EDNS0
+	p.conn = &dns.Conn{Conn: conn, UDPSize: dns.MaxMsgSize}
+	// the pipe must accept writes as soon as the driver is notified about it
+	p.setWriteReady(true)
+	go p.readLoop()
+	go p.writeLoop()
+	go p.finalize()
+	go p.sweepLoop()
+	p.metrics.observePipeEvent(p.upstream, eventCreated)
+	p.driver.pipeReady(p)
+}
+
+func (p *Pipe) finalize() {
+	<-p.doneR
+	<-p.doneW
+	p.log("finalizing")
+	if p.conn != nil {
+		p.conn.Close()
+	}
+	if p.httpClient != nil {
+		p.httpClient.CloseIdleConnections()
+	}
+}
+
+func (p *Pipe) isWriteReady() bool {
+	p.writeLock.Lock()
+	defer p.writeLock.Unlock()
+	return p.writeReady
+}
+
+func (p *Pipe) setWriteReady(ready bool) {
+	p.writeLock.Lock()
+	defer p.writeLock.Unlock()
+	p.log("W-goroutine ready (%v)", ready)
+	p.writeReady = ready
+}
+
+func (p *Pipe) process(ctx context.Context, msg *dns.Msg, timeout time.Duration) (*dns.Msg, error) {
+	p.log("processing message (%d, %v)", msg.Id, msg.Question[0].Name)
+	if !p.isWriteReady() {
+		p.log("W-goroutine not ready")
+		return nil, writeNotReady
+	}
+	if p.httpClient != nil {
+		return p.exchangeHTTPS(ctx, msg, timeout)
+	}
+
+	p.touch()
+	req, err := p.newRequest(msg, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case p.writeChan <- req:
+		contextTrace(ctx).write(Write{Upstream: p.upstream, Pipe: p.id, Time: time.Now()})
+	case <-ctx.Done():
+		p.log("message cancelled before write id(%d)", req.id)
+		p.cache.remove(req.id, req.sender)
+		return nil, ctx.Err()
+	case <-p.doneW:
+		// the writer stopped, the request may be retried through another pipe
+		p.log("W-goroutine closed before write id(%d)", req.id)
+		p.cache.remove(req.id, req.sender)
+		return nil, writeNotReady
+	case <-timer.C:
+		p.log("message timeout before write id(%d)", req.id)
+		p.cache.remove(req.id, req.sender)
+		return nil, timeoutErr
+	}
+
+	select {
+	case resp := <-req.sender.responseChan:
+		p.log("message responded (%d, %s)", resp.Id, dns.RcodeToString[resp.Rcode])
+		if !isResponseValid(msg, resp) {
+			p.log("response question mismatch id(%d)", resp.Id)
+			p.metrics.observeResponseMismatch()
+			return nil, responseMismatch
+		}
+		resp.Id = msg.Id
+		return resp, nil
+	case err := <-req.sender.errChan:
+		p.log("message error: %v", err)
+		return nil, err
+	case <-ctx.Done():
+		p.log("message cancelled id(%d)", req.id)
+		p.cache.remove(req.id, req.sender)
+		return nil, ctx.Err()
+	case <-timer.C:
+		p.log("message timeout id(%d)", req.id)
+		p.cache.remove(req.id, req.sender)
+		return nil, timeoutErr
+	}
+}
+
+// request is the query packed for the write loop under the message ID allocated by the pipe. The write loop never
+// touches the message of the caller, which may be reused as soon as process returns, e.g. after a timeout.
+type request struct {
+	id     uint16
+	wire   []byte
+	sender *Sender
+}
+
+// newRequest packs the message and allocates its ID in the sender cache, the ID is written to the packed copy only.
+func (p *Pipe) newRequest(msg *dns.Msg, timeout time.Duration) (request, error) {
+	wire, err := msg.Pack()
+	if err != nil {
+		p.log("packing failed (%d): %v", msg.Id, err)
+		return request{}, err
+	}
+	id, sender, err := p.cache.add(time.Now().Add(timeout))
+	if err != nil {
+		p.log("no message ID available")
+		return request{}, err
+	}
+	binary.BigEndian.PutUint16(wire, id)
+	return request{id: id, wire: wire, sender: sender}, nil
+}
+
+// isResponseValid checks that the response answers the question of the query. Error responses (e.g. FORMERR)
+// are allowed to omit the question section.
+func isResponseValid(query *dns.Msg, resp *dns.Msg) bool {
+	if !resp.Response {
+		return false
+	}
+	if len(resp.Question) == 0 && resp.Rcode != dns.RcodeSuccess {
+		return true
+	}
+	if len(resp.Question) != len(query.Question) {
+		return false
+	}
+	for i, q := range query.Question {
+		r := resp.Question[i]
+		if r.Qtype != q.Qtype || r.Qclass != q.Qclass || !strings.EqualFold(r.Name, q.Name) {
+			return false
+		}
+	}
+	return true
+}
+
+func (p *Pipe) readLoop() {
+	reaped := false
+	for {
+		select {
+		case <-p.doneR:
+			return
+		default:
+			//p.log("R initiated")
+			err := p.conn.SetReadDeadline(time.Now().Add(p.readTimeout))
+			if err != nil {
+				p.log("R setting deadline failed -> killing pipe")
+				p.metrics.observePipeEvent(p.upstream, eventReadDeadlineError)
+				p.closeRW(p.doneR, p.doneW)
+				return
+			}
+
+			resp, err := p.conn.ReadMsg()
+			if err != nil {
+				if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+					//p.log("R deadlined")
+					if !reaped && p.isIdle(p.reapTimeout) {
+						// the pipe is not replaced, the loop keeps reading until the drained pipe is finalized
+						p.log("R idle -> reaping pipe")
+						reaped = true
+						p.metrics.observePipeEvent(p.upstream, eventReaped)
+						p.drain()
+						continue
+					}
+					if p.isIdle(p.idleTimeout) {
+						p.log("R idle -> closing pipe")
+						p.metrics.observePipeEvent(p.upstream, eventExpired)
+						driver := p.driver
+						p.closeRW(p.doneR, p.doneW)
+						driver.pipeExpired(p)
+						return
+					}
+					continue
+				}
+				p.log("R read failed %v -> killing pipe", err)
+				p.metrics.observePipeEvent(p.upstream, eventReadError)
+				p.closeRW(p.doneR, p.doneW)
+				return
+			}
+
+			p.log("R received (%d)", resp.Id)
+			sender := p.cache.getAndRemove(resp.Id)
+			if sender != nil {
+				sender.responseChan <- resp
+			}
+		}
+	}
+}
+
+// sweepLoop periodically evicts the requests overdue by more than the sweep interval. The waiters remove their
+// requests on timeout, so the sweeper only catches the ones missed, which would otherwise occupy the pipe forever
+// when the upstream never answers them.
+func (p *Pipe) sweepLoop() {
+	ticker := time.NewTicker(p.sweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.doneR:
+			return
+		case now := <-ticker.C:
+			for _, sender := range p.cache.expire(now.Add(-p.sweepInterval)) {
+				p.log("evicting overdue request")
+				p.metrics.observeEviction(p.upstream)
+				sender.errChan <- timeoutErr
+			}
+		}
+	}
+}
+
+// dialer holds the timeouts of dialHost, which races IPv6 against IPv4 given the fallback delay.
+func (p *Pipe) dialer() *net.Dialer {
+	return &net.Dialer{Timeout: p.dialTimeout, KeepAlive: p.keepalive, FallbackDelay: p.fallbackDelay}
+}
+
+// remoteAddr returns the address of the upstream the pipe is connected to, nil for DNS over HTTPS.
+func (p *Pipe) remoteAddr() net.Addr {
+	if p.conn == nil {
+		return nil
+	}
+	return p.conn.RemoteAddr()
+}
+
+// outstanding returns the number of requests sent through the pipe and waiting for the response.
+func (p *Pipe) outstanding() int {
+	return p.cache.len()
+}
+
+// saturated reports whether the pipe reached the limit of the requests in flight.
+func (p *Pipe) saturated() bool {
+	return p.cache.limit > 0 && p.outstanding() >= p.cache.limit
+}
+
+func (p *Pipe) touch() {
+	p.lastActivity.Store(time.Now().UnixNano())
+}
+
+// isIdle reports whether no request has traversed the pipe for the timeout and none is in flight. Zero timeout
+// disables the check.
+func (p *Pipe) isIdle(timeout time.Duration) bool {
+	if timeout == 0 || p.outstanding() > 0 {
+		return false
+	}
+	return time.Since(time.Unix(0, p.lastActivity.Load())) > timeout
+}
+
+func (p *Pipe) closeRW(now chan struct{}, later chan struct{}) {
+	p.setWriteReady(false)
+	safeClose(now)
+	p.driver.removePipe(p)
+	p.resurrectReqs()
+	safeClose(later)
+}
+
+func safeClose(ch chan struct{}) {
+	select {
+	case <-ch:
+		return
+	default:
+		close(ch)
+	}
+}
+
+func (p *Pipe) writeLoop() {
+	for {
+		select {
+		case <-p.doneW:
+			p.log("W #")
+			return
+		case req := <-p.writeChan:
+			batch := p.collectBatch(req)
+			p.log("W receiving (%d) batch of %d", req.id, len(batch))
+			err := p.conn.SetWriteDeadline(time.Now().Add(p.writeTimeout))
+			if err != nil { //} || rand.Intn(3) != 0 {
+				p.log("W deadline failure")
+				p.metrics.observePipeEvent(p.upstream, eventWriteDeadlineError)
+				p.closeWriteLoop(batch)
+				return
+			}
+
+			written, err := p.writeBatch(batch)
+			if err != nil && written == 0 && p.isTransientWriteErr(err) {
+				// nothing was written, so the stream is intact and only the batch is retried elsewhere
+				p.log("W write stalled: %v", err)
+				p.returnBatch(batch)
+				continue
+			}
+			if err != nil {
+				p.log("W write err: %v", err)
+				p.metrics.observePipeEvent(p.upstream, eventWriteError)
+				p.closeWriteLoop(batch)
+				return
+			}
+
+			p.log("W write success (%d) batch of %d", req.id, len(batch))
+		}
+	}
+}
+
+// collectBatch gathers messages pending in writeChan within the batch window, so they can be written at once.
+func (p *Pipe) collectBatch(first request) []request {
+	batch := []request{first}
+	timer := time.NewTimer(p.batchWindow)
+	defer timer.Stop()
+	for len(batch) < p.batchSize {
+		select {
+		case req := <-p.writeChan:
+			batch = append(batch, req)
+		case <-timer.C:
+			return batch
+		}
+	}
+	return batch
+}
+
+// writeBatch writes all the messages of the batch in a single write call using the TCP length-prefixed framing.
+// Over UDP every message is written as a datagram of its own. The requests whose waiters are gone are skipped, their
+// IDs may be owned by other requests already. Returns the number of bytes written.
+func (p *Pipe) writeBatch(batch []request) (int, error) {
+	datagrams := p.upstream.transport() == TransportUDP
+	written := 0
+	var buf []byte
+	for _, req := range batch {
+		if !p.cache.owns(req.id, req.sender) {
+			p.log("W skipping abandoned request (%d)", req.id)
+			continue
+		}
+		data := req.wire
+		if datagrams {
+			n, err := p.conn.Conn.Write(data)
+			written += n
+			if err != nil {
+				return written, err
+			}
+			continue
+		}
+		buf = append(buf, byte(len(data)>>8), byte(len(data)))
+		buf = append(buf, data...)
+	}
+	if len(buf) == 0 {
+		return written, nil
+	}
+	return p.writeAll(buf)
+}
+
+// writeAll writes the whole buffer, resuming the write after the transient errors with an exponential backoff, as
+// the partially written message can't be taken back without breaking the framing of the stream. Returns the fatal
+// errors immediately and the transient ones once the retries are exhausted. Returns the number of bytes written.
+func (p *Pipe) writeAll(buf []byte) (int, error) {
+	backoff := p.writeBackoff
+	written := 0
+	for retry := 0; ; retry++ {
+		n, err := p.conn.Conn.Write(buf[written:])
+		written += n
+		if err == nil {
+			return written, nil
+		}
+		if !p.isTransientWriteErr(err) || retry == p.writeRetries {
+			return written, err
+		}
+		p.log("W transient write err, %d bytes left: %v", len(buf)-written, err)
+		p.metrics.observePipeEvent(p.upstream, eventWriteRetried)
+		time.Sleep(backoff)
+		backoff *= 2
+		if err := p.conn.SetWriteDeadline(time.Now().Add(p.writeTimeout)); err != nil {
+			return written, err
+		}
+	}
+}
+
+// isTransientWriteErr reports whether the write may succeed when retried: the write deadline was exceeded or the
+// socket buffer is full. Other errors mean the connection is broken, as well as any error of a TLS connection, whose
+// state is corrupted by a timed out write.
+func (p *Pipe) isTransientWriteErr(err error) bool {
+	if p.upstream.transport() == TransportTLS {
+		return false
+	}
+	var netErr net.Error
+	return errors.Is(err, os.ErrDeadlineExceeded) || errors.Is(err, syscall.EAGAIN) ||
+		errors.As(err, &netErr) && netErr.Timeout()
+}
+
+func (p *Pipe) closeWriteLoop(batch []request) {
+	p.drain()
+	p.returnBatch(batch)
+}
+
+// returnBatch hands the requests of the batch back to the driver to be retried through another pipe.
+func (p *Pipe) returnBatch(batch []request) {
+	for _, req := range batch {
+		if p.cache.remove(req.id, req.sender) {
+			p.metrics.observeResurrected(p.upstream)
+			req.sender.errChan <- writeNotReady
+		}
+	}
+}
+
+// drain stops writing to the pipe and closes it after the in-flight requests had a chance to be responded.
+func (p *Pipe) drain() {
+	p.log("draining")
+	p.setWriteReady(false)
+	p.driver.removePipe(p)
+	safeClose(p.doneW)
+	time.AfterFunc(p.finalizeTimeout, func() { safeClose(p.doneR) })
+	p.resurrectReqs()
+}
+
+func (p *Pipe) resurrectReqs() {
+	for {
+		select {
+		case req := <-p.writeChan:
+			if p.cache.remove(req.id, req.sender) {
+				p.log("Resurrecting request (%d)", req.id)
+				p.metrics.observeResurrected(p.upstream)
+				req.sender.errChan <- writeNotReady
+			}
+		default:
+			return
+		}
+	}
+}
+
+// log passes the debug message prefixed by the pipe ID to the logger of the driver, if any.
+func (p *Pipe) log(format string, a ...any) {
+	if p.logger == nil {
+		return
+	}
+	p.logger.Debugf("[%d] "+format, append([]any{p.id}, a...)...)
+}
@@ -0,0 +1,407 @@
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestPipe(t *testing.T, upstream *mockUpstream, driver *mockDriver) *Pipe {
+	t.Helper()
+	pipe := NewPipe(driver, true, upstream.addr(), PipeConfig{metrics: newMetrics("")})
+	require.Equal(t, pipe, waitFor(t, driver.ready))
+	return pipe
+}
+
+func TestPipe_process(t *testing.T) {
+	tests := []struct {
+		name      string
+		behavior  mockBehavior
+		delay     time.Duration
+		wantRcode int
+		wantErr   error
+	}{
+		{
+			name:      "answered",
+			behavior:  mockAnswer,
+			wantRcode: dns.RcodeSuccess,
+		},
+		{
+			name:      "servfail passed to the driver",
+			behavior:  mockServfail,
+			wantRcode: dns.RcodeServerFailure,
+		},
+		{
+			name:      "nxdomain without answers",
+			behavior:  mockNXDomain,
+			wantRcode: dns.RcodeNameError,
+		},
+		{
+			name:      "refused",
+			behavior:  mockRefused,
+			wantRcode: dns.RcodeRefused,
+		},
+		{
+			name:      "formerr without question",
+			behavior:  mockFormerr,
+			wantRcode: dns.RcodeFormatError,
+		},
+		{
+			name:     "dropped query timeouts",
+			behavior: mockDrop,
+			wantErr:  timeoutErr,
+		},
+		{
+			name:     "response with wrong ID is ignored",
+			behavior: mockWrongID,
+			wantErr:  timeoutErr,
+		},
+		{
+			name:     "delayed response timeouts",
+			behavior: mockAnswer,
+			delay:    300 * time.Millisecond,
+			wantErr:  timeoutErr,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstream := newMockUpstream(t)
+			upstream.setBehavior(tt.behavior)
+			upstream.setDelay(tt.delay)
+			pipe := newTestPipe(t, upstream, newMockDriver())
+			defer pipe.drain()
+
+			msg := newQuery("example.org")
+			id := msg.Id
+			resp, err := pipe.process(context.Background(), msg, 100*time.Millisecond)
+			assert.Equal(t, id, msg.Id, "message ID must be restored")
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+				assert.Equal(t, 0, pipe.cache.len())
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, id, resp.Id)
+			assert.Equal(t, tt.wantRcode, resp.Rcode)
+		})
+	}
+}
+
+func TestPipe_processPipelined(t *testing.T) {
+	upstream := newMockUpstream(t)
+	upstream.setDelay(20 * time.Millisecond)
+	pipe := newTestPipe(t, upstream, newMockDriver())
+	defer pipe.drain()
+
+	const queries = 100
+	errs := make(chan error, queries)
+	for i := 0; i < queries; i++ {
+		go func() {
+			_, err := pipe.process(context.Background(), newQuery("example.org"), time.Second)
+			errs <- err
+		}()
+	}
+	for i := 0; i < queries; i++ {
+		assert.NoError(t, <-errs)
+	}
+	assert.EqualValues(t, 1, upstream.accepted.Load(), "queries are expected to share the connection")
+}
+
+func TestPipe_processCancelled(t *testing.T) {
+	upstream := newMockUpstream(t)
+	upstream.setBehavior(mockDrop)
+	pipe := newTestPipe(t, upstream, newMockDriver())
+	defer pipe.drain()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err := pipe.process(ctx, newQuery("example.org"), time.Second)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Equal(t, 0, pipe.cache.len())
+}
+
+func TestPipe_initFailed(t *testing.T) {
+	upstream := newMockUpstream(t)
+	addr := upstream.addr()
+	upstream.close()
+
+	driver := newMockDriver()
+	pipe := NewPipe(driver, true, addr, PipeConfig{metrics: newMetrics("")})
+	assert.Equal(t, pipe, waitFor(t, driver.initFailed))
+	assert.Equal(t, 1.0, pipeEvents(pipe, eventDialFailed))
+	assert.Equal(t, 0.0, pipeEvents(pipe, eventCreated))
+}
+
+// pipeEvents returns the number of the events counted by the pipe.
+func pipeEvents(pipe *Pipe, event string) float64 {
+	return testutil.ToFloat64(pipe.metrics.pipeEventCount.WithLabelValues(pipe.upstream.String(), event))
+}
+
+func TestPipe_connectionReset(t *testing.T) {
+	upstream := newMockUpstream(t)
+	driver := newMockDriver()
+	pipe := newTestPipe(t, upstream, driver)
+
+	upstream.resetOnce()
+	_, err := pipe.process(context.Background(), newQuery("example.org"), 100*time.Millisecond)
+	assert.ErrorIs(t, err, timeoutErr)
+	assert.Equal(t, pipe, waitFor(t, driver.removed))
+	assert.False(t, pipe.isWriteReady())
+	assert.Equal(t, 1.0, pipeEvents(pipe, eventCreated))
+	assert.Equal(t, 1.0, pipeEvents(pipe, eventReadError))
+
+	_, err = pipe.process(context.Background(), newQuery("example.org"), 100*time.Millisecond)
+	assert.ErrorIs(t, err, writeNotReady)
+}
+
+func TestPipe_resurrectReqs(t *testing.T) {
+	// a pipe without the write loop running, so the request stays queued
+	pipe := &Pipe{
+		cache:      SenderCache{cache: make(map[uint16]*Sender)},
+		writeChan:  make(chan request),
+		writeReady: true,
+	}
+	errs := make(chan error, 1)
+	go func() {
+		_, err := pipe.process(context.Background(), newQuery("example.org"), time.Second)
+		errs <- err
+	}()
+
+	var err error
+	require.Eventually(t, func() bool {
+		pipe.resurrectReqs()
+		select {
+		case err = <-errs:
+			return true
+		default:
+			return false
+		}
+	}, time.Second, time.Millisecond)
+	assert.ErrorIs(t, err, writeNotReady)
+	assert.Equal(t, 0, pipe.cache.len())
+}
+
+func TestPipe_processWriteBlocked(t *testing.T) {
+	tests := []struct {
+		name    string
+		closed  bool
+		wantErr error
+	}{
+		{name: "timeout", wantErr: timeoutErr},
+		{name: "writer closed", closed: true, wantErr: writeNotReady},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// a pipe without the write loop running, the request can't be written with the uncancellable context
+			pipe := &Pipe{
+				cache:      SenderCache{cache: make(map[uint16]*Sender)},
+				writeChan:  make(chan request),
+				doneW:      make(chan struct{}),
+				writeReady: true,
+			}
+			if tt.closed {
+				close(pipe.doneW)
+			}
+			msg := newQuery("example.org")
+			msg.Id = 42
+			_, err := pipe.process(context.Background(), msg, 50*time.Millisecond)
+			assert.ErrorIs(t, err, tt.wantErr)
+			assert.Equal(t, uint16(42), msg.Id)
+			assert.Equal(t, 0, pipe.cache.len())
+		})
+	}
+}
+
+func TestPipe_idleExpiry(t *testing.T) {
+	upstream := newMockUpstream(t)
+	driver := newMockDriver()
+	pipe := NewPipe(driver, true, upstream.addr(), PipeConfig{IdleTimeout: 100 * time.Millisecond})
+	waitFor(t, driver.ready)
+
+	assert.Equal(t, pipe, waitFor(t, driver.removed))
+	assert.Equal(t, pipe, waitFor(t, driver.expired))
+}
+
+func TestPipe_stress(t *testing.T) {
+	upstream := newMockUpstream(t)
+	upstream.setDelay(time.Millisecond)
+	pipe := newTestPipe(t, upstream, newMockDriver())
+	defer pipe.drain()
+
+	const workers, queries = 16, 200
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < queries; i++ {
+				msg := newQuery(fmt.Sprintf("q%d-%d.example.org", w, i))
+				id := msg.Id
+				resp, err := pipe.process(context.Background(), msg, time.Second)
+				if assert.NoError(t, err) {
+					assert.Equal(t, id, resp.Id)
+					assert.Equal(t, msg.Question[0].Name, resp.Question[0].Name)
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	assert.Equal(t, 0, pipe.cache.len())
+}
+
+func BenchmarkPipe_process(b *testing.B) {
+	upstream := newMockUpstream(b)
+	driver := newMockDriver()
+	pipe := NewPipe(driver, true, upstream.addr(), PipeConfig{})
+	<-driver.ready
+	defer pipe.drain()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if _, err := pipe.process(context.Background(), newQuery("example.org"), time.Second); err != nil {
+				b.Error(err)
+			}
+		}
+	})
+	b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "queries/s")
+}
+
+func TestPipe_idleReap(t *testing.T) {
+	upstream := newMockUpstream(t)
+	driver := newMockDriver()
+	pipe := NewPipe(driver, true, upstream.addr(), PipeConfig{ReapTimeout: 100 * time.Millisecond,
+		metrics: newMetrics("")})
+	waitFor(t, driver.ready)
+
+	assert.Equal(t, pipe, waitFor(t, driver.removed))
+	assert.False(t, pipe.isWriteReady())
+	assert.Equal(t, 1.0, pipeEvents(pipe, eventReaped))
+	select {
+	case <-driver.expired:
+		t.Fatal("reaped pipe must not be replaced")
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestPipe_sweepOverdue(t *testing.T) {
+	upstream := newMockUpstream(t)
+	driver := newMockDriver()
+	pipe := newTestPipe(t, upstream, driver)
+
+	// a request whose waiter is gone without removing it
+	_, _, err := pipe.cache.add(time.Now().Add(-pipe.sweepInterval))
+	require.NoError(t, err)
+	require.Eventually(t, func() bool { return pipe.outstanding() == 0 }, 3*pipe.sweepInterval, 10*time.Millisecond)
+	assert.Equal(t, 1.0, testutil.ToFloat64(pipe.metrics.evictionCount.WithLabelValues(upstream.addr().String())))
+}
+
+// scriptedConn is a connection whose writes return the scripted results, the writes beyond the script succeed.
+type scriptedConn struct {
+	net.Conn
+	script  []scriptedWrite
+	written []byte
+}
+
+type scriptedWrite struct {
+	n   int
+	err error
+}
+
+func (c *scriptedConn) Write(b []byte) (int, error) {
+	if len(c.script) == 0 {
+		c.written = append(c.written, b...)
+		return len(b), nil
+	}
+	w := c.script[0]
+	c.script = c.script[1:]
+	c.written = append(c.written, b[:w.n]...)
+	return w.n, w.err
+}
+
+func (c *scriptedConn) SetWriteDeadline(time.Time) error {
+	return nil
+}
+
+func TestPipe_writeAll(t *testing.T) {
+	data := []byte("0123456789")
+	timeout := scriptedWrite{err: os.ErrDeadlineExceeded}
+	tests := []struct {
+		name        string
+		script      []scriptedWrite
+		wantWritten int
+		wantErr     error
+	}{
+		{
+			name:        "complete",
+			wantWritten: len(data),
+		},
+		{
+			name:        "resumed after partial write",
+			script:      []scriptedWrite{{n: 3, err: os.ErrDeadlineExceeded}, {n: 4, err: syscall.EAGAIN}},
+			wantWritten: len(data),
+		},
+		{
+			name:        "fatal error",
+			script:      []scriptedWrite{{n: 3, err: syscall.ECONNRESET}},
+			wantWritten: 3,
+			wantErr:     syscall.ECONNRESET,
+		},
+		{
+			name:    "retries exhausted",
+			script:  []scriptedWrite{timeout, timeout, timeout, timeout},
+			wantErr: os.ErrDeadlineExceeded,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := &scriptedConn{script: tt.script}
+			pipe := &Pipe{conn: &dns.Conn{Conn: conn}, writeRetries: 3, writeBackoff: time.Microsecond}
+			written, err := pipe.writeAll(data)
+			assert.ErrorIs(t, err, tt.wantErr)
+			assert.Equal(t, tt.wantWritten, written)
+			assert.Equal(t, string(data[:tt.wantWritten]), string(conn.written))
+		})
+	}
+}
+
+func TestPipe_hostname(t *testing.T) {
+	upstream := newMockUpstream(t)
+	driver := newMockDriver()
+	cfg := upstream.addr()
+	cfg.Hostname = "localhost"
+	pipe := NewPipe(driver, true, cfg, PipeConfig{FallbackDelay: 50 * time.Millisecond})
+	require.Equal(t, pipe, waitFor(t, driver.ready))
+
+	resp, err := pipe.process(context.Background(), newQuery("example.org"), time.Second)
+	require.NoError(t, err)
+	assert.Equal(t, dns.RcodeSuccess, resp.Rcode)
+}
+
+func TestPipe_abandonedResponse(t *testing.T) {
+	upstream := newMockUpstream(t)
+	driver := newMockDriver()
+	pipe := newTestPipe(t, upstream, driver)
+
+	// the response of a request whose waiter is gone must not block the delivery of the others
+	abandoned := newQuery("abandoned.example.org")
+	req, err := pipe.newRequest(abandoned, time.Second)
+	require.NoError(t, err)
+	pipe.writeChan <- req
+	require.Eventually(t, func() bool { return pipe.outstanding() == 0 }, time.Second, time.Millisecond)
+
+	resp, err := pipe.process(context.Background(), newQuery("example.org"), time.Second)
+	require.NoError(t, err)
+	assert.Equal(t, dns.RcodeSuccess, resp.Rcode)
+}
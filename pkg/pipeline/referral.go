@@ -0,0 +1,54 @@
+package pipeline
+
+import (
+	"github.com/miekg/dns"
+)
+
+// ReferralPolicy decides what happens to the referrals and other authority-only responses, which an authoritative
+// upstream returns instead of the answer a recursive one would resolve.
+type ReferralPolicy int
+
+const (
+	// ReferralPass returns the referrals as they are.
+	ReferralPass ReferralPolicy = iota
+	// ReferralServfail replaces the referrals by SERVFAIL.
+	ReferralServfail
+	// ReferralRetry retries the referrals on another upstream, the last one is replaced by SERVFAIL.
+	ReferralRetry
+)
+
+// isReferral reports whether the response has no answer, but carries authority or additional records. NODATA and
+// NXDOMAIN responses are recognized by the SOA record in the authority section.
+func isReferral(resp *dns.Msg) bool {
+	if resp == nil || resp.Rcode != dns.RcodeSuccess || len(resp.Answer) > 0 {
+		return false
+	}
+	for _, rr := range resp.Ns {
+		if rr.Header().Rrtype == dns.TypeSOA {
+			return false
+		}
+	}
+	if len(resp.Ns) > 0 {
+		return true
+	}
+	for _, rr := range resp.Extra {
+		if rr.Header().Rrtype != dns.TypeOPT {
+			return true
+		}
+	}
+	return false
+}
+
+// toServfail turns the referral into SERVFAIL, keeping only the OPT record.
+func toServfail(resp *dns.Msg) {
+	resp.Rcode = dns.RcodeServerFailure
+	resp.Authoritative = false
+	resp.Ns = nil
+	extra := resp.Extra[:0]
+	for _, rr := range resp.Extra {
+		if rr.Header().Rrtype == dns.TypeOPT {
+			extra = append(extra, rr)
+		}
+	}
+	resp.Extra = extra
+}
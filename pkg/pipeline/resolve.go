@@ -0,0 +1,267 @@
+package pipeline
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	hostsPath      = "/etc/hosts"
+	resolvConfPath = "/etc/resolv.conf"
+	resolveTimeout = 2 * time.Second
+)
+
+// upstreamResolver resolves the hostnames of the upstreams of all the drivers.
+var upstreamResolver = newHostResolver()
+
+// hostResolver caches the addresses of the upstream hostnames for the TTL of their records. The hostnames are resolved
+// again by the next dial after the TTL expires, so the change of the upstream addresses is picked up by the new pipes.
+// When the resolution fails, the expired addresses are used.
+type hostResolver struct {
+	lock    sync.Mutex
+	entries map[string]resolvedHost
+	lookup  func(ctx context.Context, host string) ([]netip.Addr, time.Duration, error)
+}
+
+type resolvedHost struct {
+	addrs   []netip.Addr
+	expires time.Time
+}
+
+func newHostResolver() *hostResolver {
+	return &hostResolver{entries: make(map[string]resolvedHost), lookup: lookupHost}
+}
+
+// resolve returns the addresses of the host, IPv6 ones first.
+func (r *hostResolver) resolve(ctx context.Context, host string) ([]netip.Addr, error) {
+	if addr, err := netip.ParseAddr(host); err == nil {
+		return []netip.Addr{addr}, nil
+	}
+	r.lock.Lock()
+	entry, cached := r.entries[host]
+	r.lock.Unlock()
+	if cached && time.Now().Before(entry.expires) {
+		return entry.addrs, nil
+	}
+
+	addrs, ttl, err := r.lookup(ctx, host)
+	if err == nil && len(addrs) == 0 {
+		err = fmt.Errorf("no address found for %s", host)
+	}
+	if err != nil {
+		if cached {
+			return entry.addrs, nil
+		}
+		return nil, err
+	}
+	r.lock.Lock()
+	r.entries[host] = resolvedHost{addrs: addrs, expires: time.Now().Add(ttl)}
+	r.lock.Unlock()
+	return addrs, nil
+}
+
+// lookupHost resolves the host by /etc/hosts, or by querying the nameservers of /etc/resolv.conf for AAAA and A
+// records. The TTL is the lowest one of the records, the addresses of /etc/hosts are not cached.
+func lookupHost(ctx context.Context, host string) ([]netip.Addr, time.Duration, error) {
+	if addrs := lookupHostsFile(hostsPath, host); len(addrs) > 0 {
+		return addrs, 0, nil
+	}
+	cfg, err := dns.ClientConfigFromFile(resolvConfPath)
+	if err != nil {
+		addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+		return addrs, 0, err
+	}
+
+	var addrs []netip.Addr
+	var ttl uint32
+	first := true
+	for _, qtype := range []uint16{dns.TypeAAAA, dns.TypeA} {
+		resp, err := queryNameservers(ctx, cfg, host, qtype)
+		if err != nil {
+			return nil, 0, err
+		}
+		for _, rr := range resp.Answer {
+			var ip net.IP
+			switch rr := rr.(type) {
+			case *dns.AAAA:
+				ip = rr.AAAA
+			case *dns.A:
+				ip = rr.A
+			default:
+				continue
+			}
+			if addr, ok := netip.AddrFromSlice(ip); ok {
+				addrs = append(addrs, addr.Unmap())
+			}
+			if first || rr.Header().Ttl < ttl {
+				ttl, first = rr.Header().Ttl, false
+			}
+		}
+	}
+	return addrs, time.Duration(ttl) * time.Second, nil
+}
+
+// queryNameservers asks the nameservers in turn until one of them responds.
+func queryNameservers(ctx context.Context, cfg *dns.ClientConfig, host string, qtype uint16) (*dns.Msg, error) {
+	msg := new(dns.Msg)
+	msg.SetQuestion(dns.Fqdn(host), qtype)
+	var err error
+	for _, server := range cfg.Servers {
+		var resp *dns.Msg
+		if resp, err = queryNameserver(ctx, msg, net.JoinHostPort(server, cfg.Port)); err == nil {
+			return resp, nil
+		}
+	}
+	return nil, fmt.Errorf("resolving %s failed: %w", host, err)
+}
+
+// queryNameserver asks the nameserver over UDP and retries the truncated response over TCP. The responses other than
+// NOERROR and NXDOMAIN are errors, as they don't tell whether the host has any address.
+func queryNameserver(ctx context.Context, msg *dns.Msg, server string) (*dns.Msg, error) {
+	client := dns.Client{Timeout: resolveTimeout}
+	resp, _, err := client.ExchangeContext(ctx, msg, server)
+	if err == nil && resp.Truncated {
+		client.Net = "tcp"
+		resp, _, err = client.ExchangeContext(ctx, msg, server)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if resp.Rcode != dns.RcodeSuccess && resp.Rcode != dns.RcodeNameError {
+		return nil, fmt.Errorf("nameserver %s responded %s", server, dns.RcodeToString[resp.Rcode])
+	}
+	return resp, nil
+}
+
+// lookupHostsFile returns the addresses of the host listed in the hosts file.
+func lookupHostsFile(path string, host string) []netip.Addr {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	var addrs []netip.Addr
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		addr, err := netip.ParseAddr(fields[0])
+		if err != nil {
+			continue
+		}
+		for _, name := range fields[1:] {
+			if strings.EqualFold(strings.TrimSuffix(name, "."), strings.TrimSuffix(host, ".")) {
+				addrs = append(addrs, addr.Unmap())
+				break
+			}
+		}
+	}
+	return addrs
+}
+
+// dialHost dials the address given by the hostname and port, the hostname is resolved by upstreamResolver.
+func dialHost(ctx context.Context, dialer *net.Dialer, network string, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := upstreamResolver.resolve(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	return dialAddrs(ctx, dialer, network, addrs, port)
+}
+
+// dialAddrs races the IPv6 addresses against the IPv4 ones, which are dialed after the fallback delay of the dialer
+// (Happy Eyeballs, RFC 8305). The connection established first is returned, the other one is closed. The UDP addresses
+// are not raced, the first one is used.
+func dialAddrs(ctx context.Context, dialer *net.Dialer, network string, addrs []netip.Addr,
+	port string) (net.Conn, error) {
+	var primaries, fallbacks []string
+	for _, addr := range addrs {
+		if addr.Is6() {
+			primaries = append(primaries, net.JoinHostPort(addr.String(), port))
+		} else {
+			fallbacks = append(fallbacks, net.JoinHostPort(addr.String(), port))
+		}
+	}
+	if len(primaries) == 0 || len(fallbacks) == 0 || network == "udp" {
+		return dialSerial(ctx, dialer, network, append(primaries, fallbacks...))
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	type dialResult struct {
+		conn net.Conn
+		err  error
+	}
+	results := make(chan dialResult, 2)
+	race := func(addrs []string) {
+		conn, err := dialSerial(ctx, dialer, network, addrs)
+		results <- dialResult{conn: conn, err: err}
+	}
+	go race(primaries)
+	fallbackDelay := dialer.FallbackDelay
+	if fallbackDelay <= 0 {
+		fallbackDelay = defaultFallbackDelay
+	}
+	fallbackTimer := time.NewTimer(fallbackDelay)
+	defer fallbackTimer.Stop()
+
+	pending, fallbackStarted := 1, false
+	var firstErr error
+	for pending > 0 || !fallbackStarted {
+		select {
+		case <-fallbackTimer.C:
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				if pending > 0 {
+					// the loser is closed once it connects
+					go func() {
+						if r := <-results; r.conn != nil {
+							r.conn.Close()
+						}
+					}()
+				}
+				return r.conn, nil
+			}
+			if firstErr == nil {
+				firstErr = r.err
+			}
+		}
+		if !fallbackStarted {
+			fallbackStarted = true
+			pending++
+			go race(fallbacks)
+		}
+	}
+	return nil, firstErr
+}
+
+// dialSerial dials the addresses in turn until a connection is established.
+func dialSerial(ctx context.Context, dialer *net.Dialer, network string, addrs []string) (net.Conn, error) {
+	var err error
+	for _, addr := range addrs {
+		var conn net.Conn
+		if conn, err = dialer.DialContext(ctx, network, addr); err == nil {
+			return conn, nil
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+	}
+	return nil, err
+}
@@ -0,0 +1,145 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHostResolver_resolve(t *testing.T) {
+	addrs := []netip.Addr{netip.MustParseAddr("2001:db8::1"), netip.MustParseAddr("192.0.2.1")}
+	var lookups int
+	var lookupErr error
+	resolver := newHostResolver()
+	resolver.lookup = func(ctx context.Context, host string) ([]netip.Addr, time.Duration, error) {
+		lookups++
+		return addrs, 50 * time.Millisecond, lookupErr
+	}
+
+	got, err := resolver.resolve(context.Background(), "192.0.2.2")
+	require.NoError(t, err)
+	assert.Equal(t, []netip.Addr{netip.MustParseAddr("192.0.2.2")}, got)
+	assert.Zero(t, lookups, "IP addresses are not looked up")
+
+	for i := 0; i < 2; i++ {
+		got, err = resolver.resolve(context.Background(), "dns.example")
+		require.NoError(t, err)
+		assert.Equal(t, addrs, got)
+	}
+	assert.Equal(t, 1, lookups, "addresses are cached for the TTL")
+
+	time.Sleep(60 * time.Millisecond)
+	lookupErr = errors.New("resolution failed")
+	got, err = resolver.resolve(context.Background(), "dns.example")
+	require.NoError(t, err)
+	assert.Equal(t, addrs, got, "expired addresses are used when the resolution fails")
+	assert.Equal(t, 2, lookups)
+
+	_, err = resolver.resolve(context.Background(), "other.example")
+	assert.Error(t, err)
+}
+
+func TestQueryNameserver(t *testing.T) {
+	// the hosts are answered by their rcode, the truncated answer is sent whole over TCP only
+	handler := dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		resp := new(dns.Msg)
+		resp.SetReply(r)
+		switch r.Question[0].Name {
+		case "servfail.example.":
+			resp.Rcode = dns.RcodeServerFailure
+		case "nxdomain.example.":
+			resp.Rcode = dns.RcodeNameError
+		case "truncated.example.":
+			resp.Answer = append(resp.Answer, &dns.A{
+				Hdr: dns.RR_Header{Name: r.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+				A:   net.IPv4(192, 0, 2, 1),
+			})
+			if _, ok := w.RemoteAddr().(*net.UDPAddr); ok {
+				resp.Answer = nil
+				resp.Truncated = true
+			}
+		}
+		w.WriteMsg(resp)
+	})
+	server := net.JoinHostPort("127.0.0.1", strconv.Itoa(startUDPAndTCP(t, handler)))
+
+	tests := []struct {
+		host        string
+		wantAnswers int
+		wantErr     bool
+	}{
+		{host: "truncated.example", wantAnswers: 1},
+		{host: "nxdomain.example"},
+		{host: "servfail.example", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			msg := new(dns.Msg)
+			msg.SetQuestion(dns.Fqdn(tt.host), dns.TypeA)
+			resp, err := queryNameserver(context.Background(), msg, server)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.False(t, resp.Truncated)
+			assert.Len(t, resp.Answer, tt.wantAnswers)
+		})
+	}
+}
+
+func TestLookupHostsFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hosts")
+	hosts := "127.0.0.1 localhost\n::1 localhost ip6-localhost # loopback\n192.0.2.1 dns.example\n"
+	require.NoError(t, os.WriteFile(path, []byte(hosts), 0o644))
+
+	assert.Equal(t, []netip.Addr{netip.MustParseAddr("127.0.0.1"), netip.MustParseAddr("::1")},
+		lookupHostsFile(path, "localhost"))
+	assert.Equal(t, []netip.Addr{netip.MustParseAddr("192.0.2.1")}, lookupHostsFile(path, "DNS.example."))
+	assert.Empty(t, lookupHostsFile(path, "other.example"))
+}
+
+func TestDialAddrs(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+	port := strconv.Itoa(listener.Addr().(*net.TCPAddr).Port)
+	// 100::/64 is the discard prefix, so the IPv6 attempt never succeeds
+	unreachable := netip.MustParseAddr("100::1")
+	reachable := netip.MustParseAddr("127.0.0.1")
+
+	tests := []struct {
+		name    string
+		addrs   []netip.Addr
+		wantErr bool
+	}{
+		{name: "IPv4 only", addrs: []netip.Addr{reachable}},
+		{name: "IPv6 unreachable", addrs: []netip.Addr{unreachable, reachable}},
+		{name: "all unreachable", addrs: []netip.Addr{unreachable}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dialer := &net.Dialer{Timeout: 500 * time.Millisecond, FallbackDelay: 20 * time.Millisecond}
+			start := time.Now()
+			conn, err := dialAddrs(context.Background(), dialer, "tcp", tt.addrs, port)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			defer conn.Close()
+			assert.Equal(t, "127.0.0.1", conn.RemoteAddr().(*net.TCPAddr).IP.String())
+			assert.Less(t, time.Since(start), dialer.Timeout, "IPv4 must not wait for the IPv6 attempt to time out")
+		})
+	}
+}
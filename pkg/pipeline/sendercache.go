@@ -0,0 +1,124 @@
+package pipeline
+
+import (
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+type SenderCache struct {
+	cache     map[uint16]*Sender
+	cacheLock sync.Mutex
+	// free holds the message IDs not used by any in-flight request, the IDs are picked from it at random so they cannot
+	// be predicted by a spoofer, it is filled on the first allocation
+	free []uint16
+	// limit caps the number of requests in flight, 0 means only the message ID space limits it
+	limit int
+}
+
+// Sender delivers the outcome of a request to its waiter. Whoever removes the sender from the cache sends exactly one
+// response or error, the channels are buffered, so the delivery never blocks the read or write loop even if the waiter
+// is gone, e.g. it timed out or was cancelled right after the response was read.
+type Sender struct {
+	responseChan chan *dns.Msg
+	errChan      chan error
+	// deadline is the time the request is not waited for anymore
+	deadline time.Time
+}
+
+// add allocates a message ID not used by any in-flight request and registers the sender of the request under it.
+func (c *SenderCache) add(deadline time.Time) (uint16, *Sender, error) {
+	c.cacheLock.Lock()
+	defer c.cacheLock.Unlock()
+	id, ok := c.allocateID()
+	if !ok {
+		return 0, nil, pipeSaturated
+	}
+	s := &Sender{
+		responseChan: make(chan *dns.Msg, 1),
+		errChan:      make(chan error, 1),
+		deadline:     deadline,
+	}
+	c.cache[id] = s
+	return id, s, nil
+}
+
+// allocateID removes a random message ID from the free ones and returns it. Expects cacheLock to be held.
+func (c *SenderCache) allocateID() (uint16, bool) {
+	if c.free == nil {
+		c.free = make([]uint16, 0, math.MaxUint16+1)
+		for id := 0; id <= math.MaxUint16; id++ {
+			if _, used := c.cache[uint16(id)]; !used {
+				c.free = append(c.free, uint16(id))
+			}
+		}
+	}
+	if len(c.free) == 0 || (c.limit > 0 && len(c.cache) >= c.limit) {
+		return 0, false
+	}
+	i := rand.Intn(len(c.free))
+	id := c.free[i]
+	last := len(c.free) - 1
+	c.free[i] = c.free[last]
+	c.free = c.free[:last]
+	return id, true
+}
+
+// release removes the sender registered under the ID and returns the ID to the free ones. Expects cacheLock to be held.
+func (c *SenderCache) release(id uint16) {
+	delete(c.cache, id)
+	c.free = append(c.free, id)
+}
+
+func (c *SenderCache) getAndRemove(id uint16) *Sender {
+	c.cacheLock.Lock()
+	defer c.cacheLock.Unlock()
+	sender, ok := c.cache[id]
+	if !ok {
+		return nil
+	}
+	c.release(id)
+	return sender
+}
+
+// remove removes the sender registered under the ID, unless the ID was released and allocated to another request
+// meanwhile. Reports whether the sender was removed.
+func (c *SenderCache) remove(id uint16, sender *Sender) bool {
+	c.cacheLock.Lock()
+	defer c.cacheLock.Unlock()
+	if c.cache[id] != sender {
+		return false
+	}
+	c.release(id)
+	return true
+}
+
+// owns reports whether the sender is still registered under the ID.
+func (c *SenderCache) owns(id uint16, sender *Sender) bool {
+	c.cacheLock.Lock()
+	defer c.cacheLock.Unlock()
+	return c.cache[id] == sender
+}
+
+// expire removes the senders whose deadline passed before the time and returns them.
+func (c *SenderCache) expire(before time.Time) []*Sender {
+	c.cacheLock.Lock()
+	defer c.cacheLock.Unlock()
+	var expired []*Sender
+	for id, sender := range c.cache {
+		if sender.deadline.Before(before) {
+			c.release(id)
+			expired = append(expired, sender)
+		}
+	}
+	return expired
+}
+
+func (c *SenderCache) len() int {
+	c.cacheLock.Lock()
+	defer c.cacheLock.Unlock()
+	return len(c.cache)
+}
@@ -0,0 +1,112 @@
+package pipeline
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSenderCache_add(t *testing.T) {
+	cache := SenderCache{cache: make(map[uint16]*Sender)}
+
+	id, sender, err := cache.add(time.Time{})
+	require.NoError(t, err)
+	assert.True(t, cache.owns(id, sender))
+	assert.Equal(t, sender, cache.getAndRemove(id))
+	assert.Nil(t, cache.getAndRemove(id))
+	assert.False(t, cache.owns(id, sender))
+}
+
+func TestSenderCache_remove(t *testing.T) {
+	cache := SenderCache{cache: make(map[uint16]*Sender)}
+	id, sender, err := cache.add(time.Time{})
+	require.NoError(t, err)
+
+	// the ID reallocated to another request is not removed by the previous owner
+	other := &Sender{}
+	cache.cache[id] = other
+	assert.False(t, cache.remove(id, sender))
+	assert.True(t, cache.remove(id, other))
+	assert.Equal(t, 0, cache.len())
+}
+
+func TestSenderCache_saturated(t *testing.T) {
+	cache := SenderCache{cache: make(map[uint16]*Sender)}
+	for i := 0; i <= 0xFFFF; i++ {
+		_, _, err := cache.add(time.Time{})
+		require.NoError(t, err)
+	}
+	_, _, err := cache.add(time.Time{})
+	assert.ErrorIs(t, err, pipeSaturated)
+
+	// the released ID is the only free one
+	assert.NotNil(t, cache.getAndRemove(0x1234))
+	id, _, err := cache.add(time.Time{})
+	require.NoError(t, err)
+	assert.Equal(t, uint16(0x1234), id)
+}
+
+func TestSenderCache_randomIDs(t *testing.T) {
+	cache := SenderCache{cache: make(map[uint16]*Sender)}
+	sequential := 0
+	var prev uint16
+	for i := 0; i < 100; i++ {
+		id, _, err := cache.add(time.Time{})
+		require.NoError(t, err)
+		if i > 0 && id == prev+1 {
+			sequential++
+		}
+		prev = id
+		if i%2 == 0 {
+			cache.getAndRemove(id)
+		}
+	}
+	assert.Less(t, sequential, 10)
+	assert.Len(t, cache.free, 0x10000-cache.len())
+}
+
+func TestSenderCache_limit(t *testing.T) {
+	cache := SenderCache{cache: make(map[uint16]*Sender), limit: 2}
+	var id uint16
+	for i := 0; i < 2; i++ {
+		var err error
+		id, _, err = cache.add(time.Time{})
+		require.NoError(t, err)
+	}
+	_, _, err := cache.add(time.Time{})
+	assert.ErrorIs(t, err, pipeSaturated)
+
+	cache.getAndRemove(id)
+	_, _, err = cache.add(time.Time{})
+	assert.NoError(t, err)
+}
+
+func TestSenderCache_expire(t *testing.T) {
+	cache := SenderCache{cache: make(map[uint16]*Sender)}
+	now := time.Now()
+	overdue, overdueSender, err := cache.add(now.Add(-time.Second))
+	require.NoError(t, err)
+	current, _, err := cache.add(now.Add(time.Second))
+	require.NoError(t, err)
+
+	assert.Equal(t, []*Sender{overdueSender}, cache.expire(now))
+	assert.Empty(t, cache.expire(now))
+	assert.Nil(t, cache.getAndRemove(overdue))
+	assert.NotNil(t, cache.getAndRemove(current))
+}
+
+func BenchmarkSenderCache(b *testing.B) {
+	cache := SenderCache{cache: make(map[uint16]*Sender)}
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			id, _, err := cache.add(time.Time{})
+			if err != nil {
+				b.Fatal(err)
+			}
+			cache.getAndRemove(id)
+		}
+	})
+}
@@ -0,0 +1,154 @@
+package pipeline
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// standby periodically probes the secondary pipes kept in warm standby until the driver is closed. The pipes are
+// established by the first load of the pool and receive no traffic while a primary pipe is available, so they are
+// taking it over instantly when the primaries fail.
+func (pd *Driver) standby() {
+	ticker := time.NewTicker(pd.healthCheck.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-pd.done:
+			return
+		case <-ticker.C:
+			pd.probeStandby()
+		}
+	}
+}
+
+// probeStandby probes the secondary pipes concurrently. An unhealthy upstream passes the round of the probes if all
+// its pipes pass them. When all the primary pipes are gone, the pool is loaded again, so the traffic returns to
+// the primaries once they are back.
+func (pd *Driver) probeStandby() {
+	var standby []*Pipe
+	pd.pipesLock.RLock()
+	for _, pipe := range pd.pipes {
+		if !pipe.primary {
+			standby = append(standby, pipe)
+		}
+	}
+	if primary, _ := pd.countPipes(); primary == 0 && len(pd.pipes) > 0 {
+		pd.loadPipes()
+	}
+	pd.pipesLock.RUnlock()
+
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	passed := make(map[ConnConfig]bool)
+	for _, pipe := range standby {
+		wg.Add(1)
+		go func(pipe *Pipe) {
+			defer wg.Done()
+			healthy := pd.probe(pipe)
+			lock.Lock()
+			defer lock.Unlock()
+			if previous, ok := passed[pipe.upstream]; ok {
+				healthy = healthy && previous
+			}
+			passed[pipe.upstream] = healthy
+		}(pipe)
+	}
+	wg.Wait()
+
+	for upstream, healthy := range passed {
+		if healthy {
+			pd.recover(upstream)
+		} else {
+			pd.restartRecovery(upstream)
+		}
+	}
+}
+
+// probe queries the health check name through the pipe, the pipe failing the probes repeatedly is replaced by
+// a new one and its upstream is marked unhealthy. Any response but SERVFAIL passes the probe, reported by the result.
+func (pd *Driver) probe(pipe *Pipe) bool {
+	msg := new(dns.Msg)
+	msg.SetQuestion(dns.Fqdn(pd.healthCheck.Qname), pd.healthCheck.Qtype)
+	resp, err := pipe.process(context.Background(), msg, pd.healthCheck.Timeout)
+	healthy := err == nil && resp.Rcode != dns.RcodeServerFailure
+	pd.metrics.observeProbe(pipe.upstream, healthy)
+	if healthy {
+		pipe.probeFailures.Store(0)
+		return true
+	}
+	failures := pipe.probeFailures.Add(1)
+	pipe.log("standby probe failed (%d/%d): %v", failures, pd.healthCheck.Failures, err)
+	if int(failures) < pd.healthCheck.Failures {
+		return false
+	}
+	pd.markUnhealthy(pipe.upstream)
+	if pd.isClosed() {
+		return false
+	}
+	pipe.log("standby probes failed -> replacing pipe")
+	pd.metrics.observePipeEvent(pipe.upstream, eventProbeFailed)
+	pipe.drain()
+	pd.replacePipe(pipe)
+	return false
+}
+
+// markUnhealthy excludes the standby pipes to the upstream from the failover until the upstream recovers.
+func (pd *Driver) markUnhealthy(upstream ConnConfig) {
+	pd.healthLock.Lock()
+	defer pd.healthLock.Unlock()
+	if _, unhealthy := pd.unhealthy[upstream]; !unhealthy {
+		pd.log("Driver: upstream %s unhealthy", upstream)
+	}
+	pd.unhealthy[upstream] = 0
+}
+
+// restartRecovery resets the successful rounds of the probes counted by the unhealthy upstream after a failed one.
+func (pd *Driver) restartRecovery(upstream ConnConfig) {
+	pd.healthLock.Lock()
+	defer pd.healthLock.Unlock()
+	if _, unhealthy := pd.unhealthy[upstream]; unhealthy {
+		pd.unhealthy[upstream] = 0
+	}
+}
+
+// recover counts the successful round of the probes of the unhealthy upstream, which is healthy again after
+// HealthCheckConfig.Recoveries rounds in a row.
+func (pd *Driver) recover(upstream ConnConfig) {
+	pd.healthLock.Lock()
+	defer pd.healthLock.Unlock()
+	successes, unhealthy := pd.unhealthy[upstream]
+	if !unhealthy {
+		return
+	}
+	if successes+1 < pd.healthCheck.Recoveries {
+		pd.unhealthy[upstream] = successes + 1
+		return
+	}
+	pd.log("Driver: upstream %s recovered", upstream)
+	delete(pd.unhealthy, upstream)
+}
+
+func (pd *Driver) isHealthy(upstream ConnConfig) bool {
+	pd.healthLock.Lock()
+	defer pd.healthLock.Unlock()
+	_, unhealthy := pd.unhealthy[upstream]
+	return !unhealthy
+}
+
+// healthyPipes returns the pipes to the healthy upstreams, or all of them if there is none. Expects pipesLock to be
+// held.
+func (pd *Driver) healthyPipes() []*Pipe {
+	var healthy []*Pipe
+	for _, pipe := range pd.pipes {
+		if pd.isHealthy(pipe.upstream) {
+			healthy = append(healthy, pipe)
+		}
+	}
+	if len(healthy) == 0 {
+		return pd.pipes
+	}
+	return healthy
+}
@@ -0,0 +1,111 @@
+package pipeline
+
+import "slices"
+
+// PipeState is a snapshot of a pipe.
+type PipeState struct {
+	ID          int    `json:"id"`
+	Upstream    string `json:"upstream"`
+	Primary     bool   `json:"primary"`
+	WriteReady  bool   `json:"writeReady"`
+	Outstanding int    `json:"outstanding"`
+}
+
+// UpstreamState is a snapshot of an upstream and its pipes.
+type UpstreamState struct {
+	Address    string `json:"address"`
+	Primary    bool   `json:"primary"`
+	Pipes      int    `json:"pipes"`
+	ReadyPipes int    `json:"readyPipes"`
+	Healthy    bool   `json:"healthy"`
+}
+
+// State is a snapshot of the pipes and upstreams of the driver.
+type State struct {
+	Pipes            []PipeState     `json:"pipes"`
+	Upstreams        []UpstreamState `json:"upstreams"`
+	PrimaryLoading   int             `json:"primaryLoading"`
+	SecondaryLoading int             `json:"secondaryLoading"`
+	// Queries and Failures count the queries since the driver was created, the failed ones didn't get any response.
+	Queries  int64 `json:"queries"`
+	Failures int64 `json:"failures"`
+}
+
+// State returns a snapshot of the pipes and upstreams for debugging purposes.
+func (pd *Driver) State() State {
+	var state State
+
+	pd.upstreamsLock.RLock()
+	primaries, _ := pd.upstreamSets()
+	for _, upstream := range pd.upstreams {
+		state.Upstreams = append(state.Upstreams, UpstreamState{Address: upstream.String(), Primary: slices.Contains(primaries, upstream)})
+	}
+	for _, upstream := range pd.backups {
+		state.Upstreams = append(state.Upstreams, UpstreamState{Address: upstream.String()})
+	}
+	pd.upstreamsLock.RUnlock()
+
+	pd.pipesLock.RLock()
+	for _, pipe := range pd.pipes {
+		ps := PipeState{
+			ID:          pipe.id,
+			Upstream:    pipe.upstream.String(),
+			Primary:     pipe.primary,
+			WriteReady:  pipe.isWriteReady(),
+			Outstanding: pipe.outstanding(),
+		}
+		state.Pipes = append(state.Pipes, ps)
+		for i := range state.Upstreams {
+			if state.Upstreams[i].Address == ps.Upstream {
+				state.Upstreams[i].Pipes++
+				if ps.WriteReady {
+					state.Upstreams[i].ReadyPipes++
+					state.Upstreams[i].Healthy = pd.isHealthy(pipe.upstream)
+				}
+			}
+		}
+	}
+	pd.pipesLock.RUnlock()
+
+	pd.loadingLock.Lock()
+	state.PrimaryLoading, state.SecondaryLoading = pd.primaryLoading, pd.secondaryLoading
+	pd.loadingLock.Unlock()
+
+	state.Queries, state.Failures = pd.queryCount.Load(), pd.failureCount.Load()
+	return state
+}
+
+// Ready reports whether a pipe is established to every primary upstream, or the pool of the primary pipes is full
+// already, so the queries can be forwarded. It only reports the state, the pool is loaded by the maintenance loop.
+func (pd *Driver) Ready() bool {
+	pd.upstreamsLock.RLock()
+	primaries, _ := pd.upstreamSets()
+	primaries = slices.Clone(primaries)
+	pd.upstreamsLock.RUnlock()
+	if len(primaries) == 0 {
+		return false
+	}
+
+	pd.pipesLock.RLock()
+	defer pd.pipesLock.RUnlock()
+	connected := make(map[ConnConfig]bool)
+	ready := 0
+	for _, pipe := range pd.pipes {
+		if pipe.primary && pipe.isWriteReady() {
+			connected[pipe.upstream] = true
+			ready++
+		}
+	}
+	pd.loadingLock.Lock()
+	full := ready > 0 && ready >= pd.primaryLimit
+	pd.loadingLock.Unlock()
+	if full {
+		return true
+	}
+	for _, upstream := range primaries {
+		if !connected[upstream] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,65 @@
+package pipeline
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Attempt describes a single try to forward a query through a pipe.
+type Attempt struct {
+	// Number is 0 for the first attempt and increases with every retry.
+	Number     int
+	Upstream   ConnConfig
+	Pipe       int
+	RemoteAddr net.Addr
+	Start      time.Time
+	Query      *dns.Msg
+	Response   *dns.Msg
+	Err        error
+}
+
+// Write describes the query handed over to the write loop of a pipe.
+type Write struct {
+	Upstream ConnConfig
+	Pipe     int
+	Time     time.Time
+}
+
+// Trace holds the hooks called while a query is processed by Driver.Query.
+type Trace struct {
+	// Write is called when the query is handed over to a pipe to be written.
+	Write func(Write)
+	// Attempt is called after each attempt to forward the query, including the failed ones.
+	Attempt func(Attempt)
+}
+
+type traceKey struct{}
+
+// WithTrace returns a context carrying the trace hooks for the queries made with it.
+func WithTrace(ctx context.Context, trace *Trace) context.Context {
+	return context.WithValue(ctx, traceKey{}, trace)
+}
+
+func contextTrace(ctx context.Context) *Trace {
+	trace, _ := ctx.Value(traceKey{}).(*Trace)
+	return trace
+}
+
+// attempt calls the Attempt hook, it is a no-op on nil trace.
+func (t *Trace) attempt(a Attempt) {
+	if t == nil || t.Attempt == nil {
+		return
+	}
+	t.Attempt(a)
+}
+
+// write calls the Write hook, it is a no-op on nil trace.
+func (t *Trace) write(w Write) {
+	if t == nil || t.Write == nil {
+		return
+	}
+	t.Write(w)
+}
@@ -0,0 +1,42 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// Transfer streams the zone transfer (AXFR or IXFR) from a primary upstream. The response consists of multiple
+// messages, which the pipes can't match to a single request, so a dedicated connection is opened for every transfer.
+// The connection is closed when the transfer ends or the context is done, the channel is closed afterwards.
+func (pd *Driver) Transfer(ctx context.Context, msg *dns.Msg) (chan *dns.Envelope, error) {
+	upstream, ok := pd.selectUpstream(true)
+	if !ok {
+		return nil, errors.New("no upstream available")
+	}
+	switch upstream.transport() {
+	case TransportHTTPS:
+		return nil, errors.New("zone transfer is not supported over HTTPS")
+	case TransportUDP:
+		// the zone transfers require TCP, the upstream is expected to listen on the same port
+		upstream.Transport = TransportTCP
+	}
+
+	dialer := net.Dialer{Timeout: pd.attemptTimeout, FallbackDelay: pd.pipeConfig.FallbackDelay}
+	conn, err := dialUpstream(ctx, &dialer, upstream, pd.pipeConfig.TLSConfig)
+	if err != nil {
+		return nil, err
+	}
+	context.AfterFunc(ctx, func() { conn.Close() })
+
+	pd.log("Driver: transfer of %s from %s", msg.Question[0].Name, upstream)
+	t := &dns.Transfer{Conn: &dns.Conn{Conn: conn}, ReadTimeout: pd.attemptTimeout, WriteTimeout: pd.attemptTimeout}
+	env, err := t.In(msg, upstream.String())
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return env, nil
+}
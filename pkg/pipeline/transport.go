@@ -0,0 +1,167 @@
+package pipeline
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// dohMediaType is the content type of the DNS over HTTPS messages (RFC 8484).
+const dohMediaType = "application/dns-message"
+
+// dialUpstream opens the connection to the upstream over TCP, TLS or UDP.
+func dialUpstream(ctx context.Context, dialer *net.Dialer, upstream ConnConfig, tlsConfig *tls.Config) (net.Conn, error) {
+	network := "tcp"
+	if upstream.transport() == TransportUDP {
+		network = "udp"
+	}
+	conn, err := dialHost(ctx, dialer, network, upstream.String())
+	if err != nil {
+		return nil, err
+	}
+	if upstream.transport() != TransportTLS {
+		return conn, nil
+	}
+	tlsConn := tls.Client(conn, upstreamTLSConfig(upstream, tlsConfig))
+	handshakeCtx, cancel := context.WithTimeout(ctx, dialer.Timeout)
+	defer cancel()
+	if err = tlsConn.HandshakeContext(handshakeCtx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// upstreamTLSConfig returns the TLS config verifying the hostname of the upstream, unless the config sets another one.
+func upstreamTLSConfig(upstream ConnConfig, tlsConfig *tls.Config) *tls.Config {
+	if tlsConfig == nil {
+		tlsConfig = &tls.Config{}
+	}
+	tlsConfig = tlsConfig.Clone()
+	if tlsConfig.ServerName == "" {
+		tlsConfig.ServerName = upstream.Hostname
+	}
+	return tlsConfig
+}
+
+// initHTTPS prepares the client of the DNS over HTTPS upstream. The pipe has no read and write loops, the requests are
+// multiplexed over the persistent HTTP/2 connection of the client.
+func (p *Pipe) initHTTPS(cfg ConnConfig, tlsConfig *tls.Config) {
+	p.url = (&url.URL{Scheme: "https", Host: cfg.String(), Path: cfg.Path}).String()
+	dialer := p.dialer()
+	p.httpClient = &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network string, addr string) (net.Conn, error) {
+			return dialHost(ctx, dialer, network, addr)
+		},
+		TLSClientConfig:     upstreamTLSConfig(cfg, tlsConfig),
+		TLSHandshakeTimeout: p.dialTimeout,
+		ForceAttemptHTTP2:   true,
+	}}
+	p.setWriteReady(true)
+	go p.finalize()
+	p.metrics.observePipeEvent(p.upstream, eventCreated)
+	p.driver.pipeReady(p)
+}
+
+// exchangeHTTPS posts the message to the DNS over HTTPS upstream. The sender cache only allocates the message ID
+// and counts the requests in flight, the response is matched to the request by the HTTP exchange.
+func (p *Pipe) exchangeHTTPS(ctx context.Context, msg *dns.Msg, timeout time.Duration) (*dns.Msg, error) {
+	p.touch()
+	r, err := p.newRequest(msg, timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer p.cache.remove(r.id, r.sender)
+
+	reqCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(reqCtx, http.MethodPost, p.url, bytes.NewReader(r.wire))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", dohMediaType)
+	req.Header.Set("Accept", dohMediaType)
+	contextTrace(ctx).write(Write{Upstream: p.upstream, Pipe: p.id, Time: time.Now()})
+
+	httpResp, err := p.httpClient.Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if errors.Is(err, context.DeadlineExceeded) {
+			p.log("message timeout id(%d)", r.id)
+			return nil, timeoutErr
+		}
+		p.log("message error: %v", err)
+		return nil, err
+	}
+	defer httpResp.Body.Close()
+	if httpResp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("DNS over HTTPS: unexpected status %s", httpResp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(httpResp.Body, dns.MaxMsgSize))
+	if err != nil {
+		return nil, err
+	}
+	resp := new(dns.Msg)
+	if err = resp.Unpack(body); err != nil {
+		return nil, err
+	}
+	p.log("message responded (%d, %s)", resp.Id, dns.RcodeToString[resp.Rcode])
+	if resp.Id != r.id || !isResponseValid(msg, resp) {
+		p.log("response mismatch id(%d)", resp.Id)
+		p.metrics.observeResponseMismatch()
+		return nil, responseMismatch
+	}
+	resp.Id = msg.Id
+	return resp, nil
+}
+
+// exchangeTCP retries the query truncated over UDP by a dedicated TCP connection to the same upstream, which is expected
+// to listen on the same port. The truncated responses are rare, so the connection is not kept as a pipe.
+func (pd *Driver) exchangeTCP(ctx context.Context, upstream ConnConfig, msg *dns.Msg,
+	timeout time.Duration) (*dns.Msg, error) {
+	upstream.Transport = TransportTCP
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	dialer := net.Dialer{Timeout: timeout, FallbackDelay: pd.pipeConfig.FallbackDelay}
+	conn, err := dialUpstream(ctx, &dialer, upstream, pd.pipeConfig.TLSConfig)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	context.AfterFunc(ctx, func() { conn.Close() })
+
+	dnsConn := &dns.Conn{Conn: conn}
+	if err = dnsConn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, err
+	}
+	if err = dnsConn.WriteMsg(msg); err != nil {
+		return nil, err
+	}
+	resp, err := dnsConn.ReadMsg()
+	if err != nil {
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() || errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return nil, timeoutErr
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	if resp.Id != msg.Id || !isResponseValid(msg, resp) {
+		pd.metrics.observeResponseMismatch()
+		return nil, responseMismatch
+	}
+	return resp, nil
+}
@@ -0,0 +1,166 @@
+package pipeline
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func answer(r *dns.Msg) *dns.Msg {
+	resp := new(dns.Msg)
+	resp.SetReply(r)
+	resp.Answer = append(resp.Answer, &dns.A{
+		Hdr: dns.RR_Header{Name: r.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+		A:   net.IPv4(127, 0, 0, 1),
+	})
+	return resp
+}
+
+// startTransportUpstreams starts the upstreams answering over UDP, TLS and HTTPS, all of them sharing the certificate
+// of the returned HTTPS server.
+func startTransportUpstreams(t *testing.T) (map[string]ConnConfig, *x509.CertPool) {
+	t.Helper()
+	handler := dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) { w.WriteMsg(answer(r)) })
+	doh := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		msg := new(dns.Msg)
+		if r.Header.Get("Content-Type") != dohMediaType || msg.Unpack(body) != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		data, _ := answer(msg).Pack()
+		w.Header().Set("Content-Type", dohMediaType)
+		w.Write(data)
+	}))
+	t.Cleanup(doh.Close)
+	roots := x509.NewCertPool()
+	roots.AddCert(doh.Certificate())
+
+	packetConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	udp := &dns.Server{PacketConn: packetConn, Handler: handler}
+	go udp.ActivateAndServe()
+	t.Cleanup(func() { udp.Shutdown() })
+
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: doh.TLS.Certificates})
+	require.NoError(t, err)
+	dot := &dns.Server{Listener: listener, Net: "tcp-tls", Handler: handler}
+	go dot.ActivateAndServe()
+	t.Cleanup(func() { dot.Shutdown() })
+
+	upstream := func(addr string, transport string, path string) ConnConfig {
+		host, port, err := net.SplitHostPort(addr)
+		require.NoError(t, err)
+		portNum, err := strconv.Atoi(port)
+		require.NoError(t, err)
+		return ConnConfig{Hostname: host, Port: portNum, Transport: transport, Path: path}
+	}
+	return map[string]ConnConfig{
+		TransportUDP:   upstream(packetConn.LocalAddr().String(), TransportUDP, ""),
+		TransportTLS:   upstream(listener.Addr().String(), TransportTLS, ""),
+		TransportHTTPS: upstream(doh.Listener.Addr().String(), TransportHTTPS, "/dns-query"),
+	}, roots
+}
+
+func TestDriver_transports(t *testing.T) {
+	upstreams, roots := startTransportUpstreams(t)
+	for _, transport := range []string{TransportUDP, TransportTLS, TransportHTTPS} {
+		t.Run(transport, func(t *testing.T) {
+			driver, err := New([]ConnConfig{upstreams[transport]}, Config{
+				Timeout: time.Second,
+				Pipe:    PipeConfig{TLSConfig: &tls.Config{RootCAs: roots}},
+			})
+			require.NoError(t, err)
+			t.Cleanup(driver.Close)
+
+			for i := 0; i < 3; i++ {
+				msg := newQuery("example.org")
+				resp, err := driver.Query(context.Background(), msg)
+				require.NoError(t, err)
+				assert.Equal(t, msg.Id, resp.Id)
+				require.Len(t, resp.Answer, 1)
+				assert.Equal(t, "example.org.", resp.Answer[0].Header().Name)
+			}
+		})
+	}
+}
+
+// startUDPAndTCP starts the handler over both UDP and TCP on the same port of the loopback, which is returned.
+func startUDPAndTCP(t *testing.T, handler dns.Handler) int {
+	t.Helper()
+	// the port free for UDP may be taken for TCP
+	var packetConn net.PacketConn
+	var listener net.Listener
+	require.Eventually(t, func() bool {
+		var err error
+		if packetConn, err = net.ListenPacket("udp", "127.0.0.1:0"); err != nil {
+			return false
+		}
+		if listener, err = net.Listen("tcp", packetConn.LocalAddr().String()); err != nil {
+			packetConn.Close()
+			return false
+		}
+		return true
+	}, time.Second, time.Millisecond)
+	udp := &dns.Server{PacketConn: packetConn, Handler: handler}
+	go udp.ActivateAndServe()
+	t.Cleanup(func() { udp.Shutdown() })
+	tcp := &dns.Server{Listener: listener, Handler: handler}
+	go tcp.ActivateAndServe()
+	t.Cleanup(func() { tcp.Shutdown() })
+	return packetConn.LocalAddr().(*net.UDPAddr).Port
+}
+
+func TestDriver_truncatedOverUDP(t *testing.T) {
+	// the oversized answer is truncated over UDP and sent whole over TCP on the same port
+	handler := dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		resp := new(dns.Msg)
+		resp.SetReply(r)
+		for i := 0; i < 100; i++ {
+			resp.Answer = append(resp.Answer, &dns.A{
+				Hdr: dns.RR_Header{Name: r.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+				A:   net.IPv4(127, 0, 0, byte(i)),
+			})
+		}
+		if _, ok := w.RemoteAddr().(*net.UDPAddr); ok {
+			resp.Truncate(dns.MinMsgSize)
+		}
+		w.WriteMsg(resp)
+	})
+	port := startUDPAndTCP(t, handler)
+	driver, err := New([]ConnConfig{{Hostname: "127.0.0.1", Port: port, Transport: TransportUDP}}, Config{Timeout: time.Second})
+	require.NoError(t, err)
+	t.Cleanup(driver.Close)
+
+	msg := newQuery("example.org")
+	resp, err := driver.Query(context.Background(), msg)
+	require.NoError(t, err)
+	assert.Equal(t, msg.Id, resp.Id)
+	assert.False(t, resp.Truncated)
+	assert.Len(t, resp.Answer, 100)
+}
+
+func TestDriver_transportUntrusted(t *testing.T) {
+	upstreams, _ := startTransportUpstreams(t)
+	for _, transport := range []string{TransportTLS, TransportHTTPS} {
+		t.Run(transport, func(t *testing.T) {
+			driver, err := New([]ConnConfig{upstreams[transport]}, Config{Timeout: 300 * time.Millisecond})
+			require.NoError(t, err)
+			t.Cleanup(driver.Close)
+
+			_, err = driver.Query(context.Background(), newQuery("example.org"))
+			assert.Error(t, err)
+		})
+	}
+}
@@ -0,0 +1,76 @@
+package hackforward
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+const aclActionNext = "next"
+
+// acl decides which clients are allowed to have their queries forwarded.
+type acl struct {
+	allow  []*net.IPNet
+	deny   []*net.IPNet
+	action string
+}
+
+func newACL(allow, deny []string, action string) (*acl, error) {
+	if len(allow) == 0 && len(deny) == 0 {
+		return nil, nil
+	}
+	a := acl{action: action}
+	var err error
+	if a.allow, err = convertNets(allow); err != nil {
+		return nil, err
+	}
+	if a.deny, err = convertNets(deny); err != nil {
+		return nil, err
+	}
+	return &a, nil
+}
+
+// convertNets parses CIDR lists, a bare IP address is considered a single host network.
+func convertNets(cidrs []string) (nets []*net.IPNet, err error) {
+	for _, cidr := range cidrs {
+		if !strings.Contains(cidr, "/") {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP address: %s", cidr)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+// allowed returns false if the client is denied or not explicitly allowed while an allow list is present.
+// It is safe to be called on nil acl, which allows everything.
+func (a *acl) allowed(ip net.IP) bool {
+	if a == nil {
+		return true
+	}
+	if containsIP(a.deny, ip) {
+		return false
+	}
+	return len(a.allow) == 0 || containsIP(a.allow, ip)
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, ipNet := range nets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,46 @@
+package hackforward
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+
+	"hackforward/pkg/pipeline"
+)
+
+// adminServer exposes the driver state as JSON over HTTP.
+type adminServer struct {
+	server *http.Server
+}
+
+func newAdminServer(addr string, driver *pipeline.Driver) (*adminServer, error) {
+	if addr == "" {
+		return nil, nil
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/state", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(driver.State()); err != nil {
+			log("admin: encoding state failed: %v", err)
+		}
+	})
+	a := adminServer{server: &http.Server{Handler: mux}}
+	go func() {
+		if err := a.server.Serve(ln); err != nil && err != http.ErrServerClosed {
+			log("admin: serving failed: %v", err)
+		}
+	}()
+	return &a, nil
+}
+
+func (a *adminServer) close() error {
+	if a == nil {
+		return nil
+	}
+	return a.server.Shutdown(context.Background())
+}
@@ -0,0 +1,273 @@
+package hackforward
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+type cacheConfig struct {
+	Size        int           `cf:"size" default:"10000" check:"gt(0)"`
+	MaxTTL      time.Duration `cf:"max_ttl" default:"1h" check:"gt(0)"`
+	NegativeTTL time.Duration `cf:"negative_ttl" default:"30m" check:"gte(0)"`
+	// Prefetch is the number of hits after which the entry is refreshed before its expiration (0 disables it).
+	Prefetch           int `cf:"prefetch" default:"0" check:"gte(0)"`
+	PrefetchPercentage int `cf:"prefetch_percentage" default:"10" check:"range(1-100)"`
+	// ServeStale is the maximal staleness of expired entries served when upstreams are not available or answer SERVFAIL
+	// or REFUSED (0 disables it).
+	ServeStale time.Duration `cf:"serve_stale" default:"0" check:"gte(0)"`
+}
+
+// staleTTL is the TTL of stale answers as recommended by RFC 8767.
+const staleTTL = 30
+
+type cacheKey struct {
+	name   string
+	qtype  uint16
+	qclass uint16
+	do     bool
+	// subnet is the client subnet of the ECS option, the answers tailored to one subnet must not be served to another
+	subnet string
+}
+
+type cacheEntry struct {
+	msg         *dns.Msg
+	stored      time.Time
+	expires     time.Time
+	hits        int
+	prefetching bool
+}
+
+// responseCache stores upstream responses, both positive and negative (RFC 2308) ones.
+// All methods are safe to be called on nil cache, which represents disabled caching.
+type responseCache struct {
+	size               int
+	maxTTL             time.Duration
+	negativeTTL        time.Duration
+	prefetch           int
+	prefetchPercentage int
+	serveStale         time.Duration
+	entries            map[cacheKey]*cacheEntry
+	lock               sync.Mutex
+}
+
+func newResponseCache(cfg *cacheConfig) *responseCache {
+	if cfg == nil {
+		return nil
+	}
+	return &responseCache{
+		size:               cfg.Size,
+		maxTTL:             cfg.MaxTTL,
+		negativeTTL:        cfg.NegativeTTL,
+		prefetch:           cfg.Prefetch,
+		prefetchPercentage: cfg.PrefetchPercentage,
+		serveStale:         cfg.ServeStale,
+		entries:            make(map[cacheKey]*cacheEntry),
+	}
+}
+
+func newCacheKey(msg *dns.Msg) cacheKey {
+	q := msg.Question[0]
+	key := cacheKey{name: strings.ToLower(q.Name), qtype: q.Qtype, qclass: q.Qclass}
+	if opt := msg.IsEdns0(); opt != nil {
+		key.do = opt.Do()
+		key.subnet = subnetKey(opt)
+	}
+	return key
+}
+
+// subnetKey formats the family, the source prefix length and the address of the ECS option, empty without it.
+func subnetKey(opt *dns.OPT) string {
+	for _, option := range opt.Option {
+		if subnet, ok := option.(*dns.EDNS0_SUBNET); ok {
+			return fmt.Sprintf("%d:%s/%d", subnet.Family, subnet.Address, subnet.SourceNetmask)
+		}
+	}
+	return ""
+}
+
+// get returns a copy of the cached response for the request with TTLs decreased by the time spent in the cache.
+// The returned flag signals that the entry is popular and close to its expiration, so it should be prefetched.
+func (c *responseCache) get(req *dns.Msg) (*dns.Msg, bool) {
+	if c == nil {
+		return nil, false
+	}
+	key := newCacheKey(req)
+	now := time.Now()
+
+	c.lock.Lock()
+	entry, ok := c.entries[key]
+	if ok && !now.Before(entry.expires) {
+		if !now.Before(entry.expires.Add(c.serveStale)) {
+			delete(c.entries, key)
+		}
+		ok = false
+	}
+	prefetch := false
+	if ok {
+		entry.hits++
+		if c.shouldPrefetch(entry, now) {
+			entry.prefetching = true
+			prefetch = true
+		}
+	}
+	c.lock.Unlock()
+	if !ok {
+		return nil, false
+	}
+
+	resp := entry.msg.Copy()
+	resp.Id = req.Id
+	decreaseTTLs(resp, uint32(now.Sub(entry.stored)/time.Second))
+	return resp, prefetch
+}
+
+// getStale returns a copy of the expired cached response if it is not older than the configured staleness.
+func (c *responseCache) getStale(req *dns.Msg) *dns.Msg {
+	if c == nil || c.serveStale == 0 {
+		return nil
+	}
+	key := newCacheKey(req)
+	now := time.Now()
+
+	c.lock.Lock()
+	entry, ok := c.entries[key]
+	c.lock.Unlock()
+	if !ok || !now.Before(entry.expires.Add(c.serveStale)) {
+		return nil
+	}
+
+	resp := entry.msg.Copy()
+	resp.Id = req.Id
+	setTTLs(resp, staleTTL)
+	return resp
+}
+
+func (c *responseCache) shouldPrefetch(entry *cacheEntry, now time.Time) bool {
+	if c.prefetch == 0 || entry.prefetching || entry.hits < c.prefetch {
+		return false
+	}
+	ttl := entry.expires.Sub(entry.stored)
+	return entry.expires.Sub(now) <= ttl*time.Duration(c.prefetchPercentage)/100
+}
+
+// prefetchDone lets the entry of the request be prefetched again, e.g. when the prefetch failed or its response is not
+// cacheable, the entry replaced by the prefetched response is not flagged anyway.
+func (c *responseCache) prefetchDone(req *dns.Msg) {
+	if c == nil {
+		return
+	}
+	key := newCacheKey(req)
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if entry, ok := c.entries[key]; ok {
+		entry.prefetching = false
+	}
+}
+
+func (c *responseCache) set(req *dns.Msg, resp *dns.Msg) {
+	if c == nil || resp.Truncated {
+		return
+	}
+	ttl, ok := c.ttl(resp)
+	if !ok || ttl <= 0 {
+		return
+	}
+
+	now := time.Now()
+	entry := &cacheEntry{msg: resp.Copy(), stored: now, expires: now.Add(ttl)}
+	key := newCacheKey(req)
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if _, exists := c.entries[key]; !exists && len(c.entries) >= c.size {
+		for k := range c.entries {
+			delete(c.entries, k)
+			break
+		}
+	}
+	c.entries[key] = entry
+}
+
+// ttl computes how long the response may be cached, negative responses are cached for the SOA minimum TTL.
+func (c *responseCache) ttl(resp *dns.Msg) (time.Duration, bool) {
+	switch {
+	case resp.Rcode == dns.RcodeSuccess && len(resp.Answer) > 0:
+		return minDuration(minTTL(resp.Answer), c.maxTTL), true
+	case resp.Rcode == dns.RcodeNameError || resp.Rcode == dns.RcodeSuccess:
+		for _, rr := range resp.Ns {
+			if soa, ok := rr.(*dns.SOA); ok {
+				ttl := soa.Minttl
+				if soa.Hdr.Ttl < ttl {
+					ttl = soa.Hdr.Ttl
+				}
+				return minDuration(time.Duration(ttl)*time.Second, c.negativeTTL), true
+			}
+		}
+	}
+	return 0, false
+}
+
+func minTTL(rrs []dns.RR) time.Duration {
+	ttl := rrs[0].Header().Ttl
+	for _, rr := range rrs[1:] {
+		if rr.Header().Ttl < ttl {
+			ttl = rr.Header().Ttl
+		}
+	}
+	return time.Duration(ttl) * time.Second
+}
+
+func minDuration(a, b time.Duration) time.Duration {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func decreaseTTLs(msg *dns.Msg, elapsed uint32) {
+	for _, section := range [][]dns.RR{msg.Answer, msg.Ns, msg.Extra} {
+		for _, rr := range section {
+			if rr.Header().Rrtype == dns.TypeOPT {
+				continue
+			}
+			if rr.Header().Ttl > elapsed {
+				rr.Header().Ttl -= elapsed
+			} else {
+				rr.Header().Ttl = 0
+			}
+		}
+	}
+}
+
+// clampTTLs raises the TTLs below minTTL and lowers the ones above maxTTL, 0 disables the respective bound.
+func clampTTLs(msg *dns.Msg, minTTL, maxTTL uint32) {
+	if minTTL == 0 && maxTTL == 0 {
+		return
+	}
+	for _, section := range [][]dns.RR{msg.Answer, msg.Ns, msg.Extra} {
+		for _, rr := range section {
+			hdr := rr.Header()
+			switch {
+			case hdr.Rrtype == dns.TypeOPT:
+			case hdr.Ttl < minTTL:
+				hdr.Ttl = minTTL
+			case maxTTL != 0 && hdr.Ttl > maxTTL:
+				hdr.Ttl = maxTTL
+			}
+		}
+	}
+}
+
+func setTTLs(msg *dns.Msg, ttl uint32) {
+	for _, section := range [][]dns.RR{msg.Answer, msg.Ns, msg.Extra} {
+		for _, rr := range section {
+			if rr.Header().Rrtype != dns.TypeOPT {
+				rr.Header().Ttl = ttl
+			}
+		}
+	}
+}
@@ -1,10 +1,106 @@
 package hackforward
 
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
 type config struct {
-	Upstreams []string `cf:"upstreams"`
+	Upstreams       []string           `cf:"upstreams"`
+	Backups         []string           `cf:"backups"`
+	WarmStandby     bool               `cf:"warm_standby" default:"false" check:"requiredWith(health_check)"`
+	HealthCheck     *healthCheckConfig `cf:"health_check"`
+	Except          []string           `cf:"except"`
+	Routes          [][]string         `cf:"route"`
+	Views           []*viewConfig      `cf:"view"`
+	TypeRoutes      [][]string         `cf:"route_type"`
+	BlockTypes      []string           `cf:"block_types"`
+	MaxRetries      int                `cf:"max_retries" default:"2" check:"gte(0)"`
+	RetryOn         []string           `cf:"retry_on" default:"SERVFAIL"`
+	Referrals       string             `cf:"referrals" default:"pass" check:"oneOf(pass|servfail|retry)"`
+	AttemptTimeout  time.Duration      `cf:"attempt_timeout" default:"1s" check:"gt(0)"`
+	Timeout         time.Duration      `cf:"timeout" default:"2s" check:"gt(0)"`
+	Hedge           []string           `cf:"hedge"`
+	ECS             []string           `cf:"ecs" default:"pass"`
+	ScrubOptions    []string           `cf:"scrub_options"`
+	Bufsize         int                `cf:"bufsize" default:"1232" check:"range(512-4096)"`
+	Cache           *cacheConfig       `cf:"cache"`
+	MinTTL          time.Duration      `cf:"min_ttl" default:"0" check:"gte(0)"`
+	MaxTTL          time.Duration      `cf:"max_ttl" default:"0" check:"gte(0)"`
+	Allow           []string           `cf:"allow"`
+	Deny            []string           `cf:"deny"`
+	ACLAction       string             `cf:"acl_action" default:"refuse" check:"oneOf(refuse|next)"`
+	QueryLog        *queryLogConfig    `cf:"query_log"`
+	TraceSuffixes   []string           `cf:"trace_suffixes"`
+	TraceZFlag      bool               `cf:"trace_zflag" default:"false"`
+	MaxConcurrent   int                `cf:"max_concurrent" default:"0" check:"gte(0)"`
+	MaxQueue        int                `cf:"max_queue" default:"0" check:"gte(0)"`
+	Keepalive       bool               `cf:"keepalive" default:"true"`
+	KeepalivePeriod time.Duration      `cf:"keepalive_period" default:"15s" check:"gt(0)"`
+	IdleTimeout     time.Duration      `cf:"idle_timeout" default:"0" check:"gte(0)"`
+	IdleReap        time.Duration      `cf:"idle_reap" default:"0" check:"gte(0)"`
+	MaxInflight     int                `cf:"max_inflight" default:"1000" check:"range(1-65535)"`
+	FallbackDelay   time.Duration      `cf:"happy_eyeballs_delay" default:"250ms" check:"gt(0)"`
+	ResolvConf      string             `cf:"resolvconf" default:"/etc/resolv.conf"`
+	ReloadInterval  time.Duration      `cf:"reload_interval" default:"5s" check:"gt(0)"`
+	Kubernetes      *kubernetesConfig  `cf:"kubernetes" check:"mutuallyExclusive(upstreams)"`
+	UpstreamsFile   string             `cf:"upstreams_file" check:"mutuallyExclusive(upstreams|kubernetes)"`
+	DebugListen     string             `cf:"debug_listen"`
+	Stats           bool               `cf:"stats" default:"false"`
+	Autoscale       *autoscaleConfig   `cf:"autoscale"`
+	Preconnect      bool               `cf:"preconnect" default:"false"`
+	AttemptDeadline time.Duration      `cf:"attempt_deadline" default:"500ms" check:"gt(0)"`
+	RetryInterval   time.Duration      `cf:"retry_interval" default:"100ms" check:"gt(0)"`
+	Cookies         bool               `cf:"cookies" default:"false"`
+	Dns0x20         bool               `cf:"dns0x20" default:"false"`
+}
+
+func (c *config) Check() error {
+	if c.AttemptTimeout > c.Timeout {
+		return errors.New("attempt_timeout cannot exceed timeout")
+	}
+	if c.MaxTTL != 0 && c.MinTTL > c.MaxTTL {
+		return errors.New("min_ttl cannot exceed max_ttl")
+	}
+	return nil
+}
+
+type autoscaleConfig struct {
+	MinPipes          int           `cf:"min_pipes" default:"2" check:"gt(0)"`
+	MaxPipes          int           `cf:"max_pipes" default:"50" check:"gt(0)"`
+	TargetOutstanding int           `cf:"target_outstanding" default:"10" check:"gt(0)"`
+	TargetQPS         int           `cf:"target_qps" default:"1000" check:"gt(0)"`
+	Interval          time.Duration `cf:"interval" default:"1s" check:"gt(0)"`
+	Cooldown          time.Duration `cf:"cooldown" default:"30s" check:"gte(0)"`
+}
+
+func (c *autoscaleConfig) Check() error {
+	if c.MinPipes > c.MaxPipes {
+		return errors.New("min_pipes cannot be greater than max_pipes")
+	}
+	return nil
+}
+
+// healthCheckConfig tunes the probes of the standby pipes.
+type healthCheckConfig struct {
+	Interval   time.Duration `cf:"interval" default:"5s" check:"gt(0)"`
+	Timeout    time.Duration `cf:"timeout" default:"1s" check:"gt(0)"`
+	Qname      string        `cf:"qname" default:"." check:"nonempty"`
+	Qtype      string        `cf:"qtype" default:"NS" check:"nonempty"`
+	Failures   int           `cf:"failures" default:"3" check:"gt(0)"`
+	Recoveries int           `cf:"recoveries" default:"1" check:"gt(0)"`
 }
 
-type ConnConfig struct {
-	Hostname string
-	Port     int
+func (c *healthCheckConfig) Check() error {
+	if _, ok := dns.StringToType[strings.ToUpper(c.Qtype)]; !ok {
+		return fmt.Errorf("invalid qtype: %s", c.Qtype)
+	}
+	if c.Timeout > c.Interval {
+		return errors.New("timeout cannot exceed interval")
+	}
+	return nil
 }
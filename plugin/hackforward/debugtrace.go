@@ -0,0 +1,93 @@
+package hackforward
+
+import (
+	"time"
+
+	"github.com/coredns/coredns/plugin"
+	clog "github.com/coredns/coredns/plugin/pkg/log"
+	"github.com/miekg/dns"
+
+	"hackforward/pkg/pipeline"
+)
+
+var traceLog = clog.NewWithPlugin(pluginName)
+
+// queryTracer selects the queries whose processing is logged step by step at the info level: the ones under one of
+// the suffixes, or the ones with the Z header flag set if enabled. All methods are safe to be called on nil tracer,
+// which represents disabled tracing.
+type queryTracer struct {
+	suffixes []string
+	zFlag    bool
+}
+
+func newQueryTracer(suffixes []string, zFlag bool) *queryTracer {
+	if len(suffixes) == 0 && !zFlag {
+		return nil
+	}
+	t := &queryTracer{zFlag: zFlag}
+	for _, suffix := range suffixes {
+		t.suffixes = append(t.suffixes, plugin.Host(suffix).NormalizeExact()...)
+	}
+	return t
+}
+
+func (t *queryTracer) matches(r *dns.Msg) bool {
+	if t == nil {
+		return false
+	}
+	if t.zFlag && r.Zero {
+		return true
+	}
+	for _, suffix := range t.suffixes {
+		if plugin.Name(suffix).Matches(r.Question[0].Name) {
+			return true
+		}
+	}
+	return false
+}
+
+// queryTrace logs the steps of a single traced query, all of them relative to its start.
+type queryTrace struct {
+	id    uint16
+	name  string
+	qtype string
+	start time.Time
+	// written is the time the current attempt was handed over to a pipe
+	written time.Time
+}
+
+func newQueryTrace(r *dns.Msg, start time.Time) *queryTrace {
+	return &queryTrace{id: r.Id, name: r.Question[0].Name, qtype: dns.TypeToString[r.Question[0].Qtype], start: start}
+}
+
+func (t *queryTrace) logf(format string, a ...any) {
+	if t == nil {
+		return
+	}
+	prefix := []any{t.id, t.name, t.qtype, time.Since(t.start)}
+	traceLog.Infof("trace %d %s %s +%v: "+format, append(prefix, a...)...)
+}
+
+// write and attempt are the hooks of pipeline.Trace, attempt is a no-op on nil trace.
+func (t *queryTrace) write(w pipeline.Write) {
+	t.written = w.Time
+	t.logf("written to pipe #%d (%s)", w.Pipe, w.Upstream)
+}
+
+func (t *queryTrace) attempt(a pipeline.Attempt) {
+	if t == nil {
+		return
+	}
+	if t.written.IsZero() {
+		t.logf("attempt %d via pipe #%d (%s) failed before write: %v", a.Number, a.Pipe, a.Upstream, a.Err)
+		return
+	}
+	rtt := time.Since(t.written)
+	t.written = time.Time{}
+	if a.Err != nil {
+		t.logf("attempt %d via pipe #%d (%s) failed after %v: %v", a.Number, a.Pipe, a.Upstream, rtt, a.Err)
+		return
+	}
+	t.logf("attempt %d via pipe #%d (%s) answered %s in %v", a.Number, a.Pipe, a.Upstream,
+		dns.RcodeToString[a.Response.Rcode], rtt)
+}
@@ -0,0 +1,34 @@
+package hackforward
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQueryTracer_matches(t *testing.T) {
+	tests := []struct {
+		name     string
+		suffixes []string
+		zFlag    bool
+		qname    string
+		zero     bool
+		want     bool
+	}{
+		{name: "disabled", qname: "example.org.", zero: true},
+		{name: "suffix", suffixes: []string{"debug.example.org"}, qname: "www.debug.example.org.", want: true},
+		{name: "other suffix", suffixes: []string{"debug.example.org"}, qname: "www.example.org."},
+		{name: "z flag", zFlag: true, qname: "example.org.", zero: true, want: true},
+		{name: "z flag not set", zFlag: true, qname: "example.org."},
+		{name: "z flag not enabled", suffixes: []string{"debug.example.org"}, qname: "example.org.", zero: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := new(dns.Msg)
+			r.SetQuestion(tt.qname, dns.TypeA)
+			r.Zero = tt.zero
+			assert.Equal(t, tt.want, newQueryTracer(tt.suffixes, tt.zFlag).matches(r))
+		})
+	}
+}
@@ -0,0 +1,50 @@
+package hackforward
+
+import (
+	"net"
+	"time"
+
+	"github.com/coredns/coredns/plugin/dnstap"
+	"github.com/coredns/coredns/plugin/dnstap/msg"
+	tap "github.com/dnstap/golang-dnstap"
+	"github.com/miekg/dns"
+)
+
+// SetTapPlugin appends one or more dnstap plugins to the tap plugin list.
+func (f *forwarder) SetTapPlugin(tapPlugin *dnstap.Dnstap) {
+	f.tapPlugins = append(f.tapPlugins, tapPlugin)
+	if nextPlugin, ok := tapPlugin.Next.(*dnstap.Dnstap); ok {
+		f.SetTapPlugin(nextPlugin)
+	}
+}
+
+// toDnstap sends the query forwarded through the pipe and the received reply to the dnstap plugins.
+func (f *forwarder) toDnstap(client net.Addr, upstream net.Addr, query *dns.Msg, reply *dns.Msg, start time.Time) {
+	for _, t := range f.tapPlugins {
+		q := new(tap.Message)
+		msg.SetQueryTime(q, start)
+		// Forwarder dnstap messages are from the perspective of the downstream server
+		msg.SetQueryAddress(q, client)
+		msg.SetResponseAddress(q, upstream)
+		if t.IncludeRawMessage {
+			buf, _ := query.Pack()
+			q.QueryMessage = buf
+		}
+		msg.SetType(q, tap.Message_FORWARDER_QUERY)
+		t.TapMessage(q)
+
+		if reply != nil {
+			r := new(tap.Message)
+			if t.IncludeRawMessage {
+				buf, _ := reply.Pack()
+				r.ResponseMessage = buf
+			}
+			msg.SetQueryTime(r, start)
+			msg.SetQueryAddress(r, client)
+			msg.SetResponseAddress(r, upstream)
+			msg.SetResponseTime(r, time.Now())
+			msg.SetType(r, tap.Message_FORWARDER_RESPONSE)
+			t.TapMessage(r)
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package hackforward
+
+import (
+	"errors"
+	"net"
+	"strconv"
+
+	"github.com/miekg/dns"
+)
+
+type ecsMode int
+
+const (
+	ecsPass ecsMode = iota
+	ecsStrip
+	ecsSet
+)
+
+const (
+	defaultEcsPrefix4 = 24
+	defaultEcsPrefix6 = 56
+)
+
+// ecsPolicy controls the EDNS Client Subnet option forwarded to upstreams.
+type ecsPolicy struct {
+	mode    ecsMode
+	prefix4 uint8
+	prefix6 uint8
+}
+
+// convertEcs parses the `ecs` option: `pass`, `strip` or `set [prefix4] [prefix6]`. The `set 32 128` exposes the full
+// client addresses to the upstreams, which the pipes shared by all the clients can't announce by a PROXY protocol header.
+func convertEcs(args []string) (ecsPolicy, error) {
+	policy := ecsPolicy{prefix4: defaultEcsPrefix4, prefix6: defaultEcsPrefix6}
+	if len(args) == 0 {
+		return policy, nil
+	}
+	switch args[0] {
+	case "pass":
+		policy.mode = ecsPass
+	case "strip":
+		policy.mode = ecsStrip
+	case "set":
+		policy.mode = ecsSet
+	default:
+		return policy, errors.New("ecs mode has to be one of pass|strip|set")
+	}
+	if policy.mode != ecsSet && len(args) > 1 || len(args) > 3 {
+		return policy, errors.New("ecs: too many arguments")
+	}
+	if len(args) > 1 {
+		prefix, err := strconv.ParseUint(args[1], 10, 8)
+		if err != nil || prefix > 32 {
+			return policy, errors.New("ecs: invalid IPv4 prefix length")
+		}
+		policy.prefix4 = uint8(prefix)
+	}
+	if len(args) > 2 {
+		prefix, err := strconv.ParseUint(args[2], 10, 8)
+		if err != nil || prefix > 128 {
+			return policy, errors.New("ecs: invalid IPv6 prefix length")
+		}
+		policy.prefix6 = uint8(prefix)
+	}
+	return policy, nil
+}
+
+// apply modifies the ECS option of the message prepared for the upstream according to the policy.
+func (e ecsPolicy) apply(msg *dns.Msg, client net.Addr) {
+	if e.mode == ecsPass {
+		return
+	}
+	opt := msg.IsEdns0()
+	if opt == nil {
+		return
+	}
+
+	options := opt.Option[:0]
+	for _, option := range opt.Option {
+		if option.Option() != dns.EDNS0SUBNET {
+			options = append(options, option)
+		}
+	}
+	opt.Option = options
+
+	if e.mode == ecsSet {
+		if subnet := e.subnet(client); subnet != nil {
+			opt.Option = append(opt.Option, subnet)
+		}
+	}
+}
+
+func (e ecsPolicy) subnet(client net.Addr) *dns.EDNS0_SUBNET {
+	var ip net.IP
+	switch addr := client.(type) {
+	case *net.UDPAddr:
+		ip = addr.IP
+	case *net.TCPAddr:
+		ip = addr.IP
+	default:
+		return nil
+	}
+
+	subnet := &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET}
+	if ip4 := ip.To4(); ip4 != nil {
+		subnet.Family = 1
+		subnet.SourceNetmask = e.prefix4
+		subnet.Address = ip4.Mask(net.CIDRMask(int(e.prefix4), 32))
+	} else {
+		subnet.Family = 2
+		subnet.SourceNetmask = e.prefix6
+		subnet.Address = ip.Mask(net.CIDRMask(int(e.prefix6), 128))
+	}
+	return subnet
+}
@@ -0,0 +1,115 @@
+package hackforward
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+)
+
+// ednsUDPSize is the default EDNS0 UDP payload size, the one recommended by the DNS flag day 2020.
+const ednsUDPSize = 1232
+
+// ednsOptionCodes maps the names accepted by scrub_options to the EDNS0 option codes.
+var ednsOptionCodes = map[string]uint16{
+	"NSID":          dns.EDNS0NSID,
+	"ECS":           dns.EDNS0SUBNET,
+	"SUBNET":        dns.EDNS0SUBNET,
+	"EXPIRE":        dns.EDNS0EXPIRE,
+	"COOKIE":        dns.EDNS0COOKIE,
+	"TCP-KEEPALIVE": dns.EDNS0TCPKEEPALIVE,
+	"PADDING":       dns.EDNS0PADDING,
+	"EDE":           dns.EDNS0EDE,
+}
+
+// prepareEdns returns a copy of the client request with the OPT record adjusted for the upstream, together with
+// the original client OPT record (nil if the client didn't use EDNS0). The bufsize is advertised upstream.
+func prepareEdns(r *dns.Msg, bufsize uint16) (*dns.Msg, *dns.OPT) {
+	msg := r.Copy()
+	clientOpt := r.IsEdns0()
+
+	var opt *dns.OPT
+	if clientOpt != nil {
+		opt = dns.Copy(clientOpt).(*dns.OPT)
+		removeOpt(msg)
+	} else {
+		opt = &dns.OPT{Hdr: dns.RR_Header{Name: ".", Rrtype: dns.TypeOPT}}
+	}
+	opt.SetVersion(0)
+	opt.SetUDPSize(bufsize)
+	msg.Extra = append(msg.Extra, opt)
+
+	return msg, clientOpt
+}
+
+// restoreEdns adjusts the upstream response to the EDNS0 capabilities of the client: the OPT record is dropped for
+// non-EDNS0 clients, otherwise the DO bit is kept only if requested, and options not sent by the client or listed in
+// scrub are removed. The bufsize is advertised to the client.
+func restoreEdns(resp *dns.Msg, clientOpt *dns.OPT, scrub []uint16, bufsize uint16) {
+	upstreamOpt := resp.IsEdns0()
+	removeOpt(resp)
+	if clientOpt == nil {
+		return
+	}
+
+	opt := &dns.OPT{Hdr: dns.RR_Header{Name: ".", Rrtype: dns.TypeOPT}}
+	opt.SetUDPSize(bufsize)
+	if upstreamOpt != nil {
+		opt.SetDo(upstreamOpt.Do() && clientOpt.Do())
+		for _, option := range upstreamOpt.Option {
+			if hasOption(clientOpt, option.Option()) && !slices.Contains(scrub, option.Option()) {
+				opt.Option = append(opt.Option, option)
+			}
+		}
+	}
+	resp.Extra = append(resp.Extra, opt)
+}
+
+// convertOptionCodes parses the EDNS0 options given by name, e.g. NSID or PADDING, or by numeric code.
+func convertOptionCodes(names []string) ([]uint16, error) {
+	codes := []uint16{}
+	for _, name := range names {
+		if code, ok := ednsOptionCodes[strings.ToUpper(name)]; ok {
+			codes = append(codes, code)
+			continue
+		}
+		code, err := strconv.ParseUint(name, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("unknown EDNS0 option: %s", name)
+		}
+		codes = append(codes, uint16(code))
+	}
+	return codes, nil
+}
+
+// truncateSize returns the size the response to the client is truncated to: the size advertised by the UDP client,
+// but at most the bufsize.
+func truncateSize(state request.Request, bufsize uint16) int {
+	size := state.Size()
+	if state.Proto() == "udp" && size > int(bufsize) {
+		size = int(bufsize)
+	}
+	return size
+}
+
+func removeOpt(msg *dns.Msg) {
+	extra := msg.Extra[:0]
+	for _, rr := range msg.Extra {
+		if rr.Header().Rrtype != dns.TypeOPT {
+			extra = append(extra, rr)
+		}
+	}
+	msg.Extra = extra
+}
+
+func hasOption(opt *dns.OPT, code uint16) bool {
+	for _, option := range opt.Option {
+		if option.Option() == code {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,115 @@
+package hackforward
+
+import (
+	"testing"
+
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newOpt(codes ...uint16) *dns.OPT {
+	opt := &dns.OPT{Hdr: dns.RR_Header{Name: ".", Rrtype: dns.TypeOPT}}
+	for _, code := range codes {
+		opt.Option = append(opt.Option, &dns.EDNS0_LOCAL{Code: code})
+	}
+	return opt
+}
+
+func TestRestoreEdns(t *testing.T) {
+	tests := []struct {
+		name        string
+		clientOpt   *dns.OPT
+		scrub       []uint16
+		wantOpt     bool
+		wantOptions []uint16
+	}{
+		{
+			name: "non-EDNS0 client",
+		},
+		{
+			name:        "options not sent by the client are removed",
+			clientOpt:   newOpt(dns.EDNS0NSID),
+			wantOpt:     true,
+			wantOptions: []uint16{dns.EDNS0NSID},
+		},
+		{
+			name:        "scrubbed options are removed",
+			clientOpt:   newOpt(dns.EDNS0NSID, dns.EDNS0PADDING, dns.EDNS0EDE),
+			scrub:       []uint16{dns.EDNS0NSID, dns.EDNS0PADDING},
+			wantOpt:     true,
+			wantOptions: []uint16{dns.EDNS0EDE},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := new(dns.Msg)
+			resp.Extra = append(resp.Extra, newOpt(dns.EDNS0NSID, dns.EDNS0PADDING, dns.EDNS0EDE, dns.EDNS0SUBNET))
+
+			restoreEdns(resp, tt.clientOpt, tt.scrub, 1400)
+			opt := resp.IsEdns0()
+			if !tt.wantOpt {
+				assert.Nil(t, opt)
+				return
+			}
+			require.NotNil(t, opt)
+			assert.EqualValues(t, 1400, opt.UDPSize())
+			var codes []uint16
+			for _, option := range opt.Option {
+				codes = append(codes, option.Option())
+			}
+			assert.Equal(t, tt.wantOptions, codes)
+		})
+	}
+}
+
+func TestConvertOptionCodes(t *testing.T) {
+	tests := []struct {
+		name    string
+		names   []string
+		want    []uint16
+		wantErr bool
+	}{
+		{name: "empty", want: []uint16{}},
+		{name: "names", names: []string{"nsid", "ECS", "padding"}, want: []uint16{3, 8, 12}},
+		{name: "numeric code", names: []string{"65001"}, want: []uint16{65001}},
+		{name: "unknown name", names: []string{"foo"}, wantErr: true},
+		{name: "code out of range", names: []string{"65536"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			codes, err := convertOptionCodes(tt.names)
+			assert.Equal(t, tt.wantErr, err != nil)
+			if !tt.wantErr {
+				assert.Equal(t, tt.want, codes)
+			}
+		})
+	}
+}
+
+func TestTruncateSize(t *testing.T) {
+	tests := []struct {
+		name       string
+		tcp        bool
+		clientSize uint16
+		want       int
+	}{
+		{name: "non-EDNS0 client", want: dns.MinMsgSize},
+		{name: "client size within bufsize", clientSize: 1024, want: 1024},
+		{name: "client size over bufsize", clientSize: 4096, want: 1232},
+		{name: "TCP client", tcp: true, clientSize: 4096, want: dns.MaxMsgSize},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := new(dns.Msg)
+			r.SetQuestion("example.org.", dns.TypeA)
+			if tt.clientSize > 0 {
+				r.SetEdns0(tt.clientSize, false)
+			}
+			state := request.Request{W: &test.ResponseWriter{TCP: tt.tcp}, Req: r}
+			assert.Equal(t, tt.want, truncateSize(state, 1232))
+		})
+	}
+}
@@ -0,0 +1,13 @@
+package hackforward
+
+import (
+	"context"
+
+	"github.com/miekg/dns"
+)
+
+// Engine forwards the queries accepted by the handler to the upstreams and writes the responses. The forwarder,
+// built on the persistent pipelined TCP connections of pkg/pipeline, is the only implementation so far.
+type Engine interface {
+	Process(ctx context.Context, msg *dns.Msg, w dns.ResponseWriter) (int, error)
+}
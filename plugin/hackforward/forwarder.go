@@ -0,0 +1,217 @@
+package hackforward
+
+import (
+	"context"
+	"time"
+
+	"github.com/coredns/coredns/plugin/dnstap"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+
+	"hackforward/pkg/pipeline"
+)
+
+// forwarder is the Engine forwarding the queries through the pipes of pipeline.Driver, adding the response cache,
+// EDNS0 adjustments, query coalescing, query log and dnstap on top of it.
+type forwarder struct {
+	driver     *pipeline.Driver
+	routes     routeTable
+	ecs        ecsPolicy
+	cache      *responseCache
+	inflight   *inflightGroup
+	queryLog   *queryLogger
+	tracer     *queryTracer
+	tapPlugins []*dnstap.Dnstap
+	// minTTL and maxTTL clamp the TTLs of the upstream responses in seconds, 0 leaves the bound unchanged
+	minTTL uint32
+	maxTTL uint32
+	// scrubOptions are the EDNS0 option codes never passed from the upstream responses to the clients
+	scrubOptions []uint16
+	// bufsize is the EDNS0 UDP payload size advertised upstream and to the clients, limiting the UDP responses
+	bufsize uint16
+}
+
+var _ Engine = (*forwarder)(nil)
+
+func newForwarder(driver *pipeline.Driver, ecs ecsPolicy, cache *cacheConfig, queryLog *queryLogger) *forwarder {
+	return &forwarder{
+		driver:   driver,
+		ecs:      ecs,
+		cache:    newResponseCache(cache),
+		inflight: newInflightGroup(),
+		queryLog: queryLog,
+		bufsize:  ednsUDPSize,
+	}
+}
+
+// Process forwards the query through the pipes, serving it from the cache when possible.
+func (f *forwarder) Process(ctx context.Context, r *dns.Msg, w dns.ResponseWriter) (int, error) {
+	start := time.Now()
+	rec := &queryRecord{
+		Name:   r.Question[0].Name,
+		Type:   dns.TypeToString[r.Question[0].Qtype],
+		Client: w.RemoteAddr().String(),
+
+		clientAddr: w.RemoteAddr(),
+	}
+	if f.tracer.matches(r) {
+		rec.trace = newQueryTrace(r, start)
+		rec.trace.logf("received from %s", rec.Client)
+	}
+	if qtype := r.Question[0].Qtype; qtype == dns.TypeAXFR || qtype == dns.TypeIXFR {
+		return f.transfer(ctx, r, w, rec, start)
+	}
+
+	msg, clientOpt := prepareEdns(r, f.bufsize)
+	// the Z flag may be used to request the trace, it must not be sent upstream
+	msg.Zero = false
+	f.ecs.apply(msg, w.RemoteAddr())
+
+	resp, prefetch := f.cache.get(msg)
+	if resp != nil {
+		log("Forwarder: cache hit (%s)", msg.Question[0].Name)
+		rec.Upstream = "cache"
+		rec.trace.logf("served from cache")
+		if prefetch {
+			go f.prefetch(msg.Copy())
+		}
+	} else {
+		var err error
+		resp, err = f.coalescedExchange(ctx, msg, rec)
+		var stale *dns.Msg
+		if err != nil || isUpstreamFailure(resp) {
+			stale = f.cache.getStale(msg)
+		}
+		switch {
+		case stale != nil:
+			reason := any(err)
+			if err == nil {
+				reason = dns.RcodeToString[resp.Rcode]
+			}
+			log("Forwarder: serving stale (%s): %v", msg.Question[0].Name, reason)
+			resp = stale
+			rec.Upstream = "stale"
+			rec.trace.logf("serving stale: %v", reason)
+		case err != nil:
+			rec.trace.logf("failed: %v", err)
+			f.queryLog.log(rec, nil, start)
+			return dns.RcodeServerFailure, err
+		default:
+			clampTTLs(resp, f.minTTL, f.maxTTL)
+			f.cache.set(msg, resp)
+		}
+	}
+
+	restoreEdns(resp, clientOpt, f.scrubOptions, f.bufsize)
+	// the upstream response received over TCP may not fit into the buffer of a UDP client
+	resp.Truncate(truncateSize(request.Request{W: w, Req: r}, f.bufsize))
+	f.queryLog.log(rec, resp, start)
+	if err := w.WriteMsg(resp); err != nil {
+		rec.trace.logf("writing the response failed: %v", err)
+		return dns.RcodeServerFailure, err
+	}
+	rec.trace.logf("answered %s via %s", dns.RcodeToString[resp.Rcode], rec.Upstream)
+	return dns.RcodeSuccess, nil
+}
+
+// isUpstreamFailure reports whether the response signals the failure of the upstream, which is replaced by the stale
+// answer (RFC 8767).
+func isUpstreamFailure(resp *dns.Msg) bool {
+	return resp.Rcode == dns.RcodeServerFailure || resp.Rcode == dns.RcodeRefused
+}
+
+// exchange forwards the message through the driver of the matching route or the default one, recording the upstream and the dnstap messages of the attempts.
+func (f *forwarder) exchange(ctx context.Context, msg *dns.Msg, rec *queryRecord) (*dns.Msg, error) {
+	trace := &pipeline.Trace{Attempt: func(a pipeline.Attempt) {
+		rec.Upstream = a.Upstream.String()
+		rec.trace.attempt(a)
+		if len(f.tapPlugins) != 0 && rec.clientAddr != nil {
+			f.toDnstap(rec.clientAddr, a.RemoteAddr, a.Query, a.Response, a.Start)
+		}
+	}}
+	if rec.trace != nil {
+		trace.Write = rec.trace.write
+	}
+	ctx = pipeline.WithTrace(ctx, trace)
+	return f.routedDriver(msg).Query(ctx, msg)
+}
+
+// routedDriver returns the driver of the route matching the message, or the default one.
+func (f *forwarder) routedDriver(msg *dns.Msg) *pipeline.Driver {
+	if r := f.routes.match(msg.Question[0].Name, msg.Question[0].Qtype); r != nil {
+		return r.driver
+	}
+	return f.driver
+}
+
+// transfer relays the zone transfer from the upstream to the client message by message. The transfer bypasses the
+// cache and the query coalescing, it is cancelled when the client stops accepting the messages.
+func (f *forwarder) transfer(ctx context.Context, r *dns.Msg, w dns.ResponseWriter, rec *queryRecord, start time.Time) (int, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	env, err := f.routedDriver(r).Transfer(ctx, r)
+	if err != nil {
+		f.queryLog.log(rec, nil, start)
+		return dns.RcodeServerFailure, err
+	}
+	rec.Upstream = "transfer"
+
+	var resp *dns.Msg
+	written := 0
+	for e := range env {
+		if e.Error != nil {
+			err = e.Error
+			break
+		}
+		resp = new(dns.Msg)
+		resp.SetReply(r)
+		resp.Authoritative = true
+		resp.Answer = e.RR
+		if err = w.WriteMsg(resp); err != nil {
+			break
+		}
+		written++
+	}
+	if err != nil {
+		// closes the upstream connection, so the rest of the transfer is not read
+		cancel()
+		for range env {
+		}
+		log("Forwarder: transfer of %s failed after %d messages: %v", r.Question[0].Name, written, err)
+		resp = nil
+	}
+	f.queryLog.log(rec, resp, start)
+	if err != nil && written == 0 {
+		return dns.RcodeServerFailure, err
+	}
+	// the messages already written can't be followed by an error response
+	return dns.RcodeSuccess, err
+}
+
+// coalescedExchange joins an identical request already in flight, the requests of different client subnets are never
+// joined.
+func (f *forwarder) coalescedExchange(ctx context.Context, msg *dns.Msg, rec *queryRecord) (*dns.Msg, error) {
+	callRec := *rec
+	callRec.Upstream = "inflight"
+	// the shared exchange must not be cancelled by the client that started it, nor touch its message
+	shared := msg.Copy()
+	resp, err := f.inflight.do(ctx, msg, func() (*dns.Msg, error) {
+		return f.exchange(context.WithoutCancel(ctx), shared, &callRec)
+	})
+	if err == nil {
+		rec.Upstream = callRec.Upstream
+	}
+	return resp, err
+}
+
+func (f *forwarder) prefetch(msg *dns.Msg) {
+	log("Forwarder: prefetching (%s)", msg.Question[0].Name)
+	defer f.cache.prefetchDone(msg)
+	resp, err := f.exchange(context.Background(), msg, &queryRecord{})
+	if err != nil {
+		log("Forwarder: prefetch failed (%s): %v", msg.Question[0].Name, err)
+		return
+	}
+	clampTTLs(resp, f.minTTL, f.maxTTL)
+	f.cache.set(msg, resp)
+}
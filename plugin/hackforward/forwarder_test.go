@@ -0,0 +1,259 @@
+package hackforward
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"hackforward/pkg/pipeline"
+)
+
+// newTestForwarder starts an upstream answering A queries and transferring the example.org zone, and returns
+// a forwarder using it.
+func newTestForwarder(t *testing.T, cache *cacheConfig) (*forwarder, *atomic.Int64) {
+	t.Helper()
+	var queries atomic.Int64
+	server := dnstest.NewServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		queries.Add(1)
+		if r.Question[0].Qtype == dns.TypeAXFR {
+			soa := test.SOA("example.org. 60 IN SOA ns.example.org. admin.example.org. 1 60 60 60 60")
+			ch := make(chan *dns.Envelope, 2)
+			ch <- &dns.Envelope{RR: []dns.RR{soa, test.A("a.example.org. 60 IN A 127.0.0.1")}}
+			ch <- &dns.Envelope{RR: []dns.RR{test.A("b.example.org. 60 IN A 127.0.0.2"), soa}}
+			close(ch)
+			new(dns.Transfer).Out(w, r, ch)
+			return
+		}
+		resp := new(dns.Msg)
+		resp.SetReply(r)
+		resp.Answer = append(resp.Answer, test.A(r.Question[0].Name+" 60 IN A 127.0.0.1"))
+		w.WriteMsg(resp)
+	})
+	return newUpstreamForwarder(t, server, cache), &queries
+}
+
+// newUpstreamForwarder returns a forwarder using the upstream server, which is closed by the cleanup.
+func newUpstreamForwarder(t *testing.T, server *dnstest.Server, cache *cacheConfig) *forwarder {
+	t.Helper()
+	t.Cleanup(server.Close)
+
+	host, port, err := net.SplitHostPort(server.Addr)
+	require.NoError(t, err)
+	portNum, err := strconv.Atoi(port)
+	require.NoError(t, err)
+	driver, err := pipeline.New([]pipeline.ConnConfig{{Hostname: host, Port: portNum}}, pipeline.Config{
+		MaxRetries: 1,
+		Timeout:    time.Second,
+	})
+	require.NoError(t, err)
+	t.Cleanup(driver.Close)
+	return newForwarder(driver, ecsPolicy{}, cache, nil)
+}
+
+func TestForwarder_Process(t *testing.T) {
+	fwd, _ := newTestForwarder(t, nil)
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.org.", dns.TypeA)
+	rec := dnstest.NewRecorder(&test.ResponseWriter{})
+	rcode, err := fwd.Process(context.Background(), req, rec)
+	require.NoError(t, err)
+	assert.Equal(t, dns.RcodeSuccess, rcode)
+	require.NotNil(t, rec.Msg)
+	assert.Equal(t, req.Id, rec.Msg.Id)
+	assert.Len(t, rec.Msg.Answer, 1)
+	assert.Nil(t, rec.Msg.IsEdns0(), "OPT must not be returned to a non-EDNS0 client")
+}
+
+func TestForwarder_ProcessCached(t *testing.T) {
+	fwd, queries := newTestForwarder(t, &cacheConfig{Size: 100, MaxTTL: time.Hour, PrefetchPercentage: 10})
+
+	for i := 0; i < 3; i++ {
+		req := new(dns.Msg)
+		req.SetQuestion("example.org.", dns.TypeA)
+		rec := dnstest.NewRecorder(&test.ResponseWriter{})
+		_, err := fwd.Process(context.Background(), req, rec)
+		require.NoError(t, err)
+		require.NotNil(t, rec.Msg)
+		assert.Equal(t, req.Id, rec.Msg.Id)
+	}
+	assert.EqualValues(t, 1, queries.Load())
+}
+
+func TestForwarder_ProcessCachedBySubnet(t *testing.T) {
+	fwd, queries := newTestForwarder(t, &cacheConfig{Size: 100, MaxTTL: time.Hour, PrefetchPercentage: 10})
+
+	for _, subnet := range []string{"10.0.0.0", "10.0.1.0", "10.0.0.0"} {
+		req := new(dns.Msg)
+		req.SetQuestion("example.org.", dns.TypeA)
+		req.SetEdns0(4096, false)
+		opt := req.IsEdns0()
+		opt.Option = append(opt.Option, &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: 24,
+			Address: net.ParseIP(subnet).To4()})
+		rec := dnstest.NewRecorder(&test.ResponseWriter{})
+		_, err := fwd.Process(context.Background(), req, rec)
+		require.NoError(t, err)
+		require.NotNil(t, rec.Msg)
+	}
+	// the answer for the first subnet is not served to the second one, only the repeated subnet hits the cache
+	assert.EqualValues(t, 2, queries.Load())
+}
+
+func TestForwarder_ProcessServesStale(t *testing.T) {
+	tests := []struct {
+		name  string
+		rcode int
+	}{
+		{name: "SERVFAIL", rcode: dns.RcodeServerFailure},
+		{name: "REFUSED", rcode: dns.RcodeRefused},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var failing atomic.Bool
+			server := dnstest.NewServer(func(w dns.ResponseWriter, r *dns.Msg) {
+				resp := new(dns.Msg)
+				resp.SetReply(r)
+				if failing.Load() {
+					resp.Rcode = tt.rcode
+				} else {
+					resp.Answer = append(resp.Answer, test.A(r.Question[0].Name+" 60 IN A 127.0.0.1"))
+				}
+				w.WriteMsg(resp)
+			})
+			fwd := newUpstreamForwarder(t, server, &cacheConfig{Size: 100, MaxTTL: 50 * time.Millisecond,
+				PrefetchPercentage: 10, ServeStale: time.Hour})
+
+			process := func() *dns.Msg {
+				req := new(dns.Msg)
+				req.SetQuestion("example.org.", dns.TypeA)
+				rec := dnstest.NewRecorder(&test.ResponseWriter{})
+				_, err := fwd.Process(context.Background(), req, rec)
+				require.NoError(t, err)
+				require.NotNil(t, rec.Msg)
+				return rec.Msg
+			}
+			process()
+			time.Sleep(60 * time.Millisecond)
+			failing.Store(true)
+
+			resp := process()
+			assert.Equal(t, dns.RcodeSuccess, resp.Rcode)
+			require.Len(t, resp.Answer, 1)
+			assert.EqualValues(t, staleTTL, resp.Answer[0].Header().Ttl)
+		})
+	}
+}
+
+func TestForwarder_prefetchFailed(t *testing.T) {
+	var failing atomic.Bool
+	server := dnstest.NewServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		resp := new(dns.Msg)
+		resp.SetReply(r)
+		if failing.Load() {
+			resp.Rcode = dns.RcodeServerFailure
+		} else {
+			resp.Answer = append(resp.Answer, test.A(r.Question[0].Name+" 60 IN A 127.0.0.1"))
+		}
+		w.WriteMsg(resp)
+	})
+	fwd := newUpstreamForwarder(t, server, &cacheConfig{Size: 100, MaxTTL: time.Minute, Prefetch: 1,
+		PrefetchPercentage: 100})
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.org.", dns.TypeA)
+	rec := dnstest.NewRecorder(&test.ResponseWriter{})
+	_, err := fwd.Process(context.Background(), req, rec)
+	require.NoError(t, err)
+	failing.Store(true)
+
+	_, prefetch := fwd.cache.get(req)
+	require.True(t, prefetch)
+	_, prefetch = fwd.cache.get(req)
+	assert.False(t, prefetch, "the entry is being prefetched")
+
+	fwd.prefetch(req.Copy())
+	_, prefetch = fwd.cache.get(req)
+	assert.True(t, prefetch, "the failed prefetch is expected to be retried")
+}
+
+func TestForwarder_ProcessClampsTTLs(t *testing.T) {
+	tests := []struct {
+		name    string
+		minTTL  uint32
+		maxTTL  uint32
+		wantTTL uint32
+	}{
+		{name: "disabled", wantTTL: 60},
+		{name: "raised to min_ttl", minTTL: 300, wantTTL: 300},
+		{name: "lowered to max_ttl", maxTTL: 10, wantTTL: 10},
+		{name: "within bounds", minTTL: 30, maxTTL: 120, wantTTL: 60},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fwd, _ := newTestForwarder(t, nil)
+			fwd.minTTL, fwd.maxTTL = tt.minTTL, tt.maxTTL
+
+			req := new(dns.Msg)
+			req.SetQuestion("example.org.", dns.TypeA)
+			rec := dnstest.NewRecorder(&test.ResponseWriter{})
+			_, err := fwd.Process(context.Background(), req, rec)
+			require.NoError(t, err)
+			require.NotNil(t, rec.Msg)
+			require.Len(t, rec.Msg.Answer, 1)
+			assert.Equal(t, tt.wantTTL, rec.Msg.Answer[0].Header().Ttl)
+		})
+	}
+}
+
+// messageCollector records all the messages written to the client.
+type messageCollector struct {
+	test.ResponseWriter
+	msgs []*dns.Msg
+}
+
+func (c *messageCollector) WriteMsg(m *dns.Msg) error {
+	c.msgs = append(c.msgs, m)
+	return nil
+}
+
+func TestForwarder_ProcessTransfer(t *testing.T) {
+	fwd, _ := newTestForwarder(t, nil)
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.org.", dns.TypeAXFR)
+	w := &messageCollector{}
+	rcode, err := fwd.Process(context.Background(), req, w)
+	require.NoError(t, err)
+	assert.Equal(t, dns.RcodeSuccess, rcode)
+	require.Len(t, w.msgs, 2)
+	for _, msg := range w.msgs {
+		assert.Equal(t, req.Id, msg.Id)
+		assert.Len(t, msg.Answer, 2)
+	}
+	assert.Equal(t, dns.TypeSOA, w.msgs[0].Answer[0].Header().Rrtype)
+	assert.Equal(t, dns.TypeSOA, w.msgs[1].Answer[1].Header().Rrtype)
+}
+
+func TestForwarder_ProcessTraced(t *testing.T) {
+	fwd, _ := newTestForwarder(t, nil)
+	fwd.tracer = newQueryTracer(nil, true)
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.org.", dns.TypeA)
+	req.Zero = true
+	rec := dnstest.NewRecorder(&test.ResponseWriter{})
+	rcode, err := fwd.Process(context.Background(), req, rec)
+	require.NoError(t, err)
+	assert.Equal(t, dns.RcodeSuccess, rcode)
+	require.NotNil(t, rec.Msg)
+	assert.Len(t, rec.Msg.Answer, 1)
+}
@@ -2,19 +2,109 @@ package hackforward
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"time"
 
 	"github.com/coredns/coredns/plugin"
+	"github.com/coredns/coredns/request"
 	"github.com/miekg/dns"
+
+	"hackforward/pkg/pipeline"
 )
 
 type handler struct {
-	Next       plugin.Handler
-	pipeDriver PipeDriver
+	Next         plugin.Handler
+	engine       Engine
+	except       []string
+	blockedTypes []uint16
+	views        viewTable
+	stats        *statsResponder
+	acl          *acl
+	limiter      *limiter
+	// drivers are the drivers of the default upstreams, the routes and the views, all of them must be ready
+	drivers []*pipeline.Driver
 }
 
 func (h *handler) Name() string { return pluginName }
 
-func (h *handler) ServeDNS(_ context.Context, w dns.ResponseWriter, r *dns.Msg) (int, error) {
+// Ready implements the ready.Readiness interface, so the ready plugin reports the server ready once a pipe is
+// established to every primary upstream.
+func (h *handler) Ready() bool {
+	if len(h.drivers) == 0 {
+		return false
+	}
+	for _, driver := range h.drivers {
+		if !driver.Ready() {
+			return false
+		}
+	}
+	return true
+}
+
+func (h *handler) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (int, error) {
+	if !h.isAllowedDomain(r.Question[0].Name) {
+		log("skip: %v", r.Question[0].Name)
+		return plugin.NextOrFailure(h.Name(), h.Next, ctx, w, r)
+	}
+	if slices.Contains(h.blockedTypes, r.Question[0].Qtype) {
+		log("blocked: %v %s", r.Question[0].Name, dns.TypeToString[r.Question[0].Qtype])
+		m := new(dns.Msg)
+		m.SetRcode(r, dns.RcodeRefused)
+		w.WriteMsg(m)
+		return dns.RcodeRefused, nil
+	}
+	state := request.Request{W: w, Req: r}
+	clientIP := net.ParseIP(state.IP())
+	if !h.acl.allowed(clientIP) {
+		log("denied: %v (%s)", r.Question[0].Name, state.IP())
+		if h.acl.action == aclActionNext {
+			return plugin.NextOrFailure(h.Name(), h.Next, ctx, w, r)
+		}
+		m := new(dns.Msg)
+		m.SetRcode(r, dns.RcodeRefused)
+		w.WriteMsg(m)
+		return dns.RcodeRefused, nil
+	}
+	if h.stats.matches(r) {
+		w.WriteMsg(h.stats.response(r))
+		return dns.RcodeSuccess, nil
+	}
+	if !h.limiter.acquire() {
+		log("rejected: %v", r.Question[0].Name)
+		return dns.RcodeServerFailure, errors.New("max concurrent queries reached")
+	}
+	defer h.limiter.release()
+
+	engine := h.engine
+	if v := h.views.match(clientIP); v != nil {
+		engine = v.engine
+	}
 	log("forward: %v", r.Question[0].Name)
-	return h.pipeDriver.process(r, w)
+	return engine.Process(ctx, r, w)
+}
+
+func (h *handler) isAllowedDomain(name string) bool {
+	for _, except := range h.except {
+		if plugin.Name(except).Matches(name) {
+			return false
+		}
+	}
+	return true
+}
+
+func log(format string, a ...any) {
+	s := fmt.Sprintf("%d ", time.Now().UnixNano()/1000) + fmt.Sprintf(format, a...)
+	fmt.Println(s)
+}
+
+func safeClose(ch chan struct{}) {
+	select {
+	case <-ch:
+		return
+	default:
+		close(ch)
+	}
 }
@@ -0,0 +1,48 @@
+package hackforward
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"hackforward/pkg/pipeline"
+)
+
+func TestHandler_Ready(t *testing.T) {
+	fwd, _ := newTestForwarder(t, nil)
+	h := &handler{}
+	assert.False(t, h.Ready(), "the handler without drivers is not started yet")
+
+	h.drivers = []*pipeline.Driver{fwd.driver}
+	// the pools are loaded by the maintenance loops of the drivers, not by the probe
+	require.Eventually(t, h.Ready, 3*time.Second, 10*time.Millisecond)
+
+	// nothing listens on the port of the unreachable upstream
+	unreachable, err := pipeline.New([]pipeline.ConnConfig{{Hostname: "127.0.0.1", Port: 1}}, pipeline.Config{})
+	require.NoError(t, err)
+	t.Cleanup(unreachable.Close)
+	h.drivers = append(h.drivers, unreachable)
+	assert.Never(t, h.Ready, 200*time.Millisecond, 10*time.Millisecond)
+}
+
+func TestHandler_isAllowedDomain(t *testing.T) {
+	h := &handler{except: convertExcepts([]string{"example.org", "Internal."})}
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{name: "example.org.", want: false},
+		{name: "www.example.org.", want: false},
+		{name: "host.internal.", want: false},
+		{name: "notexample.org.", want: true},
+		{name: "example.com.", want: true},
+		{name: ".", want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, h.isAllowedDomain(tt.name))
+		})
+	}
+}
@@ -0,0 +1,63 @@
+package hackforward
+
+import (
+	"context"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+type inflightCall struct {
+	done chan struct{}
+	resp *dns.Msg
+	err  error
+}
+
+// inflightGroup coalesces concurrent identical queries, so only one of them is forwarded upstream.
+type inflightGroup struct {
+	calls map[cacheKey]*inflightCall
+	lock  sync.Mutex
+}
+
+func newInflightGroup() *inflightGroup {
+	return &inflightGroup{calls: make(map[cacheKey]*inflightCall)}
+}
+
+// do executes exchange once for all concurrent requests with the same question, each of the callers receives
+// its own copy of the response. A caller stops waiting when its context is done, the exchange itself continues.
+func (g *inflightGroup) do(ctx context.Context, req *dns.Msg, exchange func() (*dns.Msg, error)) (*dns.Msg, error) {
+	key := newCacheKey(req)
+
+	g.lock.Lock()
+	call, ok := g.calls[key]
+	if ok {
+		log("Driver: joining in-flight request (%s)", req.Question[0].Name)
+	} else {
+		call = &inflightCall{done: make(chan struct{})}
+		g.calls[key] = call
+		go func() {
+			call.resp, call.err = exchange()
+			g.lock.Lock()
+			delete(g.calls, key)
+			g.lock.Unlock()
+			close(call.done)
+		}()
+	}
+	g.lock.Unlock()
+
+	select {
+	case <-call.done:
+		return call.result(req.Id)
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (c *inflightCall) result(id uint16) (*dns.Msg, error) {
+	if c.err != nil {
+		return nil, c.err
+	}
+	resp := c.resp.Copy()
+	resp.Id = id
+	return resp, nil
+}
@@ -0,0 +1,129 @@
+package hackforward
+
+import (
+	"sort"
+
+	discoveryv1 "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	toolscache "k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/clientcmd"
+
+	"hackforward/pkg/pipeline"
+)
+
+type kubernetesConfig struct {
+	Namespace  string `cf:"namespace" default:"default" check:"nonempty"`
+	Service    string `cf:"service" check:"nonempty"`
+	PortName   string `cf:"port_name"`
+	Port       int    `cf:"port" default:"53" check:"range(1-65535)"`
+	Kubeconfig string `cf:"kubeconfig"`
+}
+
+// endpointsDiscovery keeps the upstream list in sync with the EndpointSlices of a Kubernetes service.
+type endpointsDiscovery struct {
+	cfg     *kubernetesConfig
+	factory informers.SharedInformerFactory
+	stop    chan struct{}
+}
+
+func newEndpointsDiscovery(cfg *kubernetesConfig) (*endpointsDiscovery, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+	restConfig, err := kubeRestConfig(cfg.Kubeconfig)
+	if err != nil {
+		return nil, err
+	}
+	client, err := kubernetes.NewForConfig(restConfig)
+	if err != nil {
+		return nil, err
+	}
+	factory := informers.NewSharedInformerFactoryWithOptions(client, 0,
+		informers.WithNamespace(cfg.Namespace),
+		informers.WithTweakListOptions(func(opts *metav1.ListOptions) {
+			opts.LabelSelector = discoveryv1.LabelServiceName + "=" + cfg.Service
+		}))
+	return &endpointsDiscovery{cfg: cfg, factory: factory, stop: make(chan struct{})}, nil
+}
+
+func kubeRestConfig(kubeconfig string) (*rest.Config, error) {
+	if kubeconfig == "" {
+		return rest.InClusterConfig()
+	}
+	return clientcmd.BuildConfigFromFlags("", kubeconfig)
+}
+
+// start watches the service endpoints and calls onChange with the current upstream list whenever they change.
+// The initial list is delivered before start returns. It is safe to be called on nil discovery.
+func (d *endpointsDiscovery) start(onChange func([]pipeline.ConnConfig)) {
+	if d == nil {
+		return
+	}
+	informer := d.factory.Discovery().V1().EndpointSlices()
+	lister := informer.Lister().EndpointSlices(d.cfg.Namespace)
+	update := func() {
+		slices, err := lister.List(labels.Everything())
+		if err != nil {
+			log("listing endpoints of %s/%s failed: %v", d.cfg.Namespace, d.cfg.Service, err)
+			return
+		}
+		onChange(d.upstreams(slices))
+	}
+	informer.Informer().AddEventHandler(toolscache.ResourceEventHandlerFuncs{
+		AddFunc:    func(any) { update() },
+		UpdateFunc: func(any, any) { update() },
+		DeleteFunc: func(any) { update() },
+	})
+	d.factory.Start(d.stop)
+	d.factory.WaitForCacheSync(d.stop)
+	update()
+}
+
+// upstreams returns sorted addresses of the ready endpoints, so the primary upstream stays stable.
+func (d *endpointsDiscovery) upstreams(slices []*discoveryv1.EndpointSlice) []pipeline.ConnConfig {
+	seen := make(map[pipeline.ConnConfig]bool)
+	var upstreams []pipeline.ConnConfig
+	for _, slice := range slices {
+		port, ok := d.port(slice)
+		if !ok {
+			continue
+		}
+		for _, endpoint := range slice.Endpoints {
+			if endpoint.Conditions.Ready != nil && !*endpoint.Conditions.Ready {
+				continue
+			}
+			for _, address := range endpoint.Addresses {
+				upstream := pipeline.ConnConfig{Hostname: address, Port: port}
+				if !seen[upstream] {
+					seen[upstream] = true
+					upstreams = append(upstreams, upstream)
+				}
+			}
+		}
+	}
+	sort.Slice(upstreams, func(i, j int) bool { return upstreams[i].String() < upstreams[j].String() })
+	return upstreams
+}
+
+func (d *endpointsDiscovery) port(slice *discoveryv1.EndpointSlice) (int, bool) {
+	if d.cfg.PortName == "" {
+		return d.cfg.Port, true
+	}
+	for _, port := range slice.Ports {
+		if port.Name != nil && *port.Name == d.cfg.PortName && port.Port != nil {
+			return int(*port.Port), true
+		}
+	}
+	log("port %s not found in endpoint slice %s", d.cfg.PortName, slice.Name)
+	return 0, false
+}
+
+func (d *endpointsDiscovery) close() {
+	if d != nil {
+		safeClose(d.stop)
+	}
+}
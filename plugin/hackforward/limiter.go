@@ -0,0 +1,58 @@
+package hackforward
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// limiter bounds the number of concurrently processed requests, requests over the limit are queued up to maxQueue.
+type limiter struct {
+	slots    chan struct{}
+	queued   atomic.Int32
+	maxQueue int32
+	timeout  time.Duration
+}
+
+func newLimiter(maxConcurrent, maxQueue int, timeout time.Duration) *limiter {
+	if maxConcurrent == 0 {
+		return nil
+	}
+	return &limiter{slots: make(chan struct{}, maxConcurrent), maxQueue: int32(maxQueue), timeout: timeout}
+}
+
+// acquire returns false if the request has to be rejected, it is safe to be called on nil limiter.
+func (l *limiter) acquire() bool {
+	if l == nil {
+		return true
+	}
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	default:
+	}
+
+	if l.queued.Add(1) > l.maxQueue {
+		l.queued.Add(-1)
+		maxConcurrentRejectCount.Inc()
+		return false
+	}
+	queuedGauge.Inc()
+	defer func() {
+		l.queued.Add(-1)
+		queuedGauge.Dec()
+	}()
+
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	case <-time.After(l.timeout):
+		maxConcurrentRejectCount.Inc()
+		return false
+	}
+}
+
+func (l *limiter) release() {
+	if l != nil {
+		<-l.slots
+	}
+}
@@ -0,0 +1,23 @@
+package hackforward
+
+import (
+	"github.com/coredns/coredns/plugin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	maxConcurrentRejectCount = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "hack_forward",
+		Name:      "max_concurrent_rejects_total",
+		Help:      "Counter of the number of queries rejected because the concurrent queries and the queue were at maximum.",
+	})
+
+	queuedGauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "hack_forward",
+		Name:      "queued_requests",
+		Help:      "Gauge of the number of queries waiting for a free concurrency slot.",
+	})
+)
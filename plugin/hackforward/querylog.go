@@ -0,0 +1,201 @@
+package hackforward
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/syslog"
+	"math/rand"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"hackforward/pkg/corefile"
+)
+
+type queryLogConfig struct {
+	Sink       string            `cf:"sink" default:"stdout" check:"oneOf(stdout|file|syslog)"`
+	Path       string            `cf:"path"`
+	MaxSize    corefile.ByteSize `cf:"max_size" default:"10MiB" check:"gt(0)"`
+	MaxBackups int               `cf:"max_backups" default:"3" check:"gte(0)"`
+	Address    string            `cf:"address" default:"127.0.0.1:514" check:"hostport"`
+	Sample     float64           `cf:"sample" default:"1" check:"gt(0),lte(1)"`
+}
+
+func (c *queryLogConfig) Check() error {
+	if c.Sink == "file" && c.Path == "" {
+		return fmt.Errorf("path is required by the file sink")
+	}
+	return nil
+}
+
+// queryRecord collects the details about a single forwarded query.
+type queryRecord struct {
+	Time     time.Time `json:"time"`
+	Name     string    `json:"qname"`
+	Type     string    `json:"qtype"`
+	Client   string    `json:"client"`
+	Upstream string    `json:"upstream"`
+	Rcode    string    `json:"rcode"`
+	RTT      string    `json:"rtt"`
+
+	clientAddr net.Addr
+	// trace is set for the queries selected by the queryTracer
+	trace *queryTrace
+}
+
+type querySink interface {
+	write(line []byte) error
+	close() error
+}
+
+type queryLogger struct {
+	sink   querySink
+	sample float64
+}
+
+func newQueryLogger(cfg *queryLogConfig) (*queryLogger, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+	var sink querySink
+	var err error
+	switch cfg.Sink {
+	case "file":
+		sink, err = newFileSink(cfg.Path, int64(cfg.MaxSize), cfg.MaxBackups)
+	case "syslog":
+		sink, err = newSyslogSink(cfg.Address)
+	default:
+		sink = stdoutSink{}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &queryLogger{sink: sink, sample: cfg.Sample}, nil
+}
+
+// log writes the record to the sink, it is safe to be called on nil logger, which represents disabled logging.
+func (l *queryLogger) log(rec *queryRecord, resp *dns.Msg, start time.Time) {
+	if l == nil || (l.sample < 1 && rand.Float64() >= l.sample) {
+		return
+	}
+	rec.Time = start
+	rec.RTT = time.Since(start).String()
+	rec.Rcode = dns.RcodeToString[dns.RcodeServerFailure]
+	if resp != nil {
+		rec.Rcode = dns.RcodeToString[resp.Rcode]
+	}
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return
+	}
+	if err = l.sink.write(line); err != nil {
+		log("query log: write failed: %v", err)
+	}
+}
+
+func (l *queryLogger) close() error {
+	if l == nil {
+		return nil
+	}
+	return l.sink.close()
+}
+
+type stdoutSink struct{}
+
+func (stdoutSink) write(line []byte) error {
+	_, err := fmt.Println(string(line))
+	return err
+}
+
+func (stdoutSink) close() error { return nil }
+
+// fileSink writes into a file rotated when its size exceeds maxSize, keeping maxBackups of older files.
+type fileSink struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+	file       *os.File
+	size       int64
+	lock       sync.Mutex
+}
+
+func newFileSink(path string, maxSize int64, maxBackups int) (*fileSink, error) {
+	s := fileSink{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+func (s *fileSink) open() error {
+	file, err := os.OpenFile(s.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	s.file, s.size = file, info.Size()
+	return nil
+}
+
+// write appends the line, rotating the file first if the line doesn't fit into it. The line longer than maxSize is
+// written into the empty file anyway, rotating it wouldn't make the room for it.
+func (s *fileSink) write(line []byte) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.size > 0 && s.size+int64(len(line))+1 > s.maxSize {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := s.file.Write(append(line, '\n'))
+	s.size += int64(n)
+	return err
+}
+
+func (s *fileSink) rotate() error {
+	if err := s.file.Close(); err != nil {
+		return err
+	}
+	if s.maxBackups == 0 {
+		os.Remove(s.path)
+	} else {
+		for i := s.maxBackups - 1; i > 0; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", s.path, i), fmt.Sprintf("%s.%d", s.path, i+1))
+		}
+		os.Rename(s.path, s.path+".1")
+	}
+	return s.open()
+}
+
+func (s *fileSink) close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.file.Close()
+}
+
+type syslogSink struct {
+	writer *syslog.Writer
+}
+
+func newSyslogSink(address string) (*syslogSink, error) {
+	writer, err := syslog.Dial("udp", address, syslog.LOG_INFO|syslog.LOG_DAEMON, pluginName)
+	if err != nil {
+		return nil, err
+	}
+	return &syslogSink{writer: writer}, nil
+}
+
+func (s *syslogSink) write(line []byte) error {
+	return s.writer.Info(string(line))
+}
+
+func (s *syslogSink) close() error {
+	return s.writer.Close()
+}
@@ -0,0 +1,32 @@
+package hackforward
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileSink_rotate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "query.log")
+	sink, err := newFileSink(path, 10, 2)
+	require.NoError(t, err)
+	t.Cleanup(func() { sink.close() })
+
+	long := []byte(strings.Repeat("x", 20))
+	require.NoError(t, sink.write(long))
+	require.NoError(t, sink.write([]byte("a")))
+	require.NoError(t, sink.write([]byte("b")))
+
+	// the long line is not rotated out of the empty file, the next line doesn't fit after it
+	current, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, "a\nb\n", string(current))
+	backup, err := os.ReadFile(path + ".1")
+	require.NoError(t, err)
+	assert.Equal(t, string(long)+"\n", string(backup))
+	assert.NoFileExists(t, path+".2")
+}
@@ -0,0 +1,119 @@
+package hackforward
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/coredns/coredns/plugin"
+	"github.com/miekg/dns"
+
+	"hackforward/pkg/pipeline"
+)
+
+// route forwards the queries for the zone and its subdomains, or the queries of the type, to its own upstreams instead
+// of the default ones.
+type route struct {
+	zone      string
+	qtype     uint16
+	upstreams []pipeline.ConnConfig
+	driver    *pipeline.Driver
+}
+
+// routeTable is ordered with the type routes first, followed by the zone routes from the most specific zone, so the
+// first match is the type route or the longest suffix of the qname.
+type routeTable []*route
+
+// convertRoutes parses the route rows in the form of zone followed by one or more upstreams.
+func convertRoutes(rows [][]string) (routeTable, error) {
+	var table routeTable
+	seen := map[string]bool{}
+	for _, row := range rows {
+		if len(row) < 2 {
+			return nil, fmt.Errorf("route expects a zone and at least one upstream: %v", row)
+		}
+		zones := plugin.Host(row[0]).NormalizeExact()
+		if len(zones) != 1 {
+			return nil, fmt.Errorf("invalid route zone: %s", row[0])
+		}
+		if seen[zones[0]] {
+			return nil, fmt.Errorf("duplicate route zone: %s", zones[0])
+		}
+		seen[zones[0]] = true
+		upstreams, err := convertUpstreams(row[1:])
+		if err != nil {
+			return nil, err
+		}
+		table = append(table, &route{zone: zones[0], upstreams: upstreams})
+	}
+	table.sort()
+	return table, nil
+}
+
+// convertTypeRoutes parses the type route rows in the form of query type followed by one or more upstreams and adds
+// them to the table.
+func (t routeTable) convertTypeRoutes(rows [][]string) (routeTable, error) {
+	seen := map[uint16]bool{}
+	for _, row := range rows {
+		if len(row) < 2 {
+			return nil, fmt.Errorf("route_type expects a query type and at least one upstream: %v", row)
+		}
+		qtypes, err := convertQtypes(row[:1])
+		if err != nil {
+			return nil, err
+		}
+		if seen[qtypes[0]] {
+			return nil, fmt.Errorf("duplicate route type: %s", dns.TypeToString[qtypes[0]])
+		}
+		seen[qtypes[0]] = true
+		upstreams, err := convertUpstreams(row[1:])
+		if err != nil {
+			return nil, err
+		}
+		t = append(t, &route{qtype: qtypes[0], upstreams: upstreams})
+	}
+	t.sort()
+	return t, nil
+}
+
+func (t routeTable) sort() {
+	sort.SliceStable(t, func(i, j int) bool {
+		if (t[i].qtype != 0) != (t[j].qtype != 0) {
+			return t[i].qtype != 0
+		}
+		return dns.CountLabel(t[i].zone) > dns.CountLabel(t[j].zone)
+	})
+}
+
+// match returns the route of the query type or of the longest zone containing the name, nil if no route matches.
+func (t routeTable) match(name string, qtype uint16) *route {
+	for _, r := range t {
+		if r.qtype != 0 {
+			if r.qtype == qtype {
+				return r
+			}
+			continue
+		}
+		if plugin.Name(r.zone).Matches(name) {
+			return r
+		}
+	}
+	return nil
+}
+
+// start creates the drivers of the routes, all of them sharing the configuration of the default one.
+func (t routeTable) start(cfg pipeline.Config) error {
+	cfg.Backups = nil
+	for _, r := range t {
+		var err error
+		if r.driver, err = pipeline.New(r.upstreams, cfg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t routeTable) close() {
+	for _, r := range t {
+		r.driver.Close()
+	}
+}
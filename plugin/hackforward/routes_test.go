@@ -0,0 +1,89 @@
+package hackforward
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRouteTable_match(t *testing.T) {
+	table, err := convertRoutes([][]string{
+		{"example.com", "10.0.0.1"},
+		{"corp.example.com", "10.0.0.2:53", "10.0.0.3:5353"},
+		{"LAB.corp.example.com.", "10.0.0.4"},
+	})
+	require.NoError(t, err)
+	table, err = table.convertTypeRoutes([][]string{{"ptr", "10.0.0.5"}})
+	require.NoError(t, err)
+
+	tests := []struct {
+		name      string
+		qtype     uint16
+		wantZone  string
+		wantQtype uint16
+	}{
+		{name: "example.com.", qtype: dns.TypeA, wantZone: "example.com."},
+		{name: "www.example.com.", qtype: dns.TypeA, wantZone: "example.com."},
+		{name: "corp.example.com.", qtype: dns.TypeA, wantZone: "corp.example.com."},
+		{name: "host.Corp.example.com.", qtype: dns.TypeA, wantZone: "corp.example.com."},
+		{name: "host.lab.corp.example.com.", qtype: dns.TypeAAAA, wantZone: "lab.corp.example.com."},
+		{name: "notcorp.example.com.", qtype: dns.TypeA, wantZone: "example.com."},
+		{name: "corp.example.com.", qtype: dns.TypePTR, wantQtype: dns.TypePTR},
+		{name: "1.0.0.10.in-addr.arpa.", qtype: dns.TypePTR, wantQtype: dns.TypePTR},
+		{name: "example.org.", qtype: dns.TypeA},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name+" "+dns.TypeToString[tt.qtype], func(t *testing.T) {
+			r := table.match(tt.name, tt.qtype)
+			if tt.wantZone == "" && tt.wantQtype == 0 {
+				assert.Nil(t, r)
+				return
+			}
+			require.NotNil(t, r)
+			assert.Equal(t, tt.wantZone, r.zone)
+			assert.Equal(t, tt.wantQtype, r.qtype)
+		})
+	}
+}
+
+func TestConvertRoutes(t *testing.T) {
+	tests := []struct {
+		name    string
+		rows    [][]string
+		wantErr bool
+	}{
+		{name: "no routes"},
+		{name: "valid", rows: [][]string{{"corp.example.com", "10.0.0.2:53"}}},
+		{name: "missing upstream", rows: [][]string{{"corp.example.com"}}, wantErr: true},
+		{name: "invalid upstream", rows: [][]string{{"corp.example.com", "10.0.0.2:x"}}, wantErr: true},
+		{name: "duplicate zone", rows: [][]string{{"corp.example.com", "10.0.0.2"}, {"corp.example.com.", "10.0.0.3"}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := convertRoutes(tt.rows)
+			assert.Equal(t, tt.wantErr, err != nil)
+		})
+	}
+}
+
+func TestRouteTable_convertTypeRoutes(t *testing.T) {
+	tests := []struct {
+		name    string
+		rows    [][]string
+		wantErr bool
+	}{
+		{name: "no routes"},
+		{name: "valid", rows: [][]string{{"PTR", "10.0.0.5"}, {"aaaa", "10.0.0.6:53"}}},
+		{name: "missing upstream", rows: [][]string{{"PTR"}}, wantErr: true},
+		{name: "unknown type", rows: [][]string{{"XYZ", "10.0.0.5"}}, wantErr: true},
+		{name: "duplicate type", rows: [][]string{{"PTR", "10.0.0.5"}, {"ptr", "10.0.0.6"}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := routeTable(nil).convertTypeRoutes(tt.rows)
+			assert.Equal(t, tt.wantErr, err != nil)
+		})
+	}
+}
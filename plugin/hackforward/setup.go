@@ -2,13 +2,21 @@ package hackforward
 
 import (
 	"errors"
+	"fmt"
+	"net"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/coredns/caddy"
 	"github.com/coredns/coredns/core/dnsserver"
 	"github.com/coredns/coredns/plugin"
+	"github.com/coredns/coredns/plugin/dnstap"
+	clog "github.com/coredns/coredns/plugin/pkg/log"
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
 	"hackforward/pkg/corefile"
+	"hackforward/pkg/pipeline"
 )
 
 const (
@@ -24,41 +32,400 @@ func setup(c *caddy.Controller) error {
 	if err := corefile.Parse(c, &cfg); err != nil {
 		return err
 	}
+	if c.Next() {
+		return plugin.Error(pluginName, c.Err("only one hack_forward block per server block is allowed"))
+	}
 
-	h := handler{}
+	b, err := newForwardBlock(&cfg)
+	if err != nil {
+		return err
+	}
+	b.tap = func() *dnstap.Dnstap {
+		if taph := dnsserver.GetConfig(c).Handler("dnstap"); taph != nil {
+			return taph.(*dnstap.Dnstap)
+		}
+		return nil
+	}
 	dnsserver.GetConfig(c).AddPlugin(func(next plugin.Handler) plugin.Handler {
-		h.Next = next
-		return &h
+		b.handler.Next = next
+		return b.handler
 	})
+	c.OnStartup(b.start)
+	c.OnShutdown(b.stop)
+	return nil
+}
+
+// forwardBlock holds the state of a single hack_forward block of the Corefile. Every block has its own handler,
+// drivers, cache and background tasks, nothing is shared with the other blocks, so they can be configured
+// independently, e.g. one with the cache for "." and another one without it for an internal zone.
+type forwardBlock struct {
+	cfg     *config
+	handler *handler
+	// tap returns the dnstap plugin of the server, if configured
+	tap func() *dnstap.Dnstap
+
+	upstreams    []pipeline.ConnConfig
+	pipelineCfg  pipeline.Config
+	routes       routeTable
+	views        viewTable
+	ecs          ecsPolicy
+	scrubOptions []uint16
+	discovery    *endpointsDiscovery
+
+	queryLog *queryLogger
+	watcher  *fileWatcher
+	admin    *adminServer
+	driver   *pipeline.Driver
+}
+
+// newForwardBlock validates and converts the configuration of the block, the drivers are created by start.
+func newForwardBlock(cfg *config) (*forwardBlock, error) {
+	clientACL, err := newACL(cfg.Allow, cfg.Deny, cfg.ACLAction)
+	if err != nil {
+		return nil, err
+	}
+
+	blockedTypes, err := convertQtypes(cfg.BlockTypes)
+	if err != nil {
+		return nil, err
+	}
+
+	views, err := convertViews(cfg.Views)
+	if err != nil {
+		return nil, err
+	}
 
 	upstreams, err := convertUpstreams(cfg.Upstreams)
 	if err != nil {
+		return nil, err
+	}
+
+	backups, err := convertUpstreams(cfg.Backups)
+	if err != nil {
+		return nil, err
+	}
+
+	routes, err := convertRoutes(cfg.Routes)
+	if err != nil {
+		return nil, err
+	}
+	if routes, err = routes.convertTypeRoutes(cfg.TypeRoutes); err != nil {
+		return nil, err
+	}
+
+	retryRcodes, err := convertRcodes(cfg.RetryOn)
+	if err != nil {
+		return nil, err
+	}
+
+	hedgeDelay, err := convertHedge(cfg.Hedge)
+	if err != nil {
+		return nil, err
+	}
+
+	ecs, err := convertEcs(cfg.ECS)
+	if err != nil {
+		return nil, err
+	}
+
+	scrubOptions, err := convertOptionCodes(cfg.ScrubOptions)
+	if err != nil {
+		return nil, err
+	}
+
+	discovery, err := newEndpointsDiscovery(cfg.Kubernetes)
+	if err != nil {
+		return nil, err
+	}
+
+	return &forwardBlock{
+		cfg: cfg,
+		handler: &handler{
+			except:       convertExcepts(cfg.Except),
+			blockedTypes: blockedTypes,
+			views:        views,
+			acl:          clientACL,
+			limiter:      newLimiter(cfg.MaxConcurrent, cfg.MaxQueue, cfg.Timeout),
+		},
+		upstreams: upstreams,
+		pipelineCfg: pipeline.Config{
+			MaxRetries:      cfg.MaxRetries,
+			RetryRcodes:     retryRcodes,
+			Referrals:       referralPolicies[cfg.Referrals],
+			AttemptTimeout:  cfg.AttemptTimeout,
+			Timeout:         cfg.Timeout,
+			AttemptDeadline: cfg.AttemptDeadline,
+			RetryInterval:   cfg.RetryInterval,
+			Cookies:         cfg.Cookies,
+			Case0x20:        cfg.Dns0x20,
+			HedgeDelay:      hedgeDelay,
+			Backups:         backups,
+			WarmStandby:     cfg.WarmStandby,
+			HealthCheck:     convertHealthCheck(cfg.HealthCheck),
+			Autoscale:       (*pipeline.AutoscaleConfig)(cfg.Autoscale),
+			// the metrics keep the names they had before the pipeline package was extracted from the plugin
+			Metrics:          prometheus.DefaultRegisterer,
+			MetricsNamespace: plugin.Namespace + "_" + pluginName,
+			Logger:           clog.NewWithPlugin(pluginName),
+			Pipe: pipeline.PipeConfig{
+				Keepalive:       cfg.Keepalive,
+				KeepalivePeriod: cfg.KeepalivePeriod,
+				IdleTimeout:     cfg.IdleTimeout,
+				ReapTimeout:     cfg.IdleReap,
+				MaxInflight:     cfg.MaxInflight,
+				FallbackDelay:   cfg.FallbackDelay,
+			},
+		},
+		routes:       routes,
+		views:        views,
+		ecs:          ecs,
+		scrubOptions: scrubOptions,
+		discovery:    discovery,
+	}, nil
+}
+
+// newEngine returns the forwarder of the block using the driver.
+func (b *forwardBlock) newEngine(driver *pipeline.Driver) *forwarder {
+	cfg := b.cfg
+	fwd := newForwarder(driver, b.ecs, cfg.Cache, b.queryLog)
+	fwd.minTTL = uint32(cfg.MinTTL / time.Second)
+	fwd.maxTTL = uint32(cfg.MaxTTL / time.Second)
+	fwd.scrubOptions = b.scrubOptions
+	fwd.bufsize = uint16(cfg.Bufsize)
+	fwd.tracer = newQueryTracer(cfg.TraceSuffixes, cfg.TraceZFlag)
+	if b.tap != nil {
+		if tap := b.tap(); tap != nil {
+			fwd.SetTapPlugin(tap)
+		}
+	}
+	return fwd
+}
+
+// start creates the drivers and starts the background tasks of the block.
+func (b *forwardBlock) start() error {
+	cfg := b.cfg
+	var err error
+	if b.queryLog, err = newQueryLogger(cfg.QueryLog); err != nil {
 		return err
 	}
+	loadUpstreams := func() ([]pipeline.ConnConfig, error) { return loadResolvConf(cfg.ResolvConf) }
+	watchedFile := cfg.ResolvConf
+	if cfg.UpstreamsFile != "" {
+		loadUpstreams = func() ([]pipeline.ConnConfig, error) { return loadUpstreamsFile(cfg.UpstreamsFile) }
+		watchedFile = cfg.UpstreamsFile
+	}
+	if len(b.upstreams) == 0 && b.discovery == nil {
+		if b.upstreams, err = loadUpstreams(); err != nil {
+			return err
+		}
+		b.watcher = newFileWatcher(watchedFile, cfg.ReloadInterval)
+	}
 
-	c.OnStartup(func() error {
-		h.pipeDriver = NewDriver(upstreams)
-		return nil
+	driver, err := pipeline.New(b.upstreams, b.pipelineCfg)
+	if err != nil {
+		return err
+	}
+	b.driver = driver
+	if err = b.routes.start(b.pipelineCfg); err != nil {
+		return err
+	}
+	fwd := b.newEngine(driver)
+	fwd.routes = b.routes
+	b.handler.engine = fwd
+	b.handler.stats = newStatsResponder(cfg.Stats, driver)
+
+	// the views forward everything to their own upstreams, the backups and the routes don't apply to them
+	viewCfg := b.pipelineCfg
+	viewCfg.Backups = nil
+	for _, v := range b.views {
+		if v.driver, err = pipeline.New(v.upstreams, viewCfg); err != nil {
+			return err
+		}
+		v.engine = b.newEngine(v.driver)
+	}
+	b.handler.drivers = []*pipeline.Driver{driver}
+	for _, r := range b.routes {
+		b.handler.drivers = append(b.handler.drivers, r.driver)
+	}
+	for _, v := range b.views {
+		b.handler.drivers = append(b.handler.drivers, v.driver)
+	}
+
+	if b.admin, err = newAdminServer(cfg.DebugListen, driver); err != nil {
+		return err
+	}
+
+	b.watcher.start(func() {
+		fileUpstreams, err := loadUpstreams()
+		if err != nil {
+			log("reading %s failed: %v", watchedFile, err)
+			return
+		}
+		driver.SetUpstreams(fileUpstreams)
 	})
+	b.discovery.start(driver.SetUpstreams)
 
+	if cfg.Preconnect {
+		driver.Preconnect()
+		for _, r := range b.routes {
+			r.driver.Preconnect()
+		}
+		for _, v := range b.views {
+			v.driver.Preconnect()
+		}
+	}
 	return nil
 }
 
-func convertUpstreams(upstreams []string) (cfgs []ConnConfig, err error) {
-	for _, upstream := range upstreams {
-		parts := strings.Split(upstream, ":")
-		if len(parts) == 0 || len(parts) > 2 {
-			return nil, errors.New("upstream parsing failed")
+// stop closes the drivers and stops the background tasks of the block.
+func (b *forwardBlock) stop() error {
+	b.watcher.stop()
+	b.driver.Close()
+	b.routes.close()
+	b.views.close()
+	b.discovery.close()
+	if err := b.admin.close(); err != nil {
+		return err
+	}
+	return b.queryLog.close()
+}
+
+// referralPolicies maps the values of the referrals option to the policies.
+var referralPolicies = map[string]pipeline.ReferralPolicy{
+	"pass":     pipeline.ReferralPass,
+	"servfail": pipeline.ReferralServfail,
+	"retry":    pipeline.ReferralRetry,
+}
+
+// convertHedge parses the `hedge after <duration>` option, no arguments disable hedging.
+func convertHedge(args []string) (time.Duration, error) {
+	if len(args) == 0 {
+		return 0, nil
+	}
+	if len(args) != 2 || args[0] != "after" {
+		return 0, errors.New("hedge: expected hedge after <duration>")
+	}
+	delay, err := time.ParseDuration(args[1])
+	if err != nil || delay <= 0 {
+		return 0, fmt.Errorf("hedge: invalid duration: %s", args[1])
+	}
+	return delay, nil
+}
+
+// convertHealthCheck returns the probes of the pipeline, the defaults of the pipeline apply without the block.
+func convertHealthCheck(cfg *healthCheckConfig) pipeline.HealthCheckConfig {
+	if cfg == nil {
+		return pipeline.HealthCheckConfig{}
+	}
+	return pipeline.HealthCheckConfig{
+		Interval:   cfg.Interval,
+		Timeout:    cfg.Timeout,
+		Qname:      dns.Fqdn(cfg.Qname),
+		Qtype:      dns.StringToType[strings.ToUpper(cfg.Qtype)],
+		Failures:   cfg.Failures,
+		Recoveries: cfg.Recoveries,
+	}
+}
+
+// convertRcodes parses the rcode names, e.g. SERVFAIL or REFUSED.
+func convertRcodes(names []string) ([]int, error) {
+	rcodes := []int{}
+	for _, name := range names {
+		rcode, ok := dns.StringToRcode[strings.ToUpper(name)]
+		if !ok {
+			return nil, fmt.Errorf("unknown rcode: %s", name)
+		}
+		rcodes = append(rcodes, rcode)
+	}
+	return rcodes, nil
+}
+
+// convertQtypes parses the query type names, e.g. PTR or ANY.
+func convertQtypes(names []string) ([]uint16, error) {
+	qtypes := []uint16{}
+	for _, name := range names {
+		qtype, ok := dns.StringToType[strings.ToUpper(name)]
+		if !ok {
+			return nil, fmt.Errorf("unknown query type: %s", name)
 		}
-		cfg := ConnConfig{Hostname: parts[0], Port: 53}
-		if len(parts) == 2 {
-			if port, err := strconv.Atoi(parts[1]); err == nil {
-				cfg.Port = port
-			} else {
-				return nil, err
-			}
+		qtypes = append(qtypes, qtype)
+	}
+	return qtypes, nil
+}
+
+func convertUpstreams(upstreams []string) (cfgs []pipeline.ConnConfig, err error) {
+	for _, upstream := range upstreams {
+		cfg, err := parseUpstream(upstream)
+		if err != nil {
+			return nil, err
 		}
 		cfgs = append(cfgs, cfg)
 	}
 	return cfgs, err
 }
+
+// upstreamSchemes maps the schemes of the upstreams to their transports and default ports.
+var upstreamSchemes = map[string]struct {
+	transport string
+	port      int
+}{
+	"tcp":   {"", 53},
+	"udp":   {pipeline.TransportUDP, 53},
+	"tls":   {pipeline.TransportTLS, 853},
+	"https": {pipeline.TransportHTTPS, 443},
+}
+
+// defaultDohPath is the URL path of the DNS over HTTPS upstreams given without one.
+const defaultDohPath = "/dns-query"
+
+// parseUpstream parses upstream in the form of host, host:port, IPv6 literal or [IPv6]:port, optionally prefixed by
+// the transport scheme tcp://, udp://, tls:// or https://. The https upstreams may be followed by the URL path. The port
+// defaults to 53, 853 for tls and 443 for https.
+func parseUpstream(upstream string) (pipeline.ConnConfig, error) {
+	cfg := pipeline.ConnConfig{Port: 53}
+	if scheme, address, ok := strings.Cut(upstream, "://"); ok {
+		s, known := upstreamSchemes[scheme]
+		if !known {
+			return cfg, fmt.Errorf("upstream parsing failed: unknown transport %s", scheme)
+		}
+		cfg.Transport, cfg.Port, upstream = s.transport, s.port, address
+	}
+	if i := strings.Index(upstream, "/"); i >= 0 {
+		if cfg.Transport != pipeline.TransportHTTPS {
+			return cfg, errors.New("upstream parsing failed: path is allowed only for https")
+		}
+		cfg.Path, upstream = upstream[i:], upstream[:i]
+	} else if cfg.Transport == pipeline.TransportHTTPS {
+		cfg.Path = defaultDohPath
+	}
+	cfg.Hostname = upstream
+	switch {
+	case net.ParseIP(upstream) != nil:
+		return cfg, nil
+	case strings.HasPrefix(upstream, "[") && strings.HasSuffix(upstream, "]"):
+		cfg.Hostname = upstream[1 : len(upstream)-1]
+	case strings.Contains(upstream, ":"):
+		host, port, err := net.SplitHostPort(upstream)
+		if err != nil {
+			return cfg, fmt.Errorf("upstream parsing failed: %w", err)
+		}
+		if cfg.Port, err = strconv.Atoi(port); err != nil {
+			return cfg, fmt.Errorf("upstream parsing failed: %w", err)
+		}
+		cfg.Hostname = host
+	}
+	if cfg.Hostname == "" {
+		return cfg, errors.New("upstream parsing failed: empty host")
+	}
+	if cfg.Port <= 0 || cfg.Port > 65535 {
+		return cfg, fmt.Errorf("upstream parsing failed: invalid port %d", cfg.Port)
+	}
+	return cfg, nil
+}
+
+func convertExcepts(excepts []string) (zones []string) {
+	for _, except := range excepts {
+		zones = append(zones, plugin.Host(except).NormalizeExact()...)
+	}
+	return zones
+}
@@ -0,0 +1,264 @@
+package hackforward
+
+import (
+	"testing"
+	"time"
+
+	"github.com/coredns/caddy"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"hackforward/pkg/corefile"
+	"hackforward/pkg/pipeline"
+)
+
+func TestParseUpstream(t *testing.T) {
+	tests := []struct {
+		upstream string
+		want     pipeline.ConnConfig
+		wantErr  bool
+	}{
+		{upstream: "10.0.0.1", want: pipeline.ConnConfig{Hostname: "10.0.0.1", Port: 53}},
+		{upstream: "10.0.0.1:5353", want: pipeline.ConnConfig{Hostname: "10.0.0.1", Port: 5353}},
+		{upstream: "[2001:db8::1]:5353", want: pipeline.ConnConfig{Hostname: "2001:db8::1", Port: 5353}},
+		{upstream: "tcp://10.0.0.1", want: pipeline.ConnConfig{Hostname: "10.0.0.1", Port: 53}},
+		{upstream: "udp://10.0.0.1", want: pipeline.ConnConfig{Hostname: "10.0.0.1", Port: 53, Transport: pipeline.TransportUDP}},
+		{upstream: "tls://1.1.1.1", want: pipeline.ConnConfig{Hostname: "1.1.1.1", Port: 853, Transport: pipeline.TransportTLS}},
+		{upstream: "tls://[2606:4700::1111]:8853", want: pipeline.ConnConfig{Hostname: "2606:4700::1111", Port: 8853, Transport: pipeline.TransportTLS}},
+		{upstream: "https://dns.google", want: pipeline.ConnConfig{Hostname: "dns.google", Port: 443, Transport: pipeline.TransportHTTPS, Path: "/dns-query"}},
+		{upstream: "https://dns.example:8443/resolve", want: pipeline.ConnConfig{Hostname: "dns.example", Port: 8443, Transport: pipeline.TransportHTTPS, Path: "/resolve"}},
+		{upstream: "quic://10.0.0.1", wantErr: true},
+		{upstream: "tls://10.0.0.1/dns-query", wantErr: true},
+		{upstream: "tls://", wantErr: true},
+		{upstream: "10.0.0.1:70000", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.upstream, func(t *testing.T) {
+			got, err := parseUpstream(tt.upstream)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestSetup_repeatedBlock(t *testing.T) {
+	c := caddy.NewTestController("dns", `
+hack_forward {
+	upstreams 127.0.0.1
+}
+hack_forward {
+	upstreams 127.0.0.2
+}`)
+	assert.Error(t, setup(c))
+}
+
+func TestForwardBlock_independent(t *testing.T) {
+	newBlock := func(input string) *forwardBlock {
+		var cfg config
+		require.NoError(t, corefile.Parse(caddy.NewTestController("dns", input), &cfg))
+		b, err := newForwardBlock(&cfg)
+		require.NoError(t, err)
+		require.NoError(t, b.start())
+		t.Cleanup(func() { assert.NoError(t, b.stop()) })
+		return b
+	}
+	cached := newBlock(`
+hack_forward {
+	upstreams 127.0.0.1:5300
+	cache {
+		size 100
+	}
+}`)
+	internal := newBlock(`
+hack_forward {
+	upstreams 10.0.0.1
+}`)
+
+	assert.NotSame(t, cached.handler, internal.handler)
+	assert.NotSame(t, cached.driver, internal.driver)
+	cachedFwd, internalFwd := cached.handler.engine.(*forwarder), internal.handler.engine.(*forwarder)
+	assert.NotNil(t, cachedFwd.cache)
+	assert.Nil(t, internalFwd.cache)
+	require.Len(t, cached.driver.State().Upstreams, 1)
+	assert.Equal(t, "127.0.0.1:5300", cached.driver.State().Upstreams[0].Address)
+	require.Len(t, internal.driver.State().Upstreams, 1)
+	assert.Equal(t, "10.0.0.1:53", internal.driver.State().Upstreams[0].Address)
+}
+
+func TestConvertHealthCheck(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    pipeline.HealthCheckConfig
+		wantErr bool
+	}{
+		{
+			name: "no block",
+			input: `hack_forward {
+	warm_standby true
+}`,
+		},
+		{
+			name: "defaults",
+			input: `hack_forward {
+	warm_standby true
+	health_check {
+	}
+}`,
+			want: pipeline.HealthCheckConfig{Interval: 5 * time.Second, Timeout: time.Second, Qname: ".",
+				Qtype: dns.TypeNS, Failures: 3, Recoveries: 1},
+		},
+		{
+			name: "tuned",
+			input: `hack_forward {
+	warm_standby true
+	health_check {
+		interval 2s
+		timeout 500ms
+		qname probe.example
+		qtype a
+		failures 2
+		recoveries 4
+	}
+}`,
+			want: pipeline.HealthCheckConfig{Interval: 2 * time.Second, Timeout: 500 * time.Millisecond,
+				Qname: "probe.example.", Qtype: dns.TypeA, Failures: 2, Recoveries: 4},
+		},
+		{
+			name: "unknown qtype",
+			input: `hack_forward {
+	warm_standby true
+	health_check {
+		qtype BOGUS
+	}
+}`,
+			wantErr: true,
+		},
+		{
+			name: "timeout exceeding interval",
+			input: `hack_forward {
+	warm_standby true
+	health_check {
+		interval 1s
+		timeout 2s
+	}
+}`,
+			wantErr: true,
+		},
+		{
+			name: "without warm standby",
+			input: `hack_forward {
+	health_check {
+	}
+}`,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var cfg config
+			err := corefile.Parse(caddy.NewTestController("dns", tt.input), &cfg)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, convertHealthCheck(cfg.HealthCheck))
+		})
+	}
+}
+
+func TestNewForwardBlock_views(t *testing.T) {
+	var cfg config
+	require.NoError(t, corefile.Parse(caddy.NewTestController("dns", `
+hack_forward {
+	upstreams 10.0.0.1
+	view {
+		networks 10.1.0.0/16
+		upstreams 10.1.0.53
+	}
+	view {
+		networks 10.2.0.0/16 10.3.0.0/16
+		upstreams 10.2.0.53
+	}
+}`), &cfg))
+	b, err := newForwardBlock(&cfg)
+	require.NoError(t, err)
+	require.Len(t, b.views, 2)
+	assert.Equal(t, []pipeline.ConnConfig{{Hostname: "10.1.0.53", Port: 53}}, b.views[0].upstreams)
+	assert.Len(t, b.views[1].networks, 2)
+}
+
+func TestQueryLogConfig_maxSize(t *testing.T) {
+	var cfg config
+	require.NoError(t, corefile.Parse(caddy.NewTestController("dns", `
+hack_forward {
+	upstreams 10.0.0.1
+	query_log {
+		sink file
+		path /tmp/query.log
+		max_size 512KiB
+	}
+}`), &cfg))
+	require.NotNil(t, cfg.QueryLog)
+	assert.Equal(t, corefile.ByteSize(512<<10), cfg.QueryLog.MaxSize)
+}
+
+func TestConfig_marshalRoundTrip(t *testing.T) {
+	var cfg config
+	require.NoError(t, corefile.Parse(caddy.NewTestController("dns", `
+hack_forward {
+	upstreams 10.0.0.1 10.0.0.2
+	warm_standby true
+	health_check {
+		interval 10s
+	}
+	query_log {
+		sink file
+		path /tmp/query.log
+		max_size 512KiB
+	}
+	view {
+		networks 10.1.0.0/16
+		upstreams 10.1.0.53
+	}
+}`), &cfg))
+	text, err := corefile.Marshal(&cfg)
+	require.NoError(t, err)
+	var got config
+	require.NoError(t, corefile.Parse(caddy.NewTestController("dns", "hack_forward "+text), &got))
+	assert.Equal(t, cfg, got)
+}
+
+func TestConfig_describe(t *testing.T) {
+	schema, err := corefile.Describe(&config{})
+	require.NoError(t, err)
+	assert.NotEmpty(t, schema.Help())
+}
+
+func TestConfig_upstreamSources(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		wantErr bool
+	}{
+		{name: "upstreams", input: "hack_forward {\n\tupstreams 10.0.0.1\n}"},
+		{name: "upstreams file", input: "hack_forward {\n\tupstreams_file /etc/upstreams\n}"},
+		{name: "upstreams and file", input: "hack_forward {\n\tupstreams 10.0.0.1\n\tupstreams_file /etc/upstreams\n}",
+			wantErr: true},
+		{name: "upstreams and kubernetes", input: "hack_forward {\n\tupstreams 10.0.0.1\n\tkubernetes {\n\t\tservice dns\n\t}\n}",
+			wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var cfg config
+			err := corefile.Parse(caddy.NewTestController("dns", tt.input), &cfg)
+			assert.Equal(t, tt.wantErr, err != nil, "unexpected error: %v", err)
+		})
+	}
+}
@@ -0,0 +1,79 @@
+package hackforward
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"hackforward/pkg/pipeline"
+)
+
+// statsName is queried as CH TXT for the statistics, e.g. dig @server stats.hackforward. CH TXT
+const statsName = "stats.hackforward."
+
+// statsResponder answers the statistics query with the live counters of the driver, so the health can be polled
+// without Prometheus. The rate of the queries is computed since the previous poll. All methods are safe to be
+// called on nil responder, which represents disabled statistics.
+type statsResponder struct {
+	driver *pipeline.Driver
+
+	lock        sync.Mutex
+	lastPoll    time.Time
+	lastQueries int64
+}
+
+func newStatsResponder(enabled bool, driver *pipeline.Driver) *statsResponder {
+	if !enabled {
+		return nil
+	}
+	return &statsResponder{driver: driver, lastPoll: time.Now()}
+}
+
+func (s *statsResponder) matches(r *dns.Msg) bool {
+	if s == nil {
+		return false
+	}
+	q := r.Question[0]
+	return q.Qclass == dns.ClassCHAOS && q.Qtype == dns.TypeTXT && strings.EqualFold(q.Name, statsName)
+}
+
+func (s *statsResponder) response(r *dns.Msg) *dns.Msg {
+	state := s.driver.State()
+	now := time.Now()
+	s.lock.Lock()
+	qps := float64(state.Queries-s.lastQueries) / now.Sub(s.lastPoll).Seconds()
+	s.lastPoll, s.lastQueries = now, state.Queries
+	s.lock.Unlock()
+
+	ready := 0
+	for _, pipe := range state.Pipes {
+		if pipe.WriteReady {
+			ready++
+		}
+	}
+	errorRate := 0.0
+	if state.Queries > 0 {
+		errorRate = 100 * float64(state.Failures) / float64(state.Queries)
+	}
+	lines := []string{
+		fmt.Sprintf("pipes=%d ready=%d loading=%d", len(state.Pipes), ready, state.PrimaryLoading+state.SecondaryLoading),
+		fmt.Sprintf("queries=%d failures=%d error_rate=%.2f%% qps=%.1f", state.Queries, state.Failures, errorRate, qps),
+	}
+	for _, upstream := range state.Upstreams {
+		lines = append(lines, fmt.Sprintf("upstream=%s primary=%v pipes=%d ready=%d healthy=%v",
+			upstream.Address, upstream.Primary, upstream.Pipes, upstream.ReadyPipes, upstream.Healthy))
+	}
+
+	m := new(dns.Msg)
+	m.SetReply(r)
+	for _, line := range lines {
+		m.Answer = append(m.Answer, &dns.TXT{
+			Hdr: dns.RR_Header{Name: r.Question[0].Name, Rrtype: dns.TypeTXT, Class: dns.ClassCHAOS},
+			Txt: []string{line},
+		})
+	}
+	return m
+}
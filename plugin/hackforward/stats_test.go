@@ -0,0 +1,61 @@
+package hackforward
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStatsResponder_matches(t *testing.T) {
+	tests := []struct {
+		name    string
+		enabled bool
+		qname   string
+		qtype   uint16
+		qclass  uint16
+		want    bool
+	}{
+		{name: "disabled", qname: statsName, qtype: dns.TypeTXT, qclass: dns.ClassCHAOS},
+		{name: "stats", enabled: true, qname: statsName, qtype: dns.TypeTXT, qclass: dns.ClassCHAOS, want: true},
+		{name: "case insensitive", enabled: true, qname: "Stats.HackForward.", qtype: dns.TypeTXT, qclass: dns.ClassCHAOS, want: true},
+		{name: "class IN", enabled: true, qname: statsName, qtype: dns.TypeTXT, qclass: dns.ClassINET},
+		{name: "type A", enabled: true, qname: statsName, qtype: dns.TypeA, qclass: dns.ClassCHAOS},
+		{name: "other name", enabled: true, qname: "version.bind.", qtype: dns.TypeTXT, qclass: dns.ClassCHAOS},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := new(dns.Msg)
+			r.SetQuestion(tt.qname, tt.qtype)
+			r.Question[0].Qclass = tt.qclass
+			assert.Equal(t, tt.want, newStatsResponder(tt.enabled, nil).matches(r))
+		})
+	}
+}
+
+func TestStatsResponder_response(t *testing.T) {
+	fwd, _ := newTestForwarder(t, nil)
+	req := new(dns.Msg)
+	req.SetQuestion("example.org.", dns.TypeA)
+	_, err := fwd.Process(context.Background(), req, dnstest.NewRecorder(&test.ResponseWriter{}))
+	require.NoError(t, err)
+
+	stats := newStatsResponder(true, fwd.driver)
+	r := new(dns.Msg)
+	r.SetQuestion(statsName, dns.TypeTXT)
+	r.Question[0].Qclass = dns.ClassCHAOS
+	resp := stats.response(r)
+	require.Len(t, resp.Answer, 3)
+	var lines []string
+	for _, rr := range resp.Answer {
+		assert.Equal(t, uint16(dns.ClassCHAOS), rr.Header().Class)
+		lines = append(lines, rr.(*dns.TXT).Txt[0])
+	}
+	assert.True(t, strings.HasPrefix(lines[1], "queries=1 failures=0 error_rate=0.00%"), lines[1])
+	assert.Contains(t, lines[2], "healthy=true")
+}
@@ -0,0 +1,98 @@
+package hackforward
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"hackforward/pkg/pipeline"
+)
+
+// loadResolvConf reads the nameservers from the resolv.conf file.
+func loadResolvConf(path string) ([]pipeline.ConnConfig, error) {
+	cfg, err := dns.ClientConfigFromFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(cfg.Servers) == 0 {
+		return nil, fmt.Errorf("no nameservers found in %s", path)
+	}
+	var upstreams []string
+	for _, server := range cfg.Servers {
+		upstreams = append(upstreams, net.JoinHostPort(server, cfg.Port))
+	}
+	return convertUpstreams(upstreams)
+}
+
+// loadUpstreamsFile reads the upstreams from a file containing one upstream per line, '#' starts a comment.
+func loadUpstreamsFile(path string) ([]pipeline.ConnConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var upstreams []string
+	for _, line := range strings.Split(string(data), "\n") {
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		if line = strings.TrimSpace(line); line != "" {
+			upstreams = append(upstreams, line)
+		}
+	}
+	return convertUpstreams(upstreams)
+}
+
+// fileWatcher polls the modification time of a file and notifies about its changes.
+type fileWatcher struct {
+	path     string
+	interval time.Duration
+	modTime  time.Time
+	done     chan struct{}
+}
+
+func newFileWatcher(path string, interval time.Duration) *fileWatcher {
+	w := fileWatcher{path: path, interval: interval, done: make(chan struct{})}
+	w.changed()
+	return &w
+}
+
+// start calls onChange whenever the file modification time changes, it is safe to be called on nil watcher.
+func (w *fileWatcher) start(onChange func()) {
+	if w == nil {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(w.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-w.done:
+				return
+			case <-ticker.C:
+				if w.changed() {
+					log("file %s changed", w.path)
+					onChange()
+				}
+			}
+		}
+	}()
+}
+
+func (w *fileWatcher) changed() bool {
+	info, err := os.Stat(w.path)
+	if err != nil || info.ModTime().Equal(w.modTime) {
+		return false
+	}
+	w.modTime = info.ModTime()
+	return true
+}
+
+func (w *fileWatcher) stop() {
+	if w != nil {
+		safeClose(w.done)
+	}
+}
@@ -0,0 +1,60 @@
+package hackforward
+
+import (
+	"errors"
+	"net"
+
+	"hackforward/pkg/pipeline"
+)
+
+// viewConfig forwards the queries of the clients from the networks to the upstreams of the view (split horizon).
+type viewConfig struct {
+	Networks  []string `cf:"networks" check:"nonempty,cidr" checkmsg:"view requires the client networks in the CIDR notation"`
+	Upstreams []string `cf:"upstreams" check:"nonempty" checkmsg:"view requires at least one upstream"`
+}
+
+// view has its own engine, so neither the cache nor the coalesced queries are shared with the clients of other views.
+type view struct {
+	networks  []*net.IPNet
+	upstreams []pipeline.ConnConfig
+	driver    *pipeline.Driver
+	engine    Engine
+}
+
+// viewTable is ordered as configured, the first view matching the client wins.
+type viewTable []*view
+
+func convertViews(cfgs []*viewConfig) (viewTable, error) {
+	var table viewTable
+	for _, cfg := range cfgs {
+		networks, err := convertNets(cfg.Networks)
+		if err != nil {
+			return nil, err
+		}
+		upstreams, err := convertUpstreams(cfg.Upstreams)
+		if err != nil {
+			return nil, err
+		}
+		if len(upstreams) == 0 {
+			return nil, errors.New("view expects at least one upstream")
+		}
+		table = append(table, &view{networks: networks, upstreams: upstreams})
+	}
+	return table, nil
+}
+
+// match returns the view of the client, nil if the client doesn't belong to any view.
+func (t viewTable) match(ip net.IP) *view {
+	for _, v := range t {
+		if containsIP(v.networks, ip) {
+			return v
+		}
+	}
+	return nil
+}
+
+func (t viewTable) close() {
+	for _, v := range t {
+		v.driver.Close()
+	}
+}
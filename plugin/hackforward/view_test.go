@@ -0,0 +1,57 @@
+package hackforward
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestViewTable_match(t *testing.T) {
+	table, err := convertViews([]*viewConfig{
+		{Networks: []string{"10.0.0.0/8", "192.168.1.1"}, Upstreams: []string{"10.0.0.2"}},
+		{Networks: []string{"10.1.0.0/16"}, Upstreams: []string{"10.1.0.2"}},
+	})
+	require.NoError(t, err)
+
+	tests := []struct {
+		ip       string
+		wantView int
+	}{
+		{ip: "10.2.3.4", wantView: 0},
+		{ip: "10.1.2.3", wantView: 0},
+		{ip: "192.168.1.1", wantView: 0},
+		{ip: "192.168.1.2", wantView: -1},
+		{ip: "2001:db8::1", wantView: -1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.ip, func(t *testing.T) {
+			v := table.match(net.ParseIP(tt.ip))
+			if tt.wantView < 0 {
+				assert.Nil(t, v)
+				return
+			}
+			assert.Same(t, table[tt.wantView], v)
+		})
+	}
+}
+
+func TestConvertViews(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfgs    []*viewConfig
+		wantErr bool
+	}{
+		{name: "no views"},
+		{name: "valid", cfgs: []*viewConfig{{Networks: []string{"10.0.0.0/8"}, Upstreams: []string{"10.0.0.2:53"}}}},
+		{name: "invalid network", cfgs: []*viewConfig{{Networks: []string{"10.0.0.0/33"}, Upstreams: []string{"10.0.0.2"}}}, wantErr: true},
+		{name: "invalid upstream", cfgs: []*viewConfig{{Networks: []string{"10.0.0.0/8"}, Upstreams: []string{"10.0.0.2:x"}}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := convertViews(tt.cfgs)
+			assert.Equal(t, tt.wantErr, err != nil)
+		})
+	}
+}